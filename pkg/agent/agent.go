@@ -2,12 +2,20 @@ package agent
 
 import (
 	"context"
+	"os"
+	"os/signal"
 	"sync"
+	"syscall"
+	"time"
 
 	"github.com/go-kit/log"
 	"github.com/go-kit/log/level"
+	"github.com/grafana/dskit/ring"
 	"github.com/grafana/dskit/services"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/prometheus/discovery"
+	"github.com/prometheus/prometheus/discovery/targetgroup"
 
 	agentv1 "github.com/grafana/phlare/pkg/gen/agent/v1"
 	"github.com/grafana/phlare/pkg/gen/push/v1/pushv1connect"
@@ -23,8 +31,22 @@ type Agent struct {
 	manager              *discovery.Manager
 	jobs                 map[string]discovery.Configs
 	groups               map[string]*TargetGroup
+	targetGroups         map[string][]*targetgroup.Group
 	pusherClientProvider PusherClientProvider
+	receiver             *Receiver
+	metrics              *metrics
 
+	// ring and lifecycler are only set when sharding of targets is enabled.
+	ring               *ring.Ring
+	lifecycler         *ring.Lifecycler
+	ringState          ring.ReplicationSet
+	subservices        *services.Manager
+	subservicesWatcher *services.FailureWatcher
+
+	// configLoader is used to reload the scrape configs, reloading is disabled when not set.
+	configLoader ConfigLoader
+
+	ctx context.Context
 	mtx sync.Mutex
 }
 
@@ -35,24 +57,76 @@ type TargetManager interface {
 
 type PusherClientProvider func() pushv1connect.PusherServiceClient
 
-func New(config *Config, logger log.Logger, pusherClientProvider PusherClientProvider) (*Agent, error) {
+func New(config *Config, reg prometheus.Registerer, logger log.Logger, pusherClientProvider PusherClientProvider) (*Agent, error) {
 	a := &Agent{
 		Config:               config,
 		logger:               logger,
-		pusherClientProvider: pusherClientProvider,
+		pusherClientProvider: withExternalLabels(pusherClientProvider, config.ClientConfig.ExternalLabels),
+		metrics:              newMetrics(reg),
 	}
-	a.Service = services.NewBasicService(nil, a.running, nil)
-	jobs := map[string]discovery.Configs{}
-	for _, cfg := range config.ScrapeConfigs {
-		jobs[cfg.JobName] = cfg.ServiceDiscoveryConfig.Configs()
+	a.metrics.configLastReloadSuccessful.Set(1)
+	a.metrics.configLastReloadSuccessTimestamp.SetToCurrentTime()
+	a.receiver = newReceiver(config.Receiver, config.ClientConfig.TenantID, a.pusherClientProvider, a.metrics, logger)
+	if config.ShardingRing.Enabled {
+		if err := a.initRing(reg); err != nil {
+			return nil, err
+		}
 	}
+	a.Service = services.NewBasicService(a.starting, a.running, a.stopping)
+	jobs := discoveryConfigs(config.ScrapeConfigs)
 	a.jobs = jobs
 	a.groups = make(map[string]*TargetGroup, len(jobs))
+	a.targetGroups = make(map[string][]*targetgroup.Group, len(jobs))
 	return a, nil
 }
 
+func (a *Agent) initRing(reg prometheus.Registerer) error {
+	var err error
+	reg = prometheus.WrapRegistererWithPrefix("phlare_", reg)
+	a.lifecycler, err = ring.NewLifecycler(a.Config.ShardingRing.ToLifecyclerConfig(), nil, ringName, ringKey, false, a.logger, reg)
+	if err != nil {
+		return errors.Wrap(err, "create agent lifecycler")
+	}
+	a.ring, err = ring.New(a.Config.ShardingRing.ToRingConfig(), ringName, ringKey, a.logger, reg)
+	if err != nil {
+		return errors.Wrap(err, "create agent ring")
+	}
+	a.subservices, err = services.NewManager(a.lifecycler, a.ring)
+	if err != nil {
+		return errors.Wrap(err, "services manager")
+	}
+	a.subservicesWatcher = services.NewFailureWatcher()
+	a.subservicesWatcher.WatchManager(a.subservices)
+	return nil
+}
+
+func (a *Agent) starting(ctx context.Context) error {
+	if a.subservices == nil {
+		return nil
+	}
+	if err := services.StartManagerAndAwaitHealthy(ctx, a.subservices); err != nil {
+		return err
+	}
+	// Wait until this agent is ACTIVE in the ring, before that no target would be owned.
+	if err := ring.WaitInstanceState(ctx, a.ring, a.lifecycler.ID, ring.ACTIVE); err != nil {
+		return errors.Wrap(err, "waiting for agent to be active in the ring")
+	}
+	a.ringState, _ = a.ring.GetAllHealthy(shardingOp)
+	return nil
+}
+
+func (a *Agent) stopping(_ error) error {
+	if a.subservices == nil {
+		return nil
+	}
+	return services.StopManagerAndAwaitStopped(context.Background(), a.subservices)
+}
+
 func (a *Agent) running(ctx context.Context) error {
+	a.mtx.Lock()
+	a.ctx = ctx
 	a.manager = discovery.NewManager(ctx, log.With(a.logger, "component", "discovery"))
+	a.mtx.Unlock()
 	go func() {
 		if err := a.manager.Run(); err != nil {
 			level.Error(a.logger).Log("msg", "error running discovery manager", "err", err)
@@ -62,30 +136,105 @@ func (a *Agent) running(ctx context.Context) error {
 		return nil
 	}
 
+	var ringCheck <-chan time.Time
+	if a.ring != nil {
+		ticker := time.NewTicker(a.Config.ShardingRing.RingCheckPeriod)
+		defer ticker.Stop()
+		ringCheck = ticker.C
+	}
+
+	var hup chan os.Signal
+	if a.configLoader != nil {
+		hup = make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		defer signal.Stop(hup)
+	}
+
 	for {
 		select {
 		case targetGroups := <-a.manager.SyncCh():
 			a.mtx.Lock()
 			for jobName, groups := range targetGroups {
+				if _, ok := a.jobs[jobName]; !ok {
+					// The job has been removed by a reload.
+					continue
+				}
 				level.Info(a.logger).Log("msg", "received target groups", "job", jobName)
+				a.targetGroups[jobName] = groups
 				if _, ok := a.groups[jobName]; ok {
 					a.groups[jobName].sync(groups)
 					continue
 				}
-				newGroup := NewTargetGroup(ctx, jobName, jobConfig(jobName, a.Config), a.pusherClientProvider, a.Config.ClientConfig.TenantID, a.logger)
+				newGroup := a.newTargetGroup(jobName)
 				a.groups[jobName] = newGroup
 				newGroup.sync(groups)
 
 			}
 			a.mtx.Unlock()
+		case <-ringCheck:
+			a.checkRing()
+		case <-hup:
+			if err := a.Reload(); err != nil {
+				level.Error(a.logger).Log("msg", "failed to reload the agent configuration", "err", err)
+			}
+		case err := <-a.subservicesWatcher.Chan():
+			return errors.Wrap(err, "agent subservice failed")
 		case <-ctx.Done():
 			return nil
 		}
 	}
 }
 
+func (a *Agent) newTargetGroup(jobName string) *TargetGroup {
+	return NewTargetGroup(a.ctx, jobName, jobConfig(jobName, a.Config), a.pusherClientProvider, a.Config.ClientConfig.TenantID, a.owns, a.metrics, a.Config.TargetHistorySize, a.logger)
+}
+
+// checkRing re-syncs all target groups when the set of healthy agents or their tokens
+// have changed since the last check, so that targets are rebalanced between agents.
+func (a *Agent) checkRing() {
+	current, err := a.ring.GetAllHealthy(shardingOp)
+	if err != nil {
+		level.Warn(a.logger).Log("msg", "failed to get healthy agents from the ring", "err", err)
+		return
+	}
+	if !ring.HasReplicationSetChanged(a.ringState, current) {
+		return
+	}
+	a.ringState = current
+	level.Info(a.logger).Log("msg", "agents ring changed, rebalancing targets", "agents", len(current.Instances))
+
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	for jobName, tg := range a.groups {
+		tg.sync(a.targetGroups[jobName])
+	}
+}
+
+// owns returns true if the target with the given hash has to be scraped by this agent.
+// When sharding is disabled all targets are owned. Since scrape offsets are derived from
+// the target hash, a target moving between agents keeps its scrape schedule.
+func (a *Agent) owns(hash uint64) bool {
+	if a.ring == nil {
+		return true
+	}
+	var descs [1]ring.InstanceDesc
+	rs, err := a.ring.Get(shardToken(hash), shardingOp, descs[:0], nil, nil)
+	if err != nil {
+		level.Warn(a.logger).Log("msg", "failed to find the owner of a target in the ring", "err", err)
+		return false
+	}
+	return rs.Includes(a.lifecycler.Addr)
+}
+
+// Receiver returns the receiver forwarding profiles pushed to the agent.
+func (a *Agent) Receiver() *Receiver {
+	return a.receiver
+}
+
 func (a *Agent) ActiveTargets() map[string][]*Target {
 	result := map[string][]*Target{}
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
 
 	// todo: (callum) maybe return not a map + sort so the results don't reorder on every load?
 	for g, tg := range a.groups {
@@ -93,22 +242,34 @@ func (a *Agent) ActiveTargets() map[string][]*Target {
 		for _, target := range tg.activeTargets {
 			result[g] = append(result[g], target)
 		}
+		tg.mtx.RUnlock()
 	}
 	return result
 }
 
 func (a *Agent) DroppedTargets() []*Target {
 	result := []*Target{}
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
 
 	for _, tg := range a.groups {
 		tg.mtx.RLock()
 		for _, target := range tg.droppedTargets {
 			result = append(result, target)
 		}
+		tg.mtx.RUnlock()
 	}
 	return result
 }
 
+func discoveryConfigs(scrapeConfigs []*ScrapeConfig) map[string]discovery.Configs {
+	jobs := make(map[string]discovery.Configs, len(scrapeConfigs))
+	for _, cfg := range scrapeConfigs {
+		jobs[cfg.JobName] = cfg.ServiceDiscoveryConfig.Configs()
+	}
+	return jobs
+}
+
 func jobConfig(jobName string, config *Config) ScrapeConfig {
 	for _, cfg := range config.ScrapeConfigs {
 		if cfg.JobName == jobName {
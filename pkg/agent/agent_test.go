@@ -0,0 +1,100 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/grafana/dskit/flagext"
+	"github.com/grafana/dskit/kv"
+	"github.com/grafana/dskit/ring"
+	"github.com/grafana/dskit/services"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/require"
+)
+
+func newShardedTestAgent(t *testing.T, kvClient kv.Client, id string, port int) *Agent {
+	t.Helper()
+	cfg := &Config{}
+	flagext.DefaultValues(cfg)
+	cfg.ShardingRing.Enabled = true
+	cfg.ShardingRing.KVStore.Mock = kvClient
+	cfg.ShardingRing.NumTokens = 32
+	cfg.ShardingRing.InstanceID = id
+	cfg.ShardingRing.InstanceAddr = "localhost"
+	cfg.ShardingRing.InstancePort = port
+
+	a, err := New(cfg, prometheus.NewRegistry(), log.NewNopLogger(), nil)
+	require.NoError(t, err)
+	require.NoError(t, services.StartAndAwaitRunning(context.Background(), a))
+	t.Cleanup(func() {
+		require.NoError(t, services.StopAndAwaitTerminated(context.Background(), a))
+	})
+	return a
+}
+
+func Test_Sharding(t *testing.T) {
+	kvClient, err := kv.NewClient(kv.Config{Store: "inmemory"}, ring.GetCodec(), nil, log.NewNopLogger())
+	require.NoError(t, err)
+
+	agents := []*Agent{
+		newShardedTestAgent(t, kvClient, "agent-1", 1),
+		newShardedTestAgent(t, kvClient, "agent-2", 2),
+		newShardedTestAgent(t, kvClient, "agent-3", 3),
+	}
+	for _, a := range agents {
+		a := a
+		require.Eventually(t, func() bool {
+			return a.ring.InstancesCount() == len(agents)
+		}, 5*time.Second, 50*time.Millisecond)
+	}
+
+	// Every target must be owned by exactly one agent.
+	owned := make(map[string]int, len(agents))
+	for i := 0; i < 1000; i++ {
+		hash := uint64(i) * 0x9E3779B97F4A7C15
+		owners := 0
+		for _, a := range agents {
+			if a.owns(hash) {
+				owners++
+				owned[a.lifecycler.ID]++
+			}
+		}
+		require.Equal(t, 1, owners, fmt.Sprintf("target %d", i))
+	}
+	require.Len(t, owned, len(agents))
+}
+
+func Test_NoSharding(t *testing.T) {
+	a, err := New(&Config{}, prometheus.NewRegistry(), log.NewNopLogger(), nil)
+	require.NoError(t, err)
+	require.True(t, a.owns(42))
+}
+
+func Test_NotOwnedTargetsDropped(t *testing.T) {
+	cfg := &Config{
+		ScrapeConfigs: []*ScrapeConfig{
+			staticScrapeConfig("job", time.Hour, "127.0.0.1:1", "127.0.0.1:2"),
+		},
+	}
+	require.NoError(t, cfg.Validate())
+	owner := map[uint64]bool{}
+	tg := NewTargetGroup(context.Background(), "job", *cfg.ScrapeConfigs[0], nil, "", func(hash uint64) bool {
+		// Only the first target is owned by this agent.
+		if len(owner) == 0 {
+			owner[hash] = true
+		}
+		return owner[hash]
+	}, newMetrics(nil), 0, log.NewNopLogger())
+	tg.sync(cfg.ScrapeConfigs[0].ServiceDiscoveryConfig.StaticConfigs)
+	defer tg.stop()
+
+	require.Len(t, tg.activeTargets, 1)
+	require.NotEmpty(t, tg.droppedTargets)
+	for _, target := range tg.droppedTargets {
+		require.False(t, owner[target.Hash()])
+		require.Equal(t, droppedReasonNotOwned, target.droppedReason)
+	}
+}
@@ -61,6 +61,7 @@ func (a *Agent) GetTargets(ctx context.Context, req *agentv1.GetTargetsRequest)
 				Labels:           t.Labels().Map(),
 				DiscoveredLabels: t.Target.DiscoveredLabels().Map(),
 				ScrapeUrl:        t.URL().String(),
+				DroppedReason:    t.droppedReason,
 			})
 		}
 	}
@@ -68,6 +69,43 @@ func (a *Agent) GetTargets(ctx context.Context, req *agentv1.GetTargetsRequest)
 	return &resp, nil
 }
 
+func (a *Agent) GetTargetHistory(ctx context.Context, req *agentv1.GetTargetHistoryRequest) (*agentv1.GetTargetHistoryResponse, error) {
+	if req.ScrapeUrl == "" {
+		return nil, connect.NewError(connect.CodeInvalidArgument, errors.New("scrape_url is required"))
+	}
+	var target *Target
+	for _, t := range a.ActiveTargets()[req.ScrapePool] {
+		if t.URL().String() == req.ScrapeUrl {
+			target = t
+			break
+		}
+	}
+	if target == nil {
+		return nil, connect.NewError(connect.CodeNotFound, errors.Errorf("no active target %s in scrape pool %q", req.ScrapeUrl, req.ScrapePool))
+	}
+
+	history := target.History()
+	resp := &agentv1.GetTargetHistoryResponse{
+		Attempts: make([]*agentv1.ScrapeAttempt, 0, len(history)),
+	}
+	for _, h := range history {
+		attempt := &agentv1.ScrapeAttempt{
+			Timestamp:        timestamppb.New(h.timestamp),
+			Duration:         durationpb.New(h.duration),
+			Health:           h.health,
+			ProfileSizeBytes: int64(h.size),
+		}
+		if h.err != nil {
+			attempt.Error = h.err.Error()
+		}
+		if h.pushErr != nil {
+			attempt.PushError = h.pushErr.Error()
+		}
+		resp.Attempts = append(resp.Attempts, attempt)
+	}
+	return resp, nil
+}
+
 type connectAgent struct {
 	*Agent
 }
@@ -81,6 +119,15 @@ func (ca *connectAgent) GetTargets(ctx context.Context, req *connect.Request[age
 	return connect.NewResponse(resp), nil
 }
 
+func (ca *connectAgent) GetTargetHistory(ctx context.Context, req *connect.Request[agentv1.GetTargetHistoryRequest]) (*connect.Response[agentv1.GetTargetHistoryResponse], error) {
+	resp, err := ca.Agent.GetTargetHistory(ctx, req.Msg)
+	if err != nil {
+		return nil, err
+	}
+
+	return connect.NewResponse(resp), nil
+}
+
 func (a *Agent) ConnectHandler() agentv1connect.AgentServiceHandler {
 	return &connectAgent{a}
 }
@@ -21,6 +21,10 @@ import (
 type Config struct {
 	ScrapeConfigs []*ScrapeConfig `yaml:"scrape_configs,omitempty"`
 	ClientConfig  ClientConfig    `yaml:"client,omitempty"`
+	ShardingRing  RingConfig      `yaml:"agent_ring,omitempty"`
+	Receiver      ReceiverConfig  `yaml:"receiver,omitempty"`
+
+	TargetHistorySize int `yaml:"target_history_size"`
 }
 
 // RegisterFlags with prefix registers flags where every name is prefixed by
@@ -37,9 +41,15 @@ func (c *ClientConfig) RegisterFlagsWithPrefix(prefix string, f *flag.FlagSet) {
 // RegisterFlags registers flags.
 func (c *Config) RegisterFlags(flags *flag.FlagSet) {
 	c.ClientConfig.RegisterFlagsWithPrefix("", flags)
+	c.ShardingRing.RegisterFlags(flags)
+	c.Receiver.RegisterFlags(flags)
+	flags.IntVar(&c.TargetHistorySize, "agent.target-history-size", 10, "Number of scrape attempts kept per target, retrievable using the GetTargetHistory API. 0 to disable.")
 }
 
 func (c *Config) Validate() error {
+	if err := c.ClientConfig.ExternalLabels.Validate(); err != nil {
+		return fmt.Errorf("client: invalid external labels: %w", err)
+	}
 	for _, cfg := range c.ScrapeConfigs {
 		if err := cfg.Validate(); err != nil {
 			return err
@@ -55,6 +65,8 @@ type ClientConfig struct {
 	Client    commonconfig.HTTPClientConfig `yaml:",inline"`
 	// The tenant ID to use when pushing profiles to Phlare (default to anonymous).
 	TenantID string `yaml:"tenant_id"`
+	// Labels added to all profiles pushed by the agent.
+	ExternalLabels model.LabelSet `yaml:"external_labels,omitempty"`
 	// todo add backoff config
 	// BackoffConfig backoff.Config                `yaml:"backoff_config"`
 }
@@ -66,6 +78,18 @@ func (c *ClientConfig) Validate() error {
 	return c.Client.Validate()
 }
 
+type ReceiverConfig struct {
+	Enabled        bool              `yaml:"enabled"`
+	MaxBodySize    int64             `yaml:"max_body_size"`
+	RelabelConfigs []*relabel.Config `yaml:"relabel_configs,omitempty"`
+}
+
+// RegisterFlags registers flags.
+func (c *ReceiverConfig) RegisterFlags(f *flag.FlagSet) {
+	f.BoolVar(&c.Enabled, "agent.receiver.enabled", false, "Accept profiles pushed by applications to the agent, and forward them to Phlare. Profiles can be pushed using the PusherService API or by posting a pprof body to /ingest.")
+	f.Int64Var(&c.MaxBodySize, "agent.receiver.max-body-size", 16*1024*1024, "Maximum size in bytes of a pprof body posted to /ingest, larger requests are rejected. 0 to disable.")
+}
+
 type ScrapeConfig struct {
 	JobName                string                       `yaml:"job_name"`
 	Params                 url.Values                   `yaml:"params,omitempty"`
@@ -75,6 +99,9 @@ type ScrapeConfig struct {
 	RelabelConfigs         []*relabel.Config            `yaml:"relabel_configs,omitempty"`
 	ServiceDiscoveryConfig ServiceDiscoveryConfig       `yaml:",inline"`
 	ProfilingConfig        *parcaconfig.ProfilingConfig `yaml:"profiling_config,omitempty"`
+	// DeltaProfiles computes the delta of cumulative sample types in the agent,
+	// then normalizes and re-compresses profiles before pushing them.
+	DeltaProfiles bool `yaml:"delta_profiles,omitempty"`
 
 	HTTPClientConfig commonconfig.HTTPClientConfig `yaml:",inline"`
 }
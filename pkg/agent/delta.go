@@ -0,0 +1,130 @@
+package agent
+
+import (
+	"encoding/binary"
+
+	"github.com/cespare/xxhash/v2"
+
+	profilev1 "github.com/grafana/phlare/pkg/gen/google/v1"
+)
+
+// cumulativeSampleTypes lists per profile name the sample types which are
+// reported as a monotonic total since the start of the process.
+var cumulativeSampleTypes = map[string][]string{
+	"memory": {"alloc_objects", "alloc_space"},
+}
+
+// deltaProfiles computes the delta of cumulative sample types between two
+// consecutive scrapes of the same target.
+type deltaProfiles struct {
+	// previous holds the cumulative values of the last scrape per stacktrace.
+	previous    map[uint64][]int64
+	initialized bool
+	hasher      *xxhash.Digest
+	b           [8]byte
+}
+
+func newDeltaProfiles() *deltaProfiles {
+	return &deltaProfiles{
+		previous: make(map[uint64][]int64),
+		hasher:   xxhash.New(),
+	}
+}
+
+// computeDelta replaces the values of the cumulative sample types of the profile
+// with the difference from the previous scrape. Samples are expected to be
+// normalized, so a stacktrace appears only once in the profile.
+//
+// Cumulative values of the first scrape are zeroed since there is nothing to
+// compare them with. When a value decreases the target has been restarted and the
+// value is kept as is.
+func (d *deltaProfiles) computeDelta(p *profilev1.Profile, profileName string) {
+	indexes := cumulativeIndexes(p, profileName)
+	if len(indexes) == 0 {
+		return
+	}
+
+	var (
+		locations = make(map[uint64]*profilev1.Location, len(p.Location))
+		functions = make(map[uint64]*profilev1.Function, len(p.Function))
+		current   = make(map[uint64][]int64, len(p.Sample))
+	)
+	for _, l := range p.Location {
+		locations[l.Id] = l
+	}
+	for _, f := range p.Function {
+		functions[f.Id] = f
+	}
+
+	for _, s := range p.Sample {
+		key := d.sampleKey(p, s, locations, functions)
+		values := make([]int64, len(indexes))
+		for i, idx := range indexes {
+			values[i] = s.Value[idx]
+		}
+		current[key] = values
+
+		prev, ok := d.previous[key]
+		for i, idx := range indexes {
+			switch {
+			case !d.initialized:
+				s.Value[idx] = 0
+			case !ok:
+				// new stacktrace since the last scrape, the whole value is a delta.
+			case prev[i] <= s.Value[idx]:
+				s.Value[idx] -= prev[i]
+			}
+		}
+	}
+	d.previous = current
+	d.initialized = true
+}
+
+// sampleKey returns a hash identifying the sample across scrapes. Location and
+// function IDs are not stable between profiles, so the hash is computed from
+// the addresses, function names, line numbers and labels of the sample.
+func (d *deltaProfiles) sampleKey(p *profilev1.Profile, s *profilev1.Sample, locations map[uint64]*profilev1.Location, functions map[uint64]*profilev1.Function) uint64 {
+	d.hasher.Reset()
+	for _, id := range s.LocationId {
+		loc, ok := locations[id]
+		if !ok {
+			continue
+		}
+		d.writeUint64(loc.Address)
+		for _, line := range loc.Line {
+			if fn, ok := functions[line.FunctionId]; ok {
+				_, _ = d.hasher.WriteString(p.StringTable[fn.Name])
+			}
+			d.writeUint64(uint64(line.Line))
+		}
+	}
+	for _, l := range s.Label {
+		_, _ = d.hasher.WriteString(p.StringTable[l.Key])
+		_, _ = d.hasher.WriteString(p.StringTable[l.Str])
+		d.writeUint64(uint64(l.Num))
+	}
+	return d.hasher.Sum64()
+}
+
+func (d *deltaProfiles) writeUint64(v uint64) {
+	binary.LittleEndian.PutUint64(d.b[:], v)
+	_, _ = d.hasher.Write(d.b[:])
+}
+
+// cumulativeIndexes returns the indexes of the cumulative sample types of the profile.
+func cumulativeIndexes(p *profilev1.Profile, profileName string) []int {
+	types, ok := cumulativeSampleTypes[profileName]
+	if !ok {
+		return nil
+	}
+	var indexes []int
+	for i, st := range p.SampleType {
+		for _, t := range types {
+			if p.StringTable[st.Type] == t {
+				indexes = append(indexes, i)
+				break
+			}
+		}
+	}
+	return indexes
+}
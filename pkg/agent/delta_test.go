@@ -0,0 +1,95 @@
+package agent
+
+import (
+	"bytes"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/grafana/phlare/pkg/pprof"
+)
+
+func sumSampleTypes(t *testing.T, b []byte) map[string]int64 {
+	t.Helper()
+	p, err := pprof.RawFromBytes(b)
+	require.NoError(t, err)
+	defer p.Close()
+
+	sums := map[string]int64{}
+	for _, s := range p.Sample {
+		for i, v := range s.Value {
+			sums[p.StringTable[p.SampleType[i].Type]] += v
+		}
+	}
+	return sums
+}
+
+// scaleAllocations multiplies the cumulative values of the heap profile by n.
+func scaleAllocations(t *testing.T, b []byte, n int64) []byte {
+	t.Helper()
+	p, err := pprof.RawFromBytes(b)
+	require.NoError(t, err)
+	defer p.Close()
+
+	indexes := cumulativeIndexes(p.Profile, "memory")
+	for _, s := range p.Sample {
+		for _, idx := range indexes {
+			s.Value[idx] *= n
+		}
+	}
+	var out bytes.Buffer
+	_, err = p.WriteTo(&out)
+	require.NoError(t, err)
+	return out.Bytes()
+}
+
+func Test_DeltaProfiles(t *testing.T) {
+	heap, err := os.ReadFile("../pprof/testdata/heap")
+	require.NoError(t, err)
+	expected := sumSampleTypes(t, heap)
+	require.NotZero(t, expected["alloc_space"])
+
+	target := &Target{delta: newDeltaProfiles()}
+
+	// The first scrape is the baseline, no allocations are reported.
+	b, err := target.normalize(heap, "memory")
+	require.NoError(t, err)
+	sums := sumSampleTypes(t, b)
+	require.Equal(t, int64(0), sums["alloc_space"])
+	require.Equal(t, int64(0), sums["alloc_objects"])
+	require.Equal(t, expected["inuse_space"], sums["inuse_space"])
+	require.Equal(t, expected["inuse_objects"], sums["inuse_objects"])
+
+	// Allocations doubled since the baseline.
+	b, err = target.normalize(scaleAllocations(t, heap, 2), "memory")
+	require.NoError(t, err)
+	sums = sumSampleTypes(t, b)
+	require.Equal(t, expected["alloc_space"], sums["alloc_space"])
+	require.Equal(t, expected["alloc_objects"], sums["alloc_objects"])
+	require.Equal(t, expected["inuse_space"], sums["inuse_space"])
+
+	// Nothing has been allocated since the last scrape.
+	b, err = target.normalize(scaleAllocations(t, heap, 2), "memory")
+	require.NoError(t, err)
+	sums = sumSampleTypes(t, b)
+	require.Equal(t, int64(0), sums["alloc_space"])
+	require.Equal(t, expected["inuse_space"], sums["inuse_space"])
+
+	// The target restarted, values are reset.
+	b, err = target.normalize(heap, "memory")
+	require.NoError(t, err)
+	sums = sumSampleTypes(t, b)
+	require.Equal(t, expected["alloc_space"], sums["alloc_space"])
+}
+
+func Test_DeltaProfiles_NotCumulative(t *testing.T) {
+	heap, err := os.ReadFile("../pprof/testdata/heap")
+	require.NoError(t, err)
+	expected := sumSampleTypes(t, heap)
+
+	target := &Target{delta: newDeltaProfiles()}
+	b, err := target.normalize(heap, "goroutine")
+	require.NoError(t, err)
+	require.Equal(t, expected, sumSampleTypes(t, b))
+}
@@ -0,0 +1,60 @@
+package agent
+
+import (
+	"time"
+
+	agentv1 "github.com/grafana/phlare/pkg/gen/agent/v1"
+)
+
+// scrapeAttempt is the outcome of a single scrape of a target.
+type scrapeAttempt struct {
+	timestamp time.Time
+	duration  time.Duration
+	health    agentv1.Health
+	err       error
+	pushErr   error
+	size      int
+}
+
+// scrapeHistory is a ring buffer of the last scrape attempts of a target.
+type scrapeHistory struct {
+	attempts []scrapeAttempt
+	next     int
+	full     bool
+}
+
+func newScrapeHistory(size int) *scrapeHistory {
+	if size <= 0 {
+		return nil
+	}
+	return &scrapeHistory{attempts: make([]scrapeAttempt, size)}
+}
+
+// add records an attempt, overwriting the oldest one when the buffer is full.
+func (h *scrapeHistory) add(a scrapeAttempt) {
+	if h == nil {
+		return
+	}
+	h.attempts[h.next] = a
+	h.next++
+	if h.next == len(h.attempts) {
+		h.next = 0
+		h.full = true
+	}
+}
+
+// list returns the recorded attempts, the most recent first.
+func (h *scrapeHistory) list() []scrapeAttempt {
+	if h == nil {
+		return nil
+	}
+	n := h.next
+	if h.full {
+		n = len(h.attempts)
+	}
+	res := make([]scrapeAttempt, 0, n)
+	for i := 1; i <= n; i++ {
+		res = append(res, h.attempts[(h.next-i+len(h.attempts))%len(h.attempts)])
+	}
+	return res
+}
@@ -0,0 +1,114 @@
+package agent
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bufbuild/connect-go"
+	"github.com/go-kit/log"
+	"github.com/parca-dev/parca/pkg/scrape"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/atomic"
+
+	agentv1 "github.com/grafana/phlare/pkg/gen/agent/v1"
+	"github.com/grafana/phlare/pkg/gen/push/v1/pushv1connect"
+)
+
+func Test_ScrapeHistory(t *testing.T) {
+	h := newScrapeHistory(3)
+	require.Empty(t, h.list())
+
+	for i := 1; i <= 5; i++ {
+		h.add(scrapeAttempt{size: i})
+	}
+	sizes := []int{}
+	for _, a := range h.list() {
+		sizes = append(sizes, a.size)
+	}
+	require.Equal(t, []int{5, 4, 3}, sizes)
+
+	// A disabled history is nil and records nothing.
+	disabled := newScrapeHistory(0)
+	disabled.add(scrapeAttempt{})
+	require.Empty(t, disabled.list())
+}
+
+func Test_TargetScrapeHealth(t *testing.T) {
+	fail := atomic.NewBool(true)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if fail.Load() {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		_, _ = w.Write([]byte("profile"))
+	}))
+	defer server.Close()
+	serverURL, err := url.Parse(server.URL)
+	require.NoError(t, err)
+
+	lbls := labels.FromMap(map[string]string{
+		model.AddressLabel:  serverURL.Host,
+		model.SchemeLabel:   "http",
+		model.InstanceLabel: serverURL.Host,
+		model.JobLabel:      "test",
+		scrape.ProfilePath:  "/debug/pprof/allocs",
+		scrape.ProfileName:  "memory",
+	})
+	reg := prometheus.NewRegistry()
+	pusher := &fakePusher{}
+	target := &Target{
+		Target:               scrape.NewTarget(lbls, lbls, url.Values{}),
+		labels:               lbls,
+		scrapeClient:         http.DefaultClient,
+		pusherClientProvider: func() pushv1connect.PusherServiceClient { return pusher },
+		jobName:              "test",
+		metrics:              newMetrics(reg),
+		history:              newScrapeHistory(10),
+		logger:               log.NewNopLogger(),
+		timeout:              time.Second,
+	}
+
+	target.scrape(context.Background())
+	require.Equal(t, agentv1.Health_HEALTH_DOWN, target.Health())
+	require.Error(t, target.LastError())
+
+	fail.Store(false)
+	target.scrape(context.Background())
+	require.Equal(t, agentv1.Health_HEALTH_UP, target.Health())
+	require.NoError(t, target.LastError())
+	require.Len(t, pusher.reqs, 1)
+
+	history := target.History()
+	require.Len(t, history, 2)
+	require.Equal(t, agentv1.Health_HEALTH_UP, history[0].health)
+	require.Equal(t, len("profile"), history[0].size)
+	require.Equal(t, agentv1.Health_HEALTH_DOWN, history[1].health)
+	require.Error(t, history[1].err)
+
+	require.NoError(t, testutil.GatherAndCompare(reg, strings.NewReader(`
+		# HELP phlare_agent_target_up Whether the last scrape of the target was successful (1) or not (0).
+		# TYPE phlare_agent_target_up gauge
+		phlare_agent_target_up{instance="`+serverURL.Host+`",job="test",type="memory"} 1
+	`), "phlare_agent_target_up"))
+
+	target.cancel = func() {}
+	target.stop()
+	require.Equal(t, 0, testutil.CollectAndCount(target.metrics.targetUp))
+}
+
+func Test_GetTargetHistoryErrors(t *testing.T) {
+	a := (&Agent{}).ConnectHandler()
+	_, err := a.GetTargetHistory(context.Background(), connect.NewRequest(&agentv1.GetTargetHistoryRequest{}))
+	require.Equal(t, connect.CodeInvalidArgument, connect.CodeOf(err))
+	_, err = a.GetTargetHistory(context.Background(), connect.NewRequest(&agentv1.GetTargetHistoryRequest{ScrapeUrl: "http://foo/debug/pprof/heap"}))
+	require.Equal(t, connect.CodeNotFound, connect.CodeOf(err))
+}
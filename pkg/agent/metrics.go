@@ -0,0 +1,112 @@
+package agent
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+type metrics struct {
+	scrapedBytes *prometheus.HistogramVec
+	pushedBytes  *prometheus.HistogramVec
+
+	targetUp       *prometheus.GaugeVec
+	scrapeDuration *prometheus.HistogramVec
+	pushErrors     *prometheus.CounterVec
+
+	receiverReceivedProfiles *prometheus.CounterVec
+	receiverDroppedProfiles  *prometheus.CounterVec
+
+	configLastReloadSuccessful       prometheus.Gauge
+	configLastReloadSuccessTimestamp prometheus.Gauge
+}
+
+func newMetrics(reg prometheus.Registerer) *metrics {
+	m := &metrics{
+		scrapedBytes: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Namespace: "phlare",
+				Name:      "agent_scraped_profile_bytes",
+				Help:      "The number of compressed bytes per profile scraped by the agent.",
+				Buckets:   prometheus.ExponentialBucketsRange(1024, 15*1024*1024, 30),
+			},
+			[]string{"job", "type"},
+		),
+		pushedBytes: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Namespace: "phlare",
+				Name:      "agent_pushed_profile_bytes",
+				Help:      "The number of compressed bytes per profile pushed by the agent, after delta computation and normalization.",
+				Buckets:   prometheus.ExponentialBucketsRange(1024, 15*1024*1024, 30),
+			},
+			[]string{"job", "type"},
+		),
+		targetUp: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: "phlare",
+				Name:      "agent_target_up",
+				Help:      "Whether the last scrape of the target was successful (1) or not (0).",
+			},
+			[]string{"job", "instance", "type"},
+		),
+		scrapeDuration: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Namespace: "phlare",
+				Name:      "agent_scrape_duration_seconds",
+				Help:      "The duration of scrapes of targets by the agent.",
+				Buckets:   prometheus.ExponentialBuckets(0.01, 2, 14),
+			},
+			[]string{"job", "type"},
+		),
+		pushErrors: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: "phlare",
+				Name:      "agent_push_errors_total",
+				Help:      "The total number of scraped profiles which failed to be pushed, by error code.",
+			},
+			[]string{"job", "type", "code"},
+		),
+		receiverReceivedProfiles: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: "phlare",
+				Name:      "agent_receiver_received_profiles_total",
+				Help:      "The total number of profiles pushed to the agent receiver and forwarded.",
+			},
+			[]string{"type"},
+		),
+		receiverDroppedProfiles: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: "phlare",
+				Name:      "agent_receiver_dropped_profiles_total",
+				Help:      "The total number of profiles pushed to the agent receiver and dropped by relabeling.",
+			},
+			[]string{"type"},
+		),
+		configLastReloadSuccessful: prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Namespace: "phlare",
+				Name:      "agent_config_last_reload_successful",
+				Help:      "Whether the last reload of the agent configuration was successful.",
+			},
+		),
+		configLastReloadSuccessTimestamp: prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Namespace: "phlare",
+				Name:      "agent_config_last_reload_success_timestamp_seconds",
+				Help:      "Timestamp of the last successful reload of the agent configuration.",
+			},
+		),
+	}
+	if reg != nil {
+		reg.MustRegister(
+			m.scrapedBytes,
+			m.pushedBytes,
+			m.targetUp,
+			m.scrapeDuration,
+			m.pushErrors,
+			m.receiverReceivedProfiles,
+			m.receiverDroppedProfiles,
+			m.configLastReloadSuccessful,
+			m.configLastReloadSuccessTimestamp,
+		)
+	}
+	return m
+}
@@ -218,6 +218,7 @@ func (tg *TargetGroup) targetsFromGroup(group *targetgroup.Group) ([]*Target, []
 					timeout:              timeout,
 					health:               agentv1.Health_HEALTH_UNSPECIFIED,
 					logger:               tg.logger,
+					droppedReason:        droppedReasonRelabeling,
 				})
 				continue
 			}
@@ -230,12 +231,20 @@ func (tg *TargetGroup) targetsFromGroup(group *targetgroup.Group) ([]*Target, []
 				if pcfg, found := tg.config.ProfilingConfig.PprofConfig[profType]; found && pcfg.Delta {
 					params.Add("seconds", strconv.Itoa(int(time.Duration(tg.config.ScrapeTimeout)/time.Second)-1))
 				}
+				var delta *deltaProfiles
+				if tg.config.DeltaProfiles {
+					delta = newDeltaProfiles()
+				}
 				targets = append(targets, &Target{
 					Target:               scrape.NewTarget(lbls, origLabels, params),
 					labels:               lbls,
 					tenantID:             tg.tenantID,
 					scrapeClient:         tg.scrapeClient,
 					pusherClientProvider: tg.pusherClientProvider,
+					jobName:              tg.jobName,
+					metrics:              tg.metrics,
+					delta:                delta,
+					history:              newScrapeHistory(tg.historySize),
 					interval:             interval,
 					timeout:              timeout,
 					health:               agentv1.Health_HEALTH_UNSPECIFIED,
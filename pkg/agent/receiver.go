@@ -0,0 +1,193 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+
+	"github.com/bufbuild/connect-go"
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/parca-dev/parca/pkg/scrape"
+	"github.com/prometheus/common/model"
+
+	commonv1 "github.com/grafana/phlare/pkg/gen/common/v1"
+	pushv1 "github.com/grafana/phlare/pkg/gen/push/v1"
+	"github.com/grafana/phlare/pkg/gen/push/v1/pushv1connect"
+	phlaremodel "github.com/grafana/phlare/pkg/model"
+	"github.com/grafana/phlare/pkg/pprof"
+	"github.com/grafana/phlare/pkg/tenant"
+	"github.com/grafana/phlare/pkg/util"
+)
+
+// Receiver accepts profiles pushed by applications which can't be scraped, and
+// forwards them to Phlare the same way scraped profiles are.
+type Receiver struct {
+	cfg                  ReceiverConfig
+	tenantID             string
+	pusherClientProvider PusherClientProvider
+	metrics              *metrics
+	logger               log.Logger
+}
+
+func newReceiver(cfg ReceiverConfig, tenantID string, pusherClientProvider PusherClientProvider, metrics *metrics, logger log.Logger) *Receiver {
+	return &Receiver{
+		cfg:                  cfg,
+		tenantID:             tenantID,
+		pusherClientProvider: pusherClientProvider,
+		metrics:              metrics,
+		logger:               log.With(logger, "component", "receiver"),
+	}
+}
+
+// Push applies the receiver relabeling rules to the pushed series and forwards them.
+func (r *Receiver) Push(ctx context.Context, req *connect.Request[pushv1.PushRequest]) (*connect.Response[pushv1.PushResponse], error) {
+	ctx, err := r.injectTenantID(ctx, req.Header())
+	if err != nil {
+		return nil, connect.NewError(connect.CodeInvalidArgument, err)
+	}
+
+	series := make([]*pushv1.RawProfileSeries, 0, len(req.Msg.Series))
+	for _, s := range req.Msg.Series {
+		profileName := phlaremodel.Labels(s.Labels).Get(scrape.ProfileName)
+		lbls, keep := phlaremodel.Relabel(s.Labels, r.cfg.RelabelConfigs...)
+		if !keep {
+			r.metrics.receiverDroppedProfiles.WithLabelValues(profileName).Add(float64(len(s.Samples)))
+			continue
+		}
+		r.metrics.receiverReceivedProfiles.WithLabelValues(profileName).Add(float64(len(s.Samples)))
+		s.Labels = lbls
+		series = append(series, s)
+	}
+	if len(series) == 0 {
+		return connect.NewResponse(&pushv1.PushResponse{}), nil
+	}
+	req.Msg.Series = series
+
+	resp, err := r.pusherClientProvider().Push(ctx, connect.NewRequest(req.Msg))
+	if err != nil {
+		level.Error(r.logger).Log("msg", "forwarding pushed profiles failed", "err", err)
+		return nil, err
+	}
+	return resp, nil
+}
+
+// IngestHandler accepts a pprof profile, compressed or not, as the request body.
+// Labels of the profile are passed as query parameters, the profile name is
+// required using the __name__ parameter.
+func (r *Receiver) IngestHandler(w http.ResponseWriter, req *http.Request) {
+	query := req.URL.Query()
+	if query.Get(model.MetricNameLabel) == "" {
+		http.Error(w, fmt.Sprintf("%s parameter is required", model.MetricNameLabel), http.StatusBadRequest)
+		return
+	}
+	lbls := make([]*commonv1.LabelPair, 0, len(query))
+	for name := range query {
+		if !model.LabelName(name).IsValid() {
+			http.Error(w, fmt.Sprintf("invalid label name %q", name), http.StatusBadRequest)
+			return
+		}
+		lbls = append(lbls, &commonv1.LabelPair{Name: name, Value: query.Get(name)})
+	}
+	sort.Sort(phlaremodel.Labels(lbls))
+
+	if r.cfg.MaxBodySize > 0 {
+		req.Body = http.MaxBytesReader(w, req.Body, r.cfg.MaxBodySize)
+	}
+	body, err := io.ReadAll(req.Body)
+	if err != nil {
+		// The reader fails once the limit is reached.
+		if r.cfg.MaxBodySize > 0 && int64(len(body)) == r.cfg.MaxBodySize {
+			http.Error(w, fmt.Sprintf("request body larger than %d bytes", r.cfg.MaxBodySize), http.StatusRequestEntityTooLarge)
+			return
+		}
+		util.WriteError(err, w)
+		return
+	}
+	p, err := pprof.RawFromBytes(body)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("invalid pprof profile: %v", err), http.StatusBadRequest)
+		return
+	}
+	p.Close()
+
+	pushReq := connect.NewRequest(&pushv1.PushRequest{
+		Series: []*pushv1.RawProfileSeries{
+			{
+				Labels:  lbls,
+				Samples: []*pushv1.RawSample{{RawProfile: body}},
+			},
+		},
+	})
+	for k, v := range req.Header {
+		pushReq.Header()[k] = v
+	}
+	if _, err := r.Push(req.Context(), pushReq); err != nil {
+		if connect.CodeOf(err) == connect.CodeInvalidArgument {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		util.WriteError(err, w)
+		return
+	}
+}
+
+// injectTenantID uses the tenant ID of the request if any, or the tenant ID
+// of the agent otherwise.
+func (r *Receiver) injectTenantID(ctx context.Context, headers http.Header) (context.Context, error) {
+	_, tenantCtx, err := tenant.ExtractTenantIDFromHeaders(ctx, headers)
+	switch {
+	case err == tenant.ErrNoTenantID:
+		if r.tenantID != "" {
+			return tenant.InjectTenantID(ctx, r.tenantID), nil
+		}
+		return ctx, nil
+	case err != nil:
+		return nil, err
+	}
+	return tenantCtx, nil
+}
+
+// externalLabelsPusher adds the agent external labels to all series before pushing them.
+type externalLabelsPusher struct {
+	pushv1connect.PusherServiceClient
+	externalLabels model.LabelSet
+}
+
+// withExternalLabels wraps the provider so that pushed profiles get the external labels.
+func withExternalLabels(provider PusherClientProvider, externalLabels model.LabelSet) PusherClientProvider {
+	if len(externalLabels) == 0 {
+		return provider
+	}
+	return func() pushv1connect.PusherServiceClient {
+		return &externalLabelsPusher{
+			PusherServiceClient: provider(),
+			externalLabels:      externalLabels,
+		}
+	}
+}
+
+func (p *externalLabelsPusher) Push(ctx context.Context, req *connect.Request[pushv1.PushRequest]) (*connect.Response[pushv1.PushResponse], error) {
+	for _, series := range req.Msg.Series {
+		series.Labels = addExternalLabels(series.Labels, p.externalLabels)
+	}
+	return p.PusherServiceClient.Push(ctx, req)
+}
+
+// addExternalLabels adds the external labels which are not already set on the series.
+func addExternalLabels(lbls []*commonv1.LabelPair, externalLabels model.LabelSet) []*commonv1.LabelPair {
+	added := false
+	for name, value := range externalLabels {
+		if phlaremodel.Labels(lbls).Get(string(name)) != "" {
+			continue
+		}
+		lbls = append(lbls, &commonv1.LabelPair{Name: string(name), Value: string(value)})
+		added = true
+	}
+	if added {
+		sort.Sort(phlaremodel.Labels(lbls))
+	}
+	return lbls
+}
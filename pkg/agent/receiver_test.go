@@ -0,0 +1,118 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/bufbuild/connect-go"
+	"github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/relabel"
+	"github.com/stretchr/testify/require"
+
+	commonv1 "github.com/grafana/phlare/pkg/gen/common/v1"
+	pushv1 "github.com/grafana/phlare/pkg/gen/push/v1"
+	"github.com/grafana/phlare/pkg/gen/push/v1/pushv1connect"
+	"github.com/grafana/phlare/pkg/tenant"
+)
+
+type fakePusher struct {
+	pushv1connect.UnimplementedPusherServiceHandler
+	reqs    []*pushv1.PushRequest
+	tenants []string
+}
+
+func (f *fakePusher) Push(ctx context.Context, req *connect.Request[pushv1.PushRequest]) (*connect.Response[pushv1.PushResponse], error) {
+	tenantID, _ := tenant.ExtractTenantIDFromContext(ctx)
+	f.tenants = append(f.tenants, tenantID)
+	f.reqs = append(f.reqs, req.Msg)
+	return connect.NewResponse(&pushv1.PushResponse{}), nil
+}
+
+func newTestReceiver(t *testing.T, cfg ReceiverConfig, externalLabels model.LabelSet) (*Receiver, *fakePusher) {
+	t.Helper()
+	pusher := &fakePusher{}
+	provider := withExternalLabels(func() pushv1connect.PusherServiceClient { return pusher }, externalLabels)
+	return newReceiver(cfg, "agent-tenant", provider, newMetrics(prometheus.NewRegistry()), log.NewNopLogger()), pusher
+}
+
+func Test_Receiver_Push(t *testing.T) {
+	r, pusher := newTestReceiver(t, ReceiverConfig{
+		RelabelConfigs: []*relabel.Config{
+			{
+				SourceLabels: model.LabelNames{"env"},
+				Regex:        relabel.MustNewRegexp("dev"),
+				Action:       relabel.Drop,
+			},
+		},
+	}, model.LabelSet{"cluster": "eu-west", "env": "unknown"})
+
+	req := connect.NewRequest(&pushv1.PushRequest{
+		Series: []*pushv1.RawProfileSeries{
+			{
+				Labels: []*commonv1.LabelPair{
+					{Name: "__name__", Value: "memory"},
+					{Name: "env", Value: "dev"},
+				},
+				Samples: []*pushv1.RawSample{{RawProfile: []byte{}}},
+			},
+			{
+				Labels: []*commonv1.LabelPair{
+					{Name: "__name__", Value: "memory"},
+					{Name: "env", Value: "prod"},
+				},
+				Samples: []*pushv1.RawSample{{RawProfile: []byte{}}},
+			},
+		},
+	})
+	req.Header().Set("X-Scope-OrgID", "foo")
+	_, err := r.Push(context.Background(), req)
+	require.NoError(t, err)
+
+	require.Len(t, pusher.reqs, 1)
+	require.Equal(t, []string{"foo"}, pusher.tenants)
+	require.Len(t, pusher.reqs[0].Series, 1)
+	require.Equal(t, []*commonv1.LabelPair{
+		{Name: "__name__", Value: "memory"},
+		{Name: "cluster", Value: "eu-west"},
+		{Name: "env", Value: "prod"},
+	}, pusher.reqs[0].Series[0].Labels)
+}
+
+func Test_Receiver_IngestHandler(t *testing.T) {
+	heap, err := os.ReadFile("../pprof/testdata/heap")
+	require.NoError(t, err)
+	r, pusher := newTestReceiver(t, ReceiverConfig{MaxBodySize: int64(len(heap))}, nil)
+
+	for _, tc := range []struct {
+		name   string
+		url    string
+		body   []byte
+		status int
+	}{
+		{name: "body too large", url: "/ingest?__name__=memory", body: append(append([]byte{}, heap...), 0), status: http.StatusRequestEntityTooLarge},
+		{name: "missing name", url: "/ingest?service=foo", body: heap, status: http.StatusBadRequest},
+		{name: "invalid label", url: "/ingest?__name__=memory&a-b=foo", body: heap, status: http.StatusBadRequest},
+		{name: "invalid profile", url: "/ingest?__name__=memory", body: []byte("foo"), status: http.StatusBadRequest},
+		{name: "valid", url: "/ingest?__name__=memory&service=foo", body: heap, status: http.StatusOK},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			r.IngestHandler(rec, httptest.NewRequest(http.MethodPost, tc.url, bytes.NewReader(tc.body)))
+			require.Equal(t, tc.status, rec.Code, rec.Body.String())
+		})
+	}
+
+	require.Len(t, pusher.reqs, 1)
+	require.Equal(t, []string{"agent-tenant"}, pusher.tenants)
+	require.Equal(t, []*commonv1.LabelPair{
+		{Name: "__name__", Value: "memory"},
+		{Name: "service", Value: "foo"},
+	}, pusher.reqs[0].Series[0].Labels)
+	require.Equal(t, heap, pusher.reqs[0].Series[0].Samples[0].RawProfile)
+}
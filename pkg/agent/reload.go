@@ -0,0 +1,100 @@
+package agent
+
+import (
+	"net/http"
+	"reflect"
+
+	"github.com/go-kit/log/level"
+	"github.com/pkg/errors"
+)
+
+// ConfigLoader loads the latest agent configuration, usually from the config file.
+type ConfigLoader func() (*Config, error)
+
+// SetConfigLoader enables reloading the scrape configs on SIGHUP and using the
+// reload endpoint. It has to be called before the agent is started.
+func (a *Agent) SetConfigLoader(loader ConfigLoader) {
+	a.configLoader = loader
+}
+
+// Reload loads the configuration and applies its scrape configs.
+func (a *Agent) Reload() error {
+	if a.configLoader == nil {
+		return errors.New("reloading the configuration is not enabled")
+	}
+	cfg, err := a.configLoader()
+	if err == nil {
+		err = a.ApplyConfig(cfg)
+	}
+	if err != nil {
+		a.metrics.configLastReloadSuccessful.Set(0)
+		return err
+	}
+	a.metrics.configLastReloadSuccessful.Set(1)
+	a.metrics.configLastReloadSuccessTimestamp.SetToCurrentTime()
+	return nil
+}
+
+// ApplyConfig validates the scrape configs of the given configuration and applies
+// them in place: target groups of removed jobs are stopped, target groups of
+// modified jobs are restarted and new jobs are started once their targets are
+// discovered. Other agent settings require a restart.
+func (a *Agent) ApplyConfig(cfg *Config) error {
+	if err := cfg.Validate(); err != nil {
+		return errors.Wrap(err, "invalid agent configuration")
+	}
+
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+
+	current, next := scrapeConfigsByJob(a.Config.ScrapeConfigs), scrapeConfigsByJob(cfg.ScrapeConfigs)
+	jobs := discoveryConfigs(cfg.ScrapeConfigs)
+	if a.manager != nil {
+		if err := a.manager.ApplyConfig(jobs); err != nil {
+			return errors.Wrap(err, "apply discovery configs")
+		}
+	}
+	a.jobs = jobs
+	// The configuration is swapped rather than updated in place, since the
+	// current one may be shared with the caller of New.
+	updated := *a.Config
+	updated.ScrapeConfigs = cfg.ScrapeConfigs
+	a.Config = &updated
+
+	for jobName, tg := range a.groups {
+		if _, ok := next[jobName]; !ok {
+			level.Info(a.logger).Log("msg", "stopping removed job", "job", jobName)
+			tg.stop()
+			delete(a.groups, jobName)
+			delete(a.targetGroups, jobName)
+			continue
+		}
+		if reflect.DeepEqual(current[jobName], next[jobName]) {
+			continue
+		}
+		level.Info(a.logger).Log("msg", "restarting modified job", "job", jobName)
+		tg.stop()
+		newGroup := a.newTargetGroup(jobName)
+		a.groups[jobName] = newGroup
+		newGroup.sync(a.targetGroups[jobName])
+	}
+	return nil
+}
+
+// ReloadHandler reloads the agent configuration.
+func (a *Agent) ReloadHandler(w http.ResponseWriter, r *http.Request) {
+	if err := a.Reload(); err != nil {
+		level.Error(a.logger).Log("msg", "failed to reload the agent configuration", "err", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func scrapeConfigsByJob(scrapeConfigs []*ScrapeConfig) map[string]*ScrapeConfig {
+	res := make(map[string]*ScrapeConfig, len(scrapeConfigs))
+	for _, c := range scrapeConfigs {
+		res[c.JobName] = c
+	}
+	return res
+}
@@ -0,0 +1,99 @@
+package agent
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/grafana/dskit/services"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/discovery"
+	"github.com/prometheus/prometheus/discovery/targetgroup"
+	"github.com/stretchr/testify/require"
+)
+
+func staticScrapeConfig(jobName string, interval time.Duration, addresses ...string) *ScrapeConfig {
+	group := &targetgroup.Group{Source: jobName}
+	for _, addr := range addresses {
+		group.Targets = append(group.Targets, model.LabelSet{model.AddressLabel: model.LabelValue(addr)})
+	}
+	return &ScrapeConfig{
+		JobName:        jobName,
+		ScrapeInterval: model.Duration(interval),
+		ScrapeTimeout:  model.Duration(interval),
+		ServiceDiscoveryConfig: ServiceDiscoveryConfig{
+			StaticConfigs: discovery.StaticConfig{group},
+		},
+	}
+}
+
+func activeJobs(a *Agent) map[string]time.Duration {
+	res := map[string]time.Duration{}
+	for job, targets := range a.ActiveTargets() {
+		for _, t := range targets {
+			res[job] = t.interval
+		}
+	}
+	return res
+}
+
+func Test_ApplyConfig(t *testing.T) {
+	cfg := &Config{
+		ScrapeConfigs: []*ScrapeConfig{
+			staticScrapeConfig("removed", time.Hour, "127.0.0.1:1"),
+			staticScrapeConfig("modified", time.Hour, "127.0.0.1:2"),
+			staticScrapeConfig("unchanged", time.Hour, "127.0.0.1:3"),
+		},
+	}
+	require.NoError(t, cfg.Validate())
+
+	reg := prometheus.NewRegistry()
+	a, err := New(cfg, reg, log.NewNopLogger(), nil)
+	require.NoError(t, err)
+	require.NoError(t, services.StartAndAwaitRunning(context.Background(), a))
+	t.Cleanup(func() {
+		require.NoError(t, services.StopAndAwaitTerminated(context.Background(), a))
+	})
+
+	require.Eventually(t, func() bool {
+		return len(activeJobs(a)) == 3
+	}, 10*time.Second, 50*time.Millisecond)
+
+	a.mtx.Lock()
+	unchanged := a.groups["unchanged"]
+	a.mtx.Unlock()
+
+	next := &Config{
+		ScrapeConfigs: []*ScrapeConfig{
+			staticScrapeConfig("modified", 2*time.Hour, "127.0.0.1:2"),
+			staticScrapeConfig("unchanged", time.Hour, "127.0.0.1:3"),
+			staticScrapeConfig("added", time.Hour, "127.0.0.1:4"),
+		},
+	}
+	a.SetConfigLoader(func() (*Config, error) { return next, nil })
+	require.NoError(t, a.Reload())
+
+	require.Eventually(t, func() bool {
+		jobs := activeJobs(a)
+		return len(jobs) == 3 && jobs["added"] == time.Hour && jobs["modified"] == 2*time.Hour && jobs["unchanged"] == time.Hour
+	}, 10*time.Second, 50*time.Millisecond)
+
+	a.mtx.Lock()
+	require.Same(t, unchanged, a.groups["unchanged"])
+	a.mtx.Unlock()
+	// The initial configuration is left untouched.
+	require.Equal(t, "removed", cfg.ScrapeConfigs[0].JobName)
+	require.Len(t, cfg.ScrapeConfigs, 3)
+	require.Equal(t, 1., testutil.ToFloat64(a.metrics.configLastReloadSuccessful))
+
+	// An invalid configuration is rejected and the current one is kept.
+	a.SetConfigLoader(func() (*Config, error) {
+		return &Config{ScrapeConfigs: []*ScrapeConfig{{}}}, nil
+	})
+	require.Error(t, a.Reload())
+	require.Equal(t, 0., testutil.ToFloat64(a.metrics.configLastReloadSuccessful))
+	require.Len(t, activeJobs(a), 3)
+}
@@ -0,0 +1,117 @@
+package agent
+
+import (
+	"flag"
+	"os"
+	"time"
+
+	"github.com/go-kit/log/level"
+	"github.com/grafana/dskit/flagext"
+	"github.com/grafana/dskit/kv"
+	"github.com/grafana/dskit/netutil"
+	"github.com/grafana/dskit/ring"
+
+	"github.com/grafana/phlare/pkg/util"
+)
+
+const (
+	// ringName is the name of the ring used to shard targets between agents.
+	ringName = "agent"
+	// ringKey is the key under which we store the agents ring in the KVStore.
+	ringKey = "agent"
+)
+
+// shardingOp is the ring operation used to find the owner of a target. Only
+// ACTIVE instances own targets, the ownership is extended to the next instance
+// when the owner is in any other state.
+var shardingOp = ring.NewOp([]ring.InstanceState{ring.ACTIVE}, func(s ring.InstanceState) bool {
+	return s != ring.ACTIVE
+})
+
+// RingConfig masks the ring lifecycler config which contains
+// many options not really required by the agents ring. This config
+// is used to strip down the config to the minimum, and avoid confusion
+// to the user.
+type RingConfig struct {
+	Enabled          bool          `yaml:"enabled"`
+	KVStore          kv.Config     `yaml:"kvstore"`
+	HeartbeatPeriod  time.Duration `yaml:"heartbeat_period"`
+	HeartbeatTimeout time.Duration `yaml:"heartbeat_timeout"`
+	NumTokens        int           `yaml:"num_tokens"`
+	RingCheckPeriod  time.Duration `yaml:"ring_check_period"`
+
+	// Instance details
+	InstanceID             string   `yaml:"instance_id" doc:"hidden"`
+	InstanceInterfaceNames []string `yaml:"instance_interface_names" doc:"default=[<private network interfaces>]"`
+	InstancePort           int      `yaml:"instance_port" doc:"hidden"`
+	InstanceAddr           string   `yaml:"instance_addr" doc:"hidden"`
+
+	// Injected internally
+	ListenPort int `yaml:"-"`
+}
+
+// RegisterFlags adds the flags required to config this to the given FlagSet
+func (cfg *RingConfig) RegisterFlags(f *flag.FlagSet) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		level.Error(util.Logger).Log("msg", "failed to get hostname", "err", err)
+		os.Exit(1)
+	}
+
+	// Ring flags
+	f.BoolVar(&cfg.Enabled, "agent.ring.enabled", false, "Enable sharding of scrape targets between agent replicas using a hash ring. When disabled every agent scrapes all discovered targets.")
+	cfg.KVStore.RegisterFlagsWithPrefix("agent.ring.", "agents/", f)
+	f.DurationVar(&cfg.HeartbeatPeriod, "agent.ring.heartbeat-period", 5*time.Second, "Period at which to heartbeat to the ring. 0 = disabled.")
+	f.DurationVar(&cfg.HeartbeatTimeout, "agent.ring.heartbeat-timeout", time.Minute, "The heartbeat timeout after which agents are considered unhealthy within the ring. 0 = never (timeout disabled).")
+	f.IntVar(&cfg.NumTokens, "agent.ring.num-tokens", 128, "Number of tokens each agent owns in the ring.")
+	f.DurationVar(&cfg.RingCheckPeriod, "agent.ring.ring-check-period", 5*time.Second, "Period at which to check for ring changes and rebalance scrape targets.")
+
+	// Instance flags
+	cfg.InstanceInterfaceNames = netutil.PrivateNetworkInterfacesWithFallback([]string{"eth0", "en0"}, util.Logger)
+	f.Var((*flagext.StringSlice)(&cfg.InstanceInterfaceNames), "agent.ring.instance-interface-names", "Name of network interface to read address from.")
+	f.StringVar(&cfg.InstanceAddr, "agent.ring.instance-addr", "", "IP address to advertise in the ring.")
+	f.IntVar(&cfg.InstancePort, "agent.ring.instance-port", 0, "Port to advertise in the ring (defaults to server.http-listen-port).")
+	f.StringVar(&cfg.InstanceID, "agent.ring.instance-id", hostname, "Instance ID to register in the ring.")
+}
+
+// ToLifecyclerConfig returns a LifecyclerConfig based on the agent
+// ring config.
+func (cfg *RingConfig) ToLifecyclerConfig() ring.LifecyclerConfig {
+	// We have to make sure that the ring.LifecyclerConfig and ring.Config
+	// defaults are preserved
+	lc := ring.LifecyclerConfig{}
+	flagext.DefaultValues(&lc)
+
+	// Configure lifecycler
+	lc.RingConfig = cfg.ToRingConfig()
+	lc.ListenPort = cfg.ListenPort
+	lc.Addr = cfg.InstanceAddr
+	lc.Port = cfg.InstancePort
+	lc.ID = cfg.InstanceID
+	lc.InfNames = cfg.InstanceInterfaceNames
+	lc.UnregisterOnShutdown = true
+	lc.HeartbeatPeriod = cfg.HeartbeatPeriod
+	lc.ObservePeriod = 0
+	lc.NumTokens = cfg.NumTokens
+	lc.JoinAfter = 0
+	lc.MinReadyDuration = 0
+	lc.FinalSleep = 0
+
+	return lc
+}
+
+func (cfg *RingConfig) ToRingConfig() ring.Config {
+	rc := ring.Config{}
+	flagext.DefaultValues(&rc)
+
+	rc.KVStore = cfg.KVStore
+	rc.HeartbeatTimeout = cfg.HeartbeatTimeout
+	rc.ReplicationFactor = 1
+
+	return rc
+}
+
+// shardToken folds the 64 bits hash of a target into a ring token.
+func shardToken(hash uint64) uint32 {
+	return uint32(hash>>32) ^ uint32(hash)
+}
@@ -8,6 +8,7 @@ import (
 	"io"
 	"io/ioutil"
 	"net/http"
+	"sort"
 	"strings"
 	"sync"
 	"time"
@@ -17,6 +18,7 @@ import (
 	"github.com/go-kit/log/level"
 	"github.com/parca-dev/parca/pkg/scrape"
 	commonconfig "github.com/prometheus/common/config"
+	"github.com/prometheus/common/model"
 	"github.com/prometheus/common/version"
 	"github.com/prometheus/prometheus/discovery/targetgroup"
 	"github.com/prometheus/prometheus/model/labels"
@@ -26,6 +28,8 @@ import (
 	agentv1 "github.com/grafana/phlare/pkg/gen/agent/v1"
 	commonv1 "github.com/grafana/phlare/pkg/gen/common/v1"
 	pushv1 "github.com/grafana/phlare/pkg/gen/push/v1"
+	phlaremodel "github.com/grafana/phlare/pkg/model"
+	"github.com/grafana/phlare/pkg/pprof"
 	"github.com/grafana/phlare/pkg/tenant"
 )
 
@@ -34,6 +38,11 @@ var (
 	userAgentHeader = fmt.Sprintf("phlare/%s", version.Version)
 )
 
+const (
+	droppedReasonRelabeling = "dropped by relabeling"
+	droppedReasonNotOwned   = "not owned by this agent"
+)
+
 type TargetGroup struct {
 	jobName  string
 	config   ScrapeConfig
@@ -42,6 +51,9 @@ type TargetGroup struct {
 	logger               log.Logger
 	scrapeClient         *http.Client
 	pusherClientProvider PusherClientProvider
+	owns                 func(hash uint64) bool
+	metrics              *metrics
+	historySize          int
 	ctx                  context.Context
 
 	mtx            sync.RWMutex
@@ -49,7 +61,7 @@ type TargetGroup struct {
 	droppedTargets []*Target
 }
 
-func NewTargetGroup(ctx context.Context, jobName string, cfg ScrapeConfig, pusherClientProvider PusherClientProvider, tenantID string, logger log.Logger) *TargetGroup {
+func NewTargetGroup(ctx context.Context, jobName string, cfg ScrapeConfig, pusherClientProvider PusherClientProvider, tenantID string, owns func(hash uint64) bool, metrics *metrics, historySize int, logger log.Logger) *TargetGroup {
 	scrapeClient, err := commonconfig.NewClientFromConfig(cfg.HTTPClientConfig, cfg.JobName)
 	if err != nil {
 		level.Error(logger).Log("msg", "Error creating HTTP client", "err", err)
@@ -61,6 +73,9 @@ func NewTargetGroup(ctx context.Context, jobName string, cfg ScrapeConfig, pushe
 		logger:               logger,
 		scrapeClient:         scrapeClient,
 		pusherClientProvider: pusherClientProvider,
+		owns:                 owns,
+		metrics:              metrics,
+		historySize:          historySize,
 		ctx:                  ctx,
 		activeTargets:        map[uint64]*Target{},
 		tenantID:             tenantID,
@@ -81,9 +96,17 @@ func (tg *TargetGroup) sync(groups []*targetgroup.Group) {
 			continue
 		}
 		for _, t := range targets {
-			if t.Labels().Len() > 0 {
-				actives = append(actives, t)
+			if t.Labels().Len() == 0 {
+				continue
+			}
+			if !tg.owns(t.Hash()) {
+				// Targets are sharded between agents, report the targets scraped by others
+				// so that operators can tell which agent is scraping a target.
+				t.droppedReason = droppedReasonNotOwned
+				tg.droppedTargets = append(tg.droppedTargets, t)
+				continue
 			}
+			actives = append(actives, t)
 		}
 		for _, dt := range dropped {
 			tg.droppedTargets = append(tg.droppedTargets, dt)
@@ -112,6 +135,17 @@ Outer:
 	}
 }
 
+// stop stops scraping all active targets of the group.
+func (tg *TargetGroup) stop() {
+	tg.mtx.Lock()
+	defer tg.mtx.Unlock()
+
+	for h, t := range tg.activeTargets {
+		t.stop()
+		delete(tg.activeTargets, h)
+	}
+}
+
 type Target struct {
 	*scrape.Target
 	labels             labels.Labels
@@ -122,9 +156,17 @@ type Target struct {
 	lastScrapeDuration time.Duration
 	health             agentv1.Health
 	lastScrapeSize     int
+	history            *scrapeHistory
 
 	scrapeClient         *http.Client
 	pusherClientProvider PusherClientProvider
+	jobName              string
+	metrics              *metrics
+	// delta is only set when delta profiles are computed by the agent.
+	delta *deltaProfiles
+
+	// droppedReason is the reason why the target is dropped, only set for dropped targets.
+	droppedReason string
 
 	hash              uint64
 	req               *http.Request
@@ -181,10 +223,12 @@ func (t *Target) scrape(ctx context.Context) {
 
 	if err := t.fetchProfile(scrapeCtx, profileType, buf); err != nil {
 		level.Error(t.logger).Log("msg", "fetch profile failed", "target", t.Labels().String(), "err", err)
-		t.health = agentv1.Health_HEALTH_DOWN
-		t.lastScrapeDuration = time.Since(start)
-		t.lastError = err
-		t.lastScrape = start
+		t.recordAttempt(scrapeAttempt{
+			timestamp: start,
+			duration:  time.Since(start),
+			health:    agentv1.Health_HEALTH_DOWN,
+			err:       err,
+		}, profileType)
 		return
 	}
 
@@ -192,10 +236,25 @@ func (t *Target) scrape(ctx context.Context) {
 	if len(b) > 0 {
 		t.lastScrapeSize = len(b)
 	}
-	t.health = agentv1.Health_HEALTH_UP
-	t.lastScrapeDuration = time.Since(start)
-	t.lastError = nil
-	t.lastScrape = start
+	attempt := scrapeAttempt{
+		timestamp: start,
+		duration:  time.Since(start),
+		health:    agentv1.Health_HEALTH_UP,
+		size:      len(b),
+	}
+	// The attempt is recorded once the profile is pushed, to keep track of push errors.
+	defer func() { t.recordAttempt(attempt, profileType) }()
+
+	t.metrics.scrapedBytes.WithLabelValues(t.jobName, profileType).Observe(float64(len(b)))
+	if t.delta != nil {
+		var err error
+		if b, err = t.normalize(b, profileType); err != nil {
+			level.Error(t.logger).Log("msg", "computing delta profile failed", "target", t.Labels().String(), "err", err)
+			attempt.pushErr = fmt.Errorf("computing delta profile: %w", err)
+			return
+		}
+	}
+	t.metrics.pushedBytes.WithLabelValues(t.jobName, profileType).Observe(float64(len(b)))
 	// todo retry strategy
 	req := &pushv1.PushRequest{}
 	series := &pushv1.RawProfileSeries{
@@ -210,6 +269,14 @@ func (t *Target) scrape(ctx context.Context) {
 			Value: l.Value,
 		})
 	}
+	if t.delta != nil {
+		// Let the ingesters know the delta has already been computed.
+		series.Labels = append(series.Labels, &commonv1.LabelPair{
+			Name:  phlaremodel.LabelNameDelta,
+			Value: "false",
+		})
+		sort.Sort(phlaremodel.Labels(series.Labels))
+	}
 	series.Samples = []*pushv1.RawSample{
 		{
 			RawProfile: b,
@@ -224,7 +291,49 @@ func (t *Target) scrape(ctx context.Context) {
 	}
 	if _, err := t.pusherClientProvider().Push(ctx, connect.NewRequest(req)); err != nil {
 		level.Error(t.logger).Log("msg", "push failed", "labels", t.Labels().String(), "err", err)
+		t.metrics.pushErrors.WithLabelValues(t.jobName, profileType, connect.CodeOf(err).String()).Inc()
+		attempt.pushErr = err
+	}
+}
+
+// recordAttempt updates the target state and metrics with the outcome of a scrape.
+func (t *Target) recordAttempt(a scrapeAttempt, profileType string) {
+	t.mtx.Lock()
+	t.health = a.health
+	t.lastScrapeDuration = a.duration
+	t.lastError = a.err
+	t.lastScrape = a.timestamp
+	t.history.add(a)
+	t.mtx.Unlock()
+
+	up := 0.
+	if a.health == agentv1.Health_HEALTH_UP {
+		up = 1
 	}
+	t.metrics.targetUp.WithLabelValues(t.jobName, t.labels.Get(model.InstanceLabel), profileType).Set(up)
+	t.metrics.scrapeDuration.WithLabelValues(t.jobName, profileType).Observe(a.duration.Seconds())
+}
+
+// normalize computes the delta of the cumulative sample types of the scraped
+// profile, then normalizes and re-compresses it.
+func (t *Target) normalize(b []byte, profileType string) ([]byte, error) {
+	p, err := pprof.RawFromBytes(b)
+	if err != nil {
+		return nil, err
+	}
+	defer p.Close()
+
+	// Duplicate stacktraces have to be merged before computing the delta,
+	// the second pass removes the samples left empty by the delta.
+	p.Normalize()
+	t.delta.computeDelta(p.Profile, profileType)
+	p.Normalize()
+
+	var out bytes.Buffer
+	if _, err := p.WriteTo(&out); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
 }
 
 func (t *Target) fetchProfile(ctx context.Context, profileType string, buf io.Writer) error {
@@ -265,6 +374,7 @@ func (t *Target) fetchProfile(ctx context.Context, profileType string, buf io.Wr
 
 func (t *Target) stop() {
 	t.cancel()
+	t.metrics.targetUp.DeleteLabelValues(t.jobName, t.labels.Get(model.InstanceLabel), t.labels.Get(scrape.ProfileName))
 }
 
 // hash returns an identifying hash for the target.
@@ -319,6 +429,14 @@ func (t *Target) LastScrapeDuration() time.Duration {
 	return t.lastScrapeDuration
 }
 
+// History returns the last scrape attempts of the target, the most recent first.
+func (t *Target) History() []scrapeAttempt {
+	t.mtx.RLock()
+	defer t.mtx.RUnlock()
+
+	return t.history.list()
+}
+
 // Health returns the last known health state of the target.
 func (t *Target) Health() agentv1.Health {
 	t.mtx.RLock()
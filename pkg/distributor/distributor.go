@@ -20,6 +20,7 @@ import (
 	"github.com/pkg/errors"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/prometheus/model/relabel"
 	"go.uber.org/atomic"
 
 	commonv1 "github.com/grafana/phlare/pkg/gen/common/v1"
@@ -29,6 +30,7 @@ import (
 	"github.com/grafana/phlare/pkg/pprof"
 	"github.com/grafana/phlare/pkg/tenant"
 	"github.com/grafana/phlare/pkg/usagestats"
+	"github.com/grafana/phlare/pkg/validation"
 )
 
 type PushClient interface {
@@ -52,12 +54,39 @@ var (
 type Config struct {
 	PushTimeout time.Duration
 	PoolConfig  clientpool.PoolConfig `yaml:"pool_config,omitempty"`
+	HATracker   HATrackerConfig       `yaml:"ha_tracker,omitempty"`
+	Tee         TeeConfig             `yaml:"tee,omitempty"`
+
+	// Distributors ring
+	DistributorRing RingConfig `yaml:"ring" doc:"description=The distributors ring is used to share the global per-tenant ingestion rate limits between healthy distributors."`
 }
 
 // RegisterFlags registers distributor-related flags.
 func (cfg *Config) RegisterFlags(fs *flag.FlagSet) {
 	cfg.PoolConfig.RegisterFlagsWithPrefix("distributor", fs)
 	fs.DurationVar(&cfg.PushTimeout, "distributor.push.timeout", 5*time.Second, "Timeout when pushing data to ingester.")
+	cfg.HATracker.RegisterFlags(fs)
+	cfg.Tee.RegisterFlags(fs)
+	cfg.DistributorRing.RegisterFlags(fs)
+}
+
+func (cfg *Config) Validate() error {
+	if err := cfg.HATracker.Validate(); err != nil {
+		return err
+	}
+	return cfg.Tee.Validate()
+}
+
+// Limits are the per-tenant limits enforced by the distributor.
+type Limits interface {
+	IngestionRateBytes(tenantID string) float64
+	IngestionBurstSizeBytes(tenantID string) int
+	IngestionRateProfiles(tenantID string) float64
+	IngestionBurstSizeProfiles(tenantID string) int
+	IngestionTenantShardSize(tenantID string) int
+	IngestionRelabelConfigs(tenantID string) []*relabel.Config
+	validation.LabelValidationLimits
+	validation.ProfileValidationLimits
 }
 
 // Distributor coordinates replicates and distribution of log streams.
@@ -68,6 +97,14 @@ type Distributor struct {
 	cfg           Config
 	ingestersRing ring.ReadRing
 	pool          *ring_client.Pool
+	limits        Limits
+	// The global rate limits are shared between the distributors of the ring.
+	distributorsLifecycler *ring.Lifecycler
+	ingestionRateLimiter   *ingestionRateLimiter
+	// haTracker is only set when the deduplication of HA pairs is enabled.
+	haTracker *haTracker
+	// tee is only set when the mirroring of pushes is enabled.
+	tee *tee
 
 	subservices        *services.Manager
 	subservicesWatcher *services.FailureWatcher
@@ -75,16 +112,35 @@ type Distributor struct {
 	metrics *metrics
 }
 
-func New(cfg Config, ingestersRing ring.ReadRing, factory ring_client.PoolFactory, reg prometheus.Registerer, logger log.Logger, clientsOptions ...connect.ClientOption) (*Distributor, error) {
+func New(cfg Config, ingestersRing ring.ReadRing, factory ring_client.PoolFactory, limits Limits, reg prometheus.Registerer, logger log.Logger, clientsOptions ...connect.ClientOption) (*Distributor, error) {
 	d := &Distributor{
 		cfg:           cfg,
 		logger:        logger,
 		ingestersRing: ingestersRing,
 		pool:          clientpool.NewPool(cfg.PoolConfig, ingestersRing, factory, clients, logger, clientsOptions...),
+		limits:        limits,
 		metrics:       newMetrics(reg),
 	}
 	var err error
-	d.subservices, err = services.NewManager(d.pool)
+	d.distributorsLifecycler, err = ring.NewLifecycler(cfg.DistributorRing.ToLifecyclerConfig(), nil, "distributor", distributorRingKey, false, logger, prometheus.WrapRegistererWithPrefix("phlare_", reg))
+	if err != nil {
+		return nil, errors.Wrap(err, "create distributor lifecycler")
+	}
+	d.ingestionRateLimiter = newIngestionRateLimiter(limits, d.distributorsLifecycler)
+
+	subservices := []services.Service{d.pool, d.distributorsLifecycler}
+	if cfg.HATracker.Enabled {
+		d.haTracker, err = newHATracker(cfg.HATracker, d.metrics, reg, logger)
+		if err != nil {
+			return nil, err
+		}
+		subservices = append(subservices, d.haTracker)
+	}
+	if cfg.Tee.Enabled() {
+		d.tee = newTee(cfg.Tee, d.metrics, logger)
+		subservices = append(subservices, d.tee)
+	}
+	d.subservices, err = services.NewManager(subservices...)
 	if err != nil {
 		return nil, errors.Wrap(err, "services manager")
 	}
@@ -117,14 +173,54 @@ func (d *Distributor) Push(ctx context.Context, req *connect.Request[pushv1.Push
 	if err != nil {
 		return nil, connect.NewError(connect.CodeInvalidArgument, err)
 	}
+	mirrored := d.tee != nil && d.tee.selected(tenantID)
+	if mirrored {
+		d.tee.enqueue(tenantID, req.Msg)
+	}
+	if d.haTracker != nil {
+		req.Msg.Series, err = d.deduplicateSeries(ctx, tenantID, req.Msg.Series)
+		if err != nil {
+			return nil, connect.NewError(connect.CodeUnavailable, err)
+		}
+		if len(req.Msg.Series) == 0 {
+			return connect.NewResponse(&pushv1.PushResponse{}), nil
+		}
+	}
+	if profiles, bytes := countProfilesAndBytes(req.Msg.Series); profiles > 0 {
+		if err := d.ingestionRateLimiter.allow(time.Now(), tenantID, profiles, bytes); err != nil {
+			for _, series := range req.Msg.Series {
+				d.discardSamples(tenantID, err, series.Samples...)
+			}
+			return nil, err
+		}
+	}
 	var (
 		keys     = make([]uint32, 0, len(req.Msg.Series))
 		profiles = make([]*profileTracker, 0, len(req.Msg.Series))
+		// validationErr is the first validation error, invalid profiles are discarded
+		// but valid ones are still pushed to ingesters.
+		validationErr error
+		now           = time.Now()
+		relabelCfgs   = d.limits.IngestionRelabelConfigs(tenantID)
 	)
 
 	for _, series := range req.Msg.Series {
-		keys = append(keys, TokenFor(tenantID, labelsString(series.Labels)))
+		lbls, keep := phlaremodel.Relabel(series.Labels, relabelCfgs...)
+		if !keep {
+			d.metrics.relabelDroppedSeries.WithLabelValues(tenantID).Inc()
+			d.discardSamples(tenantID, validation.NewErrorf(validation.DroppedByRelabelRules, "series dropped by relabeling"), series.Samples...)
+			continue
+		}
+		series.Labels = lbls
 		profName := phlaremodel.Labels(series.Labels).Get(scrape.ProfileName)
+		if err := validation.ValidateLabels(d.limits, tenantID, series.Labels); err != nil {
+			d.discardSamples(tenantID, err, series.Samples...)
+			if validationErr == nil {
+				validationErr = err
+			}
+			continue
+		}
+		samples := series.Samples[:0]
 		for _, raw := range series.Samples {
 			usagestats.NewCounter(fmt.Sprintf("distributor_profile_type_%s_received", profName)).Inc(1)
 			profileReceivedStats.Inc(1)
@@ -133,15 +229,33 @@ func (d *Distributor) Push(ctx context.Context, req *connect.Request[pushv1.Push
 			d.metrics.receivedCompressedBytes.WithLabelValues(profName).Observe(float64(len(raw.RawProfile)))
 			p, err := pprof.RawFromBytes(raw.RawProfile)
 			if err != nil {
-				return nil, err
+				err = validation.NewErrorf(validation.InvalidProfile, "failed to decode profile of series %s: %v", phlaremodel.LabelPairsString(series.Labels), err)
+				d.discardSamples(tenantID, err, raw)
+				if validationErr == nil {
+					validationErr = err
+				}
+				continue
 			}
 			d.metrics.receivedDecompressedBytes.WithLabelValues(profName).Observe(float64(p.SizeBytes()))
 			d.metrics.receivedSamples.WithLabelValues(profName).Observe(float64(len(p.Sample)))
 
+			if err := validation.ValidateProfile(d.limits, tenantID, p.Profile, p.SizeBytes(), series.Labels, now); err != nil {
+				p.Close()
+				d.discardSamples(tenantID, err, raw)
+				if validationErr == nil {
+					validationErr = err
+				}
+				continue
+			}
+
 			p.Normalize()
 
-			// zip the data back into the buffer
-			bw := bytes.NewBuffer(raw.RawProfile[:0])
+			// zip the data back into the buffer, unless it is shared with the tee.
+			buf := raw.RawProfile[:0]
+			if mirrored {
+				buf = make([]byte, 0, len(raw.RawProfile))
+			}
+			bw := bytes.NewBuffer(buf)
 			if _, err := p.WriteTo(bw); err != nil {
 				return nil, err
 			}
@@ -149,17 +263,31 @@ func (d *Distributor) Push(ctx context.Context, req *connect.Request[pushv1.Push
 			raw.RawProfile = bw.Bytes()
 			// generate a unique profile ID before pushing.
 			raw.ID = uuid.NewString()
+			samples = append(samples, raw)
+		}
+		if len(samples) == 0 {
+			continue
 		}
+		series.Samples = samples
+		keys = append(keys, TokenFor(tenantID, labelsString(series.Labels)))
 		profiles = append(profiles, &profileTracker{profile: series})
 	}
+	if len(profiles) == 0 {
+		if validationErr != nil {
+			return nil, connect.NewError(connect.CodeInvalidArgument, validationErr)
+		}
+		return connect.NewResponse(&pushv1.PushResponse{}), nil
+	}
 
 	const maxExpectedReplicationSet = 5 // typical replication factor 3 plus one for inactive plus one for luck
 	var descs [maxExpectedReplicationSet]ring.InstanceDesc
 
+	// Profiles of the tenant are only written to its shard of ingesters.
+	ingestersRing := d.ingestersRing.ShuffleShard(tenantID, d.limits.IngestionTenantShardSize(tenantID))
 	samplesByIngester := map[string][]*profileTracker{}
 	ingesterDescs := map[string]ring.InstanceDesc{}
 	for i, key := range keys {
-		replicationSet, err := d.ingestersRing.Get(key, ring.Write, descs[:0], nil, nil)
+		replicationSet, err := ingestersRing.Get(key, ring.Write, descs[:0], nil, nil)
 		if err != nil {
 			return nil, err
 		}
@@ -191,12 +319,62 @@ func (d *Distributor) Push(ctx context.Context, req *connect.Request[pushv1.Push
 	case err := <-tracker.err:
 		return nil, err
 	case <-tracker.done:
+		if validationErr != nil {
+			return nil, connect.NewError(connect.CodeInvalidArgument, validationErr)
+		}
 		return connect.NewResponse(&pushv1.PushResponse{}), nil
 	case <-ctx.Done():
 		return nil, ctx.Err()
 	}
 }
 
+// discardSamples records the samples discarded because of the given validation error.
+func (d *Distributor) discardSamples(tenantID string, err error, samples ...*pushv1.RawSample) {
+	reason := string(validation.ReasonOf(err))
+	for _, raw := range samples {
+		d.metrics.discardedProfiles.WithLabelValues(reason, tenantID).Inc()
+		d.metrics.discardedBytes.WithLabelValues(reason, tenantID).Add(float64(len(raw.RawProfile)))
+	}
+}
+
+// deduplicateSeries drops the series pushed by replicas of HA clusters which are
+// not elected, and removes the replica label from the series of elected replicas.
+func (d *Distributor) deduplicateSeries(ctx context.Context, tenantID string, series []*pushv1.RawProfileSeries) ([]*pushv1.RawProfileSeries, error) {
+	res := series[:0]
+	for _, s := range series {
+		var (
+			lbls    = phlaremodel.Labels(s.Labels)
+			cluster = lbls.Get(d.cfg.HATracker.ClusterLabel)
+			replica = lbls.Get(d.cfg.HATracker.ReplicaLabel)
+		)
+		if cluster == "" || replica == "" {
+			res = append(res, s)
+			continue
+		}
+		err := d.haTracker.checkReplica(ctx, tenantID, cluster, replica)
+		if _, ok := err.(replicasNotMatchError); ok {
+			d.metrics.haDeduplicatedProfiles.WithLabelValues(tenantID, cluster).Add(float64(len(s.Samples)))
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		s.Labels = removeLabel(s.Labels, d.cfg.HATracker.ReplicaLabel)
+		res = append(res, s)
+	}
+	return res, nil
+}
+
+func removeLabel(lbls []*commonv1.LabelPair, name string) []*commonv1.LabelPair {
+	res := lbls[:0]
+	for _, l := range lbls {
+		if l.Name != name {
+			res = append(res, l)
+		}
+	}
+	return res
+}
+
 func (d *Distributor) sendProfiles(ctx context.Context, ingester ring.InstanceDesc, profileTrackers []*profileTracker, pushTracker *pushTracker) {
 	err := d.sendProfilesErr(ctx, ingester, profileTrackers)
 	// If we succeed, decrement each sample's pending count by one.  If we reach
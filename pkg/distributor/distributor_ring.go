@@ -14,6 +14,9 @@ import (
 	"github.com/grafana/phlare/pkg/util"
 )
 
+// distributorRingKey is the key under which we store the distributors ring in the KVStore.
+const distributorRingKey = "distributor"
+
 // RingConfig masks the ring lifecycler config which contains
 // many options not really required by the distributors ring. This config
 // is used to strip down the config to the minimum, and avoid confusion
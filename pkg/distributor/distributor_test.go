@@ -9,6 +9,7 @@ import (
 	"net/http/httptest"
 	"os"
 	"runtime/pprof"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -16,11 +17,17 @@ import (
 	"github.com/bufbuild/connect-go"
 	"github.com/dustin/go-humanize"
 	"github.com/go-kit/log"
+	"github.com/grafana/dskit/kv"
+	"github.com/grafana/dskit/kv/consul"
 	"github.com/grafana/dskit/ring"
 	"github.com/grafana/dskit/ring/client"
 	"github.com/grafana/dskit/services"
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/prometheus/model/relabel"
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v2"
 
 	commonv1 "github.com/grafana/phlare/pkg/gen/common/v1"
 	pushv1 "github.com/grafana/phlare/pkg/gen/push/v1"
@@ -28,16 +35,17 @@ import (
 	"github.com/grafana/phlare/pkg/ingester/clientpool"
 	"github.com/grafana/phlare/pkg/tenant"
 	"github.com/grafana/phlare/pkg/testhelper"
+	"github.com/grafana/phlare/pkg/validation"
 )
 
 func Test_ConnectPush(t *testing.T) {
 	mux := http.NewServeMux()
 	ing := newFakeIngester(t, false)
-	d, err := New(Config{}, testhelper.NewMockRing([]ring.InstanceDesc{
+	d, err := New(newTestConfig(t), testhelper.NewMockRing([]ring.InstanceDesc{
 		{Addr: "foo"},
 	}, 3), func(addr string) (client.PoolClient, error) {
 		return ing, nil
-	}, nil, log.NewLogfmtLogger(os.Stdout))
+	}, validation.MockDefaultOverrides(), nil, log.NewLogfmtLogger(os.Stdout))
 
 	require.NoError(t, err)
 	mux.Handle(pushv1connect.NewPusherServiceHandler(d, connect.WithInterceptors(tenant.NewAuthInterceptor(true))))
@@ -86,13 +94,13 @@ func Test_Replication(t *testing.T) {
 			},
 		},
 	})
-	d, err := New(Config{}, testhelper.NewMockRing([]ring.InstanceDesc{
+	d, err := New(newTestConfig(t), testhelper.NewMockRing([]ring.InstanceDesc{
 		{Addr: "1"},
 		{Addr: "2"},
 		{Addr: "3"},
 	}, 3), func(addr string) (client.PoolClient, error) {
 		return ingesters[addr], nil
-	}, nil, log.NewLogfmtLogger(os.Stdout))
+	}, validation.MockDefaultOverrides(), nil, log.NewLogfmtLogger(os.Stdout))
 	require.NoError(t, err)
 	// only 1 ingester failing should be fine.
 	resp, err := d.Push(ctx, req)
@@ -105,15 +113,187 @@ func Test_Replication(t *testing.T) {
 	require.Nil(t, resp)
 }
 
+func Test_Validation(t *testing.T) {
+	ing := newFakeIngester(t, false)
+	reg := prometheus.NewRegistry()
+	d, err := New(newTestConfig(t), testhelper.NewMockRing([]ring.InstanceDesc{
+		{Addr: "foo"},
+	}, 3), func(addr string) (client.PoolClient, error) {
+		return ing, nil
+	}, validation.MockDefaultOverrides(), reg, log.NewLogfmtLogger(os.Stdout))
+	require.NoError(t, err)
+
+	ctx := tenant.InjectTenantID(context.Background(), "foo")
+	_, err = d.Push(ctx, connect.NewRequest(&pushv1.PushRequest{
+		Series: []*pushv1.RawProfileSeries{
+			{
+				Labels:  []*commonv1.LabelPair{{Name: "cluster", Value: "us-central1"}},
+				Samples: []*pushv1.RawSample{{RawProfile: testProfile(t)}},
+			},
+			{
+				Labels:  []*commonv1.LabelPair{{Name: "invalid-name", Value: "foo"}},
+				Samples: []*pushv1.RawSample{{RawProfile: testProfile(t)}},
+			},
+			{
+				Labels:  []*commonv1.LabelPair{{Name: "cluster", Value: "eu-west1"}},
+				Samples: []*pushv1.RawSample{{RawProfile: []byte("not a profile")}},
+			},
+		},
+	}))
+	require.Equal(t, connect.CodeInvalidArgument, connect.CodeOf(err))
+	require.ErrorContains(t, err, `invalid label name 'invalid-name' in profile series {invalid-name="foo"}`)
+
+	// Valid series are still pushed.
+	require.Len(t, ing.requests, 1)
+	require.Len(t, ing.requests[0].Series, 3)
+	for _, s := range ing.requests[0].Series {
+		require.Equal(t, "us-central1", s.Labels[0].Value)
+	}
+	require.NoError(t, testutil.GatherAndCompare(reg, strings.NewReader(`
+		# HELP phlare_discarded_profiles_total The total number of profiles discarded by the distributor, by reason.
+		# TYPE phlare_discarded_profiles_total counter
+		phlare_discarded_profiles_total{reason="invalid_labels",tenant="foo"} 1
+		phlare_discarded_profiles_total{reason="invalid_profile",tenant="foo"} 1
+	`), "phlare_discarded_profiles_total"))
+}
+
+func Test_IngestionRelabeling(t *testing.T) {
+	var relabelConfigs []*relabel.Config
+	require.NoError(t, yaml.Unmarshal([]byte(`
+- action: labeldrop
+  regex: pod_template_hash
+- source_labels: [service]
+  target_label: service_name
+- action: labeldrop
+  regex: service
+- target_label: cluster
+  replacement: us-central1
+- source_labels: [service_name]
+  regex: dropped
+  action: drop
+`), &relabelConfigs))
+
+	ing := newFakeIngester(t, false)
+	reg := prometheus.NewRegistry()
+	d, err := New(newTestConfig(t), testhelper.NewMockRing([]ring.InstanceDesc{
+		{Addr: "foo"},
+	}, 3), func(addr string) (client.PoolClient, error) {
+		return ing, nil
+	}, validation.MockOverrides(func(defaults *validation.Limits, tenantLimits map[string]*validation.Limits) {
+		l := *defaults
+		l.IngestionRelabelConfigs = relabelConfigs
+		tenantLimits["foo"] = &l
+	}), reg, log.NewLogfmtLogger(os.Stdout))
+	require.NoError(t, err)
+
+	_, err = d.Push(tenant.InjectTenantID(context.Background(), "foo"), connect.NewRequest(&pushv1.PushRequest{
+		Series: []*pushv1.RawProfileSeries{
+			{
+				Labels: []*commonv1.LabelPair{
+					{Name: "service", Value: "api"},
+					{Name: "pod_template_hash", Value: "7d4b9c"},
+				},
+				Samples: []*pushv1.RawSample{{RawProfile: testProfile(t)}},
+			},
+			{
+				Labels:  []*commonv1.LabelPair{{Name: "service", Value: "dropped"}},
+				Samples: []*pushv1.RawSample{{RawProfile: testProfile(t)}},
+			},
+		},
+	}))
+	require.NoError(t, err)
+
+	require.Len(t, ing.requests, 1)
+	require.Len(t, ing.requests[0].Series, 3)
+	require.Equal(t, []*commonv1.LabelPair{
+		{Name: "cluster", Value: "us-central1"},
+		{Name: "service_name", Value: "api"},
+	}, ing.requests[0].Series[0].Labels)
+	require.NoError(t, testutil.GatherAndCompare(reg, strings.NewReader(`
+		# HELP phlare_discarded_profiles_total The total number of profiles discarded by the distributor, by reason.
+		# TYPE phlare_discarded_profiles_total counter
+		phlare_discarded_profiles_total{reason="dropped_by_relabel_rules",tenant="foo"} 1
+		# HELP phlare_distributor_relabel_dropped_series_total The total number of series dropped by the ingestion relabeling rules of the tenant.
+		# TYPE phlare_distributor_relabel_dropped_series_total counter
+		phlare_distributor_relabel_dropped_series_total{tenant="foo"} 1
+	`), "phlare_discarded_profiles_total", "phlare_distributor_relabel_dropped_series_total"))
+
+	// Other tenants are not relabeled.
+	_, err = d.Push(tenant.InjectTenantID(context.Background(), "bar"), connect.NewRequest(&pushv1.PushRequest{
+		Series: []*pushv1.RawProfileSeries{
+			{
+				Labels:  []*commonv1.LabelPair{{Name: "service", Value: "api"}},
+				Samples: []*pushv1.RawSample{{RawProfile: testProfile(t)}},
+			},
+		},
+	}))
+	require.NoError(t, err)
+	require.Len(t, ing.requests, 2)
+	require.Equal(t, []*commonv1.LabelPair{{Name: "service", Value: "api"}}, ing.requests[1].Series[0].Labels)
+}
+
+func Test_ShuffleSharding(t *testing.T) {
+	ingesters := map[string]*fakeIngester{
+		"1": newFakeIngester(t, false),
+		"2": newFakeIngester(t, false),
+		"3": newFakeIngester(t, false),
+	}
+	d, err := New(newTestConfig(t), testhelper.NewMockRing([]ring.InstanceDesc{
+		{Addr: "1"},
+		{Addr: "2"},
+		{Addr: "3"},
+	}, 3), func(addr string) (client.PoolClient, error) {
+		return ingesters[addr], nil
+	}, validation.MockOverrides(func(defaults *validation.Limits, tenantLimits map[string]*validation.Limits) {
+		l := *defaults
+		l.IngestionTenantShardSize = 1
+		tenantLimits["sharded"] = &l
+	}), nil, log.NewLogfmtLogger(os.Stdout))
+	require.NoError(t, err)
+
+	push := func(tenantID string) {
+		_, err := d.Push(tenant.InjectTenantID(context.Background(), tenantID), connect.NewRequest(&pushv1.PushRequest{
+			Series: []*pushv1.RawProfileSeries{
+				{
+					Labels:  []*commonv1.LabelPair{{Name: "cluster", Value: "us-central1"}},
+					Samples: []*pushv1.RawSample{{RawProfile: testProfile(t)}},
+				},
+			},
+		}))
+		require.NoError(t, err)
+	}
+
+	// Profiles of a sharded tenant are only written to the ingesters of its shard.
+	push("sharded")
+	require.Equal(t, []int{1, 0, 0}, pushedRequests(ingesters, "1", "2", "3"))
+
+	// Other tenants use all ingesters, the push returns once a quorum is reached.
+	push("foo")
+	require.Eventually(t, func() bool {
+		return assert.ObjectsAreEqual([]int{2, 1, 1}, pushedRequests(ingesters, "1", "2", "3"))
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func pushedRequests(ingesters map[string]*fakeIngester, addrs ...string) []int {
+	res := make([]int, 0, len(addrs))
+	for _, addr := range addrs {
+		ing := ingesters[addr]
+		ing.mtx.Lock()
+		res = append(res, len(ing.requests))
+		ing.mtx.Unlock()
+	}
+	return res
+}
+
 func Test_Subservices(t *testing.T) {
 	ing := newFakeIngester(t, false)
-	d, err := New(Config{
-		PoolConfig: clientpool.PoolConfig{ClientCleanupPeriod: 1 * time.Second},
-	}, testhelper.NewMockRing([]ring.InstanceDesc{
+	cfg := newTestConfig(t)
+	cfg.PoolConfig = clientpool.PoolConfig{ClientCleanupPeriod: 1 * time.Second}
+	d, err := New(cfg, testhelper.NewMockRing([]ring.InstanceDesc{
 		{Addr: "foo"},
 	}, 1), func(addr string) (client.PoolClient, error) {
 		return ing, nil
-	}, nil, log.NewLogfmtLogger(os.Stdout))
+	}, validation.MockDefaultOverrides(), nil, log.NewLogfmtLogger(os.Stdout))
 
 	require.NoError(t, err)
 	require.NoError(t, d.StartAsync(context.Background()))
@@ -128,6 +308,21 @@ func Test_Subservices(t *testing.T) {
 	}, 5*time.Second, 100*time.Millisecond)
 }
 
+func newTestConfig(t testing.TB) Config {
+	t.Helper()
+	kvClient, closer := consul.NewInMemoryClient(ring.GetCodec(), log.NewNopLogger(), nil)
+	t.Cleanup(func() { _ = closer.Close() })
+	return Config{
+		DistributorRing: RingConfig{
+			KVStore:          kv.Config{Mock: kvClient},
+			HeartbeatPeriod:  time.Second,
+			HeartbeatTimeout: time.Minute,
+			InstanceID:       "distributor",
+			InstanceAddr:     "127.0.0.1",
+		},
+	}
+}
+
 func testProfile(t *testing.T) []byte {
 	t.Helper()
 
@@ -0,0 +1,279 @@
+package distributor
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/grafana/dskit/kv"
+	"github.com/grafana/dskit/kv/memberlist"
+	"github.com/grafana/dskit/services"
+	jsoniter "github.com/json-iterator/go"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// HATrackerConfig configures the deduplication of profiles pushed by
+// redundant agents, also known as HA pairs.
+type HATrackerConfig struct {
+	Enabled         bool          `yaml:"enabled"`
+	ClusterLabel    string        `yaml:"cluster_label"`
+	ReplicaLabel    string        `yaml:"replica_label"`
+	UpdateTimeout   time.Duration `yaml:"update_timeout"`
+	FailoverTimeout time.Duration `yaml:"failover_timeout"`
+	KVStore         kv.Config     `yaml:"kvstore"`
+}
+
+// RegisterFlags adds the flags required to config this to the given FlagSet
+func (cfg *HATrackerConfig) RegisterFlags(f *flag.FlagSet) {
+	f.BoolVar(&cfg.Enabled, "distributor.ha-tracker.enabled", false, "Enable the deduplication of profiles pushed by HA pairs of agents. Only profiles of the elected replica of each cluster are accepted.")
+	f.StringVar(&cfg.ClusterLabel, "distributor.ha-tracker.cluster-label", "cluster", "Label identifying the cluster of agents a profile has been pushed by.")
+	f.StringVar(&cfg.ReplicaLabel, "distributor.ha-tracker.replica-label", "__replica__", "Label identifying the replica within a cluster of agents a profile has been pushed by. This label is removed before profiles are ingested.")
+	f.DurationVar(&cfg.UpdateTimeout, "distributor.ha-tracker.update-timeout", 15*time.Second, "Period after which the timestamp of the elected replica is updated in the KV store.")
+	f.DurationVar(&cfg.FailoverTimeout, "distributor.ha-tracker.failover-timeout", 30*time.Second, "Period after which a different replica is elected when the elected one stops pushing profiles. It must be greater than the update timeout.")
+	cfg.KVStore.RegisterFlagsWithPrefix("distributor.ha-tracker.", "ha-tracker/", f)
+}
+
+func (cfg *HATrackerConfig) Validate() error {
+	if !cfg.Enabled {
+		return nil
+	}
+	if cfg.FailoverTimeout <= cfg.UpdateTimeout {
+		return fmt.Errorf("HA tracker failover timeout (%v) must be greater than the update timeout (%v)", cfg.FailoverTimeout, cfg.UpdateTimeout)
+	}
+	return nil
+}
+
+// ReplicaDesc is the elected replica of a cluster, as stored in the KV store.
+type ReplicaDesc struct {
+	Replica string `json:"replica"`
+	// ReceivedAt is the time in milliseconds the replica has last been seen.
+	ReceivedAt int64 `json:"received_at"`
+}
+
+// Merge implements the memberlist.Mergeable interface, the most recently seen replica wins.
+func (r *ReplicaDesc) Merge(mergeable memberlist.Mergeable, localCAS bool) (memberlist.Mergeable, error) {
+	if mergeable == nil {
+		return nil, nil
+	}
+	other, ok := mergeable.(*ReplicaDesc)
+	if !ok {
+		return nil, fmt.Errorf("expected *distributor.ReplicaDesc, got %T", mergeable)
+	}
+	if other == nil {
+		return nil, nil
+	}
+	if other.ReceivedAt < r.ReceivedAt || (other.ReceivedAt == r.ReceivedAt && other.Replica >= r.Replica) {
+		return nil, nil
+	}
+	*r = *other
+	return other.Clone(), nil
+}
+
+// MergeContent describes the content of the replica desc.
+func (r *ReplicaDesc) MergeContent() []string {
+	return []string{r.Replica}
+}
+
+// RemoveTombstones is not required, replicas are never deleted.
+func (r *ReplicaDesc) RemoveTombstones(limit time.Time) (total, removed int) {
+	return 0, 0
+}
+
+func (r *ReplicaDesc) Clone() memberlist.Mergeable {
+	clone := *r
+	return &clone
+}
+
+// HATrackerCodec encodes the elected replicas in the KV store.
+var HATrackerCodec = haTrackerCodec{}
+
+type haTrackerCodec struct{}
+
+func (haTrackerCodec) Decode(data []byte) (interface{}, error) {
+	var desc ReplicaDesc
+	if err := jsoniter.ConfigFastest.Unmarshal(data, &desc); err != nil {
+		return nil, err
+	}
+	return &desc, nil
+}
+
+func (haTrackerCodec) Encode(obj interface{}) ([]byte, error) {
+	return jsoniter.ConfigFastest.Marshal(obj)
+}
+
+func (haTrackerCodec) CodecID() string { return "distributor.haTrackerCodec" }
+
+// replicasNotMatchError is returned when profiles are pushed by a replica which isn't elected.
+type replicasNotMatchError struct {
+	replica, elected string
+}
+
+func (e replicasNotMatchError) Error() string {
+	return fmt.Sprintf("replicas did not match, rejecting profiles: replica=%s elected=%s", e.replica, e.elected)
+}
+
+// haTracker elects a single replica per cluster and tenant, profiles from other
+// replicas are deduplicated. The elected replica is shared between distributors
+// using the KV store, and a new one is elected after the failover timeout.
+type haTracker struct {
+	services.Service
+
+	cfg     HATrackerConfig
+	client  kv.Client
+	logger  log.Logger
+	metrics *metrics
+
+	mtx     sync.RWMutex
+	elected map[string]ReplicaDesc
+
+	// used in tests.
+	now func() time.Time
+}
+
+func newHATracker(cfg HATrackerConfig, metrics *metrics, reg prometheus.Registerer, logger log.Logger) (*haTracker, error) {
+	client, err := kv.NewClient(cfg.KVStore, HATrackerCodec, kv.RegistererWithKVName(reg, "distributor-hatracker"), logger)
+	if err != nil {
+		return nil, errors.Wrap(err, "create HA tracker KV client")
+	}
+	t := &haTracker{
+		cfg:     cfg,
+		client:  client,
+		logger:  log.With(logger, "component", "ha-tracker"),
+		metrics: metrics,
+		elected: map[string]ReplicaDesc{},
+		now:     time.Now,
+	}
+	t.Service = services.NewBasicService(nil, t.running, nil)
+	return t, nil
+}
+
+// running keeps the local cache of elected replicas up to date with the KV store,
+// and expires the replicas of clusters which stopped pushing.
+func (t *haTracker) running(ctx context.Context) error {
+	go func() {
+		ticker := time.NewTicker(t.cfg.FailoverTimeout)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				t.expireCache(t.now())
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	t.client.WatchPrefix(ctx, "", func(key string, value interface{}) bool {
+		desc, ok := value.(*ReplicaDesc)
+		if !ok || desc == nil {
+			return true
+		}
+		t.updateCache(key, *desc)
+		return true
+	})
+	return nil
+}
+
+func (t *haTracker) updateCache(key string, desc ReplicaDesc) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	tenantID, cluster := splitHAKey(key)
+	if current, ok := t.elected[key]; !ok || current.Replica != desc.Replica {
+		t.metrics.haElectedReplicaChanges.WithLabelValues(tenantID, cluster).Inc()
+	}
+	t.elected[key] = desc
+	t.metrics.haElectedReplicaTimestamp.WithLabelValues(tenantID, cluster).Set(float64(desc.ReceivedAt / 1000))
+}
+
+// expireCache removes the replicas which haven't been seen within the failover
+// timeout from the cache, so that it doesn't grow as clusters and replicas churn.
+// A replica is elected from the KV store on the next push of their cluster.
+func (t *haTracker) expireCache(now time.Time) {
+	deadline := now.Add(-t.cfg.FailoverTimeout).UnixMilli()
+
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	for key, desc := range t.elected {
+		if desc.ReceivedAt >= deadline {
+			continue
+		}
+		delete(t.elected, key)
+		tenantID, cluster := splitHAKey(key)
+		t.metrics.haElectedReplicaChanges.DeleteLabelValues(tenantID, cluster)
+		t.metrics.haElectedReplicaTimestamp.DeleteLabelValues(tenantID, cluster)
+	}
+}
+
+// checkReplica returns nil if profiles of the given replica have to be accepted,
+// or a replicasNotMatchError if the replica isn't the elected one of the cluster.
+func (t *haTracker) checkReplica(ctx context.Context, tenantID, cluster, replica string) error {
+	var (
+		key = haKey(tenantID, cluster)
+		now = t.now()
+	)
+
+	t.mtx.RLock()
+	entry, ok := t.elected[key]
+	t.mtx.RUnlock()
+	if ok {
+		sinceReceived := now.Sub(time.UnixMilli(entry.ReceivedAt))
+		if entry.Replica == replica && sinceReceived < t.cfg.UpdateTimeout {
+			return nil
+		}
+		if entry.Replica != replica && sinceReceived < t.cfg.FailoverTimeout {
+			return replicasNotMatchError{replica: replica, elected: entry.Replica}
+		}
+	}
+
+	var (
+		elected    *ReplicaDesc
+		notElected error
+	)
+	err := t.client.CAS(ctx, key, func(in interface{}) (out interface{}, retry bool, err error) {
+		elected, notElected = nil, nil
+		if desc, ok := in.(*ReplicaDesc); ok && desc != nil {
+			sinceReceived := now.Sub(time.UnixMilli(desc.ReceivedAt))
+			if desc.Replica == replica && sinceReceived < t.cfg.UpdateTimeout {
+				elected = desc
+				return nil, false, nil
+			}
+			if desc.Replica != replica && sinceReceived < t.cfg.FailoverTimeout {
+				// Some KV stores wrap errors, so the error is kept aside.
+				elected = desc
+				notElected = replicasNotMatchError{replica: replica, elected: desc.Replica}
+				return nil, false, notElected
+			}
+		}
+		elected = &ReplicaDesc{Replica: replica, ReceivedAt: now.UnixMilli()}
+		return elected, true, nil
+	})
+	if elected != nil {
+		t.updateCache(key, *elected)
+	}
+	if notElected != nil {
+		return notElected
+	}
+	if err != nil {
+		level.Warn(t.logger).Log("msg", "failed to update the elected replica", "tenant", tenantID, "cluster", cluster, "err", err)
+		return err
+	}
+	return nil
+}
+
+func haKey(tenantID, cluster string) string {
+	return tenantID + "/" + cluster
+}
+
+func splitHAKey(key string) (tenantID, cluster string) {
+	parts := strings.SplitN(key, "/", 2)
+	if len(parts) != 2 {
+		return "", key
+	}
+	return parts[0], parts[1]
+}
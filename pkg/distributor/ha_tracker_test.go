@@ -0,0 +1,139 @@
+package distributor
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/bufbuild/connect-go"
+	"github.com/go-kit/log"
+	"github.com/grafana/dskit/kv"
+	"github.com/grafana/dskit/kv/consul"
+	"github.com/grafana/dskit/ring"
+	"github.com/grafana/dskit/ring/client"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/require"
+
+	commonv1 "github.com/grafana/phlare/pkg/gen/common/v1"
+	pushv1 "github.com/grafana/phlare/pkg/gen/push/v1"
+	"github.com/grafana/phlare/pkg/tenant"
+	"github.com/grafana/phlare/pkg/testhelper"
+	"github.com/grafana/phlare/pkg/validation"
+)
+
+func newTestHATrackerConfig(t *testing.T, kvClient kv.Client) HATrackerConfig {
+	t.Helper()
+	return HATrackerConfig{
+		Enabled:         true,
+		ClusterLabel:    "cluster",
+		ReplicaLabel:    "__replica__",
+		UpdateTimeout:   time.Second,
+		FailoverTimeout: 5 * time.Second,
+		KVStore:         kv.Config{Mock: kvClient},
+	}
+}
+
+func Test_HATracker(t *testing.T) {
+	kvClient, closer := consul.NewInMemoryClient(HATrackerCodec, log.NewNopLogger(), nil)
+	t.Cleanup(func() { _ = closer.Close() })
+
+	now := time.Now()
+	clock := func() time.Time { return now }
+	// Two distributors sharing the same KV store.
+	trackers := make([]*haTracker, 2)
+	for i := range trackers {
+		tracker, err := newHATracker(newTestHATrackerConfig(t, kvClient), newMetrics(prometheus.NewRegistry()), nil, log.NewNopLogger())
+		require.NoError(t, err)
+		tracker.now = clock
+		trackers[i] = tracker
+	}
+	ctx := context.Background()
+
+	// The first replica to push is elected.
+	require.NoError(t, trackers[0].checkReplica(ctx, "foo", "c1", "a"))
+	require.ErrorAs(t, trackers[1].checkReplica(ctx, "foo", "c1", "b"), &replicasNotMatchError{})
+	require.NoError(t, trackers[1].checkReplica(ctx, "foo", "c1", "a"))
+	// Clusters are elected per tenant.
+	require.NoError(t, trackers[1].checkReplica(ctx, "bar", "c1", "b"))
+
+	// The elected replica keeps pushing.
+	now = now.Add(3 * time.Second)
+	require.NoError(t, trackers[0].checkReplica(ctx, "foo", "c1", "a"))
+	now = now.Add(3 * time.Second)
+	require.ErrorAs(t, trackers[1].checkReplica(ctx, "foo", "c1", "b"), &replicasNotMatchError{})
+
+	// The elected replica stops pushing, the other one takes over.
+	now = now.Add(6 * time.Second)
+	require.NoError(t, trackers[1].checkReplica(ctx, "foo", "c1", "b"))
+	require.ErrorAs(t, trackers[0].checkReplica(ctx, "foo", "c1", "a"), &replicasNotMatchError{})
+}
+
+func Test_HATrackerExpireCache(t *testing.T) {
+	kvClient, closer := consul.NewInMemoryClient(HATrackerCodec, log.NewNopLogger(), nil)
+	t.Cleanup(func() { _ = closer.Close() })
+
+	now := time.Now()
+	tracker, err := newHATracker(newTestHATrackerConfig(t, kvClient), newMetrics(prometheus.NewRegistry()), nil, log.NewNopLogger())
+	require.NoError(t, err)
+	tracker.now = func() time.Time { return now }
+	ctx := context.Background()
+
+	require.NoError(t, tracker.checkReplica(ctx, "foo", "c1", "a"))
+	now = now.Add(3 * time.Second)
+	require.NoError(t, tracker.checkReplica(ctx, "foo", "c2", "a"))
+
+	// Only the replica of the cluster which stopped pushing expires.
+	now = now.Add(3 * time.Second)
+	tracker.expireCache(now)
+	require.Len(t, tracker.elected, 1)
+	require.Contains(t, tracker.elected, haKey("foo", "c2"))
+
+	// A replica of the expired cluster is elected again.
+	require.NoError(t, tracker.checkReplica(ctx, "foo", "c1", "b"))
+	require.Equal(t, "b", tracker.elected[haKey("foo", "c1")].Replica)
+}
+
+func Test_HADeduplication(t *testing.T) {
+	kvClient, closer := consul.NewInMemoryClient(HATrackerCodec, log.NewNopLogger(), nil)
+	t.Cleanup(func() { _ = closer.Close() })
+
+	ing := newFakeIngester(t, false)
+	cfg := newTestConfig(t)
+	cfg.HATracker = newTestHATrackerConfig(t, kvClient)
+	d, err := New(cfg, testhelper.NewMockRing([]ring.InstanceDesc{
+		{Addr: "foo"},
+	}, 3), func(addr string) (client.PoolClient, error) {
+		return ing, nil
+	}, validation.MockDefaultOverrides(), nil, log.NewLogfmtLogger(os.Stdout))
+	require.NoError(t, err)
+
+	push := func(replica string) {
+		_, err := d.Push(tenant.InjectTenantID(context.Background(), "foo"), connect.NewRequest(&pushv1.PushRequest{
+			Series: []*pushv1.RawProfileSeries{
+				{
+					Labels: []*commonv1.LabelPair{
+						{Name: "__name__", Value: "memory"},
+						{Name: "__replica__", Value: replica},
+						{Name: "cluster", Value: "us-central1"},
+					},
+					Samples: []*pushv1.RawSample{{RawProfile: testProfile(t)}},
+				},
+			},
+		}))
+		require.NoError(t, err)
+	}
+	push("a")
+	push("b")
+	push("a")
+
+	require.Len(t, ing.requests, 2)
+	for _, req := range ing.requests {
+		for _, s := range req.Series {
+			require.Equal(t, []*commonv1.LabelPair{
+				{Name: "__name__", Value: "memory"},
+				{Name: "cluster", Value: "us-central1"},
+			}, s.Labels)
+		}
+	}
+}
@@ -8,6 +8,18 @@ type metrics struct {
 	receivedCompressedBytes   *prometheus.HistogramVec
 	receivedDecompressedBytes *prometheus.HistogramVec
 	receivedSamples           *prometheus.HistogramVec
+	discardedProfiles         *prometheus.CounterVec
+	discardedBytes            *prometheus.CounterVec
+	relabelDroppedSeries      *prometheus.CounterVec
+
+	haElectedReplicaChanges   *prometheus.CounterVec
+	haElectedReplicaTimestamp *prometheus.GaugeVec
+	haDeduplicatedProfiles    *prometheus.CounterVec
+
+	teeRequests        *prometheus.CounterVec
+	teeDroppedRequests prometheus.Counter
+	teeQueueLength     prometheus.Gauge
+	teeRequestDuration prometheus.Histogram
 }
 
 func newMetrics(reg prometheus.Registerer) *metrics {
@@ -39,12 +51,100 @@ func newMetrics(reg prometheus.Registerer) *metrics {
 			},
 			[]string{"type"},
 		),
+		discardedProfiles: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: "phlare",
+				Name:      "discarded_profiles_total",
+				Help:      "The total number of profiles discarded by the distributor, by reason.",
+			},
+			[]string{"reason", "tenant"},
+		),
+		discardedBytes: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: "phlare",
+				Name:      "discarded_bytes_total",
+				Help:      "The total number of compressed bytes of profiles discarded by the distributor, by reason.",
+			},
+			[]string{"reason", "tenant"},
+		),
+		relabelDroppedSeries: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: "phlare",
+				Name:      "distributor_relabel_dropped_series_total",
+				Help:      "The total number of series dropped by the ingestion relabeling rules of the tenant.",
+			},
+			[]string{"tenant"},
+		),
+		haElectedReplicaChanges: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: "phlare",
+				Name:      "distributor_ha_tracker_elected_replica_changes_total",
+				Help:      "The total number of times the elected replica has changed for a HA cluster.",
+			},
+			[]string{"tenant", "cluster"},
+		),
+		haElectedReplicaTimestamp: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: "phlare",
+				Name:      "distributor_ha_tracker_elected_replica_timestamp_seconds",
+				Help:      "The timestamp stored for the elected replica of a HA cluster.",
+			},
+			[]string{"tenant", "cluster"},
+		),
+		haDeduplicatedProfiles: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: "phlare",
+				Name:      "distributor_deduplicated_profiles_total",
+				Help:      "The total number of deduplicated profiles pushed by replicas of HA clusters which are not elected.",
+			},
+			[]string{"tenant", "cluster"},
+		),
+		teeRequests: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: "phlare",
+				Name:      "distributor_tee_requests_total",
+				Help:      "The total number of pushes mirrored to the secondary cluster, by status.",
+			},
+			[]string{"status"},
+		),
+		teeDroppedRequests: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Namespace: "phlare",
+				Name:      "distributor_tee_dropped_requests_total",
+				Help:      "The total number of pushes not mirrored to the secondary cluster because the queue was full.",
+			},
+		),
+		teeQueueLength: prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Namespace: "phlare",
+				Name:      "distributor_tee_queue_length",
+				Help:      "The current number of pushes waiting to be mirrored to the secondary cluster.",
+			},
+		),
+		teeRequestDuration: prometheus.NewHistogram(
+			prometheus.HistogramOpts{
+				Namespace: "phlare",
+				Name:      "distributor_tee_request_duration_seconds",
+				Help:      "Time spent mirroring pushes to the secondary cluster.",
+				Buckets:   prometheus.DefBuckets,
+			},
+		),
 	}
 	if reg != nil {
 		reg.MustRegister(
 			m.receivedCompressedBytes,
 			m.receivedDecompressedBytes,
 			m.receivedSamples,
+			m.discardedProfiles,
+			m.discardedBytes,
+			m.relabelDroppedSeries,
+			m.haElectedReplicaChanges,
+			m.haElectedReplicaTimestamp,
+			m.haDeduplicatedProfiles,
+			m.teeRequests,
+			m.teeDroppedRequests,
+			m.teeQueueLength,
+			m.teeRequestDuration,
 		)
 	}
 	return m
@@ -0,0 +1,172 @@
+package distributor
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/bufbuild/connect-go"
+	"github.com/grafana/dskit/limiter"
+	"golang.org/x/time/rate"
+
+	pushv1 "github.com/grafana/phlare/pkg/gen/push/v1"
+	"github.com/grafana/phlare/pkg/validation"
+)
+
+// ReadLifecycler represents the read interface to the lifecycler.
+type ReadLifecycler interface {
+	HealthyInstancesCount() int
+}
+
+// globalIngestionRateStrategy divides the global per-tenant ingestion rate
+// limit between all healthy distributors. The burst isn't divided, it's the
+// maximum amount a single distributor accepts at once.
+type globalIngestionRateStrategy struct {
+	lifecycler ReadLifecycler
+	limit      func(tenantID string) float64
+	burst      func(tenantID string) int
+}
+
+func (s *globalIngestionRateStrategy) Limit(tenantID string) float64 {
+	limit := s.limit(tenantID)
+	if limit <= 0 {
+		return float64(rate.Inf)
+	}
+	if numDistributors := s.lifecycler.HealthyInstancesCount(); numDistributors > 0 {
+		return limit / float64(numDistributors)
+	}
+	return limit
+}
+
+func (s *globalIngestionRateStrategy) Burst(tenantID string) int {
+	return s.burst(tenantID)
+}
+
+// ingestionRateLimiter enforces the per-tenant ingestion rate limits in bytes
+// and profiles per second, each backed by a token bucket per tenant.
+type ingestionRateLimiter struct {
+	bytes    *tenantRateLimiter
+	profiles *tenantRateLimiter
+}
+
+func newIngestionRateLimiter(limits Limits, lifecycler ReadLifecycler) *ingestionRateLimiter {
+	return &ingestionRateLimiter{
+		bytes: newTenantRateLimiter(&globalIngestionRateStrategy{
+			lifecycler: lifecycler,
+			limit:      limits.IngestionRateBytes,
+			burst:      limits.IngestionBurstSizeBytes,
+		}, 10*time.Second),
+		profiles: newTenantRateLimiter(&globalIngestionRateStrategy{
+			lifecycler: lifecycler,
+			limit:      limits.IngestionRateProfiles,
+			burst:      limits.IngestionBurstSizeProfiles,
+		}, 10*time.Second),
+	}
+}
+
+// allow returns a resource exhausted error if pushing the given amount of
+// profiles and bytes exceeds the ingestion rate limit of the tenant, or an
+// invalid argument error if the push is larger than the burst size and can
+// never be accepted. Tokens are only consumed when both limits allow the push.
+func (l *ingestionRateLimiter) allow(now time.Time, tenantID string, profiles, bytes int) error {
+	profilesLimiter, bytesLimiter := l.profiles.limiter(now, tenantID), l.bytes.limiter(now, tenantID)
+	if err := checkBurstSize(profilesLimiter, profiles, "profiles"); err != nil {
+		return err
+	}
+	if err := checkBurstSize(bytesLimiter, bytes, "bytes"); err != nil {
+		return err
+	}
+
+	profilesReservation := profilesLimiter.ReserveN(now, profiles)
+	if delay := profilesReservation.DelayFrom(now); delay > 0 {
+		profilesReservation.CancelAt(now)
+		return rateLimitedError(fmt.Sprintf("ingestion rate limit (%v profiles/s) exceeded while adding %d profiles", float64(profilesLimiter.Limit()), profiles), retryAfter(delay))
+	}
+	bytesReservation := bytesLimiter.ReserveN(now, bytes)
+	if delay := bytesReservation.DelayFrom(now); delay > 0 {
+		bytesReservation.CancelAt(now)
+		profilesReservation.CancelAt(now)
+		return rateLimitedError(fmt.Sprintf("ingestion rate limit (%v bytes/s) exceeded while adding %d bytes", float64(bytesLimiter.Limit()), bytes), retryAfter(delay))
+	}
+	return nil
+}
+
+// checkBurstSize returns an invalid argument error if n tokens exceed the burst
+// size of the limiter, such a push would never be allowed.
+func checkBurstSize(l *rate.Limiter, n int, unit string) error {
+	if l.Limit() == rate.Inf || n <= l.Burst() {
+		return nil
+	}
+	return connect.NewError(connect.CodeInvalidArgument, validation.NewErrorf(validation.BurstSizeExceeded, "push of %d %s exceeds the ingestion burst size (%d %s), split it into smaller pushes", n, unit, l.Burst(), unit))
+}
+
+// retryAfter rounds the delay until the bucket is refilled up to the second.
+func retryAfter(delay time.Duration) time.Duration {
+	seconds := math.Ceil(delay.Seconds())
+	if seconds < 1 {
+		seconds = 1
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// tenantRateLimiter is a token bucket per tenant, whose limit and burst are
+// refreshed from the strategy every recheck period.
+type tenantRateLimiter struct {
+	strategy      limiter.RateLimiterStrategy
+	recheckPeriod time.Duration
+
+	mtx     sync.Mutex
+	tenants map[string]*tenantLimiter
+}
+
+type tenantLimiter struct {
+	*rate.Limiter
+	recheckAt time.Time
+}
+
+func newTenantRateLimiter(strategy limiter.RateLimiterStrategy, recheckPeriod time.Duration) *tenantRateLimiter {
+	return &tenantRateLimiter{
+		strategy:      strategy,
+		recheckPeriod: recheckPeriod,
+		tenants:       map[string]*tenantLimiter{},
+	}
+}
+
+func (l *tenantRateLimiter) limiter(now time.Time, tenantID string) *rate.Limiter {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	t, ok := l.tenants[tenantID]
+	if !ok {
+		t = &tenantLimiter{
+			Limiter:   rate.NewLimiter(rate.Limit(l.strategy.Limit(tenantID)), l.strategy.Burst(tenantID)),
+			recheckAt: now.Add(l.recheckPeriod),
+		}
+		l.tenants[tenantID] = t
+		return t.Limiter
+	}
+	if now.After(t.recheckAt) {
+		t.SetLimitAt(now, rate.Limit(l.strategy.Limit(tenantID)))
+		t.SetBurstAt(now, l.strategy.Burst(tenantID))
+		t.recheckAt = now.Add(l.recheckPeriod)
+	}
+	return t.Limiter
+}
+
+func rateLimitedError(msg string, retryAfter time.Duration) error {
+	err := connect.NewError(connect.CodeResourceExhausted, validation.NewErrorf(validation.RateLimited, "%s, retry after %s", msg, retryAfter))
+	err.Meta().Set("Retry-After", strconv.Itoa(int(retryAfter.Seconds())))
+	return err
+}
+
+func countProfilesAndBytes(series []*pushv1.RawProfileSeries) (profiles, bytes int) {
+	for _, s := range series {
+		for _, raw := range s.Samples {
+			profiles++
+			bytes += len(raw.RawProfile)
+		}
+	}
+	return profiles, bytes
+}
@@ -0,0 +1,136 @@
+package distributor
+
+import (
+	"context"
+	"math"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bufbuild/connect-go"
+	"github.com/go-kit/log"
+	"github.com/grafana/dskit/ring"
+	"github.com/grafana/dskit/ring/client"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+
+	commonv1 "github.com/grafana/phlare/pkg/gen/common/v1"
+	pushv1 "github.com/grafana/phlare/pkg/gen/push/v1"
+	"github.com/grafana/phlare/pkg/tenant"
+	"github.com/grafana/phlare/pkg/testhelper"
+	"github.com/grafana/phlare/pkg/validation"
+)
+
+type mockLifecycler int
+
+func (m mockLifecycler) HealthyInstancesCount() int { return int(m) }
+
+func Test_GlobalIngestionRateStrategy(t *testing.T) {
+	limits := validation.MockOverrides(func(defaults *validation.Limits, tenantLimits map[string]*validation.Limits) {
+		defaults.IngestionRateMB = 3
+		defaults.IngestionBurstSizeMB = 1
+		tenantLimits["unlimited"] = &validation.Limits{}
+	})
+	for _, tt := range []struct {
+		name          string
+		distributors  int
+		tenantID      string
+		expectedLimit float64
+	}{
+		{name: "single distributor", distributors: 1, tenantID: "foo", expectedLimit: 3 * 1024 * 1024},
+		{name: "limit shared between distributors", distributors: 3, tenantID: "foo", expectedLimit: 1024 * 1024},
+		{name: "distributor not in the ring yet", distributors: 0, tenantID: "foo", expectedLimit: 3 * 1024 * 1024},
+		{name: "unlimited", distributors: 3, tenantID: "unlimited", expectedLimit: math.MaxFloat64},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			strategy := &globalIngestionRateStrategy{
+				lifecycler: mockLifecycler(tt.distributors),
+				limit:      limits.IngestionRateBytes,
+				burst:      limits.IngestionBurstSizeBytes,
+			}
+			require.Equal(t, tt.expectedLimit, strategy.Limit(tt.tenantID))
+		})
+	}
+}
+
+func Test_IngestionRateLimit(t *testing.T) {
+	ing := newFakeIngester(t, false)
+	reg := prometheus.NewRegistry()
+	limits := validation.MockOverrides(func(defaults *validation.Limits, tenantLimits map[string]*validation.Limits) {
+		defaults.IngestionRateProfiles = 1
+		defaults.IngestionBurstSizeProfiles = 2
+	})
+	d, err := New(newTestConfig(t), testhelper.NewMockRing([]ring.InstanceDesc{
+		{Addr: "foo"},
+	}, 3), func(addr string) (client.PoolClient, error) {
+		return ing, nil
+	}, limits, reg, log.NewLogfmtLogger(os.Stdout))
+	require.NoError(t, err)
+
+	push := func(tenantID string) error {
+		_, err := d.Push(tenant.InjectTenantID(context.Background(), tenantID), connect.NewRequest(&pushv1.PushRequest{
+			Series: []*pushv1.RawProfileSeries{
+				{
+					Labels:  []*commonv1.LabelPair{{Name: "cluster", Value: "us-central1"}},
+					Samples: []*pushv1.RawSample{{RawProfile: testProfile(t)}},
+				},
+			},
+		}))
+		return err
+	}
+	require.NoError(t, push("foo"))
+	require.NoError(t, push("foo"))
+	err = push("foo")
+	require.Equal(t, connect.CodeResourceExhausted, connect.CodeOf(err))
+	require.ErrorContains(t, err, "ingestion rate limit (1 profiles/s) exceeded while adding 1 profiles, retry after 1s")
+	var connectErr *connect.Error
+	require.ErrorAs(t, err, &connectErr)
+	require.Equal(t, "1", connectErr.Meta().Get("Retry-After"))
+
+	// Tenants are limited independently.
+	require.NoError(t, push("bar"))
+
+	require.NoError(t, testutil.GatherAndCompare(reg, strings.NewReader(`
+		# HELP phlare_discarded_profiles_total The total number of profiles discarded by the distributor, by reason.
+		# TYPE phlare_discarded_profiles_total counter
+		phlare_discarded_profiles_total{reason="rate_limited",tenant="foo"} 1
+	`), "phlare_discarded_profiles_total"))
+}
+
+func Test_RetryAfter(t *testing.T) {
+	require.Equal(t, time.Second, retryAfter(100*time.Millisecond))
+	require.Equal(t, 3*time.Second, retryAfter(2500*time.Millisecond))
+	require.Equal(t, time.Second, retryAfter(0))
+}
+
+func Test_IngestionRateLimiter(t *testing.T) {
+	limits := validation.MockOverrides(func(defaults *validation.Limits, tenantLimits map[string]*validation.Limits) {
+		defaults.IngestionRateMB = 1
+		defaults.IngestionBurstSizeMB = 1
+		defaults.IngestionRateProfiles = 10
+		defaults.IngestionBurstSizeProfiles = 10
+	})
+	l := newIngestionRateLimiter(limits, mockLifecycler(1))
+	now := time.Now()
+
+	// A push larger than the burst size can never be accepted.
+	err := l.allow(now, "foo", 1, 2*1024*1024)
+	require.Equal(t, connect.CodeInvalidArgument, connect.CodeOf(err))
+	require.Equal(t, validation.BurstSizeExceeded, validation.ReasonOf(err))
+	err = l.allow(now, "foo", 11, 1)
+	require.Equal(t, connect.CodeInvalidArgument, connect.CodeOf(err))
+
+	// A push rejected by the bytes limit doesn't consume profiles tokens.
+	require.NoError(t, l.allow(now, "foo", 1, 1024*1024))
+	for i := 0; i < 5; i++ {
+		err = l.allow(now, "foo", 1, 1024)
+		require.Equal(t, connect.CodeResourceExhausted, connect.CodeOf(err))
+	}
+	require.NoError(t, l.allow(now, "foo", 9, 0))
+
+	// Limits are disabled by default.
+	l = newIngestionRateLimiter(validation.MockDefaultOverrides(), mockLifecycler(1))
+	require.NoError(t, l.allow(now, "foo", 1000, 100*1024*1024))
+}
@@ -0,0 +1,175 @@
+package distributor
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/bufbuild/connect-go"
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/grafana/dskit/flagext"
+	"github.com/grafana/dskit/services"
+
+	commonv1 "github.com/grafana/phlare/pkg/gen/common/v1"
+	pushv1 "github.com/grafana/phlare/pkg/gen/push/v1"
+	"github.com/grafana/phlare/pkg/gen/push/v1/pushv1connect"
+	"github.com/grafana/phlare/pkg/tenant"
+	"github.com/grafana/phlare/pkg/util"
+)
+
+// TeeConfig configures the mirroring of pushed profiles to a secondary
+// Phlare cluster, e.g. to validate a new version against real traffic.
+type TeeConfig struct {
+	URL               flagext.URLValue `yaml:"url"`
+	TenantsPercentage float64          `yaml:"tenants_percentage"`
+	QueueSize         int              `yaml:"queue_size"`
+	Concurrency       int              `yaml:"concurrency"`
+	Timeout           time.Duration    `yaml:"timeout"`
+}
+
+// RegisterFlags adds the flags required to config this to the given FlagSet
+func (cfg *TeeConfig) RegisterFlags(f *flag.FlagSet) {
+	f.Var(&cfg.URL, "distributor.tee.url", "URL of the PusherService of a secondary Phlare cluster, the pushes of the tenants selected are mirrored to it asynchronously. Mirroring is disabled when empty.")
+	f.Float64Var(&cfg.TenantsPercentage, "distributor.tee.tenants-percentage", 100, "Percentage of tenants whose pushes are mirrored. Tenants are selected consistently, using a hash of their ID.")
+	f.IntVar(&cfg.QueueSize, "distributor.tee.queue-size", 1000, "Maximum number of pushes waiting to be mirrored, pushes are dropped when the queue is full.")
+	f.IntVar(&cfg.Concurrency, "distributor.tee.concurrency", 4, "Number of pushes mirrored concurrently.")
+	f.DurationVar(&cfg.Timeout, "distributor.tee.timeout", 10*time.Second, "Timeout when mirroring a push to the secondary cluster.")
+}
+
+func (cfg *TeeConfig) Enabled() bool {
+	return cfg.URL.String() != ""
+}
+
+func (cfg *TeeConfig) Validate() error {
+	if !cfg.Enabled() {
+		return nil
+	}
+	if cfg.TenantsPercentage < 0 || cfg.TenantsPercentage > 100 {
+		return fmt.Errorf("tee tenants percentage (%v) must be between 0 and 100", cfg.TenantsPercentage)
+	}
+	if cfg.QueueSize <= 0 || cfg.Concurrency <= 0 {
+		return fmt.Errorf("tee queue size (%d) and concurrency (%d) must be greater than 0", cfg.QueueSize, cfg.Concurrency)
+	}
+	return nil
+}
+
+type teeRequest struct {
+	tenantID string
+	req      *pushv1.PushRequest
+}
+
+// tee mirrors pushes to a secondary cluster. Pushes are queued and sent in
+// the background, so that the secondary cluster never affects the latency
+// or the result of the primary write path.
+type tee struct {
+	services.Service
+
+	cfg     TeeConfig
+	client  PushClient
+	queue   chan teeRequest
+	metrics *metrics
+	logger  log.Logger
+}
+
+func newTee(cfg TeeConfig, metrics *metrics, logger log.Logger) *tee {
+	client := pushv1connect.NewPusherServiceClient(
+		&http.Client{Transport: util.WrapWithInstrumentedHTTPTransport(http.DefaultTransport)},
+		cfg.URL.String(),
+		connect.WithInterceptors(tenant.NewAuthInterceptor(true)),
+	)
+	return newTeeWithClient(cfg, client, metrics, logger)
+}
+
+func newTeeWithClient(cfg TeeConfig, client PushClient, metrics *metrics, logger log.Logger) *tee {
+	t := &tee{
+		cfg:     cfg,
+		client:  client,
+		queue:   make(chan teeRequest, cfg.QueueSize),
+		metrics: metrics,
+		logger:  log.With(logger, "component", "tee"),
+	}
+	t.Service = services.NewBasicService(nil, t.running, nil)
+	return t
+}
+
+// selected returns whether the pushes of the tenant are mirrored.
+func (t *tee) selected(tenantID string) bool {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(tenantID))
+	return float64(h.Sum32()%10000) < t.cfg.TenantsPercentage*100
+}
+
+// enqueue queues a copy of the push to be mirrored, the push is dropped if
+// the queue is full. It never blocks.
+func (t *tee) enqueue(tenantID string, req *pushv1.PushRequest) {
+	// The capacity is checked first, so that pushes are not copied in vain.
+	if len(t.queue) >= cap(t.queue) {
+		t.metrics.teeDroppedRequests.Inc()
+		return
+	}
+	r := teeRequest{tenantID: tenantID, req: copyPushRequest(req)}
+	select {
+	case t.queue <- r:
+		t.metrics.teeQueueLength.Set(float64(len(t.queue)))
+	default:
+		t.metrics.teeDroppedRequests.Inc()
+	}
+}
+
+// copyPushRequest copies the series, labels and samples of the push, which are
+// modified in place by the distributor. The raw profiles are shared, the
+// distributor doesn't modify them when the push is mirrored.
+func copyPushRequest(req *pushv1.PushRequest) *pushv1.PushRequest {
+	res := &pushv1.PushRequest{Series: make([]*pushv1.RawProfileSeries, len(req.Series))}
+	for i, series := range req.Series {
+		samples := make([]*pushv1.RawSample, len(series.Samples))
+		for j, raw := range series.Samples {
+			samples[j] = &pushv1.RawSample{RawProfile: raw.RawProfile, ID: raw.ID}
+		}
+		res.Series[i] = &pushv1.RawProfileSeries{
+			Labels:  append([]*commonv1.LabelPair(nil), series.Labels...),
+			Samples: samples,
+		}
+	}
+	return res
+}
+
+func (t *tee) running(ctx context.Context) error {
+	var wg sync.WaitGroup
+	wg.Add(t.cfg.Concurrency)
+	for i := 0; i < t.cfg.Concurrency; i++ {
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case r := <-t.queue:
+					t.metrics.teeQueueLength.Set(float64(len(t.queue)))
+					t.send(ctx, r)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	return nil
+}
+
+func (t *tee) send(ctx context.Context, r teeRequest) {
+	ctx, cancel := context.WithTimeout(tenant.InjectTenantID(ctx, r.tenantID), t.cfg.Timeout)
+	defer cancel()
+	start := time.Now()
+	_, err := t.client.Push(ctx, connect.NewRequest(r.req))
+	t.metrics.teeRequestDuration.Observe(time.Since(start).Seconds())
+	if err != nil {
+		t.metrics.teeRequests.WithLabelValues("failure").Inc()
+		level.Debug(t.logger).Log("msg", "failed to mirror push", "tenant", r.tenantID, "err", err)
+		return
+	}
+	t.metrics.teeRequests.WithLabelValues("success").Inc()
+}
@@ -0,0 +1,191 @@
+package distributor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bufbuild/connect-go"
+	"github.com/go-kit/log"
+	"github.com/grafana/dskit/flagext"
+	"github.com/grafana/dskit/ring"
+	"github.com/grafana/dskit/ring/client"
+	"github.com/grafana/dskit/services"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+
+	commonv1 "github.com/grafana/phlare/pkg/gen/common/v1"
+	pushv1 "github.com/grafana/phlare/pkg/gen/push/v1"
+	"github.com/grafana/phlare/pkg/gen/push/v1/pushv1connect"
+	"github.com/grafana/phlare/pkg/ingester/clientpool"
+	"github.com/grafana/phlare/pkg/tenant"
+	"github.com/grafana/phlare/pkg/testhelper"
+	"github.com/grafana/phlare/pkg/validation"
+)
+
+type fakeSecondaryPusher struct {
+	mtx      sync.Mutex
+	tenants  []string
+	requests []*pushv1.PushRequest
+	fail     bool
+}
+
+func (p *fakeSecondaryPusher) Push(ctx context.Context, req *connect.Request[pushv1.PushRequest]) (*connect.Response[pushv1.PushResponse], error) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	if p.fail {
+		return nil, connect.NewError(connect.CodeUnavailable, errors.New("unavailable"))
+	}
+	tenantID, err := tenant.ExtractTenantIDFromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	p.tenants = append(p.tenants, tenantID)
+	p.requests = append(p.requests, req.Msg)
+	return connect.NewResponse(&pushv1.PushResponse{}), nil
+}
+
+func (p *fakeSecondaryPusher) received() int {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	return len(p.requests)
+}
+
+func newTestTeeConfig(t *testing.T, pusher *fakeSecondaryPusher) TeeConfig {
+	t.Helper()
+	mux := http.NewServeMux()
+	mux.Handle(pushv1connect.NewPusherServiceHandler(pusher, connect.WithInterceptors(tenant.NewAuthInterceptor(true))))
+	s := httptest.NewServer(mux)
+	t.Cleanup(s.Close)
+	u, err := url.Parse(s.URL)
+	require.NoError(t, err)
+	return TeeConfig{
+		URL:               flagext.URLValue{URL: u},
+		TenantsPercentage: 100,
+		QueueSize:         10,
+		Concurrency:       1,
+		Timeout:           time.Second,
+	}
+}
+
+func Test_Tee(t *testing.T) {
+	for _, fail := range []bool{false, true} {
+		t.Run(fmt.Sprintf("secondary failing=%v", fail), func(t *testing.T) {
+			secondary := &fakeSecondaryPusher{fail: fail}
+			reg := prometheus.NewRegistry()
+			cfg := newTestConfig(t)
+			cfg.Tee = newTestTeeConfig(t, secondary)
+			cfg.PoolConfig = clientpool.PoolConfig{ClientCleanupPeriod: time.Second}
+			ing := newFakeIngester(t, false)
+			d, err := New(cfg, testhelper.NewMockRing([]ring.InstanceDesc{
+				{Addr: "foo"},
+			}, 3), func(addr string) (client.PoolClient, error) {
+				return ing, nil
+			}, validation.MockDefaultOverrides(), reg, log.NewLogfmtLogger(os.Stdout))
+			require.NoError(t, err)
+			require.NoError(t, services.StartAndAwaitRunning(context.Background(), d))
+			t.Cleanup(func() { _ = services.StopAndAwaitTerminated(context.Background(), d) })
+
+			rawProfile := testProfile(t)
+			_, err = d.Push(tenant.InjectTenantID(context.Background(), "foo"), connect.NewRequest(&pushv1.PushRequest{
+				Series: []*pushv1.RawProfileSeries{
+					{
+						Labels:  []*commonv1.LabelPair{{Name: "cluster", Value: "us-central1"}},
+						Samples: []*pushv1.RawSample{{RawProfile: append([]byte(nil), rawProfile...)}},
+					},
+				},
+			}))
+			// The primary write is not affected by the secondary cluster.
+			require.NoError(t, err)
+			require.Len(t, ing.requests, 1)
+
+			status := "success"
+			if fail {
+				status = "failure"
+			}
+			require.Eventually(t, func() bool {
+				return testutil.ToFloat64(d.metrics.teeRequests.WithLabelValues(status)) == 1
+			}, 5*time.Second, 10*time.Millisecond)
+			if fail {
+				return
+			}
+			// The secondary cluster receives the push as sent by the client.
+			require.Equal(t, []string{"foo"}, secondary.tenants)
+			require.Equal(t, rawProfile, secondary.requests[0].Series[0].Samples[0].RawProfile)
+			require.Empty(t, secondary.requests[0].Series[0].Samples[0].ID)
+		})
+	}
+}
+
+func Test_TeeQueue(t *testing.T) {
+	secondary := &fakeSecondaryPusher{}
+	cfg := newTestTeeConfig(t, secondary)
+	cfg.QueueSize = 1
+	reg := prometheus.NewRegistry()
+	// The tee isn't running, the queue isn't consumed.
+	tee := newTee(cfg, newMetrics(reg), log.NewNopLogger())
+
+	tee.enqueue("foo", &pushv1.PushRequest{})
+	tee.enqueue("foo", &pushv1.PushRequest{})
+	require.NoError(t, testutil.GatherAndCompare(reg, strings.NewReader(`
+		# HELP phlare_distributor_tee_dropped_requests_total The total number of pushes not mirrored to the secondary cluster because the queue was full.
+		# TYPE phlare_distributor_tee_dropped_requests_total counter
+		phlare_distributor_tee_dropped_requests_total 1
+		# HELP phlare_distributor_tee_queue_length The current number of pushes waiting to be mirrored to the secondary cluster.
+		# TYPE phlare_distributor_tee_queue_length gauge
+		phlare_distributor_tee_queue_length 1
+	`), "phlare_distributor_tee_dropped_requests_total", "phlare_distributor_tee_queue_length"))
+
+	require.NoError(t, services.StartAndAwaitRunning(context.Background(), tee))
+	require.Eventually(t, func() bool { return secondary.received() == 1 }, 5*time.Second, 10*time.Millisecond)
+	require.NoError(t, services.StopAndAwaitTerminated(context.Background(), tee))
+}
+
+func Test_CopyPushRequest(t *testing.T) {
+	raw := []byte("profile")
+	req := &pushv1.PushRequest{
+		Series: []*pushv1.RawProfileSeries{
+			{
+				Labels:  []*commonv1.LabelPair{{Name: "cluster", Value: "us-central1"}, {Name: "foo", Value: "bar"}},
+				Samples: []*pushv1.RawSample{{RawProfile: raw}},
+			},
+		},
+	}
+	c := copyPushRequest(req)
+
+	// The distributor relabels the series and sets the samples ID in place.
+	req.Series[0].Labels = append(req.Series[0].Labels[:0], req.Series[0].Labels[1:]...)
+	req.Series[0].Samples[0].ID = "id"
+	req.Series = nil
+
+	require.Len(t, c.Series, 1)
+	require.Equal(t, []*commonv1.LabelPair{{Name: "cluster", Value: "us-central1"}, {Name: "foo", Value: "bar"}}, c.Series[0].Labels)
+	require.Empty(t, c.Series[0].Samples[0].ID)
+	// The raw profiles are not copied.
+	require.Same(t, &raw[0], &c.Series[0].Samples[0].RawProfile[0])
+}
+
+func Test_TeeTenantsSelection(t *testing.T) {
+	selectedTenants := func(percentage float64) int {
+		tee := newTeeWithClient(TeeConfig{TenantsPercentage: percentage}, nil, newMetrics(nil), log.NewNopLogger())
+		selected := 0
+		for i := 0; i < 1000; i++ {
+			if tee.selected(fmt.Sprintf("tenant-%d", i)) {
+				selected++
+			}
+		}
+		return selected
+	}
+	require.Equal(t, 0, selectedTenants(0))
+	require.Equal(t, 1000, selectedTenants(100))
+	require.InDelta(t, 250, selectedTenants(25), 50)
+}
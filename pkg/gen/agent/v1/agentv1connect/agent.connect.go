@@ -29,6 +29,8 @@ const (
 type AgentServiceClient interface {
 	// Retrieve information about targets.
 	GetTargets(context.Context, *connect_go.Request[v1.GetTargetsRequest]) (*connect_go.Response[v1.GetTargetsResponse], error)
+	// Retrieve the last scrape attempts of an active target.
+	GetTargetHistory(context.Context, *connect_go.Request[v1.GetTargetHistoryRequest]) (*connect_go.Response[v1.GetTargetHistoryResponse], error)
 }
 
 // NewAgentServiceClient constructs a client for the agent.v1.AgentService service. By default, it
@@ -46,12 +48,18 @@ func NewAgentServiceClient(httpClient connect_go.HTTPClient, baseURL string, opt
 			baseURL+"/agent.v1.AgentService/GetTargets",
 			opts...,
 		),
+		getTargetHistory: connect_go.NewClient[v1.GetTargetHistoryRequest, v1.GetTargetHistoryResponse](
+			httpClient,
+			baseURL+"/agent.v1.AgentService/GetTargetHistory",
+			opts...,
+		),
 	}
 }
 
 // agentServiceClient implements AgentServiceClient.
 type agentServiceClient struct {
-	getTargets *connect_go.Client[v1.GetTargetsRequest, v1.GetTargetsResponse]
+	getTargets       *connect_go.Client[v1.GetTargetsRequest, v1.GetTargetsResponse]
+	getTargetHistory *connect_go.Client[v1.GetTargetHistoryRequest, v1.GetTargetHistoryResponse]
 }
 
 // GetTargets calls agent.v1.AgentService.GetTargets.
@@ -59,10 +67,17 @@ func (c *agentServiceClient) GetTargets(ctx context.Context, req *connect_go.Req
 	return c.getTargets.CallUnary(ctx, req)
 }
 
+// GetTargetHistory calls agent.v1.AgentService.GetTargetHistory.
+func (c *agentServiceClient) GetTargetHistory(ctx context.Context, req *connect_go.Request[v1.GetTargetHistoryRequest]) (*connect_go.Response[v1.GetTargetHistoryResponse], error) {
+	return c.getTargetHistory.CallUnary(ctx, req)
+}
+
 // AgentServiceHandler is an implementation of the agent.v1.AgentService service.
 type AgentServiceHandler interface {
 	// Retrieve information about targets.
 	GetTargets(context.Context, *connect_go.Request[v1.GetTargetsRequest]) (*connect_go.Response[v1.GetTargetsResponse], error)
+	// Retrieve the last scrape attempts of an active target.
+	GetTargetHistory(context.Context, *connect_go.Request[v1.GetTargetHistoryRequest]) (*connect_go.Response[v1.GetTargetHistoryResponse], error)
 }
 
 // NewAgentServiceHandler builds an HTTP handler from the service implementation. It returns the
@@ -77,6 +92,11 @@ func NewAgentServiceHandler(svc AgentServiceHandler, opts ...connect_go.HandlerO
 		svc.GetTargets,
 		opts...,
 	))
+	mux.Handle("/agent.v1.AgentService/GetTargetHistory", connect_go.NewUnaryHandler(
+		"/agent.v1.AgentService/GetTargetHistory",
+		svc.GetTargetHistory,
+		opts...,
+	))
 	return "/agent.v1.AgentService/", mux
 }
 
@@ -86,3 +106,7 @@ type UnimplementedAgentServiceHandler struct{}
 func (UnimplementedAgentServiceHandler) GetTargets(context.Context, *connect_go.Request[v1.GetTargetsRequest]) (*connect_go.Response[v1.GetTargetsResponse], error) {
 	return nil, connect_go.NewError(connect_go.CodeUnimplemented, errors.New("agent.v1.AgentService.GetTargets is not implemented"))
 }
+
+func (UnimplementedAgentServiceHandler) GetTargetHistory(context.Context, *connect_go.Request[v1.GetTargetHistoryRequest]) (*connect_go.Response[v1.GetTargetHistoryResponse], error) {
+	return nil, connect_go.NewError(connect_go.CodeUnimplemented, errors.New("agent.v1.AgentService.GetTargetHistory is not implemented"))
+}
@@ -24,4 +24,9 @@ func RegisterAgentServiceHandler(mux *mux.Router, svc AgentServiceHandler, opts
 		svc.GetTargets,
 		opts...,
 	))
+	mux.Handle("/agent.v1.AgentService/GetTargetHistory", connect_go.NewUnaryHandler(
+		"/agent.v1.AgentService/GetTargetHistory",
+		svc.GetTargetHistory,
+		opts...,
+	))
 }
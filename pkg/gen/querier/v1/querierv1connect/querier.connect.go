@@ -33,6 +33,10 @@ type QuerierServiceClient interface {
 	Series(context.Context, *connect_go.Request[v1.SeriesRequest]) (*connect_go.Response[v1.SeriesResponse], error)
 	SelectMergeStacktraces(context.Context, *connect_go.Request[v1.SelectMergeStacktracesRequest]) (*connect_go.Response[v1.SelectMergeStacktracesResponse], error)
 	SelectSeries(context.Context, *connect_go.Request[v1.SelectSeriesRequest]) (*connect_go.Response[v1.SelectSeriesResponse], error)
+	// QueryRange evaluates a PhlareQL query into series.
+	QueryRange(context.Context, *connect_go.Request[v1.QueryRangeRequest]) (*connect_go.Response[v1.QueryRangeResponse], error)
+	// QueryFlamegraph evaluates a PhlareQL query into a flamegraph, or into a diff flamegraph for diff queries.
+	QueryFlamegraph(context.Context, *connect_go.Request[v1.QueryFlamegraphRequest]) (*connect_go.Response[v1.QueryFlamegraphResponse], error)
 }
 
 // NewQuerierServiceClient constructs a client for the querier.v1.QuerierService service. By
@@ -75,6 +79,16 @@ func NewQuerierServiceClient(httpClient connect_go.HTTPClient, baseURL string, o
 			baseURL+"/querier.v1.QuerierService/SelectSeries",
 			opts...,
 		),
+		queryRange: connect_go.NewClient[v1.QueryRangeRequest, v1.QueryRangeResponse](
+			httpClient,
+			baseURL+"/querier.v1.QuerierService/QueryRange",
+			opts...,
+		),
+		queryFlamegraph: connect_go.NewClient[v1.QueryFlamegraphRequest, v1.QueryFlamegraphResponse](
+			httpClient,
+			baseURL+"/querier.v1.QuerierService/QueryFlamegraph",
+			opts...,
+		),
 	}
 }
 
@@ -86,6 +100,8 @@ type querierServiceClient struct {
 	series                 *connect_go.Client[v1.SeriesRequest, v1.SeriesResponse]
 	selectMergeStacktraces *connect_go.Client[v1.SelectMergeStacktracesRequest, v1.SelectMergeStacktracesResponse]
 	selectSeries           *connect_go.Client[v1.SelectSeriesRequest, v1.SelectSeriesResponse]
+	queryRange             *connect_go.Client[v1.QueryRangeRequest, v1.QueryRangeResponse]
+	queryFlamegraph        *connect_go.Client[v1.QueryFlamegraphRequest, v1.QueryFlamegraphResponse]
 }
 
 // ProfileTypes calls querier.v1.QuerierService.ProfileTypes.
@@ -118,6 +134,16 @@ func (c *querierServiceClient) SelectSeries(ctx context.Context, req *connect_go
 	return c.selectSeries.CallUnary(ctx, req)
 }
 
+// QueryRange calls querier.v1.QuerierService.QueryRange.
+func (c *querierServiceClient) QueryRange(ctx context.Context, req *connect_go.Request[v1.QueryRangeRequest]) (*connect_go.Response[v1.QueryRangeResponse], error) {
+	return c.queryRange.CallUnary(ctx, req)
+}
+
+// QueryFlamegraph calls querier.v1.QuerierService.QueryFlamegraph.
+func (c *querierServiceClient) QueryFlamegraph(ctx context.Context, req *connect_go.Request[v1.QueryFlamegraphRequest]) (*connect_go.Response[v1.QueryFlamegraphResponse], error) {
+	return c.queryFlamegraph.CallUnary(ctx, req)
+}
+
 // QuerierServiceHandler is an implementation of the querier.v1.QuerierService service.
 type QuerierServiceHandler interface {
 	ProfileTypes(context.Context, *connect_go.Request[v1.ProfileTypesRequest]) (*connect_go.Response[v1.ProfileTypesResponse], error)
@@ -126,6 +152,10 @@ type QuerierServiceHandler interface {
 	Series(context.Context, *connect_go.Request[v1.SeriesRequest]) (*connect_go.Response[v1.SeriesResponse], error)
 	SelectMergeStacktraces(context.Context, *connect_go.Request[v1.SelectMergeStacktracesRequest]) (*connect_go.Response[v1.SelectMergeStacktracesResponse], error)
 	SelectSeries(context.Context, *connect_go.Request[v1.SelectSeriesRequest]) (*connect_go.Response[v1.SelectSeriesResponse], error)
+	// QueryRange evaluates a PhlareQL query into series.
+	QueryRange(context.Context, *connect_go.Request[v1.QueryRangeRequest]) (*connect_go.Response[v1.QueryRangeResponse], error)
+	// QueryFlamegraph evaluates a PhlareQL query into a flamegraph, or into a diff flamegraph for diff queries.
+	QueryFlamegraph(context.Context, *connect_go.Request[v1.QueryFlamegraphRequest]) (*connect_go.Response[v1.QueryFlamegraphResponse], error)
 }
 
 // NewQuerierServiceHandler builds an HTTP handler from the service implementation. It returns the
@@ -165,6 +195,16 @@ func NewQuerierServiceHandler(svc QuerierServiceHandler, opts ...connect_go.Hand
 		svc.SelectSeries,
 		opts...,
 	))
+	mux.Handle("/querier.v1.QuerierService/QueryRange", connect_go.NewUnaryHandler(
+		"/querier.v1.QuerierService/QueryRange",
+		svc.QueryRange,
+		opts...,
+	))
+	mux.Handle("/querier.v1.QuerierService/QueryFlamegraph", connect_go.NewUnaryHandler(
+		"/querier.v1.QuerierService/QueryFlamegraph",
+		svc.QueryFlamegraph,
+		opts...,
+	))
 	return "/querier.v1.QuerierService/", mux
 }
 
@@ -194,3 +234,11 @@ func (UnimplementedQuerierServiceHandler) SelectMergeStacktraces(context.Context
 func (UnimplementedQuerierServiceHandler) SelectSeries(context.Context, *connect_go.Request[v1.SelectSeriesRequest]) (*connect_go.Response[v1.SelectSeriesResponse], error) {
 	return nil, connect_go.NewError(connect_go.CodeUnimplemented, errors.New("querier.v1.QuerierService.SelectSeries is not implemented"))
 }
+
+func (UnimplementedQuerierServiceHandler) QueryRange(context.Context, *connect_go.Request[v1.QueryRangeRequest]) (*connect_go.Response[v1.QueryRangeResponse], error) {
+	return nil, connect_go.NewError(connect_go.CodeUnimplemented, errors.New("querier.v1.QuerierService.QueryRange is not implemented"))
+}
+
+func (UnimplementedQuerierServiceHandler) QueryFlamegraph(context.Context, *connect_go.Request[v1.QueryFlamegraphRequest]) (*connect_go.Response[v1.QueryFlamegraphResponse], error) {
+	return nil, connect_go.NewError(connect_go.CodeUnimplemented, errors.New("querier.v1.QuerierService.QueryFlamegraph is not implemented"))
+}
@@ -49,4 +49,14 @@ func RegisterQuerierServiceHandler(mux *mux.Router, svc QuerierServiceHandler, o
 		svc.SelectSeries,
 		opts...,
 	))
+	mux.Handle("/querier.v1.QuerierService/QueryRange", connect_go.NewUnaryHandler(
+		"/querier.v1.QuerierService/QueryRange",
+		svc.QueryRange,
+		opts...,
+	))
+	mux.Handle("/querier.v1.QuerierService/QueryFlamegraph", connect_go.NewUnaryHandler(
+		"/querier.v1.QuerierService/QueryFlamegraph",
+		svc.QueryFlamegraph,
+		opts...,
+	))
 }
@@ -0,0 +1,164 @@
+package ingester
+
+import (
+	"net/http"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"golang.org/x/exp/slices"
+
+	"github.com/grafana/phlare/pkg/validation"
+)
+
+// functionMetrics exports the values of the functions tracked in the profiles
+// of all tenants, in a dedicated registry. Profiles are counted by each ingester
+// they are replicated to, so the sum of the values across ingesters must be
+// divided by the replication factor. Samples of gauge types, such as the memory
+// in use, are not tracked as their values cannot be summed into a counter.
+type functionMetrics struct {
+	registry  *prometheus.Registry
+	handler   http.Handler
+	values    *prometheus.CounterVec
+	discarded *prometheus.CounterVec
+}
+
+func newFunctionMetrics(reg prometheus.Registerer) *functionMetrics {
+	m := &functionMetrics{
+		registry: prometheus.NewRegistry(),
+		values: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: "phlare",
+				Name:      "function_value_total",
+				Help:      "The total of the sample values of the profiles with the function in their stacktrace. Each ingester counts the profiles it receives, replicas included.",
+			},
+			[]string{"tenant", "service_name", "function", "profile_type"},
+		),
+		discarded: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: "phlare",
+				Name:      "ingester_function_values_discarded_total",
+				Help:      "The total number of values of tracked functions discarded because the tenant reached its maximum number of function series.",
+			},
+			[]string{"tenant"},
+		),
+	}
+	m.registry.MustRegister(m.values)
+	m.handler = promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+	if reg != nil {
+		reg.MustRegister(m.discarded)
+	}
+	return m
+}
+
+// ProfileMetricsHandler exposes the metrics of the functions tracked in the
+// profiles ingested by the ingester.
+func (i *Ingester) ProfileMetricsHandler(w http.ResponseWriter, r *http.Request) {
+	i.functionMetrics.handler.ServeHTTP(w, r)
+}
+
+// functionSeriesStaleAfter is the time after which the series of the tracked
+// functions without new values are removed, which frees their place in the
+// limit of the tenant.
+const functionSeriesStaleAfter = time.Hour
+
+// functionTracker tracks the functions of the limits of a tenant.
+type functionTracker struct {
+	tenantID string
+	limits   Limits
+	metrics  *functionMetrics
+	now      func() time.Time
+
+	mtx sync.Mutex
+	// expressions are the regular expressions the matchers are compiled from.
+	expressions []string
+	matchers    []*regexp.Regexp
+	// series holds the time of the last value of each series.
+	series    map[functionSeries]time.Time
+	lastPrune time.Time
+}
+
+type functionSeries struct {
+	serviceName, profileType, function string
+}
+
+func newFunctionTracker(tenantID string, limits Limits, metrics *functionMetrics) *functionTracker {
+	return &functionTracker{
+		tenantID: tenantID,
+		limits:   limits,
+		metrics:  metrics,
+		now:      time.Now,
+		series:   make(map[functionSeries]time.Time),
+	}
+}
+
+func (t *functionTracker) Matcher() func(name string) bool {
+	matchers := t.currentMatchers()
+	if len(matchers) == 0 {
+		return nil
+	}
+	return func(name string) bool {
+		for _, m := range matchers {
+			if m.MatchString(name) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// currentMatchers returns the matchers of the tracked functions, compiled
+// again when the limits of the tenant changed.
+func (t *functionTracker) currentMatchers() []*regexp.Regexp {
+	expressions := t.limits.TrackedFunctions(t.tenantID)
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	if slices.Equal(expressions, t.expressions) {
+		return t.matchers
+	}
+	t.expressions = expressions
+	t.matchers = t.matchers[:0:0]
+	for _, expr := range expressions {
+		// The limits are validated when they are loaded.
+		if m, err := validation.CompileTrackedFunction(expr); err == nil {
+			t.matchers = append(t.matchers, m)
+		}
+	}
+	return t.matchers
+}
+
+func (t *functionTracker) Add(serviceName, profileType, function string, value int64) {
+	if value <= 0 {
+		return
+	}
+	s := functionSeries{serviceName: serviceName, profileType: profileType, function: function}
+	now := t.now()
+	t.mtx.Lock()
+	t.removeStaleSeries(now)
+	if _, ok := t.series[s]; !ok {
+		if max := t.limits.MaxTrackedFunctionSeries(t.tenantID); max > 0 && len(t.series) >= max {
+			t.mtx.Unlock()
+			t.metrics.discarded.WithLabelValues(t.tenantID).Inc()
+			return
+		}
+	}
+	t.series[s] = now
+	t.mtx.Unlock()
+	t.metrics.values.WithLabelValues(t.tenantID, serviceName, function, profileType).Add(float64(value))
+}
+
+// removeStaleSeries removes the series without new values for a while, at most once a minute.
+func (t *functionTracker) removeStaleSeries(now time.Time) {
+	if now.Sub(t.lastPrune) < time.Minute {
+		return
+	}
+	t.lastPrune = now
+	for s, last := range t.series {
+		if now.Sub(last) > functionSeriesStaleAfter {
+			delete(t.series, s)
+			t.metrics.values.DeleteLabelValues(t.tenantID, s.serviceName, s.function, s.profileType)
+		}
+	}
+}
@@ -2,6 +2,7 @@ package ingester
 
 import (
 	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"sync"
@@ -10,10 +11,12 @@ import (
 	"github.com/go-kit/log"
 	"github.com/go-kit/log/level"
 	"github.com/google/uuid"
+	"github.com/grafana/dskit/modules"
 	"github.com/grafana/dskit/multierror"
 	"github.com/grafana/dskit/ring"
 	"github.com/grafana/dskit/services"
 	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/atomic"
 
 	ingesterv1 "github.com/grafana/phlare/pkg/gen/ingester/v1"
 	pushv1 "github.com/grafana/phlare/pkg/gen/push/v1"
@@ -30,14 +33,19 @@ var activeTenantsStats = usagestats.NewInt("ingester_active_tenants")
 
 type Config struct {
 	LifecyclerConfig ring.LifecyclerConfig `yaml:"lifecycler,omitempty"`
+	MaxHeadBytes     uint64                `yaml:"max_head_bytes"`
 }
 
 // RegisterFlags registers the flags.
 func (cfg *Config) RegisterFlags(f *flag.FlagSet) {
 	cfg.LifecyclerConfig.RegisterFlags(f, util.Logger)
+	f.Uint64Var(&cfg.MaxHeadBytes, "ingester.max-head-bytes", 0, "Maximum size in bytes of the heads of all tenants in the ingester. Pushes are rejected once reached, until the heads are flushed. 0 to disable.")
 }
 
 func (cfg *Config) Validate() error {
+	if cfg.LifecyclerConfig.RingConfig.ZoneAwarenessEnabled && cfg.LifecyclerConfig.Zone == "" {
+		return errors.New("zone-awareness is enabled but the ingester availability zone is not set")
+	}
 	return nil
 }
 
@@ -49,14 +57,25 @@ type Ingester struct {
 	logger    log.Logger
 	phlarectx context.Context
 
+	// lifecycler is replaced when the ingester joins the ring again after a
+	// failed shutdown.
 	lifecycler        *ring.Lifecycler
+	lifecyclerMtx     sync.RWMutex
 	lifecyclerWatcher *services.FailureWatcher
 
-	storageBucket phlareobjstore.Bucket
+	storageBucket   phlareobjstore.Bucket
+	limits          Limits
+	functionMetrics *functionMetrics
 
 	instances    map[string]*instance
 	instancesMtx sync.RWMutex
 
+	// stopPushes is set when the ingester is shutting down.
+	stopPushes atomic.Bool
+	// shutdown is closed once the ingester has been shut down by the
+	// shutdown handler, to stop the process.
+	shutdown chan struct{}
+
 	reg prometheus.Registerer
 }
 
@@ -71,7 +90,7 @@ func (i *ingesterFlusherCompat) Flush() {
 	}
 }
 
-func New(phlarectx context.Context, cfg Config, dbConfig phlaredb.Config, storageBucket phlareobjstore.Bucket) (*Ingester, error) {
+func New(phlarectx context.Context, cfg Config, dbConfig phlaredb.Config, storageBucket phlareobjstore.Bucket, limits Limits) (*Ingester, error) {
 	i := &Ingester{
 		cfg:           cfg,
 		phlarectx:     phlarectx,
@@ -80,16 +99,13 @@ func New(phlarectx context.Context, cfg Config, dbConfig phlaredb.Config, storag
 		instances:     map[string]*instance{},
 		dbConfig:      dbConfig,
 		storageBucket: storageBucket,
+		limits:        limits,
+		shutdown:      make(chan struct{}),
 	}
+	i.functionMetrics = newFunctionMetrics(i.reg)
 
 	var err error
-	i.lifecycler, err = ring.NewLifecycler(
-		cfg.LifecyclerConfig,
-		&ingesterFlusherCompat{i},
-		"ingester",
-		"ring",
-		true,
-		i.logger, prometheus.WrapRegistererWithPrefix("phlare_", i.reg))
+	i.lifecycler, err = i.newLifecycler()
 	if err != nil {
 		return nil, err
 	}
@@ -100,6 +116,24 @@ func New(phlarectx context.Context, cfg Config, dbConfig phlaredb.Config, storag
 	return i, nil
 }
 
+// newLifecycler creates the lifecycler of the ingester. The metrics of a
+// previous lifecycler are replaced.
+func (i *Ingester) newLifecycler() (*ring.Lifecycler, error) {
+	return ring.NewLifecycler(
+		i.cfg.LifecyclerConfig,
+		&ingesterFlusherCompat{i},
+		"ingester",
+		"ring",
+		true,
+		i.logger, prometheus.WrapRegistererWithPrefix("phlare_", replacingRegisterer{i.reg}))
+}
+
+func (i *Ingester) getLifecycler() *ring.Lifecycler {
+	i.lifecyclerMtx.RLock()
+	defer i.lifecyclerMtx.RUnlock()
+	return i.lifecycler
+}
+
 func (i *Ingester) starting(ctx context.Context) error {
 	// pass new context to lifecycler, so that it doesn't stop automatically when Ingester's service context is done
 	err := i.lifecycler.StartAsync(context.Background())
@@ -121,6 +155,8 @@ func (i *Ingester) running(ctx context.Context) error {
 		return nil
 	case err := <-i.lifecyclerWatcher.Chan(): // handle lifecycler errors
 		return fmt.Errorf("lifecycler failed: %w", err)
+	case <-i.shutdown:
+		return modules.ErrStopProcess
 	}
 }
 
@@ -135,7 +171,7 @@ func (i *Ingester) GetOrCreateInstance(tenantID string) (*instance, error) { //n
 	inst, ok = i.instances[tenantID]
 	if !ok {
 		var err error
-		inst, err = newInstance(i.phlarectx, i.dbConfig, tenantID, i.storageBucket)
+		inst, err = newInstance(i.phlarectx, i.dbConfig, tenantID, i.storageBucket, i.limits, i.functionMetrics)
 		if err != nil {
 			return nil, err
 		}
@@ -180,6 +216,12 @@ func (i *Ingester) forInstance(ctx context.Context, f func(*instance) error) err
 }
 
 func (i *Ingester) Push(ctx context.Context, req *connect.Request[pushv1.PushRequest]) (*connect.Response[pushv1.PushResponse], error) {
+	if i.stopPushes.Load() {
+		return nil, connect.NewError(connect.CodeUnavailable, errors.New("ingester is shutting down"))
+	}
+	if err := i.checkHeadsSize(); err != nil {
+		return nil, ingestError(err)
+	}
 	return forInstanceUnary(ctx, i, func(instance *instance) (*connect.Response[pushv1.PushResponse], error) {
 		level.Debug(instance.logger).Log("msg", "message received by ingester push")
 		for _, series := range req.Msg.Series {
@@ -193,8 +235,8 @@ func (i *Ingester) Push(ctx context.Context, req *connect.Request[pushv1.PushReq
 				if err != nil {
 					return nil, err
 				}
-				if err := instance.Head().Ingest(ctx, p, id, series.Labels...); err != nil {
-					return nil, err
+				if err := instance.Ingest(ctx, p, id, series.Labels...); err != nil {
+					return nil, ingestError(err)
 				}
 				p.ReturnToVTPool()
 			}
@@ -205,7 +247,7 @@ func (i *Ingester) Push(ctx context.Context, req *connect.Request[pushv1.PushReq
 
 func (i *Ingester) stopping(_ error) error {
 	errs := multierror.New()
-	errs.Add(services.StopAndAwaitTerminated(context.Background(), i.lifecycler))
+	errs.Add(services.StopAndAwaitTerminated(context.Background(), i.getLifecycler()))
 	// stop all instances
 	i.instancesMtx.RLock()
 	defer i.instancesMtx.RUnlock()
@@ -238,5 +280,5 @@ func (i *Ingester) CheckReady(ctx context.Context) error {
 	if s := i.State(); s != services.Running && s != services.Stopping {
 		return fmt.Errorf("ingester not ready: %v", s)
 	}
-	return i.lifecycler.CheckReady(ctx)
+	return i.getLifecycler().CheckReady(ctx)
 }
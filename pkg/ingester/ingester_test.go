@@ -3,8 +3,11 @@ package ingester
 import (
 	"bytes"
 	"context"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"runtime/pprof"
+	"strings"
 	"testing"
 	"time"
 
@@ -16,6 +19,7 @@ import (
 	"github.com/grafana/dskit/ring"
 	"github.com/grafana/dskit/services"
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/require"
 
 	ingesterv1 "github.com/grafana/phlare/pkg/gen/ingester/v1"
@@ -25,7 +29,9 @@ import (
 	"github.com/grafana/phlare/pkg/objstore/providers/filesystem"
 	phlarecontext "github.com/grafana/phlare/pkg/phlare/context"
 	"github.com/grafana/phlare/pkg/phlaredb"
+	"github.com/grafana/phlare/pkg/pprof/testhelper"
 	"github.com/grafana/phlare/pkg/tenant"
+	"github.com/grafana/phlare/pkg/validation"
 )
 
 func defaultIngesterTestConfig(t testing.TB) Config {
@@ -71,7 +77,7 @@ func Test_MultitenantReadWrite(t *testing.T) {
 	ing, err := New(ctx, defaultIngesterTestConfig(t), phlaredb.Config{
 		DataPath:         dbPath,
 		MaxBlockDuration: 30 * time.Hour,
-	}, fs)
+	}, fs, validation.MockDefaultOverrides())
 	require.NoError(t, err)
 	require.NoError(t, services.StartAndAwaitRunning(context.Background(), ing))
 
@@ -115,3 +121,161 @@ func Test_MultitenantReadWrite(t *testing.T) {
 
 	require.NoError(t, services.StopAndAwaitTerminated(context.Background(), ing))
 }
+
+func Test_ConfigValidate(t *testing.T) {
+	cfg := defaultIngesterTestConfig(t)
+	require.NoError(t, cfg.Validate())
+
+	cfg.LifecyclerConfig.RingConfig.ZoneAwarenessEnabled = true
+	require.Error(t, cfg.Validate())
+
+	cfg.LifecyclerConfig.Zone = "zone-a"
+	require.NoError(t, cfg.Validate())
+}
+
+func Test_Limits(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	ctx := phlarecontext.WithRegistry(context.Background(), reg)
+	ing, err := New(ctx, defaultIngesterTestConfig(t), phlaredb.Config{
+		DataPath:         t.TempDir(),
+		MaxBlockDuration: 30 * time.Hour,
+	}, nil, validation.MockOverrides(func(defaults *validation.Limits, tenantLimits map[string]*validation.Limits) {
+		l := *defaults
+		// A heap profile has 4 sample types, so 4 series.
+		l.MaxLocalSeriesPerTenant = 4
+		tenantLimits["foo"] = &l
+	}))
+	require.NoError(t, err)
+	require.NoError(t, services.StartAndAwaitRunning(context.Background(), ing))
+	t.Cleanup(func() { _ = services.StopAndAwaitTerminated(context.Background(), ing) })
+
+	push := func(tenantID, job string) error {
+		_, err := ing.Push(tenant.InjectTenantID(context.Background(), tenantID), connect.NewRequest(&pushv1.PushRequest{
+			Series: []*pushv1.RawProfileSeries{
+				{
+					Labels:  phlaremodel.LabelsFromStrings("job", job, phlaremodel.LabelNameDelta, "false"),
+					Samples: []*pushv1.RawSample{{ID: uuid.NewString(), RawProfile: testProfile(t)}},
+				},
+			},
+		}))
+		return err
+	}
+
+	require.NoError(t, push("foo", "a"))
+	require.NoError(t, push("foo", "a"))
+	// New series are rejected once the tenant reached its limit.
+	err = push("foo", "b")
+	require.Equal(t, connect.CodeResourceExhausted, connect.CodeOf(err))
+	require.Contains(t, err.Error(), "per-tenant series limit of 4 exceeded")
+	require.NoError(t, push("bar", "b"))
+
+	require.NoError(t, testutil.GatherAndCompare(reg, strings.NewReader(`
+		# HELP phlare_ingester_memory_series The current number of series of the tenant in all the heads which are not flushed yet, as counted by the series limit.
+		# TYPE phlare_ingester_memory_series gauge
+		phlare_ingester_memory_series{tenant="bar"} 4
+		phlare_ingester_memory_series{tenant="foo"} 4
+	`), "phlare_ingester_memory_series"))
+
+	// All pushes are rejected once the heads reached the maximum size.
+	ing.cfg.MaxHeadBytes = 1
+	err = push("bar", "b")
+	require.Equal(t, connect.CodeResourceExhausted, connect.CodeOf(err))
+	require.Contains(t, err.Error(), "ingester heads size limit of 1 bytes reached")
+}
+
+func Test_FunctionMetrics(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	ctx := phlarecontext.WithRegistry(context.Background(), reg)
+	ing, err := New(ctx, defaultIngesterTestConfig(t), phlaredb.Config{
+		DataPath:         t.TempDir(),
+		MaxBlockDuration: 30 * time.Hour,
+	}, nil, validation.MockOverrides(func(defaults *validation.Limits, tenantLimits map[string]*validation.Limits) {
+		foo := *defaults
+		foo.TrackedFunctions = []string{`runtime\.gc.*`, "main"}
+		tenantLimits["foo"] = &foo
+		bar := *defaults
+		bar.TrackedFunctions = []string{"main"}
+		bar.MaxTrackedFunctionSeries = 1
+		tenantLimits["bar"] = &bar
+	}))
+	require.NoError(t, err)
+	require.NoError(t, services.StartAndAwaitRunning(context.Background(), ing))
+	t.Cleanup(func() { _ = services.StopAndAwaitTerminated(context.Background(), ing) })
+
+	pushProfile := func(tenantID string, b *testhelper.ProfileBuilder) {
+		raw, err := b.Profile.MarshalVT()
+		require.NoError(t, err)
+		_, err = ing.Push(tenant.InjectTenantID(context.Background(), tenantID), connect.NewRequest(&pushv1.PushRequest{
+			Series: []*pushv1.RawProfileSeries{
+				{
+					Labels:  b.Labels,
+					Samples: []*pushv1.RawSample{{ID: uuid.NewString(), RawProfile: raw}},
+				},
+			},
+		}))
+		require.NoError(t, err)
+	}
+	push := func(tenantID, serviceName string) {
+		b := testhelper.NewProfileBuilder(int64(time.Second)).CPUProfile().WithLabels(phlaremodel.LabelNameServiceName, serviceName)
+		// The recursive function is counted once.
+		b.ForStacktrace("runtime.gcBgMarkWorker", "runtime.gcBgMarkWorker", "main").AddSamples(3)
+		b.ForStacktrace("runtime.gcBgMarkWorker", "main").AddSamples(2)
+		b.ForStacktrace("foo", "main").AddSamples(5)
+		b.ForStacktrace("bar").AddSamples(7)
+		pushProfile(tenantID, b)
+	}
+	push("foo", "api")
+	push("foo", "api")
+	push("bar", "api")
+	// The series of the tenant are limited.
+	push("bar", "db")
+	push("baz", "api")
+	// The memory in use is a gauge, it is not tracked.
+	b := testhelper.NewProfileBuilder(int64(time.Second)).MemoryProfile().WithLabels(phlaremodel.LabelNameServiceName, "api", phlaremodel.LabelNameDelta, "false")
+	b.ForStacktrace("foo", "main").AddSamples(11, 13, 17, 19)
+	pushProfile("foo", b)
+
+	w := httptest.NewRecorder()
+	ing.ProfileMetricsHandler(w, httptest.NewRequest("GET", "/metrics/profiles", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	require.NoError(t, testutil.CollectAndCompare(ing.functionMetrics.values, strings.NewReader(`
+		# HELP phlare_function_value_total The total of the sample values of the profiles with the function in their stacktrace. Each ingester counts the profiles it receives, replicas included.
+		# TYPE phlare_function_value_total counter
+		phlare_function_value_total{function="main",profile_type="memory:alloc_objects:count:space:bytes",service_name="api",tenant="foo"} 11
+		phlare_function_value_total{function="main",profile_type="memory:alloc_space:bytes:space:bytes",service_name="api",tenant="foo"} 13
+		phlare_function_value_total{function="main",profile_type="process_cpu:cpu:nanoseconds:cpu:nanoseconds",service_name="api",tenant="bar"} 10
+		phlare_function_value_total{function="main",profile_type="process_cpu:cpu:nanoseconds:cpu:nanoseconds",service_name="api",tenant="foo"} 20
+		phlare_function_value_total{function="runtime.gcBgMarkWorker",profile_type="process_cpu:cpu:nanoseconds:cpu:nanoseconds",service_name="api",tenant="foo"} 10
+	`)))
+	require.Contains(t, w.Body.String(), `phlare_function_value_total{function="main",profile_type="process_cpu:cpu:nanoseconds:cpu:nanoseconds",service_name="api",tenant="bar"} 10`)
+	require.NoError(t, testutil.GatherAndCompare(reg, strings.NewReader(`
+		# HELP phlare_ingester_function_values_discarded_total The total number of values of tracked functions discarded because the tenant reached its maximum number of function series.
+		# TYPE phlare_ingester_function_values_discarded_total counter
+		phlare_ingester_function_values_discarded_total{tenant="bar"} 1
+	`), "phlare_ingester_function_values_discarded_total"))
+}
+
+func Test_FunctionTrackerStaleSeries(t *testing.T) {
+	metrics := newFunctionMetrics(nil)
+	tracker := newFunctionTracker("foo", validation.MockOverrides(func(defaults *validation.Limits, tenantLimits map[string]*validation.Limits) {
+		foo := *defaults
+		foo.MaxTrackedFunctionSeries = 1
+		tenantLimits["foo"] = &foo
+	}), metrics)
+	now := time.Unix(0, 0)
+	tracker.now = func() time.Time { return now }
+	const cpu = "process_cpu:cpu:nanoseconds:cpu:nanoseconds"
+
+	tracker.Add("api", cpu, "main", 1)
+	// The limit is reached.
+	tracker.Add("db", cpu, "main", 1)
+	require.Equal(t, 1, testutil.CollectAndCount(metrics.values))
+	require.Equal(t, float64(1), testutil.ToFloat64(metrics.values.WithLabelValues("foo", "api", "main", cpu)))
+
+	// Series without values for a while are removed, freeing their place in the limit.
+	now = now.Add(functionSeriesStaleAfter + time.Minute)
+	tracker.Add("db", cpu, "main", 2)
+	require.Equal(t, 1, testutil.CollectAndCount(metrics.values))
+	require.Equal(t, float64(2), testutil.ToFloat64(metrics.values.WithLabelValues("foo", "db", "main", cpu)))
+	require.Len(t, tracker.series, 1)
+}
@@ -9,6 +9,7 @@ import (
 	"github.com/go-kit/log"
 	"github.com/go-kit/log/level"
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
 
 	phlareobjstore "github.com/grafana/phlare/pkg/objstore"
 	phlarecontext "github.com/grafana/phlare/pkg/phlare/context"
@@ -28,8 +29,12 @@ type instance struct {
 	wg     sync.WaitGroup
 }
 
-func newInstance(phlarectx context.Context, cfg phlaredb.Config, tenantID string, storageBucket phlareobjstore.Bucket) (*instance, error) {
+func newInstance(phlarectx context.Context, cfg phlaredb.Config, tenantID string, storageBucket phlareobjstore.Bucket, limits Limits, functionMetrics *functionMetrics) (*instance, error) {
 	cfg.DataPath = path.Join(cfg.DataPath, tenantID)
+	if limits != nil {
+		cfg.Limits = &headLimits{tenantID: tenantID, limits: limits}
+		cfg.FunctionTracker = newFunctionTracker(tenantID, limits, functionMetrics)
+	}
 
 	phlarectx = phlarecontext.WrapTenant(phlarectx, tenantID)
 	db, err := phlaredb.New(phlarectx, cfg)
@@ -43,6 +48,12 @@ func newInstance(phlarectx context.Context, cfg phlaredb.Config, tenantID string
 		reg:      phlarecontext.Registry(phlarectx),
 		cancel:   cancel,
 	}
+	promauto.With(inst.reg).NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "phlare_ingester_memory_series",
+		Help: "The current number of series of the tenant in all the heads which are not flushed yet, as counted by the series limit.",
+	}, func() float64 {
+		return float64(inst.NumSeries())
+	})
 	if storageBucket != nil {
 		inst.shipper = shipper.New(
 			inst.logger,
@@ -82,12 +93,7 @@ func (i *instance) loop(ctx context.Context) {
 }
 
 func (i *instance) runShipper(ctx context.Context) {
-	i.shipperLock.Lock()
-	defer i.shipperLock.Unlock()
-	if i.shipper == nil {
-		return
-	}
-	uploaded, err := i.shipper.Sync(ctx)
+	uploaded, err := i.ship(ctx)
 	if err != nil {
 		level.Error(i.logger).Log("msg", "shipper run failed", "err", err)
 	} else {
@@ -95,6 +101,25 @@ func (i *instance) runShipper(ctx context.Context) {
 	}
 }
 
+// ship uploads the local blocks which haven't been uploaded yet.
+func (i *instance) ship(ctx context.Context) (uploaded int, err error) {
+	i.shipperLock.Lock()
+	defer i.shipperLock.Unlock()
+	if i.shipper == nil {
+		return 0, nil
+	}
+	return i.shipper.Sync(ctx)
+}
+
+// flushAndShip cuts and flushes the head to a local block, then uploads all
+// the local blocks which haven't been uploaded yet.
+func (i *instance) flushAndShip(ctx context.Context) (uploaded int, err error) {
+	if err := i.Flush(ctx); err != nil {
+		return 0, err
+	}
+	return i.ship(ctx)
+}
+
 func (i *instance) Stop() error {
 	err := i.PhlareDB.Close()
 	i.cancel()
@@ -0,0 +1,66 @@
+package ingester
+
+import (
+	"github.com/bufbuild/connect-go"
+
+	"github.com/grafana/phlare/pkg/validation"
+)
+
+// Limits are the per-tenant limits enforced by the ingester.
+type Limits interface {
+	MaxLocalSeriesPerTenant(tenantID string) int
+	MaxProfilesPerSeriesPerMinute(tenantID string) int
+	TrackedFunctions(tenantID string) []string
+	MaxTrackedFunctionSeries(tenantID string) int
+	MaxQueryBytesRead(tenantID string) int
+}
+
+// headLimits are the limits of a tenant enforced by its head.
+type headLimits struct {
+	tenantID string
+	limits   Limits
+}
+
+func (l *headLimits) MaxSeries() int {
+	return l.limits.MaxLocalSeriesPerTenant(l.tenantID)
+}
+
+func (l *headLimits) MaxProfilesPerSeriesPerMinute() int {
+	return l.limits.MaxProfilesPerSeriesPerMinute(l.tenantID)
+}
+
+// headsSize returns the size in bytes of the heads of all tenants, including
+// the heads waiting to be flushed.
+func (i *Ingester) headsSize() uint64 {
+	i.instancesMtx.RLock()
+	defer i.instancesMtx.RUnlock()
+	var size uint64
+	for _, inst := range i.instances {
+		size += inst.HeadsSize()
+	}
+	return size
+}
+
+// checkHeadsSize returns an error if the heads of all tenants use more than
+// the maximum head bytes of the ingester.
+func (i *Ingester) checkHeadsSize() error {
+	if i.cfg.MaxHeadBytes == 0 {
+		return nil
+	}
+	if size := i.headsSize(); size >= i.cfg.MaxHeadBytes {
+		return validation.NewErrorf(validation.HeadSizeLimit, "ingester heads size limit of %d bytes reached (%d bytes)", i.cfg.MaxHeadBytes, size)
+	}
+	return nil
+}
+
+// ingestError returns a connect error for the errors of the profiles
+// rejected by the ingester.
+func ingestError(err error) error {
+	switch validation.ReasonOf(err) {
+	case validation.SeriesLimit, validation.ProfilesPerSeriesLimit, validation.HeadSizeLimit:
+		return connect.NewError(connect.CodeResourceExhausted, err)
+	case validation.OutOfOrder:
+		return connect.NewError(connect.CodeInvalidArgument, err)
+	}
+	return err
+}
@@ -6,44 +6,56 @@ import (
 	"github.com/bufbuild/connect-go"
 
 	ingestv1 "github.com/grafana/phlare/pkg/gen/ingester/v1"
+	"github.com/grafana/phlare/pkg/tenant"
+	"github.com/grafana/phlare/pkg/util/querystats"
 )
 
 // LabelValues returns the possible label values for a given label name.
 func (i *Ingester) LabelValues(ctx context.Context, req *connect.Request[ingestv1.LabelValuesRequest]) (*connect.Response[ingestv1.LabelValuesResponse], error) {
 	return forInstanceUnary(ctx, i, func(instance *instance) (*connect.Response[ingestv1.LabelValuesResponse], error) {
-		return instance.Head().LabelValues(ctx, req)
+		return instance.LabelValues(ctx, req)
 	})
 }
 
 // LabelValues returns the possible label names.
 func (i *Ingester) LabelNames(ctx context.Context, req *connect.Request[ingestv1.LabelNamesRequest]) (*connect.Response[ingestv1.LabelNamesResponse], error) {
 	return forInstanceUnary(ctx, i, func(instance *instance) (*connect.Response[ingestv1.LabelNamesResponse], error) {
-		return instance.Head().LabelNames(ctx, req)
+		return instance.LabelNames(ctx, req)
 	})
 }
 
 // ProfileTypes returns the possible profile types.
 func (i *Ingester) ProfileTypes(ctx context.Context, req *connect.Request[ingestv1.ProfileTypesRequest]) (*connect.Response[ingestv1.ProfileTypesResponse], error) {
 	return forInstanceUnary(ctx, i, func(instance *instance) (*connect.Response[ingestv1.ProfileTypesResponse], error) {
-		return instance.Head().ProfileTypes(ctx, req)
+		return instance.ProfileTypes(ctx, req)
 	})
 }
 
 // Series returns labels series for the given set of matchers.
 func (i *Ingester) Series(ctx context.Context, req *connect.Request[ingestv1.SeriesRequest]) (*connect.Response[ingestv1.SeriesResponse], error) {
 	return forInstanceUnary(ctx, i, func(instance *instance) (*connect.Response[ingestv1.SeriesResponse], error) {
-		return instance.Head().Series(ctx, req)
+		return instance.Series(ctx, req)
 	})
 }
 
 func (i *Ingester) MergeProfilesStacktraces(ctx context.Context, stream *connect.BidiStream[ingestv1.MergeProfilesStacktracesRequest, ingestv1.MergeProfilesStacktracesResponse]) error {
 	return i.forInstance(ctx, func(instance *instance) error {
-		return instance.MergeProfilesStacktraces(ctx, stream)
+		return instance.MergeProfilesStacktraces(i.withQueryStats(ctx), stream)
 	})
 }
 
 func (i *Ingester) MergeProfilesLabels(ctx context.Context, stream *connect.BidiStream[ingestv1.MergeProfilesLabelsRequest, ingestv1.MergeProfilesLabelsResponse]) error {
 	return i.forInstance(ctx, func(instance *instance) error {
-		return instance.MergeProfilesLabels(ctx, stream)
+		return instance.MergeProfilesLabels(i.withQueryStats(ctx), stream)
 	})
 }
+
+// withQueryStats returns a context collecting the statistics of the query,
+// which fails once the query read more bytes than the tenant is allowed to.
+func (i *Ingester) withQueryStats(ctx context.Context) context.Context {
+	var limits querystats.Limits
+	if tenantID, err := tenant.ExtractTenantIDFromContext(ctx); err == nil && i.limits != nil {
+		limits.MaxBytesRead = i.limits.MaxQueryBytesRead(tenantID)
+	}
+	return querystats.NewContext(ctx, querystats.New(limits))
+}
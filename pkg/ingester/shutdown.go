@@ -0,0 +1,175 @@
+package ingester
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/grafana/dskit/ring"
+	"github.com/grafana/dskit/services"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// FlushHandler cuts and flushes the heads of all tenants, and ships all the
+// blocks which haven't been uploaded yet. Progress is reported in the
+// response body.
+func (i *Ingester) FlushHandler(w http.ResponseWriter, r *http.Request) {
+	pw := newProgressWriter(w, i.logger)
+	if err := i.flushAndShip(r.Context(), pw); err != nil {
+		pw.printf("flush failed: %v", err)
+		return
+	}
+	pw.printf("flush done")
+}
+
+// ShutdownHandler gracefully shuts the ingester down: it leaves the ring and
+// stops accepting pushes, flushes and ships the data of all tenants, and only
+// then stops the process. Progress is reported in the response body.
+//
+// The ingester is LEAVING while flushing: distributors stop sending it pushes,
+// while its data can still be queried. If the data can't be flushed or
+// shipped, the ingester joins the ring again as ACTIVE and accepts pushes
+// again, and the shutdown can be retried.
+func (i *Ingester) ShutdownHandler(w http.ResponseWriter, r *http.Request) {
+	pw := newProgressWriter(w, i.logger)
+	if !i.stopPushes.CAS(false, true) {
+		pw.printf("shutdown already in progress")
+		return
+	}
+	if err := i.getLifecycler().ChangeState(r.Context(), ring.LEAVING); err != nil {
+		i.stopPushes.Store(false)
+		pw.printf("shutdown failed: leaving the ring: %v", err)
+		return
+	}
+	pw.printf("left the ring, stopped accepting pushes")
+
+	if err := i.flushAndShip(r.Context(), pw); err != nil {
+		if rejoinErr := i.rejoinRing(r.Context()); rejoinErr != nil {
+			pw.printf("shutdown failed: %v, joining the ring again failed: %v", err, rejoinErr)
+			return
+		}
+		i.stopPushes.Store(false)
+		pw.printf("shutdown failed: %v, accepting pushes again", err)
+		return
+	}
+	// The heads are flushed already, the lifecycler only has to leave the ring
+	// once the ingester terminates.
+	lifecycler := i.getLifecycler()
+	lifecycler.SetFlushOnShutdown(false)
+	lifecycler.SetUnregisterOnShutdown(true)
+	close(i.shutdown)
+	pw.printf("shutdown done, terminating")
+}
+
+// rejoinRing moves the LEAVING ingester back to ACTIVE. The lifecycler doesn't
+// allow that transition, so it is stopped without leaving the ring and
+// replaced by a new one, which takes the LEAVING entry over as ACTIVE.
+func (i *Ingester) rejoinRing(ctx context.Context) error {
+	old := i.getLifecycler()
+	old.SetFlushOnShutdown(false)
+	old.SetUnregisterOnShutdown(false)
+	if err := services.StopAndAwaitTerminated(ctx, old); err != nil {
+		return err
+	}
+
+	lifecycler, err := i.newLifecycler()
+	if err != nil {
+		return err
+	}
+	i.lifecyclerWatcher.WatchService(lifecycler)
+	i.lifecyclerMtx.Lock()
+	i.lifecycler = lifecycler
+	i.lifecyclerMtx.Unlock()
+	// pass new context to lifecycler, so that it doesn't stop automatically when Ingester's service context is done
+	if err := services.StartAndAwaitRunning(context.Background(), lifecycler); err != nil {
+		return err
+	}
+
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for lifecycler.GetState() != ring.ACTIVE {
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("instance is %v: %w", lifecycler.GetState(), ctx.Err())
+		case <-ticker.C:
+		}
+	}
+	return nil
+}
+
+// replacingRegisterer replaces the collectors which are registered already,
+// so that the metrics of a replaced lifecycler don't conflict with the ones of
+// its successor.
+type replacingRegisterer struct {
+	prometheus.Registerer
+}
+
+func (r replacingRegisterer) Register(c prometheus.Collector) error {
+	err := r.Registerer.Register(c)
+	if errors.As(err, &prometheus.AlreadyRegisteredError{}) {
+		// The existing collector has the same descriptors.
+		r.Registerer.Unregister(c)
+		return r.Registerer.Register(c)
+	}
+	return err
+}
+
+func (r replacingRegisterer) MustRegister(cs ...prometheus.Collector) {
+	for _, c := range cs {
+		if err := r.Register(c); err != nil {
+			panic(err)
+		}
+	}
+}
+
+// flushAndShip flushes and ships the data of all tenants, one at a time.
+func (i *Ingester) flushAndShip(ctx context.Context, pw *progressWriter) error {
+	i.instancesMtx.RLock()
+	tenants := make([]string, 0, len(i.instances))
+	for tenantID := range i.instances {
+		tenants = append(tenants, tenantID)
+	}
+	i.instancesMtx.RUnlock()
+	sort.Strings(tenants)
+
+	for n, tenantID := range tenants {
+		inst, ok := i.getInstanceByID(tenantID)
+		if !ok {
+			continue
+		}
+		uploaded, err := inst.flushAndShip(ctx)
+		if err != nil {
+			return fmt.Errorf("tenant %s: %w", tenantID, err)
+		}
+		pw.printf("tenant %s: head flushed, %d blocks shipped (%d/%d tenants)", tenantID, uploaded, n+1, len(tenants))
+	}
+	return nil
+}
+
+// progressWriter reports the progress of a long running operation, line by
+// line, to the client and in the logs.
+type progressWriter struct {
+	w      io.Writer
+	logger log.Logger
+}
+
+func newProgressWriter(w http.ResponseWriter, logger log.Logger) *progressWriter {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	return &progressWriter{w: w, logger: logger}
+}
+
+func (p *progressWriter) printf(format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	level.Info(p.logger).Log("msg", msg)
+	_, _ = fmt.Fprintln(p.w, msg)
+	if f, ok := p.w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
@@ -0,0 +1,143 @@
+package ingester
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/bufbuild/connect-go"
+	"github.com/go-kit/log"
+	"github.com/google/uuid"
+	"github.com/grafana/dskit/modules"
+	"github.com/grafana/dskit/ring"
+	"github.com/grafana/dskit/services"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/atomic"
+
+	pushv1 "github.com/grafana/phlare/pkg/gen/push/v1"
+	phlaremodel "github.com/grafana/phlare/pkg/model"
+	phlareobjstore "github.com/grafana/phlare/pkg/objstore"
+	"github.com/grafana/phlare/pkg/objstore/client"
+	"github.com/grafana/phlare/pkg/objstore/providers/filesystem"
+	phlarecontext "github.com/grafana/phlare/pkg/phlare/context"
+	"github.com/grafana/phlare/pkg/phlaredb"
+	"github.com/grafana/phlare/pkg/tenant"
+	"github.com/grafana/phlare/pkg/validation"
+)
+
+// failingBucket fails the uploads while failing is set. onUpload is called
+// before each upload.
+type failingBucket struct {
+	phlareobjstore.Bucket
+	failing  atomic.Bool
+	onUpload func()
+}
+
+func (b *failingBucket) Upload(ctx context.Context, name string, r io.Reader) error {
+	if b.onUpload != nil {
+		b.onUpload()
+	}
+	if b.failing.Load() {
+		return errors.New("upload failed")
+	}
+	return b.Bucket.Upload(ctx, name, r)
+}
+
+func Test_FlushAndShutdownHandlers(t *testing.T) {
+	ctx := phlarecontext.WithLogger(context.Background(), log.NewLogfmtLogger(os.Stdout))
+	ctx = phlarecontext.WithRegistry(ctx, prometheus.NewRegistry())
+	fsBucket, err := client.NewBucket(ctx, client.Config{StorageBackendConfig: client.StorageBackendConfig{
+		Backend:    client.Filesystem,
+		Filesystem: filesystem.Config{Directory: t.TempDir()},
+	}}, "storage")
+	require.NoError(t, err)
+	bucket := &failingBucket{Bucket: fsBucket}
+
+	cfg := defaultIngesterTestConfig(t)
+	ing, err := New(ctx, cfg, phlaredb.Config{
+		DataPath:         t.TempDir(),
+		MaxBlockDuration: 30 * time.Hour,
+	}, bucket, validation.MockDefaultOverrides())
+	require.NoError(t, err)
+	require.NoError(t, services.StartAndAwaitRunning(context.Background(), ing))
+	ringState := func() ring.InstanceState {
+		desc, err := cfg.LifecyclerConfig.RingConfig.KVStore.Mock.Get(context.Background(), "ring")
+		require.NoError(t, err)
+		return desc.(*ring.Desc).Ingesters[cfg.LifecyclerConfig.ID].State
+	}
+	require.Eventually(t, func() bool {
+		return ringState() == ring.ACTIVE
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// The ring state of the ingester while it ships blocks.
+	var shippingState ring.InstanceState
+	bucket.onUpload = func() { shippingState = ringState() }
+
+	push := func(tenantID string) error {
+		_, err := ing.Push(tenant.InjectTenantID(context.Background(), tenantID), connect.NewRequest(&pushv1.PushRequest{
+			Series: []*pushv1.RawProfileSeries{
+				{
+					Labels:  phlaremodel.LabelsFromStrings("foo", "bar"),
+					Samples: []*pushv1.RawSample{{ID: uuid.NewString(), RawProfile: testProfile(t)}},
+				},
+			},
+		}))
+		return err
+	}
+	shippedBlocks := func(tenantID string) int {
+		var n int
+		require.NoError(t, bucket.Iter(context.Background(), tenantID+"/phlaredb/", func(string) error {
+			n++
+			return nil
+		}))
+		return n
+	}
+	post := func(handler http.HandlerFunc) string {
+		rec := httptest.NewRecorder()
+		handler(rec, httptest.NewRequest(http.MethodPost, "/", nil))
+		require.Equal(t, http.StatusOK, rec.Code)
+		return rec.Body.String()
+	}
+
+	require.NoError(t, push("foo"))
+	require.NoError(t, push("bar"))
+	require.Equal(t, "tenant bar: head flushed, 1 blocks shipped (1/2 tenants)\n"+
+		"tenant foo: head flushed, 1 blocks shipped (2/2 tenants)\n"+
+		"flush done\n", post(ing.FlushHandler))
+	require.Equal(t, 1, shippedBlocks("foo"))
+	require.Equal(t, 1, shippedBlocks("bar"))
+	require.Equal(t, ring.ACTIVE, shippingState)
+
+	// A failed shutdown can be retried, the ingester accepts pushes meanwhile.
+	require.NoError(t, push("foo"))
+	bucket.failing.Store(true)
+	require.Regexp(t, "^left the ring, stopped accepting pushes\n"+
+		"tenant bar: head flushed, 0 blocks shipped \\(1/2 tenants\\)\n"+
+		"shutdown failed: tenant foo: .*upload failed.*, accepting pushes again\n$", post(ing.ShutdownHandler))
+	require.Equal(t, ring.LEAVING, shippingState)
+	require.Equal(t, ring.ACTIVE, ringState())
+	require.NoError(t, push("foo"))
+	require.Equal(t, services.Running, ing.State())
+
+	bucket.failing.Store(false)
+	shippingState = ring.PENDING
+	require.Equal(t, "left the ring, stopped accepting pushes\n"+
+		"tenant bar: head flushed, 0 blocks shipped (1/2 tenants)\n"+
+		"tenant foo: head flushed, 2 blocks shipped (2/2 tenants)\n"+
+		"shutdown done, terminating\n", post(ing.ShutdownHandler))
+	require.Equal(t, 3, shippedBlocks("foo"))
+	require.Equal(t, ring.LEAVING, shippingState)
+	require.Equal(t, ring.LEAVING, ringState())
+	require.Equal(t, connect.CodeUnavailable, connect.CodeOf(push("foo")))
+
+	// The ingester stops the process, leaving the ring.
+	require.Error(t, ing.AwaitTerminated(context.Background()))
+	require.Equal(t, modules.ErrStopProcess, ing.FailureCase())
+	require.Equal(t, services.Terminated, ing.getLifecycler().State())
+}
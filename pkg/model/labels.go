@@ -8,6 +8,7 @@ import (
 
 	"github.com/cespare/xxhash/v2"
 	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/model/relabel"
 	"github.com/prometheus/prometheus/promql/parser"
 
 	commonv1 "github.com/grafana/phlare/pkg/gen/common/v1"
@@ -21,6 +22,9 @@ const (
 	LabelNameUnit        = "__unit__"
 	LabelNamePeriodType  = "__period_type__"
 	LabelNamePeriodUnit  = "__period_unit__"
+	LabelNameDelta       = "__delta__"
+	LabelNameServiceName = "service_name"
+	LabelNameTenantID    = "__tenant_id__"
 
 	labelSep = '\xfe'
 )
@@ -136,6 +140,23 @@ func (ls Labels) ToPrometheusLabels() labels.Labels {
 	return res
 }
 
+// Relabel applies the relabeling rules to the labels. It returns false if the
+// labels have been dropped.
+func Relabel(ls Labels, cfgs ...*relabel.Config) (Labels, bool) {
+	if len(cfgs) == 0 {
+		return ls, true
+	}
+	processed := relabel.Process(ls.ToPrometheusLabels(), cfgs...)
+	if len(processed) == 0 {
+		return nil, false
+	}
+	res := make(Labels, 0, len(processed))
+	for _, l := range processed {
+		res = append(res, &commonv1.LabelPair{Name: l.Name, Value: l.Value})
+	}
+	return res, true
+}
+
 func (ls Labels) WithoutPrivateLabels() Labels {
 	res := make([]*commonv1.LabelPair, 0, len(ls))
 	for _, l := range ls {
@@ -0,0 +1,34 @@
+package model
+
+import (
+	"testing"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/relabel"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRelabel(t *testing.T) {
+	lbls := LabelsFromStrings("__name__", "cpu", "pod", "foo")
+
+	res, keep := Relabel(lbls)
+	require.True(t, keep)
+	require.Equal(t, lbls, res)
+
+	res, keep = Relabel(lbls, &relabel.Config{
+		SourceLabels: model.LabelNames{"pod"},
+		Regex:        relabel.MustNewRegexp("(.*)"),
+		TargetLabel:  "instance",
+		Replacement:  "$1",
+		Action:       relabel.Replace,
+	})
+	require.True(t, keep)
+	require.Equal(t, LabelsFromStrings("__name__", "cpu", "instance", "foo", "pod", "foo"), res)
+
+	_, keep = Relabel(lbls, &relabel.Config{
+		SourceLabels: model.LabelNames{"pod"},
+		Regex:        relabel.MustNewRegexp("foo"),
+		Action:       relabel.Drop,
+	})
+	require.False(t, keep)
+}
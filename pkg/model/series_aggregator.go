@@ -0,0 +1,161 @@
+package model
+
+import (
+	"math"
+	"sort"
+
+	commonv1 "github.com/grafana/phlare/pkg/gen/common/v1"
+	ingestv1 "github.com/grafana/phlare/pkg/gen/ingester/v1"
+)
+
+// SeriesAggregator aggregates values into series of points spaced by step from start to end.
+// A point at ts aggregates all values with a timestamp in (ts-step, ts], values before start
+// belong to the first point and values after the last point are dropped.
+// When step is 0, values are not aggregated and each one becomes a point.
+type SeriesAggregator struct {
+	agg              commonv1.SeriesAggregation
+	start, end, step int64
+	series           map[uint64]*aggregatedSeries
+}
+
+type aggregatedSeries struct {
+	*commonv1.Series
+	counts []int64
+	// index of the point of each step.
+	steps map[int64]int
+}
+
+func (s *aggregatedSeries) Len() int { return len(s.Points) }
+
+func (s *aggregatedSeries) Less(i, j int) bool { return s.Points[i].Timestamp < s.Points[j].Timestamp }
+
+func (s *aggregatedSeries) Swap(i, j int) {
+	s.Points[i], s.Points[j] = s.Points[j], s.Points[i]
+	s.counts[i], s.counts[j] = s.counts[j], s.counts[i]
+}
+
+// NewSeriesAggregator returns a SeriesAggregator, start, end and step are in milliseconds.
+func NewSeriesAggregator(agg commonv1.SeriesAggregation, start, end, step int64) *SeriesAggregator {
+	return &SeriesAggregator{
+		agg:    agg,
+		start:  start,
+		end:    end,
+		step:   step,
+		series: make(map[uint64]*aggregatedSeries),
+	}
+}
+
+// Add aggregates the value at ts into the series with the given labels and labels hash.
+// count is the number of profiles the value already aggregates.
+func (a *SeriesAggregator) Add(lbs []*commonv1.LabelPair, hash uint64, ts int64, value float64, count int64) {
+	ts, ok := a.stepOf(ts)
+	if !ok {
+		return
+	}
+	s, ok := a.series[hash]
+	if !ok {
+		s = &aggregatedSeries{Series: &commonv1.Series{Labels: lbs}}
+		if a.step > 0 {
+			s.steps = make(map[int64]int)
+		}
+		a.series[hash] = s
+	}
+	if a.step > 0 {
+		if i, ok := s.steps[ts]; ok {
+			s.Points[i].Value = a.aggregate(s.Points[i].Value, value)
+			s.counts[i] += count
+			return
+		}
+		s.steps[ts] = len(s.Points)
+	}
+	s.Points = append(s.Points, &commonv1.Point{Timestamp: ts, Value: value})
+	s.counts = append(s.counts, count)
+}
+
+// Merge aggregates series returned by the Series method of another aggregator.
+// When counts are missing, each point is considered to aggregate a single profile.
+func (a *SeriesAggregator) Merge(series []*commonv1.Series, counts []*ingestv1.SeriesCounts) {
+	for i, s := range series {
+		hash := Labels(s.Labels).Hash()
+		for j, p := range s.Points {
+			count := int64(1)
+			if i < len(counts) && j < len(counts[i].Counts) {
+				count = counts[i].Counts[j]
+			}
+			a.Add(s.Labels, hash, p.Timestamp, p.Value, count)
+		}
+	}
+}
+
+// Series returns the series sorted by labels, with their points sorted by timestamp.
+// Averages are not computed yet so that series can be merged, their points hold the sum of the values
+// and the counts of profiles per point are returned alongside.
+func (a *SeriesAggregator) Series() ([]*commonv1.Series, []*ingestv1.SeriesCounts) {
+	sorted := a.sorted()
+	series := make([]*commonv1.Series, len(sorted))
+	var counts []*ingestv1.SeriesCounts
+	if a.agg == commonv1.SeriesAggregation_SERIES_AGGREGATION_AVG {
+		counts = make([]*ingestv1.SeriesCounts, len(sorted))
+	}
+	for i, s := range sorted {
+		series[i] = s.Series
+		if counts != nil {
+			counts[i] = &ingestv1.SeriesCounts{Counts: s.counts}
+		}
+	}
+	return series, counts
+}
+
+// Result returns the final series sorted by labels, with their points sorted by timestamp.
+func (a *SeriesAggregator) Result() []*commonv1.Series {
+	sorted := a.sorted()
+	series := make([]*commonv1.Series, len(sorted))
+	for i, s := range sorted {
+		if a.agg == commonv1.SeriesAggregation_SERIES_AGGREGATION_AVG {
+			for j, p := range s.Points {
+				p.Value /= float64(s.counts[j])
+			}
+		}
+		series[i] = s.Series
+	}
+	return series
+}
+
+func (a *SeriesAggregator) sorted() []*aggregatedSeries {
+	result := make([]*aggregatedSeries, 0, len(a.series))
+	for _, s := range a.series {
+		// Profiles of different fingerprints are not added in order.
+		sort.Stable(s)
+		result = append(result, s)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return CompareLabelPairs(result[i].Labels, result[j].Labels) < 0
+	})
+	return result
+}
+
+// stepOf returns the timestamp of the point the value at ts belongs to.
+func (a *SeriesAggregator) stepOf(ts int64) (int64, bool) {
+	if a.step <= 0 {
+		return ts, true
+	}
+	if ts <= a.start {
+		return a.start, true
+	}
+	ts = a.start + (ts-a.start+a.step-1)/a.step*a.step
+	if ts > a.end {
+		return 0, false
+	}
+	return ts, true
+}
+
+func (a *SeriesAggregator) aggregate(point, value float64) float64 {
+	switch a.agg {
+	case commonv1.SeriesAggregation_SERIES_AGGREGATION_MIN:
+		return math.Min(point, value)
+	case commonv1.SeriesAggregation_SERIES_AGGREGATION_MAX:
+		return math.Max(point, value)
+	default:
+		return point + value
+	}
+}
@@ -0,0 +1,90 @@
+package model
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	commonv1 "github.com/grafana/phlare/pkg/gen/common/v1"
+	ingestv1 "github.com/grafana/phlare/pkg/gen/ingester/v1"
+	"github.com/grafana/phlare/pkg/testhelper"
+)
+
+func TestSeriesAggregator(t *testing.T) {
+	foo := LabelsFromStrings("foo", "bar")
+	bar := LabelsFromStrings("bar", "buzz")
+
+	t.Run("steps", func(t *testing.T) {
+		a := NewSeriesAggregator(commonv1.SeriesAggregation_SERIES_AGGREGATION_SUM, 10, 30, 10)
+		for _, ts := range []int64{0, 10, 11, 20, 25, 30, 31} {
+			a.Add(foo, foo.Hash(), ts, float64(ts), 1)
+		}
+		a.Add(bar, bar.Hash(), 15, 1, 1)
+		testhelper.EqualProto(t, []*commonv1.Series{
+			{Labels: bar, Points: []*commonv1.Point{{Timestamp: 20, Value: 1}}},
+			{Labels: foo, Points: []*commonv1.Point{
+				{Timestamp: 10, Value: 10},
+				{Timestamp: 20, Value: 31},
+				{Timestamp: 30, Value: 55},
+			}},
+		}, a.Result())
+	})
+
+	t.Run("no step", func(t *testing.T) {
+		a := NewSeriesAggregator(commonv1.SeriesAggregation_SERIES_AGGREGATION_SUM, 0, 0, 0)
+		a.Add(foo, foo.Hash(), 2, 2, 1)
+		a.Add(foo, foo.Hash(), 1, 1, 1)
+		a.Add(foo, foo.Hash(), 1, 1, 1)
+		testhelper.EqualProto(t, []*commonv1.Series{
+			{Labels: foo, Points: []*commonv1.Point{
+				{Timestamp: 1, Value: 1},
+				{Timestamp: 1, Value: 1},
+				{Timestamp: 2, Value: 2},
+			}},
+		}, a.Result())
+	})
+
+	t.Run("merge averages", func(t *testing.T) {
+		ingester1 := NewSeriesAggregator(commonv1.SeriesAggregation_SERIES_AGGREGATION_AVG, 10, 20, 10)
+		ingester1.Add(foo, foo.Hash(), 5, 1, 1)
+		ingester1.Add(foo, foo.Hash(), 6, 3, 1)
+		ingester1.Add(foo, foo.Hash(), 15, 6, 1)
+		ingester2 := NewSeriesAggregator(commonv1.SeriesAggregation_SERIES_AGGREGATION_AVG, 10, 20, 10)
+		ingester2.Add(foo, foo.Hash(), 7, 8, 1)
+
+		series, counts := ingester1.Series()
+		require.Equal(t, []*ingestv1.SeriesCounts{{Counts: []int64{2, 1}}}, counts)
+
+		querier := NewSeriesAggregator(commonv1.SeriesAggregation_SERIES_AGGREGATION_AVG, 10, 20, 10)
+		querier.Merge(series, counts)
+		querier.Merge(ingester2.Series())
+		testhelper.EqualProto(t, []*commonv1.Series{
+			{Labels: foo, Points: []*commonv1.Point{
+				{Timestamp: 10, Value: 4},
+				{Timestamp: 20, Value: 6},
+			}},
+		}, querier.Result())
+	})
+
+	t.Run("merge min and max", func(t *testing.T) {
+		for _, tc := range []struct {
+			agg      commonv1.SeriesAggregation
+			expected float64
+		}{
+			{commonv1.SeriesAggregation_SERIES_AGGREGATION_MIN, 1},
+			{commonv1.SeriesAggregation_SERIES_AGGREGATION_MAX, 5},
+		} {
+			querier := NewSeriesAggregator(tc.agg, 10, 10, 10)
+			for _, v := range []float64{3, 1, 5} {
+				ingester := NewSeriesAggregator(tc.agg, 10, 10, 10)
+				ingester.Add(foo, foo.Hash(), 5, v, 1)
+				series, counts := ingester.Series()
+				require.Nil(t, counts)
+				querier.Merge(series, counts)
+			}
+			testhelper.EqualProto(t, []*commonv1.Series{
+				{Labels: foo, Points: []*commonv1.Point{{Timestamp: 10, Value: tc.expected}}},
+			}, querier.Result())
+		}
+	})
+}
@@ -12,6 +12,7 @@ import (
 	"github.com/grafana/dskit/kv/codec"
 	"github.com/grafana/dskit/kv/memberlist"
 	"github.com/grafana/dskit/ring"
+	"github.com/grafana/dskit/runtimeconfig"
 	"github.com/grafana/dskit/services"
 	grpcgw "github.com/grpc-ecosystem/grpc-gateway/v2/runtime"
 	"github.com/pkg/errors"
@@ -28,6 +29,7 @@ import (
 	"golang.org/x/net/http2/h2c"
 
 	"github.com/grafana/phlare/pkg/agent"
+	"github.com/grafana/phlare/pkg/cfg"
 	"github.com/grafana/phlare/pkg/distributor"
 	agentv1 "github.com/grafana/phlare/pkg/gen/agent/v1"
 	"github.com/grafana/phlare/pkg/gen/agent/v1/agentv1connect"
@@ -41,34 +43,36 @@ import (
 	"github.com/grafana/phlare/pkg/openapiv2"
 	phlarecontext "github.com/grafana/phlare/pkg/phlare/context"
 	"github.com/grafana/phlare/pkg/querier"
+	"github.com/grafana/phlare/pkg/ruler"
 	"github.com/grafana/phlare/pkg/usagestats"
 	"github.com/grafana/phlare/pkg/util"
 	"github.com/grafana/phlare/pkg/util/build"
+	"github.com/grafana/phlare/pkg/validation"
 )
 
 // The various modules that make up Phlare.
 const (
-	All          string = "all"
-	Agent        string = "agent"
-	Distributor  string = "distributor"
-	Server       string = "server"
-	Ring         string = "ring"
-	Ingester     string = "ingester"
-	MemberlistKV string = "memberlist-kv"
-	Querier      string = "querier"
-	GRPCGateway  string = "grpc-gateway"
-	Storage      string = "storage"
-	UsageReport  string = "usage-stats"
-
-	// RuntimeConfig            string = "runtime-config"
-	// Overrides                string = "overrides"
+	All           string = "all"
+	Agent         string = "agent"
+	Distributor   string = "distributor"
+	Server        string = "server"
+	Ring          string = "ring"
+	Ingester      string = "ingester"
+	MemberlistKV  string = "memberlist-kv"
+	Querier       string = "querier"
+	GRPCGateway   string = "grpc-gateway"
+	Storage       string = "storage"
+	UsageReport   string = "usage-stats"
+	RuntimeConfig string = "runtime-config"
+	Overrides     string = "overrides"
+	Ruler         string = "ruler"
+
 	// OverridesExporter        string = "overrides-exporter"
 	// TenantConfigs            string = "tenant-configs"
 	// IngesterQuerier          string = "ingester-querier"
 	// QueryFrontend            string = "query-frontend"
 	// QueryFrontendTripperware string = "query-frontend-tripperware"
 	// RulerStorage             string = "ruler-storage"
-	// Ruler                    string = "ruler"
 	// TableManager             string = "table-manager"
 	// Compactor                string = "compactor"
 	// IndexGateway             string = "index-gateway"
@@ -79,7 +83,11 @@ const (
 var objectStoreTypeStats = usagestats.NewString("store_object_type")
 
 func (f *Phlare) initQuerier() (services.Service, error) {
-	q, err := querier.New(f.Cfg.Querier, f.ring, nil, f.logger, f.auth)
+	// The results of the ingestion window of the ingesters are not cached.
+	if f.Cfg.PhlareDB.BlockAlignment > 0 {
+		f.Cfg.Querier.ResultsCache.IngestionWindow = f.Cfg.PhlareDB.BlockAlignment + f.Cfg.PhlareDB.OutOfOrderWindow
+	}
+	q, err := querier.New(f.Cfg.Querier, f.ring, nil, f.Overrides, f.reg, f.logger, f.auth)
 	if err != nil {
 		return nil, err
 	}
@@ -87,10 +95,26 @@ func (f *Phlare) initQuerier() (services.Service, error) {
 	f.Server.HTTP.Handle("/pyroscope/render", http.HandlerFunc(q.RenderHandler))
 	f.Server.HTTP.Handle("/pyroscope/label-values", http.HandlerFunc(q.LabelValuesHandler))
 	querierv1connect.RegisterQuerierServiceHandler(f.Server.HTTP, q, f.auth)
+	f.querier = q
 
 	return q, nil
 }
 
+func (f *Phlare) initRuler() (services.Service, error) {
+	// Rules are evaluated by the querier of the same process, unless the URL of a querier is set.
+	var q ruler.QuerierClient = f.querier
+	if url := f.Cfg.Ruler.QuerierURL.String(); url != "" {
+		q = querierv1connect.NewQuerierServiceClient(
+			&http.Client{Transport: util.WrapWithInstrumentedHTTPTransport(http.DefaultTransport)},
+			url,
+			f.auth,
+		)
+	}
+	r := ruler.New(f.Cfg.Ruler, q, f.Cfg.MultitenancyEnabled, f.reg, f.logger)
+	f.Server.HTTP.Path("/rules").Methods("GET").Handler(http.HandlerFunc(r.RulesHandler))
+	return r, nil
+}
+
 func (f *Phlare) getPusherClient() pushv1connect.PusherServiceClient {
 	return f.pusherClient
 }
@@ -110,8 +134,33 @@ func (f *Phlare) initGRPCGateway() (services.Service, error) {
 	return nil, nil
 }
 
+func (f *Phlare) initRuntimeConfig() (services.Service, error) {
+	if len(f.Cfg.RuntimeConfig.LoadPath) == 0 {
+		// no need to initialize module if load path is empty
+		return nil, nil
+	}
+	f.Cfg.RuntimeConfig.Loader = loadRuntimeConfig
+
+	// make sure to set default limits before we start loading configuration into memory
+	validation.SetDefaultLimitsForYAMLUnmarshalling(f.Cfg.LimitsConfig)
+
+	serv, err := runtimeconfig.New(f.Cfg.RuntimeConfig, prometheus.WrapRegistererWithPrefix("phlare_", f.reg), log.With(f.logger, "component", "runtime-config"))
+	if err != nil {
+		return nil, err
+	}
+	f.RuntimeConfig = serv
+	return serv, nil
+}
+
+func (f *Phlare) initOverrides() (serv services.Service, err error) {
+	f.Overrides, err = validation.NewOverrides(f.Cfg.LimitsConfig, newTenantLimits(f.RuntimeConfig))
+	// Overrides are not a service, since they don't have any operational state.
+	return nil, err
+}
+
 func (f *Phlare) initDistributor() (services.Service, error) {
-	d, err := distributor.New(f.Cfg.Distributor, f.ring, nil, f.reg, f.logger, f.auth)
+	f.Cfg.Distributor.DistributorRing.ListenPort = f.Cfg.Server.HTTPListenPort
+	d, err := distributor.New(f.Cfg.Distributor, f.ring, nil, f.Overrides, f.reg, f.logger, f.auth)
 	if err != nil {
 		return nil, err
 	}
@@ -124,11 +173,18 @@ func (f *Phlare) initDistributor() (services.Service, error) {
 }
 
 func (f *Phlare) initAgent() (services.Service, error) {
-	a, err := agent.New(&f.Cfg.AgentConfig, f.logger, f.getPusherClient)
+	f.Cfg.AgentConfig.ShardingRing.ListenPort = f.Cfg.Server.HTTPListenPort
+
+	a, err := agent.New(&f.Cfg.AgentConfig, f.reg, f.logger, f.getPusherClient)
 	if err != nil {
 		return nil, err
 	}
 	f.agent = a
+	// The scrape configs can only be reloaded from a config file.
+	if f.Cfg.ConfigFile != "" {
+		a.SetConfigLoader(f.loadAgentConfig)
+		f.Server.HTTP.Path("/-/reload").Methods("POST").Handler(http.HandlerFunc(a.ReloadHandler))
+	}
 
 	// register endpoint at grpc gateway
 	if err := agentv1.RegisterAgentServiceHandlerServer(context.Background(), f.grpcGatewayMux, a); err != nil {
@@ -136,14 +192,28 @@ func (f *Phlare) initAgent() (services.Service, error) {
 	}
 
 	agentv1connect.RegisterAgentServiceHandler(f.Server.HTTP, a.ConnectHandler())
+	if f.Cfg.AgentConfig.Receiver.Enabled {
+		pushv1connect.RegisterPusherServiceHandler(f.Server.HTTP, a.Receiver())
+		f.Server.HTTP.Path("/ingest").Methods("POST").Handler(http.HandlerFunc(a.Receiver().IngestHandler))
+	}
 	return a, nil
 }
 
+// loadAgentConfig reads the agent configuration from the config file.
+func (f *Phlare) loadAgentConfig() (*agent.Config, error) {
+	c := newDefaultConfig()
+	if err := cfg.YAML(f.Cfg.ConfigFile, f.Cfg.ConfigExpandEnv)(c); err != nil {
+		return nil, err
+	}
+	return &c.AgentConfig, nil
+}
+
 func (f *Phlare) initMemberlistKV() (services.Service, error) {
 	f.Cfg.MemberlistKV.MetricsRegisterer = f.reg
 	f.Cfg.MemberlistKV.Codecs = []codec.Codec{
 		ring.GetCodec(),
 		usagestats.JSONCodec,
+		distributor.HATrackerCodec,
 	}
 
 	dnsProviderReg := prometheus.WrapRegistererWithPrefix(
@@ -158,6 +228,9 @@ func (f *Phlare) initMemberlistKV() (services.Service, error) {
 	f.MemberlistKV = memberlist.NewKVInitService(&f.Cfg.MemberlistKV, f.logger, dnsProvider, f.reg)
 
 	f.Cfg.Ingester.LifecyclerConfig.RingConfig.KVStore.MemberlistKV = f.MemberlistKV.GetMemberlistKV
+	f.Cfg.AgentConfig.ShardingRing.KVStore.MemberlistKV = f.MemberlistKV.GetMemberlistKV
+	f.Cfg.Distributor.HATracker.KVStore.MemberlistKV = f.MemberlistKV.GetMemberlistKV
+	f.Cfg.Distributor.DistributorRing.KVStore.MemberlistKV = f.MemberlistKV.GetMemberlistKV
 
 	return f.MemberlistKV, nil
 }
@@ -201,13 +274,16 @@ func (f *Phlare) context() context.Context {
 func (f *Phlare) initIngester() (_ services.Service, err error) {
 	f.Cfg.Ingester.LifecyclerConfig.ListenPort = f.Cfg.Server.HTTPListenPort
 
-	ingester, err := ingester.New(f.context(), f.Cfg.Ingester, f.Cfg.PhlareDB, f.storageBucket)
+	ingester, err := ingester.New(f.context(), f.Cfg.Ingester, f.Cfg.PhlareDB, f.storageBucket, f.Overrides)
 	if err != nil {
 		return nil, err
 	}
 	prefix, handler := grpchealth.NewHandler(grpchealth.NewStaticChecker(ingesterv1connect.IngesterServiceName))
 	f.Server.HTTP.NewRoute().PathPrefix(prefix).Handler(handler)
 	ingesterv1connect.RegisterIngesterServiceHandler(f.Server.HTTP, ingester, f.auth)
+	f.Server.HTTP.Path("/ingester/flush").Methods("POST").Handler(http.HandlerFunc(ingester.FlushHandler))
+	f.Server.HTTP.Path("/ingester/shutdown").Methods("POST").Handler(http.HandlerFunc(ingester.ShutdownHandler))
+	f.Server.HTTP.Path("/metrics/profiles").Methods("GET").Handler(http.HandlerFunc(ingester.ProfileMetricsHandler))
 	return ingester, nil
 }
 
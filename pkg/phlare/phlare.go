@@ -18,6 +18,7 @@ import (
 	"github.com/grafana/dskit/kv/memberlist"
 	"github.com/grafana/dskit/modules"
 	"github.com/grafana/dskit/ring"
+	"github.com/grafana/dskit/runtimeconfig"
 	"github.com/grafana/dskit/services"
 	grpcgw "github.com/grpc-ecosystem/grpc-gateway/v2/runtime"
 	"github.com/prometheus/client_golang/prometheus"
@@ -40,29 +41,35 @@ import (
 	phlarecontext "github.com/grafana/phlare/pkg/phlare/context"
 	"github.com/grafana/phlare/pkg/phlaredb"
 	"github.com/grafana/phlare/pkg/querier"
+	"github.com/grafana/phlare/pkg/ruler"
 	"github.com/grafana/phlare/pkg/tenant"
 	"github.com/grafana/phlare/pkg/tracing"
 	"github.com/grafana/phlare/pkg/usagestats"
 	"github.com/grafana/phlare/pkg/util"
+	"github.com/grafana/phlare/pkg/validation"
 )
 
 type Config struct {
-	Target       flagext.StringSliceCSV `yaml:"target,omitempty"`
-	AgentConfig  agent.Config           `yaml:",inline"`
-	Server       server.Config          `yaml:"server,omitempty"`
-	Distributor  distributor.Config     `yaml:"distributor,omitempty"`
-	Querier      querier.Config         `yaml:"querier,omitempty"`
-	Ingester     ingester.Config        `yaml:"ingester,omitempty"`
-	MemberlistKV memberlist.KVConfig    `yaml:"memberlist"`
-	PhlareDB     phlaredb.Config        `yaml:"phlaredb,omitempty"`
-	Tracing      tracing.Config         `yaml:"tracing"`
+	Target        flagext.StringSliceCSV `yaml:"target,omitempty"`
+	AgentConfig   agent.Config           `yaml:",inline"`
+	Server        server.Config          `yaml:"server,omitempty"`
+	Distributor   distributor.Config     `yaml:"distributor,omitempty"`
+	Querier       querier.Config         `yaml:"querier,omitempty"`
+	Ruler         ruler.Config           `yaml:"ruler,omitempty"`
+	Ingester      ingester.Config        `yaml:"ingester,omitempty"`
+	MemberlistKV  memberlist.KVConfig    `yaml:"memberlist"`
+	PhlareDB      phlaredb.Config        `yaml:"phlaredb,omitempty"`
+	Tracing       tracing.Config         `yaml:"tracing"`
+	LimitsConfig  validation.Limits      `yaml:"limits"`
+	RuntimeConfig runtimeconfig.Config   `yaml:"runtime_config"`
 
 	Storage StorageConfig `yaml:"storage"`
 
 	MultitenancyEnabled bool              `yaml:"multitenancy_enabled,omitempty"`
 	Analytics           usagestats.Config `yaml:"analytics"`
 
-	ConfigFile string `yaml:"-"`
+	ConfigFile      string `yaml:"-"`
+	ConfigExpandEnv bool   `yaml:"-"`
 }
 
 func newDefaultConfig() *Config {
@@ -89,6 +96,7 @@ func (c *Config) RegisterFlagsWithContext(ctx context.Context, f *flag.FlagSet)
 	// Set the default module list to 'all'
 	c.Target = []string{All}
 	f.StringVar(&c.ConfigFile, "config.file", "", "yaml file to load")
+	f.BoolVar(&c.ConfigExpandEnv, "config.expand-env", false, "Expands ${var} in the config file according to the values of the environment variables.")
 	f.Var(&c.Target, "target", "Comma-separated list of Phlare modules to load. "+
 		"The alias 'all' can be used in the list to load a number of core modules and will enable single-binary mode. ")
 	f.BoolVar(&c.MultitenancyEnabled, "auth.multitenancy-enabled", false, "When set to true, incoming HTTP requests must specify tenant ID in HTTP X-Scope-OrgId header. When set to false, tenant ID anonymous is used instead.")
@@ -98,8 +106,11 @@ func (c *Config) RegisterFlagsWithContext(ctx context.Context, f *flag.FlagSet)
 	c.MemberlistKV.RegisterFlags(f)
 	c.Distributor.RegisterFlags(f)
 	c.Querier.RegisterFlags(f)
+	c.Ruler.RegisterFlags(f)
 	c.PhlareDB.RegisterFlags(f)
 	c.Tracing.RegisterFlags(f)
+	c.LimitsConfig.RegisterFlags(f)
+	c.RuntimeConfig.RegisterFlags(f)
 	c.Storage.RegisterFlagsWithContext(ctx, f)
 	c.Analytics.RegisterFlags(f)
 }
@@ -132,11 +143,40 @@ func (c *Config) Validate() error {
 	if err := c.Ingester.Validate(); err != nil {
 		return err
 	}
+	if err := c.PhlareDB.Validate(); err != nil {
+		return err
+	}
+	if err := c.Distributor.Validate(); err != nil {
+		return err
+	}
+	if err := c.Querier.Validate(); err != nil {
+		return err
+	}
+	if c.isModuleEnabled(Ruler) {
+		if err := c.Ruler.Validate(); err != nil {
+			return err
+		}
+	}
+	if c.AgentConfig.Receiver.Enabled && (c.isModuleEnabled(All) || c.isModuleEnabled(Distributor)) {
+		return errors.New("the agent receiver can't be enabled along with the distributor, profiles can be pushed to the distributor directly")
+	}
 	return c.AgentConfig.Validate()
 }
 
+func (c *Config) isModuleEnabled(m string) bool {
+	for _, target := range c.Target {
+		if target == m {
+			return true
+		}
+	}
+	return false
+}
+
 func (c *Config) ApplyDynamicConfig() cfg.Source {
 	c.Ingester.LifecyclerConfig.RingConfig.KVStore.Store = "memberlist"
+	c.AgentConfig.ShardingRing.KVStore.Store = "memberlist"
+	c.Distributor.HATracker.KVStore.Store = "memberlist"
+	c.Distributor.DistributorRing.KVStore.Store = "memberlist"
 	return func(dst cfg.Cloneable) error {
 		r, ok := dst.(*Config)
 		if !ok {
@@ -178,8 +218,11 @@ type Phlare struct {
 	MemberlistKV       *memberlist.KVInitService
 	ring               *ring.Ring
 	agent              *agent.Agent
+	querier            *querier.Querier
 	pusherClient       pushv1connect.PusherServiceClient
 	usageReport        *usagestats.Reporter
+	RuntimeConfig      *runtimeconfig.Manager
+	Overrides          *validation.Overrides
 
 	storageBucket objstore.Bucket
 
@@ -235,31 +278,36 @@ func (f *Phlare) setupModuleManager() error {
 	mm.RegisterModule(GRPCGateway, f.initGRPCGateway, modules.UserInvisibleModule)
 	mm.RegisterModule(MemberlistKV, f.initMemberlistKV, modules.UserInvisibleModule)
 	mm.RegisterModule(Ring, f.initRing, modules.UserInvisibleModule)
+	mm.RegisterModule(RuntimeConfig, f.initRuntimeConfig, modules.UserInvisibleModule)
+	mm.RegisterModule(Overrides, f.initOverrides, modules.UserInvisibleModule)
 	mm.RegisterModule(Ingester, f.initIngester)
 	mm.RegisterModule(Server, f.initServer, modules.UserInvisibleModule)
 	mm.RegisterModule(Distributor, f.initDistributor)
 	mm.RegisterModule(Querier, f.initQuerier)
 	mm.RegisterModule(Agent, f.initAgent)
+	mm.RegisterModule(Ruler, f.initRuler)
 	mm.RegisterModule(UsageReport, f.initUsageReport)
 	mm.RegisterModule(All, nil)
 
 	// Add dependencies
 	deps := map[string][]string{
-		All:          {Agent, Ingester, Distributor, Querier},
-		UsageReport:  {Storage, MemberlistKV},
-		Distributor:  {Ring, Server, UsageReport},
-		Querier:      {Ring, Server, UsageReport},
-		Agent:        {Server},
-		Ingester:     {Server, MemberlistKV, Storage, UsageReport},
-		Ring:         {Server, MemberlistKV},
-		MemberlistKV: {Server},
-		Server:       {GRPCGateway},
+		All:           {Agent, Ingester, Distributor, Querier},
+		UsageReport:   {Storage, MemberlistKV},
+		Distributor:   {Overrides, Ring, Server, UsageReport},
+		Querier:       {Overrides, Ring, Server, UsageReport},
+		Agent:         {Server},
+		Ruler:         {Server},
+		Ingester:      {Overrides, Server, MemberlistKV, Storage, UsageReport},
+		Ring:          {Server, MemberlistKV},
+		MemberlistKV:  {Server},
+		Server:        {GRPCGateway},
+		Overrides:     {RuntimeConfig},
+		RuntimeConfig: {Server},
 
 		// Querier:                  {Store, Ring, Server, IngesterQuerier, TenantConfigs, UsageReport},
 		// QueryFrontendTripperware: {Server, Overrides, TenantConfigs},
 		// QueryFrontend:            {QueryFrontendTripperware, UsageReport},
 		// QueryScheduler:           {Server, Overrides, MemberlistKV, UsageReport},
-		// Ruler:                    {Ring, Server, Store, RulerStorage, IngesterQuerier, Overrides, TenantConfigs, UsageReport},
 		// TableManager:             {Server, UsageReport},
 		// Compactor:                {Server, Overrides, MemberlistKV, UsageReport},
 		// IndexGateway:             {Server, Store, Overrides, UsageReport, MemberlistKV, IndexGatewayRing},
@@ -267,6 +315,16 @@ func (f *Phlare) setupModuleManager() error {
 		// IndexGatewayRing:         {RuntimeConfig, Server, MemberlistKV},
 	}
 
+	// Without the URL of a querier, rules are evaluated by the querier of the same process.
+	if f.Cfg.Ruler.QuerierURL.String() == "" {
+		deps[Ruler] = append(deps[Ruler], Querier)
+	}
+
+	// The agents ring is only required when sharding of targets is enabled.
+	if f.Cfg.AgentConfig.ShardingRing.Enabled {
+		deps[Agent] = append(deps[Agent], MemberlistKV)
+	}
+
 	for mod, targets := range deps {
 		if err := mm.AddDependency(mod, targets...); err != nil {
 			return err
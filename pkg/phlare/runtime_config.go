@@ -0,0 +1,49 @@
+package phlare
+
+import (
+	"io"
+
+	"github.com/grafana/dskit/runtimeconfig"
+	"gopkg.in/yaml.v2"
+
+	"github.com/grafana/phlare/pkg/validation"
+)
+
+// runtimeConfigValues are values that can be reloaded from configuration file while Phlare is running.
+// Reloading is done by runtimeconfig.Manager, which also keeps the currently loaded config.
+// These values are then pushed to the components that are interested in them.
+type runtimeConfigValues struct {
+	TenantLimits map[string]*validation.Limits `yaml:"overrides"`
+}
+
+func loadRuntimeConfig(r io.Reader) (interface{}, error) {
+	overrides := &runtimeConfigValues{}
+
+	decoder := yaml.NewDecoder(r)
+	decoder.SetStrict(true)
+	if err := decoder.Decode(&overrides); err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	return overrides, nil
+}
+
+// runtimeConfigTenantLimits provides the per-tenant limits of the runtime configuration.
+type runtimeConfigTenantLimits struct {
+	manager *runtimeconfig.Manager
+}
+
+func newTenantLimits(manager *runtimeconfig.Manager) validation.TenantLimits {
+	if manager == nil {
+		return nil
+	}
+	return &runtimeConfigTenantLimits{manager: manager}
+}
+
+func (l *runtimeConfigTenantLimits) TenantLimits(tenantID string) *validation.Limits {
+	cfg, ok := l.manager.GetConfig().(*runtimeConfigValues)
+	if !ok || cfg == nil {
+		return nil
+	}
+	return cfg.TenantLimits[tenantID]
+}
@@ -0,0 +1,64 @@
+package phlare
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/grafana/dskit/flagext"
+	"github.com/prometheus/prometheus/model/relabel"
+	"github.com/stretchr/testify/require"
+
+	"github.com/grafana/phlare/pkg/validation"
+)
+
+func TestLoadRuntimeConfig_ShouldLoadTenantLimits(t *testing.T) {
+	var defaults validation.Limits
+	flagext.DefaultValues(&defaults)
+	defaults.MaxLabelNamesPerSeries = 10
+	validation.SetDefaultLimitsForYAMLUnmarshalling(defaults)
+
+	actual, err := loadRuntimeConfig(strings.NewReader(`
+overrides:
+  tenant-a:
+    max_label_name_length: 512
+`))
+	require.NoError(t, err)
+
+	limits := actual.(*runtimeConfigValues).TenantLimits["tenant-a"]
+	require.Equal(t, 512, limits.MaxLabelNameLength)
+	// Limits which aren't overridden default to the configured limits.
+	require.Equal(t, 10, limits.MaxLabelNamesPerSeries)
+	require.Equal(t, defaults.MaxLabelValueLength, limits.MaxLabelValueLength)
+}
+
+func TestLoadRuntimeConfig_ShouldRejectUnknownFields(t *testing.T) {
+	_, err := loadRuntimeConfig(strings.NewReader(`
+overrides:
+  tenant-a:
+    unknown_limit: 1
+`))
+	require.Error(t, err)
+}
+
+func TestLoadRuntimeConfig_ShouldLoadIngestionRelabelConfigs(t *testing.T) {
+	actual, err := loadRuntimeConfig(strings.NewReader(`
+overrides:
+  tenant-a:
+    ingestion_relabel_configs:
+      - action: labeldrop
+        regex: pod_template_hash
+`))
+	require.NoError(t, err)
+	cfgs := actual.(*runtimeConfigValues).TenantLimits["tenant-a"].IngestionRelabelConfigs
+	require.Len(t, cfgs, 1)
+	require.Equal(t, relabel.LabelDrop, cfgs[0].Action)
+
+	_, err = loadRuntimeConfig(strings.NewReader(`
+overrides:
+  tenant-a:
+    ingestion_relabel_configs:
+      - action: labeldrop
+        regex: "("
+`))
+	require.Error(t, err)
+}
@@ -0,0 +1,110 @@
+package phlaredb
+
+import (
+	"context"
+	"time"
+
+	"github.com/go-kit/log/level"
+	"github.com/google/uuid"
+
+	commonv1 "github.com/grafana/phlare/pkg/gen/common/v1"
+	profilev1 "github.com/grafana/phlare/pkg/gen/google/v1"
+	"github.com/grafana/phlare/pkg/validation"
+)
+
+// Ingest ingests the profile in the head. With block alignment, the profile
+// is ingested in the head of the window of its timestamp.
+func (f *PhlareDB) Ingest(ctx context.Context, p *profilev1.Profile, id uuid.UUID, externalLabels ...*commonv1.LabelPair) error {
+	head, err := f.headFor(time.Unix(0, p.TimeNanos))
+	if err != nil {
+		return err
+	}
+	return head.Ingest(ctx, p, id, externalLabels...)
+}
+
+// headFor returns the head receiving the profiles with the given timestamp.
+func (f *PhlareDB) headFor(ts time.Time) (*Head, error) {
+	if f.cfg.BlockAlignment <= 0 {
+		return f.Head(), nil
+	}
+	window := ts.Truncate(f.cfg.BlockAlignment)
+
+	f.headLock.RLock()
+	if window.Equal(f.headWindow) {
+		defer f.headLock.RUnlock()
+		return f.head, nil
+	}
+	f.headLock.RUnlock()
+
+	f.headLock.Lock()
+	defer f.headLock.Unlock()
+	previousWindow := f.headWindow.Add(-f.cfg.BlockAlignment)
+	switch {
+	case window.Equal(f.headWindow):
+		return f.head, nil
+	case window.After(f.headWindow):
+		// The window of the head may be over before the heads are rotated by
+		// the loop. Profiles ahead of the clock of the ingester go to the head
+		// of the current window, heads are never started for future windows.
+		if current := f.now().Truncate(f.cfg.BlockAlignment); current.After(f.headWindow) {
+			if err := f.rotateHeadLocked(current); err != nil {
+				return nil, err
+			}
+		}
+		return f.head, nil
+	case window.Equal(previousWindow) && f.now().Before(f.headWindow.Add(f.cfg.OutOfOrderWindow)):
+		if f.previousHead == nil {
+			h, err := f.newHead()
+			if err != nil {
+				return nil, err
+			}
+			// The metrics keep reporting the current head.
+			h.metrics.setHead(f.head)
+			f.previousHead = h
+		}
+		return f.previousHead, nil
+	}
+	return nil, validation.NewErrorf(validation.OutOfOrder, "profile timestamp %s is too old, the head block of its window %s was closed after the out-of-order window of %s", ts.UTC().Format(time.RFC3339), window.UTC().Format(time.RFC3339), f.cfg.OutOfOrderWindow)
+}
+
+// rotateHeadLocked starts a new head for the given window, the current head
+// becomes the previous head if it is the head of the window right before.
+// The heads of older windows are queued to be flushed.
+func (f *PhlareDB) rotateHeadLocked(window time.Time) error {
+	head, err := f.newHead()
+	if err != nil {
+		return err
+	}
+	if f.previousHead != nil {
+		f.pendingHeads = append(f.pendingHeads, f.previousHead)
+		f.previousHead = nil
+	}
+	if window.Equal(f.headWindow.Add(f.cfg.BlockAlignment)) {
+		f.previousHead = f.head
+	} else {
+		f.pendingHeads = append(f.pendingHeads, f.head)
+	}
+	f.head = head
+	f.headWindow = window
+	return nil
+}
+
+// closeAlignedHeads starts the head of the current window once the window of
+// the head is over, and queues the previous head to be flushed once the
+// out-of-order window is over. It returns whether heads are waiting to be
+// flushed.
+func (f *PhlareDB) closeAlignedHeads() bool {
+	f.headLock.Lock()
+	defer f.headLock.Unlock()
+	now := f.now()
+	if window := now.Truncate(f.cfg.BlockAlignment); window.After(f.headWindow) {
+		if err := f.rotateHeadLocked(window); err != nil {
+			level.Error(f.logger).Log("msg", "starting the head of the new window failed", "err", err)
+		}
+	}
+	if f.previousHead != nil && !now.Before(f.headWindow.Add(f.cfg.OutOfOrderWindow)) {
+		f.pendingHeads = append(f.pendingHeads, f.previousHead)
+		f.previousHead = nil
+	}
+	return len(f.pendingHeads) > 0
+}
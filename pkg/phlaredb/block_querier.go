@@ -27,7 +27,6 @@ import (
 	"golang.org/x/sync/errgroup"
 	"google.golang.org/grpc/codes"
 
-	commonv1 "github.com/grafana/phlare/pkg/gen/common/v1"
 	profilev1 "github.com/grafana/phlare/pkg/gen/google/v1"
 	ingestv1 "github.com/grafana/phlare/pkg/gen/ingester/v1"
 	"github.com/grafana/phlare/pkg/iter"
@@ -418,6 +417,14 @@ func (m *mapPredicate[K, V]) KeepValue(v parquet.Value) bool {
 	return exists
 }
 
+// timeNanosPredicate selects the profiles from start to end inclusive. Like
+// in the head, the whole end millisecond is included, so that profiles with a
+// sub-millisecond timestamp are selected by exactly one of two adjacent
+// ranges [a,b] and [b+1,c].
+func timeNanosPredicate(start, end model.Time) query.Predicate {
+	return query.NewIntBetweenPredicate(start.UnixNano(), (end+1).UnixNano()-1)
+}
+
 type labelsInfo struct {
 	fp  model.Fingerprint
 	lbs phlaremodel.Labels
@@ -460,9 +467,9 @@ func (b *singleBlockQuerier) forMatchingProfiles(ctx context.Context, matchers [
 	rowNums := query.NewJoinIterator(
 		0,
 		[]query.Iterator{
-			b.profiles.columnIter(ctx, "SeriesIndex", newMapPredicate(lblsPerIndex), "SeriesIndex"),                              // get all profiles with matching seriesRef
-			b.profiles.columnIter(ctx, "TimeNanos", query.NewIntBetweenPredicate(start.UnixNano(), end.UnixNano()), "TimeNanos"), // get all profiles within the time window
-			b.profiles.columnIter(ctx, "ID", nil, "ID"),                                                                          // get all IDs
+			b.profiles.columnIter(ctx, "SeriesIndex", newMapPredicate(lblsPerIndex), "SeriesIndex"), // get all profiles with matching seriesRef
+			b.profiles.columnIter(ctx, "TimeNanos", timeNanosPredicate(start, end), "TimeNanos"),    // get all profiles within the time window
+			b.profiles.columnIter(ctx, "ID", nil, "ID"),                                             // get all IDs
 			// TODO: Provide option to ignore samples
 			b.profiles.columnIter(ctx, "Samples.list.element.StacktraceID", nil, "StacktraceIDs"),
 			b.profiles.columnIter(ctx, "Samples.list.element.Value", nil, "SampleValues"),
@@ -518,17 +525,22 @@ type Querier interface {
 	InRange(start, end model.Time) bool
 	SelectMatchingProfiles(ctx context.Context, params *ingestv1.SelectProfilesRequest) (iter.Iterator[Profile], error)
 	MergeByStacktraces(ctx context.Context, rows iter.Iterator[Profile]) (*ingestv1.MergeProfilesStacktracesResult, error)
-	MergeByLabels(ctx context.Context, rows iter.Iterator[Profile], by ...string) ([]*commonv1.Series, error)
+	MergeByLabels(ctx context.Context, rows iter.Iterator[Profile], agg SeriesAggregation, by ...string) (*phlaremodel.SeriesAggregator, error)
 
 	// Sorts profiles for retrieval.
 	Sort([]Profile) []Profile
+
+	forMatchingSeries(ctx context.Context, matchers []*labels.Matcher, start, end model.Time, fn func(lbs phlaremodel.Labels, fp model.Fingerprint) error) error
+	labelValues(ctx context.Context, name string, matchers []*labels.Matcher, start, end model.Time) ([]string, error)
+	labelNames(ctx context.Context, matchers []*labels.Matcher, start, end model.Time) ([]string, error)
 }
 
 type BlockProfile struct {
-	labels phlaremodel.Labels
-	fp     model.Fingerprint
-	ts     model.Time
-	RowNum int64
+	labels        phlaremodel.Labels
+	fp            model.Fingerprint
+	ts            model.Time
+	durationNanos int64
+	RowNum        int64
 }
 
 func (p BlockProfile) RowNumber() int64 {
@@ -557,6 +569,10 @@ func (b *singleBlockQuerier) SelectMatchingProfiles(ctx context.Context, params
 	if err != nil {
 		return nil, status.Error(codes.InvalidArgument, "failed to parse label selectors: "+err.Error())
 	}
+	matchers, shard, err := splitShardMatcher(matchers)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, "failed to parse shard: "+err.Error())
+	}
 	matchers = append(matchers, phlaremodel.SelectorFromProfileType(params.Type))
 
 	postings, err := PostingsForMatchers(b.index, nil, matchers...)
@@ -576,6 +592,10 @@ func (b *singleBlockQuerier) SelectMatchingProfiles(ctx context.Context, params
 		if err != nil {
 			return nil, err
 		}
+		// Series are not sorted by fingerprint in the index, so the shard can't be used to restrict the postings.
+		if shard != nil && !shard.Match(model.Fingerprint(fp)) {
+			continue
+		}
 		if lblsExisting, exists := lblsPerRef[int64(chks[0].SeriesIndex)]; exists {
 			// Compare to check if there is a clash
 			if phlaremodel.CompareLabelPairs(lbls, lblsExisting.lbs) != 0 {
@@ -593,19 +613,20 @@ func (b *singleBlockQuerier) SelectMatchingProfiles(ctx context.Context, params
 		0,
 		[]query.Iterator{
 			b.profiles.columnIter(ctx, "SeriesIndex", newMapPredicate(lblsPerRef), "SeriesIndex"),
-			b.profiles.columnIter(ctx, "TimeNanos", query.NewIntBetweenPredicate(model.Time(params.Start).UnixNano(), model.Time(params.End).UnixNano()), "TimeNanos"),
+			b.profiles.columnIter(ctx, "TimeNanos", timeNanosPredicate(model.Time(params.Start), model.Time(params.End)), "TimeNanos"),
+			b.profiles.columnIter(ctx, "DurationNanos", nil, "DurationNanos"),
 		},
 		nil,
 	)
 	iters := make([]iter.Iterator[Profile], 0, len(lblsPerRef))
-	buf := make([][]parquet.Value, 2)
+	buf := make([][]parquet.Value, 3)
 	defer pIt.Close()
 
 	currSeriesIndex := int64(-1)
 	var currentSeriesSlice []Profile
 	for pIt.Next() {
 		res := pIt.At()
-		buf = res.Columns(buf, "SeriesIndex", "TimeNanos")
+		buf = res.Columns(buf, "SeriesIndex", "TimeNanos", "DurationNanos")
 		seriesIndex := buf[0][0].Int64()
 		if seriesIndex != currSeriesIndex {
 			currSeriesIndex++
@@ -615,10 +636,11 @@ func (b *singleBlockQuerier) SelectMatchingProfiles(ctx context.Context, params
 			currentSeriesSlice = make([]Profile, 0, 100)
 		}
 		currentSeriesSlice = append(currentSeriesSlice, BlockProfile{
-			labels: lblsPerRef[seriesIndex].lbs,
-			fp:     lblsPerRef[seriesIndex].fp,
-			ts:     model.TimeFromUnixNano(buf[1][0].Int64()),
-			RowNum: res.RowNumber[0],
+			labels:        lblsPerRef[seriesIndex].lbs,
+			fp:            lblsPerRef[seriesIndex].fp,
+			ts:            model.TimeFromUnixNano(buf[1][0].Int64()),
+			durationNanos: buf[2][0].Int64(),
+			RowNum:        res.RowNumber[0],
 		})
 	}
 	if len(currentSeriesSlice) > 0 {
@@ -60,13 +60,33 @@ func (s *deduplicatingSlice[M, K, H, P]) Init(path string, cfg *ParquetConfig) e
 		return err
 	}
 	s.file = file
+	s.writer = s.newWriter(file)
+	s.lookup = make(map[K]int64)
+	return nil
+}
 
+func (s *deduplicatingSlice[M, K, H, P]) newWriter(file *os.File) *parquet.Writer {
 	// TODO: Reuse parquet.Writer beyond life time of the head.
-	s.writer = parquet.NewWriter(file, s.persister.Schema(),
+	return parquet.NewWriter(file, s.persister.Schema(),
 		parquet.ColumnPageBuffers(parquet.NewFileBufferPool(os.TempDir(), "phlaredb-parquet-buffers*")),
 		parquet.CreatedBy("github.com/grafana/phlare/", build.Version, build.Revision),
 	)
-	s.lookup = make(map[K]int64)
+}
+
+// Reset truncates the parquet file, so that all the rows are flushed again.
+func (s *deduplicatingSlice[M, K, H, P]) Reset() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	// The writer and the file may be closed already.
+	_ = s.writer.Close()
+	_ = s.file.Close()
+	file, err := os.OpenFile(s.file.Name(), os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+	s.file = file
+	s.writer = s.newWriter(file)
+	s.rowsFlushed = 0
 	return nil
 }
 
@@ -13,6 +13,8 @@ const (
 	memoryProfileName   = "memory"
 	allocObjectTypeName = "alloc_objects"
 	allocSpaceTypeName  = "alloc_space"
+	inuseTypeNamePrefix = "inuse_"
+	goroutineTypeName   = "goroutine"
 )
 
 // deltaProfiles is a helper to compute delta of profiles.
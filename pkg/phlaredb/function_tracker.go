@@ -0,0 +1,93 @@
+package phlaredb
+
+import (
+	"strings"
+
+	"github.com/samber/lo"
+
+	profilev1 "github.com/grafana/phlare/pkg/gen/google/v1"
+	phlaremodel "github.com/grafana/phlare/pkg/model"
+	schemav1 "github.com/grafana/phlare/pkg/phlaredb/schemas/v1"
+)
+
+// FunctionTracker attributes the sample values of the profiles ingested in the
+// head to the tracked functions found in their stacktraces.
+type FunctionTracker interface {
+	// Matcher returns whether a function is tracked, it is nil when no function is tracked.
+	// It is resolved once per profile.
+	Matcher() func(name string) bool
+	// Add adds the value of the samples of a series with the function in their stacktrace.
+	Add(serviceName, profileType, function string, value int64)
+}
+
+// sampleFunctions returns the tracked functions found in the stacktrace of each
+// sample of the profile, each function at most once per sample. It must be
+// called before the references of the profile are rewritten.
+func sampleFunctions(p *profilev1.Profile, match func(name string) bool) [][]string {
+	matches := make(map[uint64]string, len(p.Function))
+	for _, fn := range p.Function {
+		if fn.Name < 0 || fn.Name >= int64(len(p.StringTable)) {
+			continue
+		}
+		if name := p.StringTable[fn.Name]; match(name) {
+			matches[fn.Id] = name
+		}
+	}
+	if len(matches) == 0 {
+		return nil
+	}
+	locations := make(map[uint64]*profilev1.Location, len(p.Location))
+	for _, loc := range p.Location {
+		locations[loc.Id] = loc
+	}
+
+	result := make([][]string, len(p.Sample))
+	for i, s := range p.Sample {
+		var functions []string
+		for _, id := range s.LocationId {
+			loc, ok := locations[id]
+			if !ok {
+				continue
+			}
+			for _, line := range loc.Line {
+				name, ok := matches[line.FunctionId]
+				if !ok || lo.Contains(functions, name) {
+					continue
+				}
+				functions = append(functions, name)
+			}
+		}
+		result[i] = functions
+	}
+	return result
+}
+
+// trackFunctions adds the values of the samples of a profile of the series to
+// their tracked functions, found by stacktrace. The samples of gauge types are
+// not tracked, their values add up to nothing meaningful over time.
+func (h *Head) trackFunctions(lbs phlaremodel.Labels, samples []*schemav1.Sample, functions map[uint64][]string) {
+	if isGauge(lbs) {
+		return
+	}
+	var (
+		serviceName = lbs.Get(phlaremodel.LabelNameServiceName)
+		profileType = lbs.Get(phlaremodel.LabelNameProfileType)
+		totals      = make(map[string]int64)
+	)
+	for _, s := range samples {
+		for _, fn := range functions[s.StacktraceID] {
+			totals[fn] += s.Value
+		}
+	}
+	for fn, v := range totals {
+		h.functionTracker.Add(serviceName, profileType, fn, v)
+	}
+}
+
+// isGauge returns whether the samples of the series are the state of the
+// process when profiled, such as the memory in use, rather than what happened
+// since the previous profile.
+func isGauge(lbs phlaremodel.Labels) bool {
+	ty := lbs.Get(phlaremodel.LabelNameType)
+	return strings.HasPrefix(ty, inuseTypeNamePrefix) || ty == goroutineTypeName
+}
@@ -20,7 +20,6 @@ import (
 	"github.com/opentracing/opentracing-go"
 	"github.com/pkg/errors"
 	"github.com/prometheus/common/model"
-	"github.com/prometheus/prometheus/model/labels"
 	"github.com/prometheus/prometheus/promql/parser"
 	"github.com/prometheus/prometheus/tsdb/fileutil"
 	"github.com/samber/lo"
@@ -96,6 +95,9 @@ type Table interface {
 	Init(path string, cfg *ParquetConfig) error
 	Flush() (numRows uint64, numRowGroups uint64, err error)
 	Close() error
+	// Reset discards the rows flushed so far, to flush the table again after a
+	// failed flush.
+	Reset() error
 }
 
 type Head struct {
@@ -115,6 +117,9 @@ type Head struct {
 	meta     *block.Meta
 
 	index           *profilesIndex
+	limits          HeadLimits
+	seriesLimiter   *seriesLimiter
+	functionTracker FunctionTracker
 	parquetConfig   *ParquetConfig
 	strings         deduplicatingSlice[string, string, *stringsHelper, *schemav1.StringPersister]
 	mappings        deduplicatingSlice[*profilev1.Mapping, mappingsKey, *mappingsHelper, *schemav1.MappingPersister]
@@ -124,6 +129,7 @@ type Head struct {
 	profiles        deduplicatingSlice[*schemav1.Profile, noKey, *profilesHelper, *schemav1.ProfilePersister]
 	totalSamples    *atomic.Uint64
 	tables          []Table
+	flushFailed     bool // set when the previous flush failed
 	delta           *deltaProfiles
 	pprofLabelCache labelCache
 }
@@ -147,7 +153,10 @@ func NewHead(phlarectx context.Context, cfg Config) (*Head, error) {
 		flushCh:          make(chan struct{}),
 		flushForcedTimer: time.NewTimer(cfg.MaxBlockDuration),
 
-		parquetConfig: defaultParquetConfig,
+		parquetConfig:   defaultParquetConfig,
+		limits:          cfg.Limits,
+		seriesLimiter:   newSeriesLimiter(),
+		functionTracker: cfg.FunctionTracker,
 	}
 	h.headPath = filepath.Join(cfg.DataPath, pathHead, h.meta.ULID.String())
 	h.localPath = filepath.Join(cfg.DataPath, pathLocal, h.meta.ULID.String())
@@ -278,10 +287,35 @@ func (h *Head) convertSamples(ctx context.Context, r *rewriter, in []*profilev1.
 	return out, nil
 }
 
+// NumSeries returns the number of series in the head.
+func (h *Head) NumSeries() uint64 {
+	return uint64(h.index.totalSeries.Load())
+}
+
 func (h *Head) Ingest(ctx context.Context, p *profilev1.Profile, id uuid.UUID, externalLabels ...*commonv1.LabelPair) error {
 	metricName := phlaremodel.Labels(externalLabels).Get(model.MetricNameLabel)
+	// Agents computing the delta of cumulative profiles themselves disable it here.
+	delta := phlaremodel.Labels(externalLabels).Get(phlaremodel.LabelNameDelta) != "false"
 	labels, seriesFingerprints := labelsForProfile(p, externalLabels...)
 
+	if err := h.index.checkLimits(h.limits, seriesFingerprints, p.TimeNanos); err != nil {
+		return err
+	}
+	maxSeries := 0
+	if h.limits != nil {
+		maxSeries = h.limits.MaxSeries()
+	}
+	if err := h.seriesLimiter.reserve(h, seriesFingerprints, maxSeries); err != nil {
+		return err
+	}
+
+	var functions [][]string
+	if h.functionTracker != nil {
+		if match := h.functionTracker.Matcher(); match != nil {
+			functions = sampleFunctions(p, match)
+		}
+	}
+
 	// create a rewriter state
 	rewrites := &rewriter{}
 
@@ -306,6 +340,16 @@ func (h *Head) Ingest(ctx context.Context, p *profilev1.Profile, id uuid.UUID, e
 		return err
 	}
 
+	var functionsByStacktrace map[uint64][]string
+	if len(functions) > 0 && len(samplesPerType) > 0 {
+		functionsByStacktrace = make(map[uint64][]string, len(functions))
+		for idxSample, s := range samplesPerType[0] {
+			if len(functions[idxSample]) > 0 {
+				functionsByStacktrace[s.StacktraceID] = functions[idxSample]
+			}
+		}
+	}
+
 	var profileIngested bool
 	for idxType := range samplesPerType {
 		profile := &schemav1.Profile{
@@ -320,7 +364,9 @@ func (h *Head) Ingest(ctx context.Context, p *profilev1.Profile, id uuid.UUID, e
 			DefaultSampleType: p.DefaultSampleType,
 		}
 
-		profile = h.delta.computeDelta(profile, labels[idxType])
+		if delta {
+			profile = h.delta.computeDelta(profile, labels[idxType])
+		}
 
 		if profile == nil {
 			continue
@@ -332,6 +378,10 @@ func (h *Head) Ingest(ctx context.Context, p *profilev1.Profile, id uuid.UUID, e
 
 		h.index.Add(profile, labels[idxType], metricName)
 
+		if len(functionsByStacktrace) > 0 {
+			h.trackFunctions(labels[idxType], profile.Samples, functionsByStacktrace)
+		}
+
 		profileIngested = true
 	}
 
@@ -366,6 +416,8 @@ func labelsForProfile(p *profilev1.Profile, externalLabels ...*commonv1.LabelPai
 		metricName                                     = phlaremodel.Labels(externalLabels).Get(model.MetricNameLabel)
 	)
 
+	lbls.Del(phlaremodel.LabelNameDelta)
+
 	// set common labels
 	if p.PeriodType != nil {
 		periodType = p.StringTable[p.PeriodType.Type]
@@ -404,47 +456,29 @@ func labelsForProfile(p *profilev1.Profile, externalLabels ...*commonv1.LabelPai
 
 // LabelValues returns the possible label values for a given label name.
 func (h *Head) LabelValues(ctx context.Context, req *connect.Request[ingestv1.LabelValuesRequest]) (*connect.Response[ingestv1.LabelValuesResponse], error) {
-	values, err := h.index.ix.LabelValues(req.Msg.Name, nil)
+	res, err := Queriers{h}.LabelValues(ctx, req.Msg)
 	if err != nil {
 		return nil, err
 	}
-	return connect.NewResponse(&ingestv1.LabelValuesResponse{
-		Names: values,
-	}), nil
+	return connect.NewResponse(res), nil
 }
 
-// LabelValues returns the possible label values for a given label name.
+// LabelNames returns the possible label names.
 func (h *Head) LabelNames(ctx context.Context, req *connect.Request[ingestv1.LabelNamesRequest]) (*connect.Response[ingestv1.LabelNamesResponse], error) {
-	values, err := h.index.ix.LabelNames(nil)
+	res, err := Queriers{h}.LabelNames(ctx, req.Msg)
 	if err != nil {
 		return nil, err
 	}
-	sort.Strings(values)
-	return connect.NewResponse(&ingestv1.LabelNamesResponse{
-		Names: values,
-	}), nil
+	return connect.NewResponse(res), nil
 }
 
 // ProfileTypes returns the possible profile types.
 func (h *Head) ProfileTypes(ctx context.Context, req *connect.Request[ingestv1.ProfileTypesRequest]) (*connect.Response[ingestv1.ProfileTypesResponse], error) {
-	values, err := h.index.ix.LabelValues(phlaremodel.LabelNameProfileType, nil)
+	res, err := Queriers{h}.ProfileTypes(ctx, req.Msg)
 	if err != nil {
 		return nil, err
 	}
-	sort.Strings(values)
-
-	profileTypes := make([]*commonv1.ProfileType, len(values))
-	for i, v := range values {
-		tp, err := phlaremodel.ParseProfileTypeSelector(v)
-		if err != nil {
-			return nil, err
-		}
-		profileTypes[i] = tp
-	}
-
-	return connect.NewResponse(&ingestv1.ProfileTypesResponse{
-		ProfileTypes: profileTypes,
-	}), nil
+	return connect.NewResponse(res), nil
 }
 
 func (h *Head) InRange(start, end model.Time) bool {
@@ -464,8 +498,12 @@ func (h *Head) SelectMatchingProfiles(ctx context.Context, params *ingestv1.Sele
 	if err != nil {
 		return nil, status.Error(codes.InvalidArgument, "failed to parse label selectors: "+err.Error())
 	}
+	selectors, shard, err := splitShardMatcher(selectors)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, "failed to parse shard: "+err.Error())
+	}
 	selectors = append(selectors, phlaremodel.SelectorFromProfileType(params.Type))
-	return h.index.SelectProfiles(selectors, model.Time(params.Start), model.Time(params.End))
+	return h.index.SelectProfiles(selectors, shard, model.Time(params.Start), model.Time(params.End))
 }
 
 func (h *Head) MergeByStacktraces(ctx context.Context, rows iter.Iterator[Profile]) (*ingestv1.MergeProfilesStacktracesResult, error) {
@@ -533,13 +571,12 @@ func (h *Head) MergeByStacktraces(ctx context.Context, rows iter.Iterator[Profil
 	}, nil
 }
 
-func (h *Head) MergeByLabels(ctx context.Context, rows iter.Iterator[Profile], by ...string) ([]*commonv1.Series, error) {
+func (h *Head) MergeByLabels(ctx context.Context, rows iter.Iterator[Profile], agg SeriesAggregation, by ...string) (*phlaremodel.SeriesAggregator, error) {
 	sp, _ := opentracing.StartSpanFromContext(ctx, "MergeByLabels - Head")
 	defer sp.Finish()
 
-	labelsByFingerprint := map[model.Fingerprint]string{}
-	seriesByLabels := map[string]*commonv1.Series{}
-	labelBuf := make([]byte, 0, 1024)
+	result := agg.newAggregator()
+	keys := newSeriesKeys(by)
 	defer rows.Close()
 
 	for rows.Next() {
@@ -547,44 +584,12 @@ func (h *Head) MergeByLabels(ctx context.Context, rows iter.Iterator[Profile], b
 		if !ok {
 			return nil, errors.New("expected ProfileWithLabels")
 		}
-		labelsByString, ok := labelsByFingerprint[p.fp]
-		if !ok {
-			labelBuf = p.Labels().BytesWithLabels(labelBuf, by...)
-			labelsByString = string(labelBuf)
-			labelsByFingerprint[p.fp] = labelsByString
-			if _, ok := seriesByLabels[labelsByString]; !ok {
-				seriesByLabels[labelsByString] = &commonv1.Series{
-					Labels: p.Labels().WithLabels(by...),
-					Points: []*commonv1.Point{
-						{
-							Timestamp: int64(p.Timestamp()),
-							Value:     float64(p.Total()),
-						},
-					},
-				}
-				continue
-			}
-		}
-		series := seriesByLabels[labelsByString]
-		series.Points = append(series.Points, &commonv1.Point{
-			Timestamp: int64(p.Timestamp()),
-			Value:     float64(p.Total()),
-		})
-
+		k := keys.get(p)
+		result.Add(k.labels, k.hash, int64(p.Timestamp()), agg.value(p.Total(), p.DurationNanos), 1)
 	}
 	if err := rows.Err(); err != nil {
 		return nil, err
 	}
-	result := lo.Values(seriesByLabels)
-	sort.Slice(result, func(i, j int) bool {
-		return phlaremodel.CompareLabelPairs(result[i].Labels, result[j].Labels) < 0
-	})
-	// we have to sort the points in each series because labels reduction may have changed the order
-	for _, s := range result {
-		sort.Slice(s.Points, func(i, j int) bool {
-			return s.Points[i].Timestamp < s.Points[j].Timestamp
-		})
-	}
 	return result, nil
 }
 
@@ -644,33 +649,13 @@ func (it *ProfileSelectorIterator) Err() error {
 	return nil
 }
 
+// Series returns the labels of the series matching the selectors.
 func (h *Head) Series(ctx context.Context, req *connect.Request[ingestv1.SeriesRequest]) (*connect.Response[ingestv1.SeriesResponse], error) {
-	selectors := make([][]*labels.Matcher, 0, len(req.Msg.Matchers))
-	for _, m := range req.Msg.Matchers {
-		s, err := parser.ParseMetricSelector(m)
-		if err != nil {
-			return nil, status.Error(codes.InvalidArgument, "failed to label selector")
-		}
-		selectors = append(selectors, s)
-	}
-	response := &ingestv1.SeriesResponse{}
-	uniqu := map[model.Fingerprint]struct{}{}
-	for _, selector := range selectors {
-		if err := h.index.forMatchingLabels(selector, func(lbs phlaremodel.Labels, fp model.Fingerprint) error {
-			if _, ok := uniqu[fp]; ok {
-				return nil
-			}
-			uniqu[fp] = struct{}{}
-			response.LabelsSet = append(response.LabelsSet, &commonv1.Labels{Labels: lbs})
-			return nil
-		}); err != nil {
-			return nil, err
-		}
+	res, err := Queriers{h}.Series(ctx, req.Msg)
+	if err != nil {
+		return nil, err
 	}
-	sort.Slice(response.LabelsSet, func(i, j int) bool {
-		return phlaremodel.CompareLabelPairs(response.LabelsSet[i].Labels, response.LabelsSet[j].Labels) < 0
-	})
-	return connect.NewResponse(response), nil
+	return connect.NewResponse(res), nil
 }
 
 // Flush closes the head and writes data to disk
@@ -686,8 +671,20 @@ func (h *Head) Close() error {
 	return merr.Err()
 }
 
-// Flush closes the head and writes data to disk
-func (h *Head) Flush(ctx context.Context) error {
+// Flush closes the head and writes data to disk. A failed flush can be
+// retried, the data is then written again from the start.
+func (h *Head) Flush(ctx context.Context) (err error) {
+	if h.flushFailed {
+		for _, t := range h.tables {
+			if err := t.Reset(); err != nil {
+				return errors.Wrapf(err, "resetting of table %s", t.Name())
+			}
+		}
+	}
+	defer func() {
+		h.flushFailed = err != nil
+	}()
+
 	if len(h.profiles.slice) == 0 {
 		level.Info(h.logger).Log("msg", "head empty - no block written")
 		return os.RemoveAll(h.headPath)
@@ -19,6 +19,7 @@ import (
 	phlaremodel "github.com/grafana/phlare/pkg/model"
 	phlarecontext "github.com/grafana/phlare/pkg/phlare/context"
 	"github.com/grafana/phlare/pkg/pprof"
+	"github.com/grafana/phlare/pkg/validation"
 )
 
 func newTestHead(t testing.TB) *testHead {
@@ -374,3 +375,39 @@ func BenchmarkHeadIngestProfiles(t *testing.B) {
 		}
 	}
 }
+
+type mockHeadLimits struct {
+	maxSeries, maxProfilesPerSeriesPerMinute int
+}
+
+func (l *mockHeadLimits) MaxSeries() int                     { return l.maxSeries }
+func (l *mockHeadLimits) MaxProfilesPerSeriesPerMinute() int { return l.maxProfilesPerSeriesPerMinute }
+
+func TestHeadLimits(t *testing.T) {
+	ctx := phlarecontext.WithRegistry(context.Background(), prometheus.NewPedanticRegistry())
+	head, err := NewHead(ctx, Config{DataPath: t.TempDir(), Limits: &mockHeadLimits{maxSeries: 1, maxProfilesPerSeriesPerMinute: 2}})
+	require.NoError(t, err)
+
+	fooLabels := phlaremodel.NewLabelsBuilder(nil).Set("job", "foo").Labels()
+	barLabels := phlaremodel.NewLabelsBuilder(nil).Set("job", "bar").Labels()
+	ingest := func(lbs phlaremodel.Labels, ts time.Duration) error {
+		p := newProfileFoo()
+		p.TimeNanos = int64(ts)
+		return head.Ingest(context.Background(), p, uuid.New(), lbs...)
+	}
+
+	require.NoError(t, ingest(fooLabels, 0))
+	require.NoError(t, ingest(fooLabels, 10*time.Second))
+	// The series has reached its profiles per minute.
+	err = ingest(fooLabels, 20*time.Second)
+	require.Error(t, err)
+	require.Equal(t, validation.ProfilesPerSeriesLimit, validation.ReasonOf(err))
+	// The next minute is accepted.
+	require.NoError(t, ingest(fooLabels, time.Minute))
+
+	// The tenant has reached its series limit.
+	err = ingest(barLabels, time.Minute)
+	require.Error(t, err)
+	require.Equal(t, validation.SeriesLimit, validation.ReasonOf(err))
+	require.Equal(t, uint64(1), head.NumSeries())
+}
@@ -0,0 +1,317 @@
+package phlaredb
+
+import (
+	"context"
+	"sort"
+
+	"github.com/gogo/status"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql/parser"
+	"github.com/prometheus/prometheus/storage"
+	"github.com/samber/lo"
+	"google.golang.org/grpc/codes"
+
+	commonv1 "github.com/grafana/phlare/pkg/gen/common/v1"
+	ingestv1 "github.com/grafana/phlare/pkg/gen/ingester/v1"
+	phlaremodel "github.com/grafana/phlare/pkg/model"
+	"github.com/grafana/phlare/pkg/phlaredb/tsdb/index"
+)
+
+// timeRange returns the time range of a labels request, the end is unbounded
+// when 0.
+func timeRange(start, end int64) (model.Time, model.Time) {
+	if end == 0 {
+		return model.Time(start), model.Latest
+	}
+	return model.Time(start), model.Time(end)
+}
+
+// parseSelectors parses the label selectors of a labels request, a single
+// selector matching all series is returned when there are none.
+func parseSelectors(matchers []string) ([][]*labels.Matcher, error) {
+	if len(matchers) == 0 {
+		return [][]*labels.Matcher{nil}, nil
+	}
+	selectors := make([][]*labels.Matcher, 0, len(matchers))
+	for _, m := range matchers {
+		s, err := parser.ParseMetricSelector(m)
+		if err != nil {
+			return nil, status.Error(codes.InvalidArgument, "failed to parse label selectors: "+err.Error())
+		}
+		selectors = append(selectors, s)
+	}
+	return selectors, nil
+}
+
+// forMatchingSeries calls fn once for each series of the queriers matching
+// any of the selectors within the time range.
+func (queriers Queriers) forMatchingSeries(ctx context.Context, matchers []string, start, end model.Time, fn func(lbs phlaremodel.Labels) error) error {
+	selectors, err := parseSelectors(matchers)
+	if err != nil {
+		return err
+	}
+	seen := map[model.Fingerprint]struct{}{}
+	for _, q := range queriers {
+		for _, selector := range selectors {
+			if err := q.forMatchingSeries(ctx, selector, start, end, func(lbs phlaremodel.Labels, fp model.Fingerprint) error {
+				if _, ok := seen[fp]; ok {
+					return nil
+				}
+				seen[fp] = struct{}{}
+				return fn(lbs)
+			}); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// LabelValues returns the values of the label of the series matching the request.
+func (queriers Queriers) LabelValues(ctx context.Context, req *ingestv1.LabelValuesRequest) (*ingestv1.LabelValuesResponse, error) {
+	start, end := timeRange(req.Start, req.End)
+	selectors, err := parseSelectors(req.Matchers)
+	if err != nil {
+		return nil, err
+	}
+	values := map[string]struct{}{}
+	for _, q := range queriers {
+		for _, selector := range selectors {
+			vs, err := q.labelValues(ctx, req.Name, selector, start, end)
+			if err != nil {
+				return nil, err
+			}
+			for _, v := range vs {
+				if v != "" {
+					values[v] = struct{}{}
+				}
+			}
+		}
+	}
+	return &ingestv1.LabelValuesResponse{Names: sortedKeys(values)}, nil
+}
+
+// LabelNames returns the label names of the series matching the request.
+func (queriers Queriers) LabelNames(ctx context.Context, req *ingestv1.LabelNamesRequest) (*ingestv1.LabelNamesResponse, error) {
+	start, end := timeRange(req.Start, req.End)
+	selectors, err := parseSelectors(req.Matchers)
+	if err != nil {
+		return nil, err
+	}
+	names := map[string]struct{}{}
+	for _, q := range queriers {
+		for _, selector := range selectors {
+			ns, err := q.labelNames(ctx, selector, start, end)
+			if err != nil {
+				return nil, err
+			}
+			for _, n := range ns {
+				names[n] = struct{}{}
+			}
+		}
+	}
+	return &ingestv1.LabelNamesResponse{Names: sortedKeys(names)}, nil
+}
+
+// ProfileTypes returns the profile types of the series within the time range of the request.
+func (queriers Queriers) ProfileTypes(ctx context.Context, req *ingestv1.ProfileTypesRequest) (*ingestv1.ProfileTypesResponse, error) {
+	values, err := queriers.LabelValues(ctx, &ingestv1.LabelValuesRequest{
+		Name:  phlaremodel.LabelNameProfileType,
+		Start: req.Start,
+		End:   req.End,
+	})
+	if err != nil {
+		return nil, err
+	}
+	profileTypes := make([]*commonv1.ProfileType, len(values.Names))
+	for i, v := range values.Names {
+		tp, err := phlaremodel.ParseProfileTypeSelector(v)
+		if err != nil {
+			return nil, err
+		}
+		profileTypes[i] = tp
+	}
+	return &ingestv1.ProfileTypesResponse{ProfileTypes: profileTypes}, nil
+}
+
+// Series returns the labels of the series matching the request.
+func (queriers Queriers) Series(ctx context.Context, req *ingestv1.SeriesRequest) (*ingestv1.SeriesResponse, error) {
+	start, end := timeRange(req.Start, req.End)
+	response := &ingestv1.SeriesResponse{}
+	if err := queriers.forMatchingSeries(ctx, req.Matchers, start, end, func(lbs phlaremodel.Labels) error {
+		response.LabelsSet = append(response.LabelsSet, &commonv1.Labels{Labels: lbs})
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	sort.Slice(response.LabelsSet, func(i, j int) bool {
+		return phlaremodel.CompareLabelPairs(response.LabelsSet[i].Labels, response.LabelsSet[j].Labels) < 0
+	})
+	return response, nil
+}
+
+func sortedKeys(m map[string]struct{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// forMatchingSeries calls fn for each series of the block matching the
+// matchers. The time range is only checked for the whole block.
+func (b *singleBlockQuerier) forMatchingSeries(ctx context.Context, matchers []*labels.Matcher, start, end model.Time, fn func(lbs phlaremodel.Labels, fp model.Fingerprint) error) error {
+	postings, err := b.matchingPostings(ctx, matchers, start, end)
+	if err != nil || postings == nil {
+		return err
+	}
+	chks := make([]index.ChunkMeta, 1)
+	for postings.Next() {
+		lbls := make(phlaremodel.Labels, 0, 6)
+		fp, err := b.index.Series(postings.At(), &lbls, &chks)
+		if err != nil {
+			return err
+		}
+		if err := fn(lbls, model.Fingerprint(fp)); err != nil {
+			return err
+		}
+	}
+	return postings.Err()
+}
+
+// matchingPostings returns the postings of the series of the block matching
+// the matchers, or nil if the block is not within the time range.
+func (b *singleBlockQuerier) matchingPostings(ctx context.Context, matchers []*labels.Matcher, start, end model.Time) (index.Postings, error) {
+	if !b.InRange(start, end) {
+		return nil, nil
+	}
+	if err := b.open(ctx); err != nil {
+		return nil, err
+	}
+	if len(matchers) == 0 {
+		k, v := index.AllPostingsKey()
+		return b.index.Postings(k, nil, v)
+	}
+	return PostingsForMatchers(b.index, nil, matchers...)
+}
+
+// labelValues returns the values of the label in the block. With matchers,
+// only the values whose postings intersect the postings of the matching
+// series are returned, the labels of the series are not read.
+func (b *singleBlockQuerier) labelValues(ctx context.Context, name string, matchers []*labels.Matcher, start, end model.Time) ([]string, error) {
+	if len(matchers) == 0 {
+		if !b.InRange(start, end) {
+			return nil, nil
+		}
+		if err := b.open(ctx); err != nil {
+			return nil, err
+		}
+		return b.index.LabelValues(name)
+	}
+	postings, err := b.matchingPostings(ctx, matchers, start, end)
+	if err != nil || postings == nil {
+		return nil, err
+	}
+	matching := map[storage.SeriesRef]struct{}{}
+	for postings.Next() {
+		matching[postings.At()] = struct{}{}
+	}
+	if err := postings.Err(); err != nil || len(matching) == 0 {
+		return nil, err
+	}
+	values, err := b.index.LabelValues(name)
+	if err != nil {
+		return nil, err
+	}
+	result := values[:0]
+	for _, v := range values {
+		p, err := b.index.Postings(name, nil, v)
+		if err != nil {
+			return nil, err
+		}
+		for p.Next() {
+			if _, ok := matching[p.At()]; ok {
+				result = append(result, v)
+				break
+			}
+		}
+		if err := p.Err(); err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+// labelNames returns the label names of the block. With matchers, only the
+// names of the matching series are returned.
+func (b *singleBlockQuerier) labelNames(ctx context.Context, matchers []*labels.Matcher, start, end model.Time) ([]string, error) {
+	if len(matchers) == 0 {
+		if !b.InRange(start, end) {
+			return nil, nil
+		}
+		if err := b.open(ctx); err != nil {
+			return nil, err
+		}
+		return b.index.LabelNames()
+	}
+	postings, err := b.matchingPostings(ctx, matchers, start, end)
+	if err != nil || postings == nil {
+		return nil, err
+	}
+	refs, err := index.ExpandPostings(postings)
+	if err != nil || len(refs) == 0 {
+		return nil, err
+	}
+	return b.index.LabelNamesFor(refs...)
+}
+
+// forMatchingSeries calls fn for each series of the head matching the
+// matchers. The time range is only checked for the whole head.
+func (h *Head) forMatchingSeries(ctx context.Context, matchers []*labels.Matcher, start, end model.Time, fn func(lbs phlaremodel.Labels, fp model.Fingerprint) error) error {
+	if !h.InRange(start, end) {
+		return nil
+	}
+	return h.index.forMatchingLabels(matchers, fn)
+}
+
+// labelValues returns the values of the label in the head, looked up in its
+// inverted index when there are no matchers.
+func (h *Head) labelValues(ctx context.Context, name string, matchers []*labels.Matcher, start, end model.Time) ([]string, error) {
+	if !h.InRange(start, end) {
+		return nil, nil
+	}
+	if len(matchers) == 0 {
+		return h.index.ix.LabelValues(name, nil)
+	}
+	values := map[string]struct{}{}
+	if err := h.index.forMatchingLabels(matchers, func(lbs phlaremodel.Labels, _ model.Fingerprint) error {
+		values[lbs.Get(name)] = struct{}{}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return lo.Keys(values), nil
+}
+
+// labelNames returns the label names of the head, looked up in its inverted
+// index when there are no matchers.
+func (h *Head) labelNames(ctx context.Context, matchers []*labels.Matcher, start, end model.Time) ([]string, error) {
+	if !h.InRange(start, end) {
+		return nil, nil
+	}
+	if len(matchers) == 0 {
+		return h.index.ix.LabelNames(nil)
+	}
+	names := map[string]struct{}{}
+	if err := h.index.forMatchingLabels(matchers, func(lbs phlaremodel.Labels, _ model.Fingerprint) error {
+		for _, l := range lbs {
+			names[l.Name] = struct{}{}
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return lo.Keys(names), nil
+}
@@ -0,0 +1,109 @@
+package phlaredb
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/common/model"
+
+	"github.com/grafana/phlare/pkg/validation"
+)
+
+// HeadLimits are the limits enforced when ingesting profiles in the head.
+type HeadLimits interface {
+	// MaxSeries returns the maximum number of series in the head, 0 means unlimited.
+	MaxSeries() int
+	// MaxProfilesPerSeriesPerMinute returns the maximum number of profiles of a
+	// series per minute, 0 means unlimited.
+	MaxProfilesPerSeriesPerMinute() int
+}
+
+// checkLimits returns an error if ingesting a profile at timeNanos in the
+// given series would exceed the profiles per series per minute limit. The
+// series limit is enforced by the seriesLimiter.
+func (pi *profilesIndex) checkLimits(limits HeadLimits, fps []model.Fingerprint, timeNanos int64) error {
+	if limits == nil {
+		return nil
+	}
+	maxProfiles := limits.MaxProfilesPerSeriesPerMinute()
+	if maxProfiles <= 0 {
+		return nil
+	}
+	minute := timeNanos / int64(time.Minute)
+
+	pi.mutex.RLock()
+	defer pi.mutex.RUnlock()
+	for _, fp := range fps {
+		profiles, ok := pi.profilesPerFP[fp]
+		if ok && profiles.minute == minute && profiles.profilesInMinute >= maxProfiles {
+			return validation.NewErrorf(validation.ProfilesPerSeriesLimit, "per-series profiles limit of %d per minute exceeded for series %s", maxProfiles, profiles.lbs.ToPrometheusLabels().String())
+		}
+	}
+	return nil
+}
+
+// seriesLimiter counts the series of all the heads of a tenant which are not
+// flushed yet, so that the series limit doesn't reset when a head is cut. A
+// series is counted once, as long as any of the heads holds it.
+type seriesLimiter struct {
+	mtx sync.Mutex
+	// series is the number of heads holding each series.
+	series map[model.Fingerprint]int
+	// heads are the series reserved by each head.
+	heads map[*Head]map[model.Fingerprint]struct{}
+}
+
+func newSeriesLimiter() *seriesLimiter {
+	return &seriesLimiter{
+		series: map[model.Fingerprint]int{},
+		heads:  map[*Head]map[model.Fingerprint]struct{}{},
+	}
+}
+
+// reserve reserves the series of a profile in the head before it is
+// ingested. It returns an error, reserving nothing, if the new series would
+// exceed maxSeries.
+func (l *seriesLimiter) reserve(h *Head, fps []model.Fingerprint, maxSeries int) error {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	reserved := l.heads[h]
+	newSeries := 0
+	for _, fp := range fps {
+		if _, ok := reserved[fp]; !ok && l.series[fp] == 0 {
+			newSeries++
+		}
+	}
+	if maxSeries > 0 && newSeries > 0 && len(l.series)+newSeries > maxSeries {
+		return validation.NewErrorf(validation.SeriesLimit, "per-tenant series limit of %d exceeded, %d series are active", maxSeries, len(l.series))
+	}
+	if reserved == nil {
+		reserved = make(map[model.Fingerprint]struct{}, len(fps))
+		l.heads[h] = reserved
+	}
+	for _, fp := range fps {
+		if _, ok := reserved[fp]; !ok {
+			reserved[fp] = struct{}{}
+			l.series[fp]++
+		}
+	}
+	return nil
+}
+
+// numSeries returns the number of series the limit is enforced against.
+func (l *seriesLimiter) numSeries() int {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	return len(l.series)
+}
+
+// release releases the series of the head, once it is flushed.
+func (l *seriesLimiter) release(h *Head) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	for fp := range l.heads[h] {
+		if l.series[fp]--; l.series[fp] <= 0 {
+			delete(l.series, fp)
+		}
+	}
+	delete(l.heads, h)
+}
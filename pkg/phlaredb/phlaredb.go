@@ -36,6 +36,7 @@ import (
 	phlarecontext "github.com/grafana/phlare/pkg/phlare/context"
 	"github.com/grafana/phlare/pkg/phlaredb/block"
 	diskutil "github.com/grafana/phlare/pkg/util/disk"
+	"github.com/grafana/phlare/pkg/util/querystats"
 )
 
 const (
@@ -47,8 +48,15 @@ type Config struct {
 	DataPath string `yaml:"data_path,omitempty"`
 	// Blocks are generally cut once they reach 1000M of memory size, this will setup an upper limit to the duration of data that a block has that is cut by the ingester.
 	MaxBlockDuration time.Duration `yaml:"max_block_duration,omitempty"`
+	// Heads are aligned to fixed windows on the clock, so the blocks of all the ingesters cover the same time ranges.
+	BlockAlignment   time.Duration `yaml:"block_alignment,omitempty"`
+	OutOfOrderWindow time.Duration `yaml:"out_of_order_window,omitempty"`
 
 	Parquet *ParquetConfig `yaml:"-"` // Those configs should not be exposed to the user, rather they should be determiend by phlare itself. Currently they are solely used for test cases
+
+	Limits HeadLimits `yaml:"-"` // Limits of the tenant enforced when ingesting profiles, set by the ingester.
+
+	FunctionTracker FunctionTracker `yaml:"-"` // Tracks the values of the functions of the tenant in the ingested profiles, set by the ingester.
 }
 
 type ParquetConfig struct {
@@ -60,6 +68,18 @@ type ParquetConfig struct {
 func (cfg *Config) RegisterFlags(f *flag.FlagSet) {
 	f.StringVar(&cfg.DataPath, "phlaredb.data-path", "./data", "Directory used for local storage.")
 	f.DurationVar(&cfg.MaxBlockDuration, "phlaredb.max-block-duration", 3*time.Hour, "Upper limit to the duration of a Phlare block.")
+	f.DurationVar(&cfg.BlockAlignment, "phlaredb.block-alignment", 0, "Align the head blocks to fixed windows of this duration on the clock, e.g. 1h. Profiles are ingested in the head of the window of their timestamp, and heads are flushed once their window is over. 0 to disable.")
+	f.DurationVar(&cfg.OutOfOrderWindow, "phlaredb.out-of-order-window", 5*time.Minute, "Duration after the end of an aligned window during which late profiles are still accepted in its head. Older profiles are rejected. Only used when block alignment is enabled.")
+}
+
+func (cfg *Config) Validate() error {
+	if cfg.BlockAlignment < 0 || cfg.OutOfOrderWindow < 0 {
+		return errors.New("block alignment and out-of-order window must not be negative")
+	}
+	if cfg.BlockAlignment > 0 && cfg.OutOfOrderWindow >= cfg.BlockAlignment {
+		return fmt.Errorf("out-of-order window (%s) must be shorter than the block alignment (%s)", cfg.OutOfOrderWindow, cfg.BlockAlignment)
+	}
+	return nil
 }
 
 type fileSystem interface {
@@ -85,6 +105,18 @@ type PhlareDB struct {
 
 	headLock sync.RWMutex
 	head     *Head
+	// With block alignment, headWindow is the start of the window of the
+	// head, and previousHead receives the late profiles of the previous
+	// window until the out-of-order window is over.
+	headWindow   time.Time
+	previousHead *Head
+	// pendingHeads are the heads cut and waiting to be flushed, they are
+	// still queried until then.
+	pendingHeads []*Head
+	// seriesLimiter enforces the series limit across all the heads.
+	seriesLimiter *seriesLimiter
+	flushLock     sync.Mutex
+	now           func() time.Time
 
 	volumeChecker diskutil.VolumeChecker
 	fs            fileSystem
@@ -108,7 +140,9 @@ func New(phlarectx context.Context, cfg Config) (*PhlareDB, error) {
 			minFreeDisk,
 			minDiskAvailablePercentage,
 		),
-		fs: &realFileSystem{},
+		fs:            &realFileSystem{},
+		now:           time.Now,
+		seriesLimiter: newSeriesLimiter(),
 	}
 	if err := os.MkdirAll(f.LocalDataPath(), 0o777); err != nil {
 		return nil, fmt.Errorf("mkdir %s: %w", f.LocalDataPath(), err)
@@ -248,6 +282,13 @@ func (f *PhlareDB) runBlockQuerierSync(ctx context.Context) {
 
 func (f *PhlareDB) loop() {
 	blockScanTicker := time.NewTicker(5 * time.Minute)
+	// alignedHeadsTicker is only used with block alignment.
+	var alignedHeadsTick <-chan time.Time
+	if f.cfg.BlockAlignment > 0 {
+		alignedHeadsTicker := time.NewTicker(5 * time.Second)
+		defer alignedHeadsTicker.Stop()
+		alignedHeadsTick = alignedHeadsTicker.C
+	}
 	defer func() {
 		blockScanTicker.Stop()
 		f.wg.Done()
@@ -260,7 +301,20 @@ func (f *PhlareDB) loop() {
 		case <-f.stopCh:
 			return
 		case <-f.Head().flushCh:
-			if err := f.Flush(ctx); err != nil {
+			if err := f.cutHeads(false); err != nil {
+				level.Error(f.logger).Log("msg", "cutting head block failed", "err", err)
+				continue
+			}
+			if err := f.flushPendingHeads(ctx); err != nil {
+				level.Error(f.logger).Log("msg", "flushing head block failed", "err", err)
+				continue
+			}
+			f.runBlockQuerierSync(ctx)
+		case <-alignedHeadsTick:
+			if !f.closeAlignedHeads() {
+				continue
+			}
+			if err := f.flushPendingHeads(ctx); err != nil {
 				level.Error(f.logger).Log("msg", "flushing head block failed", "err", err)
 				continue
 			}
@@ -276,6 +330,12 @@ func (f *PhlareDB) Close() error {
 	if f.head != nil {
 		errs.Add(f.head.Close())
 	}
+	if f.previousHead != nil {
+		errs.Add(f.previousHead.Close())
+	}
+	for _, h := range f.pendingHeads {
+		errs.Add(h.Close())
+	}
 	close(f.stopCh)
 	f.wg.Wait()
 	if err := f.blockQuerier.Close(); err != nil {
@@ -294,13 +354,84 @@ type Queriers []Querier
 
 func (f *PhlareDB) querierFor(start, end model.Time) Queriers {
 	blocks := f.blockQuerier.queriersFor(start, end)
-	if f.Head().InRange(start, end) {
-		res := make(Queriers, 0, len(blocks)+1)
-		res = append(res, f.Head())
-		res = append(res, blocks...)
-		return res
+	var res Queriers
+	for _, h := range f.heads() {
+		if h.InRange(start, end) {
+			res = append(res, h)
+		}
+	}
+	if len(res) == 0 {
+		return blocks
+	}
+	return append(res, blocks...)
+}
+
+// LabelValues returns the label values of the series of the heads and the
+// blocks matching the request.
+func (f *PhlareDB) LabelValues(ctx context.Context, req *connect.Request[ingestv1.LabelValuesRequest]) (*connect.Response[ingestv1.LabelValuesResponse], error) {
+	res, err := f.querierFor(timeRange(req.Msg.Start, req.Msg.End)).LabelValues(ctx, req.Msg)
+	if err != nil {
+		return nil, err
+	}
+	return connect.NewResponse(res), nil
+}
+
+// LabelNames returns the label names of the series of the heads and the
+// blocks matching the request.
+func (f *PhlareDB) LabelNames(ctx context.Context, req *connect.Request[ingestv1.LabelNamesRequest]) (*connect.Response[ingestv1.LabelNamesResponse], error) {
+	res, err := f.querierFor(timeRange(req.Msg.Start, req.Msg.End)).LabelNames(ctx, req.Msg)
+	if err != nil {
+		return nil, err
+	}
+	return connect.NewResponse(res), nil
+}
+
+// ProfileTypes returns the profile types of the heads and the blocks within
+// the time range of the request.
+func (f *PhlareDB) ProfileTypes(ctx context.Context, req *connect.Request[ingestv1.ProfileTypesRequest]) (*connect.Response[ingestv1.ProfileTypesResponse], error) {
+	res, err := f.querierFor(timeRange(req.Msg.Start, req.Msg.End)).ProfileTypes(ctx, req.Msg)
+	if err != nil {
+		return nil, err
+	}
+	return connect.NewResponse(res), nil
+}
+
+// Series returns the labels of the series of the heads and the blocks
+// matching the request.
+func (f *PhlareDB) Series(ctx context.Context, req *connect.Request[ingestv1.SeriesRequest]) (*connect.Response[ingestv1.SeriesResponse], error) {
+	res, err := f.querierFor(timeRange(req.Msg.Start, req.Msg.End)).Series(ctx, req.Msg)
+	if err != nil {
+		return nil, err
+	}
+	return connect.NewResponse(res), nil
+}
+
+// HeadsSize returns the size in bytes of all the heads which are not flushed
+// yet.
+func (f *PhlareDB) HeadsSize() uint64 {
+	var size uint64
+	for _, h := range f.heads() {
+		size += h.Size()
+	}
+	return size
+}
+
+// NumSeries returns the number of series of all the heads which are not
+// flushed yet, as counted by the series limit.
+func (f *PhlareDB) NumSeries() uint64 {
+	return uint64(f.seriesLimiter.numSeries())
+}
+
+// heads returns all the heads which are not flushed yet.
+func (f *PhlareDB) heads() []*Head {
+	f.headLock.RLock()
+	defer f.headLock.RUnlock()
+	heads := make([]*Head, 0, len(f.pendingHeads)+2)
+	heads = append(heads, f.head)
+	if f.previousHead != nil {
+		heads = append(heads, f.previousHead)
 	}
-	return blocks
+	return append(heads, f.pendingHeads...)
 }
 
 func (f *PhlareDB) MergeProfilesStacktraces(ctx context.Context, stream *connect.BidiStream[ingestv1.MergeProfilesStacktracesRequest, ingestv1.MergeProfilesStacktracesResponse]) error {
@@ -319,16 +450,22 @@ func (f *PhlareDB) MergeProfilesStacktraces(ctx context.Context, stream *connect
 		return connect.NewError(connect.CodeInvalidArgument, errors.New("missing initial select request"))
 	}
 	request := r.Request
+	by := r.By
+	sort.Strings(by)
 	sp.LogFields(
 		otlog.String("start", model.Time(request.Start).Time().String()),
 		otlog.String("end", model.Time(request.End).Time().String()),
 		otlog.String("selector", request.LabelSelector),
 		otlog.String("profile_id", request.Type.ID),
+		otlog.String("by", strings.Join(by, ",")),
 	)
 
 	queriers := f.querierFor(model.Time(request.Start), model.Time(request.End))
+	st := querystats.FromContext(ctx)
+	st.AddBlocksQueried(len(queriers))
 
-	result := make([]*ingestv1.MergeProfilesStacktracesResult, 0, len(queriers))
+	// The merges of each group of profiles, from all queriers.
+	groups := make(map[uint64]*stacktracesGroup)
 	var lock sync.Mutex
 	g, ctx := errgroup.WithContext(ctx)
 
@@ -352,13 +489,18 @@ func (f *PhlareDB) MergeProfilesStacktraces(ctx context.Context, stream *connect
 		selectedProfiles = q.Sort(selectedProfiles)
 		// Merge async the result so we can continue streaming profiles.
 		g.Go(func() error {
-			merge, err := q.MergeByStacktraces(ctx, iter.NewSliceIterator(selectedProfiles))
-			if err != nil {
-				return err
+			for _, group := range groupProfiles(selectedProfiles, by) {
+				merge, err := q.MergeByStacktraces(ctx, iter.NewSliceIterator(group.profiles))
+				if err != nil {
+					return err
+				}
+				lock.Lock()
+				if _, ok := groups[group.hash]; !ok {
+					groups[group.hash] = &stacktracesGroup{labels: group.labels}
+				}
+				groups[group.hash].results = append(groups[group.hash].results, merge)
+				lock.Unlock()
 			}
-			lock.Lock()
-			defer lock.Unlock()
-			result = append(result, merge)
 			return nil
 		})
 	}
@@ -374,9 +516,27 @@ func (f *PhlareDB) MergeProfilesStacktraces(ctx context.Context, stream *connect
 	}
 
 	// sends the final result to the client.
-	err = stream.Send(&ingestv1.MergeProfilesStacktracesResponse{
-		Result: phlaremodel.MergeBatchMergeStacktraces(result...),
-	})
+	res := &ingestv1.MergeProfilesStacktracesResponse{
+		Stats: st.Proto(),
+	}
+	if len(by) == 0 {
+		var results []*ingestv1.MergeProfilesStacktracesResult
+		for _, group := range groups {
+			results = append(results, group.results...)
+		}
+		res.Result = phlaremodel.MergeBatchMergeStacktraces(results...)
+	} else {
+		res.Groups = make([]*ingestv1.MergeProfilesStacktracesResult, 0, len(groups))
+		for _, group := range groups {
+			merge := phlaremodel.MergeBatchMergeStacktraces(group.results...)
+			merge.Labels = group.labels
+			res.Groups = append(res.Groups, merge)
+		}
+		sort.Slice(res.Groups, func(i, j int) bool {
+			return phlaremodel.CompareLabelPairs(res.Groups[i].Labels, res.Groups[j].Labels) < 0
+		})
+	}
+	err = stream.Send(res)
 	if err != nil {
 		if errors.Is(err, io.EOF) {
 			return connect.NewError(connect.CodeCanceled, errors.New("client closed stream"))
@@ -387,6 +547,43 @@ func (f *PhlareDB) MergeProfilesStacktraces(ctx context.Context, stream *connect
 	return nil
 }
 
+// stacktracesGroup is the merges of the stacktraces of a group of profiles.
+type stacktracesGroup struct {
+	labels  phlaremodel.Labels
+	results []*ingestv1.MergeProfilesStacktracesResult
+}
+
+// profilesGroup is a group of profiles with the same values for the labels they are grouped by.
+type profilesGroup struct {
+	hash     uint64
+	labels   phlaremodel.Labels
+	profiles []Profile
+}
+
+// groupProfiles groups the profiles by the given labels, keeping their order within each group.
+// Profiles are all in the same group when they are not grouped by any label.
+func groupProfiles(profiles []Profile, by []string) []*profilesGroup {
+	if len(by) == 0 {
+		return []*profilesGroup{{profiles: profiles}}
+	}
+	var (
+		result []*profilesGroup
+		groups = make(map[uint64]*profilesGroup)
+	)
+	for _, p := range profiles {
+		lbs := p.Labels().WithLabels(by...)
+		hash := lbs.Hash()
+		group, ok := groups[hash]
+		if !ok {
+			group = &profilesGroup{hash: hash, labels: lbs}
+			groups[hash] = group
+			result = append(result, group)
+		}
+		group.profiles = append(group.profiles, p)
+	}
+	return result
+}
+
 func (f *PhlareDB) MergeProfilesLabels(ctx context.Context, stream *connect.BidiStream[ingestv1.MergeProfilesLabelsRequest, ingestv1.MergeProfilesLabelsResponse]) error {
 	sp, ctx := opentracing.StartSpanFromContext(ctx, "MergeProfilesLabels")
 	defer sp.Finish()
@@ -405,16 +602,28 @@ func (f *PhlareDB) MergeProfilesLabels(ctx context.Context, stream *connect.Bidi
 	request := r.Request
 	by := r.By
 	sort.Strings(by)
+	agg := SeriesAggregation{
+		Type:  r.Aggregation,
+		Step:  time.Duration(r.Step * float64(time.Second)),
+		Start: request.Start,
+		End:   request.End,
+	}
+	// The first point aggregates the profiles from the start of the request to the first step.
+	agg.Start += agg.Step.Milliseconds()
 	sp.LogFields(
 		otlog.String("start", model.Time(request.Start).Time().String()),
 		otlog.String("end", model.Time(request.End).Time().String()),
 		otlog.String("selector", request.LabelSelector),
 		otlog.String("profile_id", request.Type.ID),
 		otlog.String("by", strings.Join(by, ",")),
+		otlog.String("aggregation", agg.Type.String()),
+		otlog.Int64("step_ms", agg.Step.Milliseconds()),
 	)
 
 	queriers := f.querierFor(model.Time(request.Start), model.Time(request.End))
-	result := make([][]*commonv1.Series, 0, len(queriers))
+	st := querystats.FromContext(ctx)
+	st.AddBlocksQueried(len(queriers))
+	result := agg.newAggregator()
 	g, ctx := errgroup.WithContext(ctx)
 	s := lo.Synchronize()
 	// Start streaming profiles from all stores in order.
@@ -437,12 +646,12 @@ func (f *PhlareDB) MergeProfilesLabels(ctx context.Context, stream *connect.Bidi
 		selectedProfiles = q.Sort(selectedProfiles)
 		// Merge async the result so we can continue streaming profiles.
 		g.Go(func() error {
-			merge, err := q.MergeByLabels(ctx, iter.NewSliceIterator(selectedProfiles), by...)
+			merge, err := q.MergeByLabels(ctx, iter.NewSliceIterator(selectedProfiles), agg, by...)
 			if err != nil {
 				return err
 			}
 			s.Do(func() {
-				result = append(result, merge)
+				result.Merge(merge.Series())
 			})
 
 			return nil
@@ -460,8 +669,11 @@ func (f *PhlareDB) MergeProfilesLabels(ctx context.Context, stream *connect.Bidi
 	}
 
 	// sends the final result to the client.
+	series, counts := result.Series()
 	err = stream.Send(&ingestv1.MergeProfilesLabelsResponse{
-		Series: phlaremodel.MergeSeries(result...),
+		Series: series,
+		Counts: counts,
+		Stats:  st.Proto(),
 	})
 	if err != nil {
 		if errors.Is(err, io.EOF) {
@@ -581,25 +793,75 @@ func filterProfiles[B BidiServerMerge[Res, Req],
 	return selection, nil
 }
 
+// newHead returns a new head sharing the series limiter of the other heads.
+func (f *PhlareDB) newHead() (*Head, error) {
+	h, err := NewHead(f.phlarectx, f.cfg)
+	if err != nil {
+		return nil, err
+	}
+	h.seriesLimiter = f.seriesLimiter
+	return h, nil
+}
+
 func (f *PhlareDB) initHead() (oldHead *Head, err error) {
 	f.headLock.Lock()
 	defer f.headLock.Unlock()
 	oldHead = f.head
-	f.head, err = NewHead(f.phlarectx, f.cfg)
+	f.head, err = f.newHead()
 	if err != nil {
 		return oldHead, err
 	}
+	if f.cfg.BlockAlignment > 0 {
+		f.headWindow = f.now().Truncate(f.cfg.BlockAlignment)
+	}
 	return oldHead, nil
 }
 
-func (f *PhlareDB) Flush(ctx context.Context) error {
-	oldHead, err := f.initHead()
+// cutHeads replaces the head by a new one, and queues the old head to be
+// flushed. The previous head of the aligned windows is also queued when
+// previous is true.
+func (f *PhlareDB) cutHeads(previous bool) error {
+	f.headLock.Lock()
+	defer f.headLock.Unlock()
+	head, err := f.newHead()
 	if err != nil {
 		return err
 	}
+	f.pendingHeads = append(f.pendingHeads, f.head)
+	f.head = head
+	if previous && f.previousHead != nil {
+		f.pendingHeads = append(f.pendingHeads, f.previousHead)
+		f.previousHead = nil
+	}
+	return nil
+}
 
-	if oldHead == nil {
-		return nil
+// flushPendingHeads flushes the heads which have been cut, in order.
+func (f *PhlareDB) flushPendingHeads(ctx context.Context) error {
+	f.flushLock.Lock()
+	defer f.flushLock.Unlock()
+
+	f.headLock.RLock()
+	pending := append([]*Head(nil), f.pendingHeads...)
+	f.headLock.RUnlock()
+
+	for _, h := range pending {
+		// A head which failed to flush is kept, it is still queried and its
+		// flush is retried from the start with the next flush.
+		if err := h.Flush(ctx); err != nil {
+			return err
+		}
+		f.headLock.Lock()
+		f.pendingHeads = lo.Without(f.pendingHeads, h)
+		f.headLock.Unlock()
+		f.seriesLimiter.release(h)
+	}
+	return nil
+}
+
+func (f *PhlareDB) Flush(ctx context.Context) error {
+	if err := f.cutHeads(true); err != nil {
+		return err
 	}
-	return oldHead.Flush(ctx)
+	return f.flushPendingHeads(ctx)
 }
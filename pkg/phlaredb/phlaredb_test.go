@@ -8,7 +8,10 @@ import (
 	"io/ioutil"
 	"net/http"
 	"os"
+	"path/filepath"
+	"sort"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -20,6 +23,7 @@ import (
 	"github.com/samber/lo"
 	"github.com/stretchr/testify/mock"
 	"github.com/stretchr/testify/require"
+	"go.uber.org/atomic"
 	"go.uber.org/goleak"
 
 	commonv1 "github.com/grafana/phlare/pkg/gen/common/v1"
@@ -32,6 +36,7 @@ import (
 	schemav1 "github.com/grafana/phlare/pkg/phlaredb/schemas/v1"
 	"github.com/grafana/phlare/pkg/testhelper"
 	diskutil "github.com/grafana/phlare/pkg/util/disk"
+	"github.com/grafana/phlare/pkg/validation"
 )
 
 func TestCreateLocalDir(t *testing.T) {
@@ -149,6 +154,10 @@ func TestMergeProfilesStacktraces(t *testing.T) {
 		&commonv1.LabelPair{Name: "namespace", Value: "my-namespace"},
 		&commonv1.LabelPair{Name: "pod", Value: "my-pod"},
 	)
+	ingestProfiles(t, db, cpuProfileGenerator, start.UnixNano(), end.UnixNano(), step,
+		&commonv1.LabelPair{Name: "namespace", Value: "my-namespace"},
+		&commonv1.LabelPair{Name: "pod", Value: "my-other-pod"},
+	)
 
 	// create client
 	ctx := context.Background()
@@ -189,6 +198,48 @@ func TestMergeProfilesStacktraces(t *testing.T) {
 		require.NotNil(t, resp.Result)
 		require.Len(t, resp.Result.Stacktraces, 48)
 		require.Len(t, resp.Result.FunctionNames, 247)
+		// the head is the only block queried.
+		require.Equal(t, int64(1), resp.Stats.GetBlocksQueried())
+	})
+
+	t.Run("group the stacktraces by pod", func(t *testing.T) {
+		bidi := client.MergeProfilesStacktraces(ctx)
+
+		require.NoError(t, bidi.Send(&ingestv1.MergeProfilesStacktracesRequest{
+			Request: &ingestv1.SelectProfilesRequest{
+				LabelSelector: `{namespace="my-namespace"}`,
+				Type:          mustParseProfileSelector(t, "process_cpu:cpu:nanoseconds:cpu:nanoseconds"),
+				Start:         start.UnixMilli(),
+				End:           end.UnixMilli(),
+			},
+			By: []string{"pod"},
+		}))
+
+		resp, err := bidi.Receive()
+		require.NoError(t, err)
+		require.Len(t, resp.SelectedProfiles.LabelsSets, 2)
+		require.Len(t, resp.SelectedProfiles.Profiles, 10)
+
+		require.NoError(t, bidi.Send(&ingestv1.MergeProfilesStacktracesRequest{
+			Profiles: lo.Times(10, func(int) bool { return true }),
+		}))
+
+		// expect empty resp to signal it is finished
+		resp, err = bidi.Receive()
+		require.NoError(t, err)
+		require.Nil(t, resp.Result)
+
+		// received a result per pod
+		resp, err = bidi.Receive()
+		require.NoError(t, err)
+		require.Nil(t, resp.Result)
+		require.Len(t, resp.Groups, 2)
+		require.Equal(t, phlaremodel.LabelsFromStrings("pod", "my-other-pod"), phlaremodel.Labels(resp.Groups[0].Labels))
+		require.Equal(t, phlaremodel.LabelsFromStrings("pod", "my-pod"), phlaremodel.Labels(resp.Groups[1].Labels))
+		for _, group := range resp.Groups {
+			require.Len(t, group.Stacktraces, 48)
+			require.Len(t, group.FunctionNames, 247)
+		}
 	})
 
 	t.Run("request non existing series", func(t *testing.T) {
@@ -494,3 +545,263 @@ func TestPhlareDB_cleanupBlocksWhenHighDiskUtilization(t *testing.T) {
 		})
 	}
 }
+
+func TestAlignedHeads(t *testing.T) {
+	db, err := New(context.Background(), Config{
+		DataPath:         t.TempDir(),
+		MaxBlockDuration: 3 * time.Hour,
+		BlockAlignment:   time.Hour,
+		OutOfOrderWindow: 5 * time.Minute,
+	})
+	require.NoError(t, err)
+	defer func() { require.NoError(t, db.Close()) }()
+
+	window := time.Now().Truncate(time.Hour).Add(2 * time.Hour)
+	clock := atomic.NewInt64(0)
+	setClock := func(d time.Duration) {
+		clock.Store(window.Add(d).UnixNano())
+		db.closeAlignedHeads()
+		require.NoError(t, db.flushPendingHeads(context.Background()))
+	}
+	db.headLock.Lock()
+	db.now = func() time.Time { return time.Unix(0, clock.Load()) }
+	db.headLock.Unlock()
+	ingest := func(d time.Duration) error {
+		p, name := cpuProfileGenerator(window.Add(d).UnixNano(), t)
+		return db.Ingest(context.Background(), p, uuid.New(), &commonv1.LabelPair{Name: model.MetricNameLabel, Value: name})
+	}
+
+	setClock(time.Minute)
+	require.NoError(t, ingest(10*time.Minute))
+	// Late profiles go in the previous head during the out-of-order window.
+	require.NoError(t, ingest(-10*time.Minute))
+	setClock(6 * time.Minute)
+	err = ingest(-10 * time.Minute)
+	require.Error(t, err)
+	require.Equal(t, validation.OutOfOrder, validation.ReasonOf(err))
+
+	// The head of the window keeps receiving late profiles after the window is over.
+	setClock(61 * time.Minute)
+	require.NoError(t, ingest(50*time.Minute))
+	require.NoError(t, ingest(62*time.Minute))
+	setClock(66 * time.Minute)
+	// Profiles ahead of the clock go to the head of the current window.
+	require.NoError(t, ingest(3*time.Hour))
+	require.Equal(t, window.Add(time.Hour), db.headWindow)
+
+	metas, err := db.BlockMetas(context.Background())
+	require.NoError(t, err)
+	require.Len(t, metas, 2)
+	sort.Slice(metas, func(i, j int) bool { return metas[i].MinTime < metas[j].MinTime })
+	require.Equal(t, model.TimeFromUnixNano(window.Add(-10*time.Minute).UnixNano()), metas[0].MinTime)
+	require.Equal(t, model.TimeFromUnixNano(window.Add(10*time.Minute).UnixNano()), metas[1].MinTime)
+	require.Equal(t, model.TimeFromUnixNano(window.Add(50*time.Minute).UnixNano()), metas[1].MaxTime)
+
+	// The head of the current window is flushed on demand.
+	require.NoError(t, db.Flush(context.Background()))
+	metas, err = db.BlockMetas(context.Background())
+	require.NoError(t, err)
+	require.Len(t, metas, 3)
+	require.Equal(t, model.TimeFromUnixNano(window.Add(3*time.Hour).UnixNano()), metas[2].MaxTime)
+}
+
+func TestFlushFailureKeepsHead(t *testing.T) {
+	ctx := context.Background()
+	db, err := New(ctx, Config{
+		DataPath:         t.TempDir(),
+		MaxBlockDuration: time.Hour,
+	})
+	require.NoError(t, err)
+	defer func() { require.NoError(t, db.Close()) }()
+
+	ingestProfiles(t, db, cpuProfileGenerator, int64(time.Minute), int64(time.Minute), time.Minute)
+	// The head can't be moved to its block directory.
+	head := db.Head()
+	require.NoError(t, os.MkdirAll(filepath.Join(head.localPath, "blocker"), defaultFolderMode))
+	require.Error(t, db.Flush(ctx))
+	require.Equal(t, []*Head{head}, db.pendingHeads)
+	require.Len(t, db.heads(), 2)
+
+	// The flush is retried from the start.
+	require.NoError(t, os.RemoveAll(head.localPath))
+	require.NoError(t, db.flushPendingHeads(ctx))
+	require.Empty(t, db.pendingHeads)
+
+	require.NoError(t, db.blockQuerier.Sync(ctx))
+	require.Len(t, db.blockQuerier.queriers, 1)
+	profiles, err := db.blockQuerier.queriers[0].SelectMatchingProfiles(ctx, &ingestv1.SelectProfilesRequest{
+		LabelSelector: `{}`,
+		Type: &commonv1.ProfileType{
+			Name:       "process_cpu",
+			SampleType: "cpu",
+			SampleUnit: "nanoseconds",
+			PeriodType: "cpu",
+			PeriodUnit: "nanoseconds",
+		},
+		Start: 0,
+		End:   int64(model.TimeFromUnixNano(int64(time.Hour))),
+	})
+	require.NoError(t, err)
+	stacktraces, err := db.blockQuerier.queriers[0].MergeByStacktraces(ctx, profiles)
+	require.NoError(t, err)
+	require.NotEmpty(t, stacktraces.Stacktraces)
+}
+
+func TestBlockSelectMillisecondBoundary(t *testing.T) {
+	ctx := context.Background()
+	db, err := New(ctx, Config{
+		DataPath:         t.TempDir(),
+		MaxBlockDuration: time.Hour,
+	})
+	require.NoError(t, err)
+	defer func() { require.NoError(t, db.Close()) }()
+
+	// The profile is in the last millisecond before the boundary.
+	boundary := model.TimeFromUnixNano(int64(10 * time.Minute))
+	ts := boundary.UnixNano() - int64(time.Millisecond) + int64(500*time.Microsecond)
+	ingestProfiles(t, db, cpuProfileGenerator, ts, ts, time.Minute)
+	require.NoError(t, db.Flush(ctx))
+	require.NoError(t, db.blockQuerier.Sync(ctx))
+	require.Len(t, db.blockQuerier.queriers, 1)
+
+	selectProfiles := func(start, end model.Time) int {
+		profiles, err := db.blockQuerier.queriers[0].SelectMatchingProfiles(ctx, &ingestv1.SelectProfilesRequest{
+			LabelSelector: `{}`,
+			Type: &commonv1.ProfileType{
+				Name:       "process_cpu",
+				SampleType: "cpu",
+				SampleUnit: "nanoseconds",
+				PeriodType: "cpu",
+				PeriodUnit: "nanoseconds",
+			},
+			Start: int64(start),
+			End:   int64(end),
+		})
+		require.NoError(t, err)
+		var n int
+		for profiles.Next() {
+			n++
+		}
+		require.NoError(t, profiles.Err())
+		return n
+	}
+	// The profile is selected by exactly one of two adjacent ranges.
+	require.Equal(t, 1, selectProfiles(0, boundary-1))
+	require.Equal(t, 0, selectProfiles(boundary, 2*boundary))
+}
+
+func TestLabelsAcrossHeadAndBlocks(t *testing.T) {
+	ctx := context.Background()
+	db, err := New(ctx, Config{
+		DataPath:         t.TempDir(),
+		MaxBlockDuration: time.Hour,
+	})
+	require.NoError(t, err)
+	defer func() { require.NoError(t, db.Close()) }()
+
+	// The series of job a are flushed to a block, the series of job b are in the head.
+	ingestProfiles(t, db, cpuProfileGenerator, int64(time.Minute), int64(time.Minute), time.Minute,
+		&commonv1.LabelPair{Name: "job", Value: "a"}, &commonv1.LabelPair{Name: "env", Value: "prod"})
+	require.NoError(t, db.Flush(ctx))
+	require.NoError(t, db.blockQuerier.Sync(ctx))
+	ingestProfiles(t, db, cpuProfileGenerator, int64(2*time.Hour), int64(2*time.Hour), time.Minute,
+		&commonv1.LabelPair{Name: "job", Value: "b"}, &commonv1.LabelPair{Name: "env", Value: "dev"})
+
+	labelValues := func(req *ingestv1.LabelValuesRequest) []string {
+		res, err := db.LabelValues(ctx, connect.NewRequest(req))
+		require.NoError(t, err)
+		return res.Msg.Names
+	}
+	require.Equal(t, []string{"a", "b"}, labelValues(&ingestv1.LabelValuesRequest{Name: "job"}))
+	require.Equal(t, []string{"prod"}, labelValues(&ingestv1.LabelValuesRequest{Name: "env", Matchers: []string{`{job="a"}`}}))
+	require.Equal(t, []string{"dev"}, labelValues(&ingestv1.LabelValuesRequest{Name: "env", Matchers: []string{`{job="b"}`}}))
+	require.Equal(t, []string{"dev", "prod"}, labelValues(&ingestv1.LabelValuesRequest{Name: "env", Matchers: []string{`{job="a"}`, `{job="b"}`}}))
+	require.Empty(t, labelValues(&ingestv1.LabelValuesRequest{Name: "env", Matchers: []string{`{job="c"}`}}))
+	require.Equal(t, []string{"a"}, labelValues(&ingestv1.LabelValuesRequest{Name: "job", End: int64(model.TimeFromUnixNano(int64(30 * time.Minute)))}))
+	require.Equal(t, []string{"b"}, labelValues(&ingestv1.LabelValuesRequest{Name: "job", Start: int64(model.TimeFromUnixNano(int64(time.Hour)))}))
+
+	names, err := db.LabelNames(ctx, connect.NewRequest(&ingestv1.LabelNamesRequest{Matchers: []string{`{job="a"}`}}))
+	require.NoError(t, err)
+	require.Contains(t, names.Msg.Names, "env")
+	require.Contains(t, names.Msg.Names, "job")
+	names, err = db.LabelNames(ctx, connect.NewRequest(&ingestv1.LabelNamesRequest{}))
+	require.NoError(t, err)
+	require.Contains(t, names.Msg.Names, "env")
+	names, err = db.LabelNames(ctx, connect.NewRequest(&ingestv1.LabelNamesRequest{Matchers: []string{`{job="c"}`}}))
+	require.NoError(t, err)
+	require.Empty(t, names.Msg.Names)
+
+	series, err := db.Series(ctx, connect.NewRequest(&ingestv1.SeriesRequest{Matchers: []string{`{env="prod"}`, `{env="dev"}`}}))
+	require.NoError(t, err)
+	jobs := lo.Uniq(lo.Map(series.Msg.LabelsSet, func(l *commonv1.Labels, _ int) string {
+		return phlaremodel.Labels(l.Labels).Get("job")
+	}))
+	require.ElementsMatch(t, []string{"a", "b"}, jobs)
+
+	profileTypes, err := db.ProfileTypes(ctx, connect.NewRequest(&ingestv1.ProfileTypesRequest{}))
+	require.NoError(t, err)
+	require.NotEmpty(t, profileTypes.Msg.ProfileTypes)
+
+	_, err = db.Series(ctx, connect.NewRequest(&ingestv1.SeriesRequest{Matchers: []string{`{job=`}}))
+	require.Error(t, err)
+}
+
+func TestSeriesLimitAcrossHeads(t *testing.T) {
+	ctx := context.Background()
+	db, err := New(ctx, Config{
+		DataPath:         t.TempDir(),
+		MaxBlockDuration: time.Hour,
+		Limits:           &mockHeadLimits{maxSeries: 1},
+	})
+	require.NoError(t, err)
+	defer func() { require.NoError(t, db.Close()) }()
+
+	ingest := func(job string) error {
+		return db.Ingest(ctx, newProfileFoo(), uuid.New(), phlaremodel.NewLabelsBuilder(nil).Set("job", job).Labels()...)
+	}
+	require.NoError(t, ingest("foo"))
+	// The series of the heads waiting to be flushed are still active.
+	require.NoError(t, db.cutHeads(false))
+	require.Greater(t, db.HeadsSize(), db.Head().Size())
+	require.Equal(t, uint64(0), db.Head().NumSeries())
+	require.Equal(t, uint64(1), db.NumSeries())
+	err = ingest("bar")
+	require.Error(t, err)
+	require.Equal(t, validation.SeriesLimit, validation.ReasonOf(err))
+	require.NoError(t, ingest("foo"))
+
+	// The series are released once all the heads holding them are flushed.
+	require.NoError(t, db.flushPendingHeads(ctx))
+	require.Error(t, ingest("bar"))
+	require.NoError(t, db.Flush(ctx))
+	require.Equal(t, uint64(0), db.NumSeries())
+	require.NoError(t, ingest("bar"))
+}
+
+func TestSeriesLimitConcurrentIngest(t *testing.T) {
+	ctx := context.Background()
+	db, err := New(ctx, Config{
+		DataPath:         t.TempDir(),
+		MaxBlockDuration: time.Hour,
+		Limits:           &mockHeadLimits{maxSeries: 10},
+	})
+	require.NoError(t, err)
+	defer func() { require.NoError(t, db.Close()) }()
+
+	var (
+		wg       sync.WaitGroup
+		accepted atomic.Int64
+	)
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if db.Ingest(ctx, newProfileFoo(), uuid.New(), phlaremodel.NewLabelsBuilder(nil).Set("job", fmt.Sprint(i)).Labels()...) == nil {
+				accepted.Inc()
+			}
+		}(i)
+	}
+	wg.Wait()
+	require.Equal(t, int64(10), accepted.Load())
+	require.Equal(t, uint64(10), db.Head().NumSeries())
+}
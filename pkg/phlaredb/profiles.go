@@ -4,6 +4,7 @@ import (
 	"context"
 	"sort"
 	"sync"
+	"time"
 	"unsafe"
 
 	"github.com/google/uuid"
@@ -17,12 +18,18 @@ import (
 	schemav1 "github.com/grafana/phlare/pkg/phlaredb/schemas/v1"
 	"github.com/grafana/phlare/pkg/phlaredb/tsdb"
 	"github.com/grafana/phlare/pkg/phlaredb/tsdb/index"
+	"github.com/grafana/phlare/pkg/phlaredb/tsdb/shard"
 )
 
 type profileLabels struct {
 	lbs      phlaremodel.Labels
 	fp       model.Fingerprint
 	profiles []*schemav1.Profile
+
+	// minute and profilesInMinute count the profiles of the series in the
+	// latest minute, to limit the number of profiles per series per minute.
+	minute           int64
+	profilesInMinute int
 }
 
 type profilesIndex struct {
@@ -67,6 +74,11 @@ func (pi *profilesIndex) Add(ps *schemav1.Profile, lbs phlaremodel.Labels, profi
 		pi.metrics.seriesCreated.WithLabelValues(profileName).Inc()
 	}
 	profiles.profiles = append(profiles.profiles, ps)
+	if minute := ps.TimeNanos / int64(time.Minute); minute != profiles.minute {
+		profiles.minute = minute
+		profiles.profilesInMinute = 0
+	}
+	profiles.profilesInMinute++
 	pi.totalProfiles.Inc()
 	pi.metrics.profilesCreated.WithLabelValues(profileName).Inc()
 }
@@ -112,7 +124,7 @@ outer:
 	return nil
 }
 
-func (pi *profilesIndex) SelectProfiles(matchers []*labels.Matcher, start, end model.Time) (iter.Iterator[Profile], error) {
+func (pi *profilesIndex) SelectProfiles(matchers []*labels.Matcher, shard *shard.Annotation, start, end model.Time) (iter.Iterator[Profile], error) {
 	filters, matchers := SplitFiltersAndMatchers(matchers)
 	ids, err := pi.ix.Lookup(matchers, nil)
 	if err != nil {
@@ -125,6 +137,9 @@ func (pi *profilesIndex) SelectProfiles(matchers []*labels.Matcher, start, end m
 	iters := make([]iter.Iterator[Profile], 0, len(ids))
 outer:
 	for _, fp := range ids {
+		if shard != nil && !shard.Match(fp) {
+			continue
+		}
 		profile, ok := pi.profilesPerFP[fp]
 		if !ok {
 			// If a profile labels is missing here, it has already been flushed
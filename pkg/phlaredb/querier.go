@@ -9,6 +9,7 @@ import (
 	phlaremodel "github.com/grafana/phlare/pkg/model"
 	"github.com/grafana/phlare/pkg/phlaredb/tsdb"
 	"github.com/grafana/phlare/pkg/phlaredb/tsdb/index"
+	"github.com/grafana/phlare/pkg/phlaredb/tsdb/shard"
 )
 
 // IndexReader provides reading access of serialized index data.
@@ -56,6 +57,16 @@ type IndexReader interface {
 	Close() error
 }
 
+// splitShardMatcher removes the shard matcher from the matchers and returns the shard it selects, if any.
+// Series belong to the shard of their fingerprint, so that the same series is in the same shard in heads and blocks.
+func splitShardMatcher(matchers []*labels.Matcher) ([]*labels.Matcher, *shard.Annotation, error) {
+	s, idx, err := shard.FromMatchers(matchers)
+	if err != nil || s == nil {
+		return matchers, nil, err
+	}
+	return append(matchers[:idx:idx], matchers[idx+1:]...), s, nil
+}
+
 // PostingsForMatchers assembles a single postings iterator against the index reader
 // based on the given matchers. The resulting postings are not ordered by series.
 func PostingsForMatchers(ix IndexReader, shard *index.ShardAnnotation, ms ...*labels.Matcher) (index.Postings, error) {
@@ -3,8 +3,10 @@ package phlaredb
 import (
 	"context"
 	"fmt"
+	"path/filepath"
 	"sort"
 	"testing"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/prometheus/client_golang/prometheus"
@@ -13,9 +15,12 @@ import (
 	"github.com/stretchr/testify/require"
 
 	commonv1 "github.com/grafana/phlare/pkg/gen/common/v1"
+	ingestv1 "github.com/grafana/phlare/pkg/gen/ingester/v1"
 	phlaremodel "github.com/grafana/phlare/pkg/model"
+	"github.com/grafana/phlare/pkg/objstore/providers/filesystem"
 	v1 "github.com/grafana/phlare/pkg/phlaredb/schemas/v1"
 	"github.com/grafana/phlare/pkg/phlaredb/tsdb/index"
+	pprofth "github.com/grafana/phlare/pkg/pprof/testhelper"
 )
 
 func TestQueryIndex(t *testing.T) {
@@ -79,3 +84,68 @@ func TestQueryIndex(t *testing.T) {
 		require.Equal(t, int64(9), chks[0].MaxTime)
 	}
 }
+
+func TestSelectShardedProfiles(t *testing.T) {
+	const shards = 4
+	ctx := context.Background()
+	testPath := t.TempDir()
+	db, err := New(ctx, Config{
+		DataPath:         testPath,
+		MaxBlockDuration: time.Duration(100000) * time.Minute, // we will manually flush
+	})
+	require.NoError(t, err)
+	for i := 0; i < 20; i++ {
+		p := pprofth.NewProfileBuilder(int64(15*time.Second)).CPUProfile().WithLabels("pod", fmt.Sprint(i))
+		p.ForStacktrace("my", "other").AddSamples(1)
+		require.NoError(t, db.Head().Ingest(ctx, p.Profile, p.UUID, p.Labels...))
+	}
+
+	selectShards := func(q Querier) []map[model.Fingerprint]struct{} {
+		result := make([]map[model.Fingerprint]struct{}, shards)
+		for i := range result {
+			profiles, err := q.SelectMatchingProfiles(ctx, &ingestv1.SelectProfilesRequest{
+				LabelSelector: fmt.Sprintf(`{__cortex_shard__="%d_of_%d"}`, i, shards),
+				Type: &commonv1.ProfileType{
+					Name:       "process_cpu",
+					SampleType: "cpu",
+					SampleUnit: "nanoseconds",
+					PeriodType: "cpu",
+					PeriodUnit: "nanoseconds",
+				},
+				Start: 0,
+				End:   int64(model.TimeFromUnixNano(int64(time.Minute))),
+			})
+			require.NoError(t, err)
+			result[i] = map[model.Fingerprint]struct{}{}
+			for profiles.Next() {
+				result[i][profiles.At().Fingerprint()] = struct{}{}
+			}
+			require.NoError(t, profiles.Err())
+		}
+		return result
+	}
+
+	headShards := selectShards(db.Head())
+	total := 0
+	for _, fps := range headShards {
+		total += len(fps)
+	}
+	// Each series is selected by exactly one shard.
+	require.Equal(t, 20, total)
+
+	require.NoError(t, db.Flush(ctx))
+	b, err := filesystem.NewBucket(filepath.Join(testPath, pathLocal))
+	require.NoError(t, err)
+	q := NewBlockQuerier(ctx, b)
+	require.NoError(t, q.Sync(ctx))
+	require.NoError(t, q.queriers[0].open(ctx))
+
+	// Series are in the same shard once flushed.
+	require.Equal(t, headShards, selectShards(q.queriers[0]))
+
+	_, err = q.queriers[0].SelectMatchingProfiles(ctx, &ingestv1.SelectProfilesRequest{
+		LabelSelector: `{__cortex_shard__="4_of_4"}`,
+		Type:          &commonv1.ProfileType{Name: "process_cpu"},
+	})
+	require.Error(t, err)
+}
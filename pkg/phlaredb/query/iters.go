@@ -16,6 +16,7 @@ import (
 	"github.com/segmentio/parquet-go"
 
 	"github.com/grafana/phlare/pkg/iter"
+	"github.com/grafana/phlare/pkg/util/querystats"
 )
 
 // RowNumber is the sequence of row numbers uniquely identifying a value
@@ -248,6 +249,7 @@ type ColumnIterator struct {
 	seekTo   atomic.Value
 
 	metrics *Metrics
+	stats   *querystats.Stats
 	table   string
 	quit    chan struct{}
 	ch      chan *columnIteratorBuffer
@@ -270,6 +272,7 @@ type columnIteratorBuffer struct {
 func NewColumnIterator(ctx context.Context, rgs []parquet.RowGroup, column int, columnName string, readSize int, filter Predicate, selectAs string) *ColumnIterator {
 	c := &ColumnIterator{
 		metrics:  getMetricsFromContext(ctx),
+		stats:    querystats.FromContext(ctx),
 		table:    strings.ToLower(rgs[0].Schema().Name()) + "s",
 		rgs:      rgs,
 		col:      column,
@@ -300,6 +303,7 @@ func (c *ColumnIterator) iterate(ctx context.Context, readSize int) {
 		span.SetTag("keptPages", c.filter.KeptPages.Load())
 		span.SetTag("keptValues", c.filter.KeptValues.Load())
 		span.Finish()
+		c.stats.AddValuesRead(c.filter.InspectedValues.Load())
 	}()
 
 	rn := EmptyRowNumber()
@@ -336,7 +340,8 @@ func (c *ColumnIterator) iterate(ctx context.Context, readSize int) {
 			}
 		}
 
-		func(col parquet.ColumnChunk) {
+		// stop is true once the iteration must stop: the query exceeded its limits, the iterator was closed or failed.
+		stop := func(col parquet.ColumnChunk) bool {
 			pgs := col.Pages()
 			defer func() {
 				if err := pgs.Close(); err != nil {
@@ -346,16 +351,24 @@ func (c *ColumnIterator) iterate(ctx context.Context, readSize int) {
 			for {
 				pg, err := pgs.ReadPage()
 				if pg == nil || err == io.EOF {
-					break
+					return false
 				}
 				c.metrics.pageReadsTotal.WithLabelValues(c.table, c.colName).Add(1)
+				c.stats.AddPagesRead(1)
+				if err := c.stats.AddBytesRead(pg.Size()); err != nil {
+					select {
+					case c.ch <- &columnIteratorBuffer{err: err}:
+					case <-c.quit:
+					}
+					return true
+				}
 				span.LogFields(
 					log.String("msg", "reading page"),
 					log.Int64("page_num_values", pg.NumValues()),
 					log.Int64("page_size", pg.Size()),
 				)
 				if err != nil {
-					return
+					return true
 				}
 
 				if checkSkip(pg.NumRows()) {
@@ -402,7 +415,7 @@ func (c *ColumnIterator) iterate(ctx context.Context, readSize int) {
 							select {
 							case c.ch <- newBuffer:
 							case <-c.quit:
-								return
+								return true
 							}
 						} else {
 							// All values excluded, we go ahead and immediately
@@ -418,12 +431,15 @@ func (c *ColumnIterator) iterate(ctx context.Context, readSize int) {
 					}
 					if err != nil {
 						c.ch <- &columnIteratorBuffer{err: err}
-						return
+						return true
 					}
 				}
 
 			}
 		}(col)
+		if stop {
+			return
+		}
 	}
 }
 
@@ -5,8 +5,11 @@ import (
 	"errors"
 	"testing"
 
+	"github.com/bufbuild/connect-go"
 	"github.com/segmentio/parquet-go"
 	"github.com/stretchr/testify/require"
+
+	"github.com/grafana/phlare/pkg/util/querystats"
 )
 
 type testData struct {
@@ -173,3 +176,24 @@ func TestCompareRowNumbers(t *testing.T) {
 		require.Equal(t, tc.expected, CompareRowNumbers(5, tc.a, tc.b))
 	}
 }
+
+func TestColumnIteratorStats(t *testing.T) {
+	st := querystats.New(querystats.Limits{})
+	i := NewColumnIterator(querystats.NewContext(context.Background(), st), newTestSet(), 0, "id", 10, nil, "id")
+	for i.Next() {
+	}
+	require.NoError(t, i.Err())
+	require.NoError(t, i.Close())
+	res := st.Proto()
+	require.Equal(t, int64(2), res.PagesRead)
+	require.Equal(t, int64(4), res.ValuesRead)
+	require.Greater(t, res.BytesRead, int64(0))
+
+	// the iteration stops once the query read more bytes than its limit.
+	st = querystats.New(querystats.Limits{MaxBytesRead: 1})
+	i = NewColumnIterator(querystats.NewContext(context.Background(), st), newTestSet(), 0, "id", 10, nil, "id")
+	require.False(t, i.Next())
+	require.Equal(t, connect.CodeResourceExhausted, connect.CodeOf(i.Err()))
+	require.NoError(t, i.Close())
+	require.Equal(t, int64(1), st.Proto().PagesRead)
+}
@@ -11,6 +11,7 @@ import (
 	"github.com/segmentio/parquet-go"
 
 	"github.com/grafana/phlare/pkg/iter"
+	"github.com/grafana/phlare/pkg/util/querystats"
 )
 
 type RepeatedRow[T any] struct {
@@ -24,6 +25,7 @@ type repeatedPageIterator[T any] struct {
 	readSize int
 	ctx      context.Context
 	span     opentracing.Span
+	stats    *querystats.Stats
 
 	rgs                 []parquet.RowGroup
 	startRowGroupRowNum int64
@@ -63,6 +65,7 @@ func NewRepeatedPageIterator[T any](
 	return &repeatedPageIterator[T]{
 		ctx:            ctx,
 		span:           span,
+		stats:          querystats.FromContext(ctx),
 		rows:           rows,
 		rgs:            rgs,
 		column:         column,
@@ -136,6 +139,11 @@ Outer:
 				otlog.Int64("startPageRowNum", it.startPageRowNum),
 				otlog.Int64("pageRowNum", it.currentPage.NumRows()),
 			)
+			it.stats.AddPagesRead(1)
+			if err := it.stats.AddBytesRead(it.currentPage.Size()); err != nil {
+				it.err = err
+				return false
+			}
 			it.valueReader = it.currentPage.Values()
 		}
 		// if there's no more value in that page we can skip it.
@@ -6,10 +6,8 @@ import (
 
 	"github.com/opentracing/opentracing-go"
 	otlog "github.com/opentracing/opentracing-go/log"
-	"github.com/prometheus/common/model"
 	"github.com/samber/lo"
 
-	commonv1 "github.com/grafana/phlare/pkg/gen/common/v1"
 	ingestv1 "github.com/grafana/phlare/pkg/gen/ingester/v1"
 	"github.com/grafana/phlare/pkg/iter"
 	phlaremodel "github.com/grafana/phlare/pkg/model"
@@ -177,7 +175,7 @@ func (b *singleBlockQuerier) resolveSymbols(ctx context.Context, stacktraceAggrB
 	}, nil
 }
 
-func (b *singleBlockQuerier) MergeByLabels(ctx context.Context, rows iter.Iterator[Profile], by ...string) ([]*commonv1.Series, error) {
+func (b *singleBlockQuerier) MergeByLabels(ctx context.Context, rows iter.Iterator[Profile], agg SeriesAggregation, by ...string) (*phlaremodel.SeriesAggregator, error) {
 	sp, ctx := opentracing.StartSpanFromContext(ctx, "MergeByLabels - Block")
 	defer sp.Finish()
 
@@ -185,9 +183,8 @@ func (b *singleBlockQuerier) MergeByLabels(ctx context.Context, rows iter.Iterat
 
 	defer it.Close()
 
-	labelsByFingerprint := map[model.Fingerprint]string{}
-	seriesByLabels := map[string]*commonv1.Series{}
-	labelBuf := make([]byte, 0, 1024)
+	result := agg.newAggregator()
+	keys := newSeriesKeys(by)
 
 	for it.Next() {
 		values := it.At()
@@ -196,40 +193,11 @@ func (b *singleBlockQuerier) MergeByLabels(ctx context.Context, rows iter.Iterat
 		for _, e := range values.Values {
 			total += e.Int64()
 		}
-		labelsByString, ok := labelsByFingerprint[p.Fingerprint()]
-		if !ok {
-			labelBuf = p.Labels().BytesWithLabels(labelBuf, by...)
-			labelsByString = string(labelBuf)
-			labelsByFingerprint[p.Fingerprint()] = labelsByString
-			if _, ok := seriesByLabels[labelsByString]; !ok {
-				seriesByLabels[labelsByString] = &commonv1.Series{
-					Labels: p.Labels().WithLabels(by...),
-					Points: []*commonv1.Point{
-						{
-							Timestamp: int64(p.Timestamp()),
-							Value:     float64(total),
-						},
-					},
-				}
-				continue
-			}
-		}
-		series := seriesByLabels[labelsByString]
-		series.Points = append(series.Points, &commonv1.Point{
-			Timestamp: int64(p.Timestamp()),
-			Value:     float64(total),
-		})
+		k := keys.get(p)
+		result.Add(k.labels, k.hash, int64(p.Timestamp()), agg.value(total, p.(BlockProfile).durationNanos), 1)
 	}
-
-	result := lo.Values(seriesByLabels)
-	sort.Slice(result, func(i, j int) bool {
-		return phlaremodel.CompareLabelPairs(result[i].Labels, result[j].Labels) < 0
-	})
-	// we have to sort the points in each series because labels reduction may have changed the order
-	for _, s := range result {
-		sort.Slice(s.Points, func(i, j int) bool {
-			return s.Points[i].Timestamp < s.Points[j].Timestamp
-		})
+	if err := it.Err(); err != nil {
+		return nil, err
 	}
 	return result, nil
 }
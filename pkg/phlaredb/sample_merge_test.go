@@ -302,6 +302,7 @@ func TestMergeSampleByLabels(t *testing.T) {
 		in       func() []*pprofth.ProfileBuilder
 		expected []*commonv1.Series
 		by       []string
+		agg      SeriesAggregation
 	}{
 		{
 			name: "single profile",
@@ -372,6 +373,76 @@ func TestMergeSampleByLabels(t *testing.T) {
 				},
 			},
 		},
+		{
+			name: "rate",
+			by:   []string{"foo"},
+			agg: SeriesAggregation{
+				Type:  commonv1.SeriesAggregation_SERIES_AGGREGATION_RATE,
+				Step:  5 * time.Second,
+				Start: 5000,
+				End:   60000,
+			},
+			in: func() (ps []*pprofth.ProfileBuilder) {
+				p := pprofth.NewProfileBuilder(int64(15*time.Second)).CPUProfile().WithLabels("foo", "bar")
+				p.DurationNanos = int64(10 * time.Second)
+				p.ForStacktrace("my", "other").AddSamples(20)
+				ps = append(ps, p)
+
+				// Without duration, the profile is spread over the step.
+				p = pprofth.NewProfileBuilder(int64(30*time.Second)).CPUProfile().WithLabels("foo", "bar")
+				p.ForStacktrace("my", "other").AddSamples(10)
+				ps = append(ps, p)
+				return
+			},
+			expected: []*commonv1.Series{
+				{
+					Labels: []*commonv1.LabelPair{{Name: "foo", Value: "bar"}},
+					Points: []*commonv1.Point{{Timestamp: 15000, Value: 2}, {Timestamp: 30000, Value: 2}},
+				},
+			},
+		},
+		{
+			name: "step",
+			by:   []string{"foo"},
+			agg: SeriesAggregation{
+				Type:  commonv1.SeriesAggregation_SERIES_AGGREGATION_MAX,
+				Step:  20 * time.Second,
+				Start: 20000,
+				End:   50000,
+			},
+			in: func() (ps []*pprofth.ProfileBuilder) {
+				for _, ts := range []time.Duration{5 * time.Second, 20 * time.Second, 25 * time.Second, 40 * time.Second, 45 * time.Second} {
+					p := pprofth.NewProfileBuilder(int64(ts)).CPUProfile().WithLabels("foo", "bar")
+					p.ForStacktrace("my", "other").AddSamples(int64(ts / time.Second))
+					ps = append(ps, p)
+				}
+				return
+			},
+			expected: []*commonv1.Series{
+				{
+					Labels: []*commonv1.LabelPair{{Name: "foo", Value: "bar"}},
+					// The profile at 45s is after the last step.
+					Points: []*commonv1.Point{{Timestamp: 20000, Value: 20}, {Timestamp: 40000, Value: 40}},
+				},
+			},
+		},
+		{
+			name: "count",
+			by:   []string{"foo"},
+			agg:  SeriesAggregation{Type: commonv1.SeriesAggregation_SERIES_AGGREGATION_COUNT},
+			in: func() (ps []*pprofth.ProfileBuilder) {
+				p := pprofth.NewProfileBuilder(int64(15*time.Second)).CPUProfile().WithLabels("foo", "bar")
+				p.ForStacktrace("my", "other").AddSamples(20)
+				ps = append(ps, p)
+				return
+			},
+			expected: []*commonv1.Series{
+				{
+					Labels: []*commonv1.LabelPair{{Name: "foo", Value: "bar"}},
+					Points: []*commonv1.Point{{Timestamp: 15000, Value: 1}},
+				},
+			},
+		},
 	} {
 		tc := tc
 		t.Run(tc.name, func(t *testing.T) {
@@ -413,8 +484,9 @@ func TestMergeSampleByLabels(t *testing.T) {
 			require.NoError(t, err)
 
 			q.queriers[0].Sort(profiles)
-			series, err := q.queriers[0].MergeByLabels(ctx, iter.NewSliceIterator(profiles), tc.by...)
+			result, err := q.queriers[0].MergeByLabels(ctx, iter.NewSliceIterator(profiles), tc.agg, tc.by...)
 			require.NoError(t, err)
+			series, _ := result.Series()
 
 			testhelper.EqualProto(t, tc.expected, series)
 		})
@@ -529,14 +601,72 @@ func TestHeadMergeSampleByLabels(t *testing.T) {
 			require.NoError(t, err)
 
 			db.Head().Sort(profiles)
-			series, err := db.Head().MergeByLabels(ctx, iter.NewSliceIterator(profiles), tc.by...)
+			result, err := db.Head().MergeByLabels(ctx, iter.NewSliceIterator(profiles), SeriesAggregation{}, tc.by...)
 			require.NoError(t, err)
+			series, _ := result.Series()
 
 			testhelper.EqualProto(t, tc.expected, series)
 		})
 	}
 }
 
+func BenchmarkHeadMergeByLabels(b *testing.B) {
+	const (
+		interval = 15 * time.Second
+		span     = 24 * time.Hour
+	)
+	ctx := context.Background()
+	db, err := New(ctx, Config{
+		DataPath:         b.TempDir(),
+		MaxBlockDuration: time.Duration(100000) * time.Minute, // we will manually flush
+	})
+	require.NoError(b, err)
+	for ts := time.Duration(0); ts < span; ts += interval {
+		for _, pod := range []string{"a", "b", "c", "d"} {
+			p := pprofth.NewProfileBuilder(int64(ts)).CPUProfile().WithLabels("pod", pod)
+			p.ForStacktrace("my", "other").AddSamples(1)
+			require.NoError(b, db.Head().Ingest(ctx, p.Profile, p.UUID, p.Labels...))
+		}
+	}
+	profileIt, err := db.Head().SelectMatchingProfiles(ctx, &ingesterv1.SelectProfilesRequest{
+		LabelSelector: `{}`,
+		Type: &commonv1.ProfileType{
+			Name:       "process_cpu",
+			SampleType: "cpu",
+			SampleUnit: "nanoseconds",
+			PeriodType: "cpu",
+			PeriodUnit: "nanoseconds",
+		},
+		Start: 0,
+		End:   span.Milliseconds(),
+	})
+	require.NoError(b, err)
+	profiles, err := iter.Slice(profileIt)
+	require.NoError(b, err)
+
+	// A step of 0 returns one point per profile, as ingesters used to.
+	for _, step := range []time.Duration{0, time.Minute, time.Hour} {
+		b.Run(fmt.Sprintf("step=%s", step), func(b *testing.B) {
+			agg := SeriesAggregation{
+				Type:  commonv1.SeriesAggregation_SERIES_AGGREGATION_AVG,
+				Step:  step,
+				Start: step.Milliseconds(),
+				End:   span.Milliseconds(),
+			}
+			var size int
+			b.ReportAllocs()
+			b.ResetTimer()
+			for n := 0; n < b.N; n++ {
+				result, err := db.Head().MergeByLabels(ctx, iter.NewSliceIterator(profiles), agg, "pod")
+				require.NoError(b, err)
+				series, counts := result.Series()
+				size = (&ingestv1.MergeProfilesLabelsResponse{Series: series, Counts: counts}).SizeVT()
+			}
+			b.ReportMetric(float64(size), "response_bytes")
+		})
+	}
+}
+
 // func BenchmarkSelectBlockProfiles(b *testing.B) {
 // 	fs, err := filesystem.NewBucket("./testdata/")
 // 	require.NoError(b, err)
@@ -0,0 +1,70 @@
+package phlaredb
+
+import (
+	"time"
+
+	"github.com/prometheus/common/model"
+
+	commonv1 "github.com/grafana/phlare/pkg/gen/common/v1"
+	phlaremodel "github.com/grafana/phlare/pkg/model"
+)
+
+// SeriesAggregation describes how profiles are aggregated into the points returned by MergeByLabels.
+type SeriesAggregation struct {
+	Type commonv1.SeriesAggregation
+	// Step is the query resolution, rates are computed over the step when it is longer than the profile duration.
+	// When 0, one point is returned per profile.
+	Step time.Duration
+	// Start and End are the timestamps in milliseconds of the first and the last possible points.
+	Start, End int64
+}
+
+func (a SeriesAggregation) newAggregator() *phlaremodel.SeriesAggregator {
+	return phlaremodel.NewSeriesAggregator(a.Type, a.Start, a.End, a.Step.Milliseconds())
+}
+
+func (a SeriesAggregation) value(total, durationNanos int64) float64 {
+	switch a.Type {
+	case commonv1.SeriesAggregation_SERIES_AGGREGATION_COUNT:
+		return 1
+	case commonv1.SeriesAggregation_SERIES_AGGREGATION_RATE:
+		d := time.Duration(durationNanos)
+		if a.Step > d {
+			d = a.Step
+		}
+		if d <= 0 {
+			return float64(total)
+		}
+		return float64(total) / d.Seconds()
+	default:
+		return float64(total)
+	}
+}
+
+type seriesKey struct {
+	labels []*commonv1.LabelPair
+	hash   uint64
+}
+
+// seriesKeys caches the group-by labels of each profile series.
+type seriesKeys struct {
+	by            []string
+	byFingerprint map[model.Fingerprint]seriesKey
+}
+
+func newSeriesKeys(by []string) *seriesKeys {
+	return &seriesKeys{
+		by:            by,
+		byFingerprint: make(map[model.Fingerprint]seriesKey),
+	}
+}
+
+func (k *seriesKeys) get(p Profile) seriesKey {
+	key, ok := k.byFingerprint[p.Fingerprint()]
+	if !ok {
+		lbs := p.Labels().WithLabels(k.by...)
+		key = seriesKey{labels: lbs, hash: lbs.Hash()}
+		k.byFingerprint[p.Fingerprint()] = key
+	}
+	return key
+}
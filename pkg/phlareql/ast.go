@@ -0,0 +1,182 @@
+// Package phlareql implements PhlareQL, the query language of profiles.
+//
+// A query selects profiles of a profile type, optionally filtered by label matchers,
+// and combines them using aggregations, arithmetic and functions:
+//
+//	sum by (service) (process_cpu:cpu:nanoseconds:cpu:nanoseconds{namespace="prod"})
+//	topk(5, sum by (pod) (rate(cpu{service="api"})))
+//	sum by (service) (alloc_space) / sum by (service) (alloc_objects)
+//	diff(cpu{version="v1"}, cpu{version="v2"})
+package phlareql
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/prometheus/model/labels"
+)
+
+// Expr is a node of a parsed query.
+type Expr interface {
+	String() string
+	expr()
+}
+
+// Selector selects the profiles of a profile type matching label matchers.
+type Selector struct {
+	// Name is the profile type, either an ID or a short name like cpu or memory:alloc_space.
+	Name     string
+	Matchers []*labels.Matcher
+}
+
+// AggregateOp is an aggregation operator.
+type AggregateOp int
+
+const (
+	Sum AggregateOp = iota
+	Avg
+	Min
+	Max
+	Count
+	TopK
+	BottomK
+)
+
+var aggregateOps = map[string]AggregateOp{
+	"sum":     Sum,
+	"avg":     Avg,
+	"min":     Min,
+	"max":     Max,
+	"count":   Count,
+	"topk":    TopK,
+	"bottomk": BottomK,
+}
+
+func (op AggregateOp) String() string {
+	for name, o := range aggregateOps {
+		if o == op {
+			return name
+		}
+	}
+	return "AggregateOp(" + strconv.Itoa(int(op)) + ")"
+}
+
+// AggregateExpr aggregates the series of an expression, grouped by labels.
+type AggregateExpr struct {
+	Op AggregateOp
+	// Param is the number of series kept by topk and bottomk.
+	Param    int
+	Grouping []string
+	Expr     Expr
+}
+
+// BinaryOp is an arithmetic operator.
+type BinaryOp int
+
+const (
+	Add BinaryOp = iota
+	Sub
+	Mul
+	Div
+)
+
+func (op BinaryOp) String() string {
+	switch op {
+	case Add:
+		return "+"
+	case Sub:
+		return "-"
+	case Mul:
+		return "*"
+	case Div:
+		return "/"
+	}
+	return "BinaryOp(" + strconv.Itoa(int(op)) + ")"
+}
+
+func (op BinaryOp) precedence() int {
+	if op == Mul || op == Div {
+		return 2
+	}
+	return 1
+}
+
+// BinaryExpr applies an arithmetic operator to two expressions.
+type BinaryExpr struct {
+	Op       BinaryOp
+	LHS, RHS Expr
+}
+
+// Call is a function call.
+type Call struct {
+	Func string
+	Args []Expr
+}
+
+// functions are the supported functions and their number of arguments.
+var functions = map[string]int{
+	// diff compares the flamegraphs of two selections of profiles.
+	"diff": 2,
+	// rate returns the per-second rate of the values of the profiles.
+	"rate": 1,
+}
+
+// NumberLiteral is a number.
+type NumberLiteral struct {
+	Val float64
+}
+
+func (*Selector) expr()      {}
+func (*AggregateExpr) expr() {}
+func (*BinaryExpr) expr()    {}
+func (*Call) expr()          {}
+func (*NumberLiteral) expr() {}
+
+func (s *Selector) String() string {
+	if len(s.Matchers) == 0 {
+		return s.Name
+	}
+	matchers := make([]string, len(s.Matchers))
+	for i, m := range s.Matchers {
+		matchers[i] = m.String()
+	}
+	return s.Name + "{" + strings.Join(matchers, ",") + "}"
+}
+
+func (a *AggregateExpr) String() string {
+	var b strings.Builder
+	b.WriteString(a.Op.String())
+	if len(a.Grouping) > 0 {
+		b.WriteString(" by (" + strings.Join(a.Grouping, ", ") + ") ")
+	}
+	b.WriteString("(")
+	if a.Op == TopK || a.Op == BottomK {
+		b.WriteString(strconv.Itoa(a.Param) + ", ")
+	}
+	b.WriteString(a.Expr.String() + ")")
+	return b.String()
+}
+
+func (b *BinaryExpr) String() string {
+	lhs, rhs := b.LHS.String(), b.RHS.String()
+	if e, ok := b.LHS.(*BinaryExpr); ok && e.Op.precedence() < b.Op.precedence() {
+		lhs = "(" + lhs + ")"
+	}
+	// Operators are left associative, the right side is enclosed when it has the same precedence.
+	if e, ok := b.RHS.(*BinaryExpr); ok && e.Op.precedence() <= b.Op.precedence() {
+		rhs = "(" + rhs + ")"
+	}
+	return lhs + " " + b.Op.String() + " " + rhs
+}
+
+func (c *Call) String() string {
+	args := make([]string, len(c.Args))
+	for i, a := range c.Args {
+		args[i] = a.String()
+	}
+	return c.Func + "(" + strings.Join(args, ", ") + ")"
+}
+
+func (n *NumberLiteral) String() string {
+	return strconv.FormatFloat(n.Val, 'g', -1, 64)
+}
@@ -0,0 +1,191 @@
+package phlareql
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+type tokenType int
+
+const (
+	tokenEOF tokenType = iota
+	tokenIdentifier
+	tokenNumber
+	tokenString
+	tokenLeftParen
+	tokenRightParen
+	tokenLeftBrace
+	tokenRightBrace
+	tokenComma
+	tokenEqual
+	tokenNotEqual
+	tokenRegexMatch
+	tokenRegexNotMatch
+	tokenAdd
+	tokenSub
+	tokenMul
+	tokenDiv
+)
+
+type token struct {
+	typ tokenType
+	// pos is the byte offset of the token in the query.
+	pos int
+	// val is the text of the token, unquoted for strings.
+	val string
+}
+
+func (t token) String() string {
+	switch t.typ {
+	case tokenEOF:
+		return "end of query"
+	case tokenString:
+		return strconv.Quote(t.val)
+	}
+	return fmt.Sprintf("%q", t.val)
+}
+
+// lex splits the query into tokens, the last one being tokenEOF.
+func lex(query string) ([]token, error) {
+	var tokens []token
+	pos := 0
+	for {
+		for pos < len(query) && isSpace(query[pos]) {
+			pos++
+		}
+		if pos == len(query) {
+			return append(tokens, token{typ: tokenEOF, pos: pos}), nil
+		}
+		start := pos
+		c := query[pos]
+		switch {
+		case c == '(':
+			tokens = append(tokens, token{typ: tokenLeftParen, pos: pos, val: "("})
+			pos++
+		case c == ')':
+			tokens = append(tokens, token{typ: tokenRightParen, pos: pos, val: ")"})
+			pos++
+		case c == '{':
+			tokens = append(tokens, token{typ: tokenLeftBrace, pos: pos, val: "{"})
+			pos++
+		case c == '}':
+			tokens = append(tokens, token{typ: tokenRightBrace, pos: pos, val: "}"})
+			pos++
+		case c == ',':
+			tokens = append(tokens, token{typ: tokenComma, pos: pos, val: ","})
+			pos++
+		case c == '+':
+			tokens = append(tokens, token{typ: tokenAdd, pos: pos, val: "+"})
+			pos++
+		case c == '-':
+			tokens = append(tokens, token{typ: tokenSub, pos: pos, val: "-"})
+			pos++
+		case c == '*':
+			tokens = append(tokens, token{typ: tokenMul, pos: pos, val: "*"})
+			pos++
+		case c == '/':
+			tokens = append(tokens, token{typ: tokenDiv, pos: pos, val: "/"})
+			pos++
+		case c == '=':
+			if strings.HasPrefix(query[pos:], "=~") {
+				tokens = append(tokens, token{typ: tokenRegexMatch, pos: pos, val: "=~"})
+				pos += 2
+			} else {
+				tokens = append(tokens, token{typ: tokenEqual, pos: pos, val: "="})
+				pos++
+			}
+		case c == '!':
+			switch {
+			case strings.HasPrefix(query[pos:], "!="):
+				tokens = append(tokens, token{typ: tokenNotEqual, pos: pos, val: "!="})
+			case strings.HasPrefix(query[pos:], "!~"):
+				tokens = append(tokens, token{typ: tokenRegexNotMatch, pos: pos, val: "!~"})
+			default:
+				return nil, errorAt(pos, "unexpected character %q", c)
+			}
+			pos += 2
+		case c == '"' || c == '\'' || c == '`':
+			end, val, err := lexString(query, pos)
+			if err != nil {
+				return nil, err
+			}
+			tokens = append(tokens, token{typ: tokenString, pos: pos, val: val})
+			pos = end
+		case isDigit(c) || (c == '.' && pos+1 < len(query) && isDigit(query[pos+1])):
+			for pos < len(query) && (isDigit(query[pos]) || query[pos] == '.') {
+				pos++
+			}
+			// exponent
+			if pos < len(query) && (query[pos] == 'e' || query[pos] == 'E') {
+				pos++
+				if pos < len(query) && (query[pos] == '+' || query[pos] == '-') {
+					pos++
+				}
+				for pos < len(query) && isDigit(query[pos]) {
+					pos++
+				}
+			}
+			tokens = append(tokens, token{typ: tokenNumber, pos: start, val: query[start:pos]})
+		case isIdentifierStart(c):
+			for pos < len(query) && isIdentifierChar(query[pos]) {
+				pos++
+			}
+			tokens = append(tokens, token{typ: tokenIdentifier, pos: start, val: query[start:pos]})
+		default:
+			r, _ := utf8.DecodeRuneInString(query[pos:])
+			return nil, errorAt(pos, "unexpected character %q", r)
+		}
+	}
+}
+
+// lexString returns the end and the unquoted value of the string starting at pos.
+// Backquoted strings are raw, escape sequences are interpreted in other strings.
+func lexString(query string, pos int) (int, string, error) {
+	quote := query[pos]
+	s := query[pos+1:]
+	if quote == '`' {
+		end := strings.IndexByte(s, '`')
+		if end < 0 {
+			return 0, "", errorAt(pos, "unterminated string")
+		}
+		return pos + end + 2, s[:end], nil
+	}
+	var b strings.Builder
+	for len(s) > 0 && s[0] != quote {
+		if s[0] == '\n' {
+			break
+		}
+		r, _, tail, err := strconv.UnquoteChar(s, quote)
+		if err != nil {
+			return 0, "", errorAt(len(query)-len(s), "invalid escape sequence in string")
+		}
+		b.WriteRune(r)
+		s = tail
+	}
+	if len(s) == 0 || s[0] != quote {
+		return 0, "", errorAt(pos, "unterminated string")
+	}
+	return len(query) - len(s) + 1, b.String(), nil
+}
+
+func isSpace(c byte) bool {
+	return unicode.IsSpace(rune(c))
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+// isIdentifierStart reports whether c can start an identifier.
+func isIdentifierStart(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c == '_' || c == ':'
+}
+
+// isIdentifierChar reports whether c can be part of an identifier.
+// Profile type IDs are identifiers, they contain colons and may contain dots.
+func isIdentifierChar(c byte) bool {
+	return isIdentifierStart(c) || isDigit(c) || c == '.'
+}
@@ -0,0 +1,298 @@
+package phlareql
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+
+	"github.com/prometheus/prometheus/model/labels"
+)
+
+// ParseError is returned for invalid queries.
+type ParseError struct {
+	// Pos is the byte offset of the error in the query.
+	Pos int
+	Err string
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("parse error at char %d: %s", e.Pos+1, e.Err)
+}
+
+func errorAt(pos int, format string, args ...interface{}) error {
+	return &ParseError{Pos: pos, Err: fmt.Sprintf(format, args...)}
+}
+
+// ParseExpr parses a query.
+func ParseExpr(query string) (Expr, error) {
+	tokens, err := lex(query)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{tokens: tokens}
+	expr, err := p.parseExpr()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.next(); t.typ != tokenEOF {
+		return nil, errorAt(t.pos, "unexpected %s", t)
+	}
+	return expr, nil
+}
+
+type parser struct {
+	tokens []token
+	pos    int
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() token {
+	t := p.tokens[p.pos]
+	// The last token is tokenEOF, which is returned forever.
+	if p.pos < len(p.tokens)-1 {
+		p.pos++
+	}
+	return t
+}
+
+func (p *parser) expect(typ tokenType, context string) (token, error) {
+	t := p.next()
+	if t.typ != typ {
+		return t, errorAt(t.pos, "unexpected %s in %s", t, context)
+	}
+	return t, nil
+}
+
+var binaryOps = map[tokenType]BinaryOp{
+	tokenAdd: Add,
+	tokenSub: Sub,
+	tokenMul: Mul,
+	tokenDiv: Div,
+}
+
+// parseExpr parses binary expressions, + and - have a lower precedence than * and /.
+func (p *parser) parseExpr() (Expr, error) {
+	return p.parseBinaryExpr(1)
+}
+
+func (p *parser) parseBinaryExpr(precedence int) (Expr, error) {
+	parseOperand := p.parseUnaryExpr
+	if precedence == 1 {
+		parseOperand = func() (Expr, error) { return p.parseBinaryExpr(2) }
+	}
+	lhs, err := parseOperand()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op, ok := binaryOps[p.peek().typ]
+		if !ok || op.precedence() != precedence {
+			return lhs, nil
+		}
+		p.next()
+		rhs, err := parseOperand()
+		if err != nil {
+			return nil, err
+		}
+		lhs = &BinaryExpr{Op: op, LHS: lhs, RHS: rhs}
+	}
+}
+
+func (p *parser) parseUnaryExpr() (Expr, error) {
+	t := p.next()
+	switch t.typ {
+	case tokenNumber:
+		return p.parseNumber(t, 1)
+	case tokenSub:
+		n, err := p.expect(tokenNumber, "negative number")
+		if err != nil {
+			return nil, err
+		}
+		return p.parseNumber(n, -1)
+	case tokenLeftParen:
+		expr, err := p.parseExpr()
+		if err != nil {
+			return nil, err
+		}
+		if _, err := p.expect(tokenRightParen, "parenthesized expression"); err != nil {
+			return nil, err
+		}
+		return expr, nil
+	case tokenLeftBrace:
+		return p.parseSelector("", t.pos)
+	case tokenIdentifier:
+		next := p.peek()
+		if op, ok := aggregateOps[t.val]; ok && (next.typ == tokenLeftParen || isKeyword(next, "by")) {
+			return p.parseAggregateExpr(op)
+		}
+		if next.typ == tokenLeftParen {
+			return p.parseCall(t)
+		}
+		if next.typ == tokenLeftBrace {
+			p.next()
+			return p.parseSelector(t.val, t.pos)
+		}
+		return &Selector{Name: t.val}, nil
+	}
+	return nil, errorAt(t.pos, "unexpected %s", t)
+}
+
+func (p *parser) parseNumber(t token, sign float64) (*NumberLiteral, error) {
+	v, err := strconv.ParseFloat(t.val, 64)
+	if err != nil || math.IsInf(v, 0) {
+		return nil, errorAt(t.pos, "invalid number %s", t)
+	}
+	return &NumberLiteral{Val: sign * v}, nil
+}
+
+// parseSelector parses the matchers of a selector, after the opening brace.
+// The profile type is either the name or set with a __name__ equal matcher.
+func (p *parser) parseSelector(name string, pos int) (*Selector, error) {
+	s := &Selector{Name: name}
+	for p.peek().typ != tokenRightBrace {
+		label, err := p.expect(tokenIdentifier, "label matcher")
+		if err != nil {
+			return nil, err
+		}
+		opToken := p.next()
+		var op labels.MatchType
+		switch opToken.typ {
+		case tokenEqual:
+			op = labels.MatchEqual
+		case tokenNotEqual:
+			op = labels.MatchNotEqual
+		case tokenRegexMatch:
+			op = labels.MatchRegexp
+		case tokenRegexNotMatch:
+			op = labels.MatchNotRegexp
+		default:
+			return nil, errorAt(opToken.pos, "unexpected %s in label matcher, expected one of =, !=, =~, !~", opToken)
+		}
+		value, err := p.expect(tokenString, "label matcher")
+		if err != nil {
+			return nil, err
+		}
+		if label.val == labels.MetricName {
+			if op != labels.MatchEqual || s.Name != "" {
+				return nil, errorAt(label.pos, "the profile type must be selected once, with the = operator")
+			}
+			s.Name = value.val
+		} else {
+			m, err := labels.NewMatcher(op, label.val, value.val)
+			if err != nil {
+				return nil, errorAt(value.pos, "invalid label matcher: %v", err)
+			}
+			s.Matchers = append(s.Matchers, m)
+		}
+		if p.peek().typ == tokenRightBrace {
+			break
+		}
+		if _, err := p.expect(tokenComma, "label matchers"); err != nil {
+			return nil, err
+		}
+	}
+	p.next()
+	if s.Name == "" {
+		return nil, errorAt(pos, "selector must select a profile type")
+	}
+	return s, nil
+}
+
+// parseAggregateExpr parses an aggregation, after its operator.
+// The grouping is either before or after the arguments.
+func (p *parser) parseAggregateExpr(op AggregateOp) (*AggregateExpr, error) {
+	a := &AggregateExpr{Op: op}
+	var err error
+	if isKeyword(p.peek(), "by") {
+		if a.Grouping, err = p.parseGrouping(); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := p.expect(tokenLeftParen, "aggregation"); err != nil {
+		return nil, err
+	}
+	if op == TopK || op == BottomK {
+		t, err := p.expect(tokenNumber, "aggregation parameter")
+		if err != nil {
+			return nil, err
+		}
+		k, err := strconv.Atoi(t.val)
+		if err != nil || k <= 0 {
+			return nil, errorAt(t.pos, "%s parameter must be a positive integer, got %s", op, t)
+		}
+		a.Param = k
+		if _, err := p.expect(tokenComma, "aggregation"); err != nil {
+			return nil, err
+		}
+	}
+	if a.Expr, err = p.parseExpr(); err != nil {
+		return nil, err
+	}
+	if _, err := p.expect(tokenRightParen, "aggregation"); err != nil {
+		return nil, err
+	}
+	if a.Grouping == nil && isKeyword(p.peek(), "by") {
+		if a.Grouping, err = p.parseGrouping(); err != nil {
+			return nil, err
+		}
+	}
+	return a, nil
+}
+
+func (p *parser) parseGrouping() ([]string, error) {
+	p.next()
+	if _, err := p.expect(tokenLeftParen, "grouping"); err != nil {
+		return nil, err
+	}
+	grouping := []string{}
+	for p.peek().typ != tokenRightParen {
+		label, err := p.expect(tokenIdentifier, "grouping")
+		if err != nil {
+			return nil, err
+		}
+		grouping = append(grouping, label.val)
+		if p.peek().typ == tokenRightParen {
+			break
+		}
+		if _, err := p.expect(tokenComma, "grouping"); err != nil {
+			return nil, err
+		}
+	}
+	p.next()
+	return grouping, nil
+}
+
+// parseCall parses a function call, after the function name.
+func (p *parser) parseCall(name token) (*Call, error) {
+	arity, ok := functions[name.val]
+	if !ok {
+		return nil, errorAt(name.pos, "unknown function %s", name)
+	}
+	p.next()
+	c := &Call{Func: name.val}
+	for p.peek().typ != tokenRightParen {
+		arg, err := p.parseExpr()
+		if err != nil {
+			return nil, err
+		}
+		c.Args = append(c.Args, arg)
+		if p.peek().typ == tokenRightParen {
+			break
+		}
+		if _, err := p.expect(tokenComma, "function call"); err != nil {
+			return nil, err
+		}
+	}
+	p.next()
+	if len(c.Args) != arity {
+		return nil, errorAt(name.pos, "function %s expects %d arguments, got %d", name.val, arity, len(c.Args))
+	}
+	return c, nil
+}
+
+func isKeyword(t token, keyword string) bool {
+	return t.typ == tokenIdentifier && t.val == keyword
+}
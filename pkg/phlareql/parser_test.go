@@ -0,0 +1,131 @@
+package phlareql
+
+import (
+	"testing"
+
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseExpr(t *testing.T) {
+	cpu := "process_cpu:cpu:nanoseconds:cpu:nanoseconds"
+	for _, tc := range []struct {
+		query    string
+		expected Expr
+		// String of the expression, the query when empty.
+		str string
+	}{
+		{
+			query:    cpu,
+			expected: &Selector{Name: cpu},
+		},
+		{
+			query: `memory:alloc_space{service="api", pod=~"api-.*",}`,
+			expected: &Selector{Name: "memory:alloc_space", Matchers: []*labels.Matcher{
+				labels.MustNewMatcher(labels.MatchEqual, "service", "api"),
+				labels.MustNewMatcher(labels.MatchRegexp, "pod", "api-.*"),
+			}},
+			str: `memory:alloc_space{service="api",pod=~"api-.*"}`,
+		},
+		{
+			query: `{__name__='cpu', env!="dev", pod!~` + "`a\\d`" + `}`,
+			expected: &Selector{Name: "cpu", Matchers: []*labels.Matcher{
+				labels.MustNewMatcher(labels.MatchNotEqual, "env", "dev"),
+				labels.MustNewMatcher(labels.MatchNotRegexp, "pod", `a\d`),
+			}},
+			str: `cpu{env!="dev",pod!~"a\\d"}`,
+		},
+		{
+			query: `sum by (service, pod) (cpu{env="prod"})`,
+			expected: &AggregateExpr{Op: Sum, Grouping: []string{"service", "pod"}, Expr: &Selector{
+				Name:     "cpu",
+				Matchers: []*labels.Matcher{labels.MustNewMatcher(labels.MatchEqual, "env", "prod")},
+			}},
+			str: `sum by (service, pod) (cpu{env="prod"})`,
+		},
+		{
+			query:    `avg(cpu) by (service)`,
+			expected: &AggregateExpr{Op: Avg, Grouping: []string{"service"}, Expr: &Selector{Name: "cpu"}},
+			str:      `avg by (service) (cpu)`,
+		},
+		{
+			query: `topk(5, sum by (pod) (rate(cpu)))`,
+			expected: &AggregateExpr{Op: TopK, Param: 5, Expr: &AggregateExpr{
+				Op: Sum, Grouping: []string{"pod"}, Expr: &Call{Func: "rate", Args: []Expr{&Selector{Name: "cpu"}}},
+			}},
+		},
+		{
+			query: `alloc_space / alloc_objects * 2 + 1`,
+			expected: &BinaryExpr{
+				Op: Add,
+				LHS: &BinaryExpr{
+					Op:  Mul,
+					LHS: &BinaryExpr{Op: Div, LHS: &Selector{Name: "alloc_space"}, RHS: &Selector{Name: "alloc_objects"}},
+					RHS: &NumberLiteral{Val: 2},
+				},
+				RHS: &NumberLiteral{Val: 1},
+			},
+		},
+		{
+			query: `alloc_space / (alloc_objects - -1.5e3)`,
+			expected: &BinaryExpr{
+				Op:  Div,
+				LHS: &Selector{Name: "alloc_space"},
+				RHS: &BinaryExpr{Op: Sub, LHS: &Selector{Name: "alloc_objects"}, RHS: &NumberLiteral{Val: -1500}},
+			},
+			str: `alloc_space / (alloc_objects - -1500)`,
+		},
+		{
+			query: `diff(cpu{version="1"}, cpu{version="2"})`,
+			expected: &Call{Func: "diff", Args: []Expr{
+				&Selector{Name: "cpu", Matchers: []*labels.Matcher{labels.MustNewMatcher(labels.MatchEqual, "version", "1")}},
+				&Selector{Name: "cpu", Matchers: []*labels.Matcher{labels.MustNewMatcher(labels.MatchEqual, "version", "2")}},
+			}},
+		},
+	} {
+		tc := tc
+		t.Run(tc.query, func(t *testing.T) {
+			expr, err := ParseExpr(tc.query)
+			require.NoError(t, err)
+			require.Equal(t, tc.expected, expr)
+			str := tc.str
+			if str == "" {
+				str = tc.query
+			}
+			require.Equal(t, str, expr.String())
+			// The string of an expression is parsed into the same expression.
+			reparsed, err := ParseExpr(expr.String())
+			require.NoError(t, err)
+			require.Equal(t, expr, reparsed)
+		})
+	}
+}
+
+func TestParseExprErrors(t *testing.T) {
+	for _, tc := range []struct {
+		query string
+		err   string
+	}{
+		{``, `parse error at char 1: unexpected end of query`},
+		{`{service="api"}`, `parse error at char 1: selector must select a profile type`},
+		{`cpu{service="api"`, `parse error at char 18: unexpected end of query in label matchers`},
+		{`cpu{service=api}`, `parse error at char 13: unexpected "api" in label matcher`},
+		{`cpu{service~"api"}`, `parse error at char 12: unexpected character '~'`},
+		{`cpu{pod=~"("}`, "parse error at char 10: invalid label matcher: error parsing regexp: missing closing ): `^(?:()$`"},
+		{`cpu{__name__=~"c.*"}`, `parse error at char 5: the profile type must be selected once, with the = operator`},
+		{`cpu{service="api}`, `parse error at char 13: unterminated string`},
+		{`sum by service (cpu)`, `parse error at char 8: unexpected "service" in grouping`},
+		{`topk(cpu)`, `parse error at char 6: unexpected "cpu" in aggregation parameter`},
+		{`topk(1.5, cpu)`, `parse error at char 6: topk parameter must be a positive integer, got "1.5"`},
+		{`rate(cpu, cpu)`, `parse error at char 1: function rate expects 1 arguments, got 2`},
+		{`delta(cpu)`, `parse error at char 1: unknown function "delta"`},
+		{`cpu cpu`, `parse error at char 5: unexpected "cpu"`},
+		{`cpu / `, `parse error at char 7: unexpected end of query`},
+	} {
+		tc := tc
+		t.Run(tc.query, func(t *testing.T) {
+			_, err := ParseExpr(tc.query)
+			require.EqualError(t, err, tc.err)
+		})
+	}
+}
@@ -0,0 +1,316 @@
+package querier
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/bufbuild/connect-go"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql/parser"
+	"github.com/samber/lo"
+	"golang.org/x/sync/errgroup"
+
+	commonv1 "github.com/grafana/phlare/pkg/gen/common/v1"
+	ingestv1 "github.com/grafana/phlare/pkg/gen/ingester/v1"
+	querierv1 "github.com/grafana/phlare/pkg/gen/querier/v1"
+	"github.com/grafana/phlare/pkg/iter"
+	phlaremodel "github.com/grafana/phlare/pkg/model"
+	"github.com/grafana/phlare/pkg/tenant"
+)
+
+// federatedTenants returns the tenants of a query across several tenants,
+// separated by | in the tenant ID of the context, or nil when the query
+// targets a single tenant. Federation must be enabled for all the tenants.
+func (q *Querier) federatedTenants(ctx context.Context) ([]string, error) {
+	orgID, err := tenant.ExtractTenantIDFromContext(ctx)
+	if err != nil || !strings.Contains(orgID, "|") {
+		return nil, nil
+	}
+	tenantIDs, err := tenant.ExtractTenantIDsFromContext(ctx)
+	if err != nil {
+		return nil, connect.NewError(connect.CodeInvalidArgument, err)
+	}
+	for _, tenantID := range tenantIDs {
+		if q.limits == nil || !q.limits.TenantFederationEnabled(tenantID) {
+			return nil, connect.NewError(connect.CodePermissionDenied, fmt.Errorf("tenant federation is not enabled for tenant %s", tenantID))
+		}
+	}
+	return tenantIDs, nil
+}
+
+// tenantSelector returns the selector without its matchers of the tenant
+// label, and whether the tenant matches them.
+func tenantSelector(selector, tenantID string) (string, bool, error) {
+	matchers, err := parser.ParseMetricSelector(selector)
+	if err != nil {
+		return "", false, connect.NewError(connect.CodeInvalidArgument, err)
+	}
+	if !lo.ContainsBy(matchers, func(m *labels.Matcher) bool { return m.Name == phlaremodel.LabelNameTenantID }) {
+		return selector, true, nil
+	}
+	others := make([]string, 0, len(matchers))
+	for _, m := range matchers {
+		if m.Name != phlaremodel.LabelNameTenantID {
+			others = append(others, m.String())
+			continue
+		}
+		if !m.Matches(tenantID) {
+			return "", false, nil
+		}
+	}
+	return "{" + strings.Join(others, ",") + "}", true, nil
+}
+
+// tenantSelectors returns the selectors matching the tenant, without their
+// matchers of the tenant label, and whether any selector matches the tenant.
+// All tenants match when there are no selectors.
+func tenantSelectors(selectors []string, tenantID string) ([]string, bool, error) {
+	if len(selectors) == 0 {
+		return nil, true, nil
+	}
+	result := make([]string, 0, len(selectors))
+	for _, s := range selectors {
+		selector, ok, err := tenantSelector(s, tenantID)
+		if err != nil {
+			return nil, false, err
+		}
+		if ok {
+			result = append(result, selector)
+		}
+	}
+	return result, len(result) > 0, nil
+}
+
+// forTenants runs f, in parallel, for each tenant with the context of the tenant.
+func forTenants[T any](ctx context.Context, tenantIDs []string, f func(ctx context.Context, tenantID string) (T, error)) ([]T, error) {
+	results := make([]T, len(tenantIDs))
+	g, gCtx := errgroup.WithContext(ctx)
+	for i, tenantID := range tenantIDs {
+		i, tenantID := i, tenantID
+		g.Go(func() error {
+			res, err := f(tenant.InjectTenantID(gCtx, tenantID), tenantID)
+			results[i] = res
+			return err
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+func (q *Querier) federatedProfileTypes(ctx context.Context, tenantIDs []string, req *querierv1.ProfileTypesRequest) (*querierv1.ProfileTypesResponse, error) {
+	responses, err := forTenants(ctx, tenantIDs, func(ctx context.Context, _ string) ([]*commonv1.ProfileType, error) {
+		res, err := q.ProfileTypes(ctx, connect.NewRequest(req))
+		if err != nil {
+			return nil, err
+		}
+		return res.Msg.ProfileTypes, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	profileTypes := lo.UniqBy(lo.Flatten(responses), func(t *commonv1.ProfileType) string { return t.ID })
+	sort.Slice(profileTypes, func(i, j int) bool { return profileTypes[i].ID < profileTypes[j].ID })
+	return &querierv1.ProfileTypesResponse{ProfileTypes: profileTypes}, nil
+}
+
+func (q *Querier) federatedLabelValues(ctx context.Context, tenantIDs []string, req *querierv1.LabelValuesRequest) (*querierv1.LabelValuesResponse, error) {
+	responses, err := forTenants(ctx, tenantIDs, func(ctx context.Context, tenantID string) ([]string, error) {
+		matchers, ok, err := tenantSelectors(req.Matchers, tenantID)
+		if err != nil || !ok {
+			return nil, err
+		}
+		if req.Name == phlaremodel.LabelNameTenantID {
+			return []string{tenantID}, nil
+		}
+		res, err := q.LabelValues(ctx, connect.NewRequest(&querierv1.LabelValuesRequest{
+			Name:     req.Name,
+			Matchers: matchers,
+			Start:    req.Start,
+			End:      req.End,
+		}))
+		if err != nil {
+			return nil, err
+		}
+		return res.Msg.Names, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &querierv1.LabelValuesResponse{Names: uniqueSortedTenantStrings(responses)}, nil
+}
+
+func (q *Querier) federatedLabelNames(ctx context.Context, tenantIDs []string, req *querierv1.LabelNamesRequest) (*querierv1.LabelNamesResponse, error) {
+	responses, err := forTenants(ctx, tenantIDs, func(ctx context.Context, tenantID string) ([]string, error) {
+		matchers, ok, err := tenantSelectors(req.Matchers, tenantID)
+		if err != nil || !ok {
+			return nil, err
+		}
+		res, err := q.LabelNames(ctx, connect.NewRequest(&querierv1.LabelNamesRequest{
+			Matchers: matchers,
+			Start:    req.Start,
+			End:      req.End,
+		}))
+		if err != nil {
+			return nil, err
+		}
+		return append(res.Msg.Names, phlaremodel.LabelNameTenantID), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &querierv1.LabelNamesResponse{Names: uniqueSortedTenantStrings(responses)}, nil
+}
+
+func (q *Querier) federatedSeries(ctx context.Context, tenantIDs []string, req *querierv1.SeriesRequest) (*querierv1.SeriesResponse, error) {
+	responses, err := forTenants(ctx, tenantIDs, func(ctx context.Context, tenantID string) ([]*commonv1.Labels, error) {
+		matchers, ok, err := tenantSelectors(req.Matchers, tenantID)
+		if err != nil || !ok {
+			return nil, err
+		}
+		res, err := q.Series(ctx, connect.NewRequest(&querierv1.SeriesRequest{
+			Matchers: matchers,
+			Start:    req.Start,
+			End:      req.End,
+		}))
+		if err != nil {
+			return nil, err
+		}
+		for _, lbs := range res.Msg.LabelsSet {
+			lbs.Labels = withTenantLabel(lbs.Labels, tenantID)
+		}
+		return res.Msg.LabelsSet, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	labelsSet := lo.Flatten(responses)
+	sort.Slice(labelsSet, func(i, j int) bool {
+		return phlaremodel.CompareLabelPairs(labelsSet[i].Labels, labelsSet[j].Labels) < 0
+	})
+	return &querierv1.SeriesResponse{LabelsSet: labelsSet}, nil
+}
+
+// selectFederatedStacktraces selects the stacktraces of the profiles of each tenant.
+// The tenant label is added to the labels of the groups when grouped by it.
+func (q *Querier) selectFederatedStacktraces(ctx context.Context, tenantIDs []string, profileType *commonv1.ProfileType, selector string, start, end int64, by []string) ([]stacktraces, error) {
+	byTenant := lo.Contains(by, phlaremodel.LabelNameTenantID)
+	results, err := forTenants(ctx, tenantIDs, func(ctx context.Context, tenantID string) ([]stacktraces, error) {
+		selector, ok, err := tenantSelector(selector, tenantID)
+		if err != nil || !ok {
+			return nil, err
+		}
+		st, err := q.selectShardedStacktraces(ctx, profileType, selector, start, end, lo.Without(by, phlaremodel.LabelNameTenantID))
+		if err != nil || !byTenant {
+			return st, err
+		}
+		withTenant := make(map[uint64]phlaremodel.Labels)
+		for i := range st {
+			hash := st[i].labels.Hash()
+			lbs, ok := withTenant[hash]
+			if !ok {
+				lbs = append(st[i].labels.Clone(), &commonv1.LabelPair{Name: phlaremodel.LabelNameTenantID, Value: tenantID})
+				sort.Sort(lbs)
+				withTenant[hash] = lbs
+			}
+			st[i].labels = lbs
+		}
+		return st, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return lo.Flatten(results), nil
+}
+
+// selectFederatedProfileValues selects the values of the profiles of each
+// tenant. The tenant label is added to the labels of the values when they are
+// grouped by it, or not grouped at all.
+func (q *Querier) selectFederatedProfileValues(ctx context.Context, tenantIDs []string, req *ingestv1.MergeProfilesLabelsRequest) (iter.Iterator[ProfileValue], error) {
+	var (
+		byTenant = len(req.By) == 0 || lo.Contains(req.By, phlaremodel.LabelNameTenantID)
+		// Ingesters group all values of a tenant together when grouped only by tenant.
+		onlyTenant = len(req.By) == 1 && byTenant
+		by         = lo.Without(req.By, phlaremodel.LabelNameTenantID)
+	)
+	iters, err := forTenants(ctx, tenantIDs, func(ctx context.Context, tenantID string) (iter.Iterator[ProfileValue], error) {
+		selector, ok, err := tenantSelector(req.Request.LabelSelector, tenantID)
+		if err != nil || !ok {
+			return iter.NewSliceIterator[ProfileValue](nil), err
+		}
+		it, err := q.selectProfileValues(ctx, &ingestv1.MergeProfilesLabelsRequest{
+			Request: &ingestv1.SelectProfilesRequest{
+				LabelSelector: selector,
+				Start:         req.Request.Start,
+				End:           req.Request.End,
+				Type:          req.Request.Type,
+			},
+			By:          by,
+			Aggregation: req.Aggregation,
+			Step:        req.Step,
+		})
+		if err != nil || !byTenant {
+			return it, err
+		}
+		return &tenantProfileValues{Iterator: it, tenantID: tenantID, onlyTenant: onlyTenant, labels: make(map[uint64]tenantLabels)}, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return iter.NewSortProfileIterator(iters), nil
+}
+
+// tenantProfileValues adds the tenant label to the labels of profile values.
+type tenantProfileValues struct {
+	iter.Iterator[ProfileValue]
+	tenantID string
+	// onlyTenant replaces the labels of the values with the tenant label.
+	onlyTenant bool
+
+	// labels caches the labels with the tenant label by hash of the labels without.
+	labels map[uint64]tenantLabels
+	curr   ProfileValue
+}
+
+type tenantLabels struct {
+	lbs  phlaremodel.Labels
+	hash uint64
+}
+
+func (it *tenantProfileValues) Next() bool {
+	if !it.Iterator.Next() {
+		return false
+	}
+	it.curr = it.Iterator.At()
+	l, ok := it.labels[it.curr.LabelsHash]
+	if !ok {
+		if it.onlyTenant {
+			l.lbs = phlaremodel.LabelsFromStrings(phlaremodel.LabelNameTenantID, it.tenantID)
+		} else {
+			l.lbs = withTenantLabel(it.curr.Lbs, it.tenantID)
+		}
+		l.hash = l.lbs.Hash()
+		it.labels[it.curr.LabelsHash] = l
+	}
+	it.curr.Lbs = l.lbs
+	it.curr.LabelsHash = l.hash
+	return true
+}
+
+func (it *tenantProfileValues) At() ProfileValue {
+	return it.curr
+}
+
+// withTenantLabel returns the labels with the tenant label.
+func withTenantLabel(lbs phlaremodel.Labels, tenantID string) phlaremodel.Labels {
+	return phlaremodel.NewLabelsBuilder(lbs).Set(phlaremodel.LabelNameTenantID, tenantID).Labels()
+}
+
+func uniqueSortedTenantStrings(responses [][]string) []string {
+	result := lo.Uniq(lo.Flatten(responses))
+	sort.Strings(result)
+	return result
+}
@@ -0,0 +1,226 @@
+package querier
+
+import (
+	"context"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bufbuild/connect-go"
+	"github.com/go-kit/log"
+	"github.com/grafana/dskit/ring"
+	"github.com/grafana/dskit/ring/client"
+	"github.com/stretchr/testify/require"
+
+	commonv1 "github.com/grafana/phlare/pkg/gen/common/v1"
+	ingestv1 "github.com/grafana/phlare/pkg/gen/ingester/v1"
+	querierv1 "github.com/grafana/phlare/pkg/gen/querier/v1"
+	"github.com/grafana/phlare/pkg/ingester/clientpool"
+	phlaremodel "github.com/grafana/phlare/pkg/model"
+	"github.com/grafana/phlare/pkg/tenant"
+	"github.com/grafana/phlare/pkg/testhelper"
+	"github.com/grafana/phlare/pkg/validation"
+)
+
+// tenantIngester answers with the series of the tenant of the request.
+type tenantIngester struct {
+	testhelper.FakePoolClient
+
+	mtx      sync.Mutex
+	series   map[string][]*commonv1.Labels
+	values   map[string]float64
+	matchers map[string][]string
+}
+
+func newTenantIngester() *tenantIngester {
+	return &tenantIngester{
+		series: map[string][]*commonv1.Labels{
+			"a": {{Labels: phlaremodel.LabelsFromStrings("service", "api", "pod", "api-1")}},
+			"b": {{Labels: phlaremodel.LabelsFromStrings("service", "api", "pod", "api-2")}, {Labels: phlaremodel.LabelsFromStrings("service", "db")}},
+			"c": {{Labels: phlaremodel.LabelsFromStrings("service", "api")}},
+		},
+		values:   map[string]float64{"a": 1, "b": 2, "c": 4},
+		matchers: make(map[string][]string),
+	}
+}
+
+func (f *tenantIngester) tenant(ctx context.Context, matchers []string) string {
+	tenantID, err := tenant.ExtractTenantIDFromContext(ctx)
+	if err != nil {
+		panic(err)
+	}
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	f.matchers[tenantID] = matchers
+	return tenantID
+}
+
+func (f *tenantIngester) LabelValues(ctx context.Context, req *connect.Request[ingestv1.LabelValuesRequest]) (*connect.Response[ingestv1.LabelValuesResponse], error) {
+	var names []string
+	for _, lbs := range f.series[f.tenant(ctx, req.Msg.Matchers)] {
+		if v := phlaremodel.Labels(lbs.Labels).Get(req.Msg.Name); v != "" {
+			names = append(names, v)
+		}
+	}
+	return connect.NewResponse(&ingestv1.LabelValuesResponse{Names: names}), nil
+}
+
+func (f *tenantIngester) LabelNames(ctx context.Context, req *connect.Request[ingestv1.LabelNamesRequest]) (*connect.Response[ingestv1.LabelNamesResponse], error) {
+	var names []string
+	for _, lbs := range f.series[f.tenant(ctx, req.Msg.Matchers)] {
+		for _, l := range lbs.Labels {
+			names = append(names, l.Name)
+		}
+	}
+	return connect.NewResponse(&ingestv1.LabelNamesResponse{Names: names}), nil
+}
+
+func (f *tenantIngester) ProfileTypes(ctx context.Context, req *connect.Request[ingestv1.ProfileTypesRequest]) (*connect.Response[ingestv1.ProfileTypesResponse], error) {
+	return connect.NewResponse(&ingestv1.ProfileTypesResponse{
+		ProfileTypes: []*commonv1.ProfileType{{ID: "profile:" + f.tenant(ctx, nil)}},
+	}), nil
+}
+
+func (f *tenantIngester) Series(ctx context.Context, req *connect.Request[ingestv1.SeriesRequest]) (*connect.Response[ingestv1.SeriesResponse], error) {
+	var labelsSet []*commonv1.Labels
+	for _, lbs := range f.series[f.tenant(ctx, req.Msg.Matchers)] {
+		labelsSet = append(labelsSet, &commonv1.Labels{Labels: phlaremodel.Labels(lbs.Labels).Clone()})
+	}
+	return connect.NewResponse(&ingestv1.SeriesResponse{LabelsSet: labelsSet}), nil
+}
+
+func (f *tenantIngester) MergeProfilesStacktraces(ctx context.Context) clientpool.BidiClientMergeProfilesStacktraces {
+	f.tenant(ctx, nil)
+	return newFakeBidiClientStacktraces([]*ingestv1.ProfileSets{{
+		LabelsSets: []*commonv1.Labels{{Labels: phlaremodel.LabelsFromStrings("service", "api")}},
+		Profiles:   []*ingestv1.SeriesProfile{{Timestamp: 1, LabelIndex: 0}},
+	}})
+}
+
+func (f *tenantIngester) MergeProfilesLabels(ctx context.Context) clientpool.BidiClientMergeProfilesLabels {
+	tenantID := f.tenant(ctx, nil)
+	var result []*commonv1.Series
+	for _, lbs := range f.series[tenantID] {
+		result = append(result, &commonv1.Series{
+			Labels: phlaremodel.LabelsFromStrings("service", phlaremodel.Labels(lbs.Labels).Get("service")),
+			Points: []*commonv1.Point{{Timestamp: 1, Value: f.values[tenantID]}},
+		})
+	}
+	return newFakeBidiClientSeries([]*ingestv1.ProfileSets{{
+		LabelsSets: []*commonv1.Labels{{Labels: phlaremodel.LabelsFromStrings("service", "api")}},
+		Profiles:   []*ingestv1.SeriesProfile{{Timestamp: 1, LabelIndex: 0}},
+	}}, result...)
+}
+
+func newFederationTestQuerier(t *testing.T) (*Querier, *tenantIngester) {
+	ingester := newTenantIngester()
+	querier, err := New(Config{
+		PoolConfig: clientpool.PoolConfig{ClientCleanupPeriod: 1 * time.Millisecond},
+	}, testhelper.NewMockRing([]ring.InstanceDesc{{Addr: "1"}}, 1), func(addr string) (client.PoolClient, error) {
+		return ingester, nil
+	}, validation.MockOverrides(func(defaults *validation.Limits, tenantLimits map[string]*validation.Limits) {
+		defaults.TenantFederationEnabled = true
+		c := *defaults
+		c.TenantFederationEnabled = false
+		tenantLimits["c"] = &c
+	}), nil, log.NewLogfmtLogger(os.Stdout))
+	require.NoError(t, err)
+	return querier, ingester
+}
+
+func Test_FederatedLabels(t *testing.T) {
+	querier, ingester := newFederationTestQuerier(t)
+	ctx := tenant.InjectTenantID(context.Background(), "b|a")
+
+	names, err := querier.LabelNames(ctx, connect.NewRequest(&querierv1.LabelNamesRequest{}))
+	require.NoError(t, err)
+	require.Equal(t, []string{"__tenant_id__", "pod", "service"}, names.Msg.Names)
+
+	values, err := querier.LabelValues(ctx, connect.NewRequest(&querierv1.LabelValuesRequest{Name: "pod"}))
+	require.NoError(t, err)
+	require.Equal(t, []string{"api-1", "api-2"}, values.Msg.Names)
+
+	values, err = querier.LabelValues(ctx, connect.NewRequest(&querierv1.LabelValuesRequest{
+		Name:     "__tenant_id__",
+		Matchers: []string{`{__tenant_id__=~"b|c"}`},
+	}))
+	require.NoError(t, err)
+	require.Equal(t, []string{"b"}, values.Msg.Names)
+
+	profileTypes, err := querier.ProfileTypes(ctx, connect.NewRequest(&querierv1.ProfileTypesRequest{}))
+	require.NoError(t, err)
+	require.Equal(t, []*commonv1.ProfileType{{ID: "profile:a"}, {ID: "profile:b"}}, profileTypes.Msg.ProfileTypes)
+
+	// The tenant matchers select the tenants and are not sent to the ingesters.
+	ingester.matchers = make(map[string][]string)
+	series, err := querier.Series(ctx, connect.NewRequest(&querierv1.SeriesRequest{
+		Matchers: []string{`{__tenant_id__="a",service="api"}`},
+	}))
+	require.NoError(t, err)
+	require.Equal(t, map[string][]string{"a": {`{service="api"}`}}, ingester.matchers)
+	require.Equal(t, []*commonv1.Labels{
+		{Labels: phlaremodel.LabelsFromStrings("__tenant_id__", "a", "pod", "api-1", "service", "api")},
+	}, series.Msg.LabelsSet)
+
+	series, err = querier.Series(ctx, connect.NewRequest(&querierv1.SeriesRequest{}))
+	require.NoError(t, err)
+	require.Equal(t, []*commonv1.Labels{
+		{Labels: phlaremodel.LabelsFromStrings("__tenant_id__", "a", "pod", "api-1", "service", "api")},
+		{Labels: phlaremodel.LabelsFromStrings("__tenant_id__", "b", "pod", "api-2", "service", "api")},
+		{Labels: phlaremodel.LabelsFromStrings("__tenant_id__", "b", "service", "db")},
+	}, series.Msg.LabelsSet)
+}
+
+func Test_FederatedSelect(t *testing.T) {
+	querier, _ := newFederationTestQuerier(t)
+	ctx := tenant.InjectTenantID(context.Background(), "a|b")
+
+	selectSeries := func(selector string, groupBy ...string) []*commonv1.Series {
+		res, err := querier.SelectSeries(ctx, connect.NewRequest(&querierv1.SelectSeriesRequest{
+			ProfileTypeID: "memory:inuse_space:bytes:space:bytes",
+			LabelSelector: selector,
+			Start:         0,
+			End:           2,
+			Step:          0.001,
+			GroupBy:       groupBy,
+		}))
+		require.NoError(t, err)
+		return res.Msg.Series
+	}
+	testhelper.EqualProto(t, []*commonv1.Series{
+		{Labels: phlaremodel.LabelsFromStrings("__tenant_id__", "a"), Points: []*commonv1.Point{{Timestamp: 1, Value: 1}}},
+		{Labels: phlaremodel.LabelsFromStrings("__tenant_id__", "b"), Points: []*commonv1.Point{{Timestamp: 1, Value: 4}}},
+	}, selectSeries("{}", "__tenant_id__"))
+	testhelper.EqualProto(t, []*commonv1.Series{
+		{Labels: phlaremodel.LabelsFromStrings("service", "api"), Points: []*commonv1.Point{{Timestamp: 1, Value: 3}}},
+		{Labels: phlaremodel.LabelsFromStrings("service", "db"), Points: []*commonv1.Point{{Timestamp: 1, Value: 2}}},
+	}, selectSeries("{}", "service"))
+	testhelper.EqualProto(t, []*commonv1.Series{
+		{Labels: phlaremodel.LabelsFromStrings("__tenant_id__", "b", "service", "api"), Points: []*commonv1.Point{{Timestamp: 1, Value: 2}}},
+		{Labels: phlaremodel.LabelsFromStrings("__tenant_id__", "b", "service", "db"), Points: []*commonv1.Point{{Timestamp: 1, Value: 2}}},
+	}, selectSeries(`{__tenant_id__!="a"}`))
+
+	res, err := querier.SelectMergeStacktraces(ctx, connect.NewRequest(&querierv1.SelectMergeStacktracesRequest{
+		ProfileTypeID: "memory:inuse_space:bytes:space:bytes",
+		LabelSelector: "{}",
+		Start:         0,
+		End:           2,
+	}))
+	require.NoError(t, err)
+	// The stacktraces of both tenants are merged.
+	require.Equal(t, int64(2), res.Msg.Flamegraph.Total)
+}
+
+func Test_FederationDisabled(t *testing.T) {
+	querier, _ := newFederationTestQuerier(t)
+
+	_, err := querier.LabelNames(tenant.InjectTenantID(context.Background(), "a|c"), connect.NewRequest(&querierv1.LabelNamesRequest{}))
+	require.Equal(t, connect.CodePermissionDenied, connect.CodeOf(err))
+	require.Contains(t, err.Error(), "tenant federation is not enabled for tenant c")
+
+	// Queries of a single tenant don't require federation.
+	names, err := querier.LabelNames(tenant.InjectTenantID(context.Background(), "c"), connect.NewRequest(&querierv1.LabelNamesRequest{}))
+	require.NoError(t, err)
+	require.Equal(t, []string{"service"}, names.Msg.Names)
+}
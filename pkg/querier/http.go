@@ -11,12 +11,12 @@ import (
 	"github.com/gogo/status"
 	"github.com/prometheus/common/model"
 	"github.com/prometheus/prometheus/model/labels"
-	"github.com/prometheus/prometheus/promql/parser"
 	"google.golang.org/grpc/codes"
 
 	commonv1 "github.com/grafana/phlare/pkg/gen/common/v1"
 	querierv1 "github.com/grafana/phlare/pkg/gen/querier/v1"
 	phlaremodel "github.com/grafana/phlare/pkg/model"
+	"github.com/grafana/phlare/pkg/phlareql"
 )
 
 // LabelValuesHandler only returns the label values for the given label name.
@@ -78,6 +78,9 @@ func (q *Querier) RenderHandler(w http.ResponseWriter, req *http.Request) {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	for k, v := range res.Header() {
+		w.Header()[k] = v
+	}
 	w.Header().Add("Content-Type", "application/json")
 	if err := json.NewEncoder(w).Encode(ExportToFlamebearer(res.Msg.Flamegraph, profileType)); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -117,29 +120,20 @@ func parseQuery(req *http.Request) (string, *commonv1.ProfileType, error) {
 		return "", nil, fmt.Errorf("query is required")
 	}
 
-	parsedSelector, err := parser.ParseMetricSelector(q)
+	expr, err := phlareql.ParseExpr(q)
 	if err != nil {
 		return "", nil, status.Error(codes.InvalidArgument, "failed to parse query")
 	}
-
-	sel := make([]*labels.Matcher, 0, len(parsedSelector))
-	var nameLabel *labels.Matcher
-	for _, matcher := range parsedSelector {
-		if matcher.Name == labels.MetricName {
-			nameLabel = matcher
-		} else {
-			sel = append(sel, matcher)
-		}
-	}
-	if nameLabel == nil {
-		return "", nil, status.Error(codes.InvalidArgument, "query must contain a profile-type selection")
+	selector, ok := expr.(*phlareql.Selector)
+	if !ok {
+		return "", nil, status.Error(codes.InvalidArgument, "query must be a profile-type selection")
 	}
 
-	profileSelector, err := phlaremodel.ParseProfileTypeSelector(nameLabel.Value)
+	profileSelector, err := phlaremodel.ParseProfileTypeSelector(selector.Name)
 	if err != nil {
 		return "", nil, status.Error(codes.InvalidArgument, "failed to parse query")
 	}
-	return convertMatchersToString(sel), profileSelector, nil
+	return convertMatchersToString(selector.Matchers), profileSelector, nil
 }
 
 func parseRelativeTime(s string) (time.Duration, error) {
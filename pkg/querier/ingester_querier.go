@@ -10,6 +10,7 @@ import (
 
 	ingestv1 "github.com/grafana/phlare/pkg/gen/ingester/v1"
 	"github.com/grafana/phlare/pkg/ingester/clientpool"
+	"github.com/grafana/phlare/pkg/tenant"
 )
 
 type IngesterQueryClient interface {
@@ -33,19 +34,42 @@ type IngesterQuerier struct {
 	ring            ring.ReadRing
 	pool            *ring_client.Pool
 	extraQueryDelay time.Duration
+
+	limits         Limits
+	lookbackPeriod time.Duration
 }
 
-func NewIngesterQuerier(pool *ring_client.Pool, ring ring.ReadRing, extraQueryDelay time.Duration) *IngesterQuerier {
+func NewIngesterQuerier(pool *ring_client.Pool, ring ring.ReadRing, extraQueryDelay time.Duration, limits Limits, lookbackPeriod time.Duration) *IngesterQuerier {
 	return &IngesterQuerier{
 		ring:            ring,
 		pool:            pool,
 		extraQueryDelay: extraQueryDelay,
+		limits:          limits,
+		lookbackPeriod:  lookbackPeriod,
 	}
 }
 
-// forAllIngesters runs f, in parallel, for all ingesters
+// ringForTenant returns the ingesters which may have received profiles of the
+// tenant: its shuffle shard, and the ingesters which were part of the shard
+// within the lookback period.
+func (q *IngesterQuerier) ringForTenant(ctx context.Context) (ring.ReadRing, error) {
+	if q.lookbackPeriod <= 0 {
+		return q.ring, nil
+	}
+	tenantID, err := tenant.ExtractTenantIDFromContext(ctx)
+	if err != nil {
+		return nil, connect.NewError(connect.CodeInvalidArgument, err)
+	}
+	return q.ring.ShuffleShardWithLookback(tenantID, q.limits.IngestionTenantShardSize(tenantID), q.lookbackPeriod, time.Now()), nil
+}
+
+// forAllIngesters runs f, in parallel, for all ingesters of the tenant
 func forAllIngesters[T any](ctx context.Context, q *IngesterQuerier, f IngesterFn[T]) ([]responseFromIngesters[T], error) {
-	replicationSet, err := q.ring.GetReplicationSetForOperation(ring.Read)
+	r, err := q.ringForTenant(ctx)
+	if err != nil {
+		return nil, err
+	}
+	replicationSet, err := r.GetReplicationSetForOperation(ring.Read)
 	if err != nil {
 		return nil, err
 	}
@@ -18,6 +18,8 @@ import (
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql/parser"
 	"github.com/samber/lo"
 	"golang.org/x/sync/errgroup"
 
@@ -27,6 +29,7 @@ import (
 	"github.com/grafana/phlare/pkg/ingester/clientpool"
 	"github.com/grafana/phlare/pkg/iter"
 	phlaremodel "github.com/grafana/phlare/pkg/model"
+	"github.com/grafana/phlare/pkg/phlaredb/tsdb/shard"
 )
 
 // todo: move to non global metrics.
@@ -39,12 +42,38 @@ var clients = promauto.NewGauge(prometheus.GaugeOpts{
 type Config struct {
 	PoolConfig      clientpool.PoolConfig `yaml:"pool_config,omitempty"`
 	ExtraQueryDelay time.Duration         `yaml:"extra_query_delay,omitempty"`
+
+	ShuffleShardingIngestersLookbackPeriod time.Duration `yaml:"shuffle_sharding_ingesters_lookback_period,omitempty"`
+
+	QueryShards int `yaml:"query_shards,omitempty"`
+
+	ResultsCache ResultsCacheConfig `yaml:"results_cache,omitempty"`
+
+	LogQueriesLongerThan time.Duration `yaml:"log_queries_longer_than,omitempty"`
 }
 
 // RegisterFlags registers distributor-related flags.
 func (cfg *Config) RegisterFlags(fs *flag.FlagSet) {
 	cfg.PoolConfig.RegisterFlagsWithPrefix("querier", fs)
 	fs.DurationVar(&cfg.ExtraQueryDelay, "querier.extra-query-delay", 0, "Time to wait before sending more than the minimum successful query requests.")
+	fs.DurationVar(&cfg.ShuffleShardingIngestersLookbackPeriod, "querier.shuffle-sharding-ingesters-lookback-period", 0, "When distributor's sharding strategy is shuffle-sharding and this setting is > 0, queriers fetch in-memory profiles only from ingesters that have received profiles of the tenant within the lookback period. It should be greater than the time ingesters keep the profiles of a tenant. 0 to query all ingesters.")
+	fs.IntVar(&cfg.QueryShards, "querier.query-shards", 0, "Number of shards a merge stacktraces query is split into. Shards select series by fingerprint and are queried in parallel. 0 or 1 to disable query sharding.")
+	cfg.ResultsCache.RegisterFlagsWithPrefix("querier.results-cache", fs)
+	fs.DurationVar(&cfg.LogQueriesLongerThan, "querier.log-queries-longer-than", 0, "Log the queries taking longer than this duration, with their statistics. 0 to disable.")
+}
+
+func (cfg *Config) Validate() error {
+	return cfg.ResultsCache.Validate()
+}
+
+// Limits are the per-tenant limits used by the querier.
+type Limits interface {
+	IngestionTenantShardSize(tenantID string) int
+	TenantFederationEnabled(tenantID string) bool
+	MaxQueryStacktraces(tenantID string) int
+	MaxQuerySeries(tenantID string) int
+	MaxQueryBytesRead(tenantID string) int
+	RejectOlderThan(tenantID string) time.Duration
 }
 
 type Querier struct {
@@ -54,20 +83,27 @@ type Querier struct {
 
 	cfg    Config
 	logger log.Logger
+	limits Limits
 
 	ingestersRing   ring.ReadRing
 	pool            *ring_client.Pool
 	ingesterQuerier *IngesterQuerier
+	resultsCache    *resultsCache
 }
 
-func New(cfg Config, ingestersRing ring.ReadRing, factory ring_client.PoolFactory, logger log.Logger, clientsOptions ...connect.ClientOption) (*Querier, error) {
+func New(cfg Config, ingestersRing ring.ReadRing, factory ring_client.PoolFactory, limits Limits, reg prometheus.Registerer, logger log.Logger, clientsOptions ...connect.ClientOption) (*Querier, error) {
+	resultsCache, err := newResultsCache(cfg.ResultsCache, reg, logger)
+	if err != nil {
+		return nil, errors.Wrap(err, "results cache")
+	}
 	q := &Querier{
 		cfg:           cfg,
 		logger:        logger,
+		limits:        limits,
 		ingestersRing: ingestersRing,
 		pool:          clientpool.NewPool(cfg.PoolConfig, ingestersRing, factory, clients, logger, clientsOptions...),
+		resultsCache:  resultsCache,
 	}
-	var err error
 	q.subservices, err = services.NewManager(q.pool)
 	if err != nil {
 		return nil, errors.Wrap(err, "services manager")
@@ -75,7 +111,7 @@ func New(cfg Config, ingestersRing ring.ReadRing, factory ring_client.PoolFactor
 	q.subservicesWatcher = services.NewFailureWatcher()
 	q.subservicesWatcher.WatchManager(q.subservices)
 	q.Service = services.NewBasicService(q.starting, q.running, q.stopping)
-	q.ingesterQuerier = NewIngesterQuerier(q.pool, ingestersRing, cfg.ExtraQueryDelay)
+	q.ingesterQuerier = NewIngesterQuerier(q.pool, ingestersRing, cfg.ExtraQueryDelay, limits, cfg.ShuffleShardingIngestersLookbackPeriod)
 	return q, nil
 }
 
@@ -93,6 +129,9 @@ func (q *Querier) running(ctx context.Context) error {
 }
 
 func (q *Querier) stopping(_ error) error {
+	if q.resultsCache != nil {
+		q.resultsCache.backend.Stop()
+	}
 	return services.StopManagerAndAwaitStopped(context.Background(), q.subservices)
 }
 
@@ -100,8 +139,23 @@ func (q *Querier) ProfileTypes(ctx context.Context, req *connect.Request[querier
 	sp, ctx := opentracing.StartSpanFromContext(ctx, "ProfileTypes")
 	defer sp.Finish()
 
+	tenantIDs, err := q.federatedTenants(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if tenantIDs != nil {
+		res, err := q.federatedProfileTypes(ctx, tenantIDs, req.Msg)
+		if err != nil {
+			return nil, err
+		}
+		return connect.NewResponse(res), nil
+	}
+
 	responses, err := forAllIngesters(ctx, q.ingesterQuerier, func(childCtx context.Context, ic IngesterQueryClient) ([]*commonv1.ProfileType, error) {
-		res, err := ic.ProfileTypes(childCtx, connect.NewRequest(&ingestv1.ProfileTypesRequest{}))
+		res, err := ic.ProfileTypes(childCtx, connect.NewRequest(&ingestv1.ProfileTypesRequest{
+			Start: req.Msg.Start,
+			End:   req.Msg.End,
+		}))
 		if err != nil {
 			return nil, err
 		}
@@ -138,9 +192,23 @@ func (q *Querier) LabelValues(ctx context.Context, req *connect.Request[querierv
 		)
 		sp.Finish()
 	}()
+	tenantIDs, err := q.federatedTenants(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if tenantIDs != nil {
+		res, err := q.federatedLabelValues(ctx, tenantIDs, req.Msg)
+		if err != nil {
+			return nil, err
+		}
+		return connect.NewResponse(res), nil
+	}
 	responses, err := forAllIngesters(ctx, q.ingesterQuerier, func(childCtx context.Context, ic IngesterQueryClient) ([]string, error) {
 		res, err := ic.LabelValues(childCtx, connect.NewRequest(&ingestv1.LabelValuesRequest{
-			Name: req.Msg.Name,
+			Name:     req.Msg.Name,
+			Matchers: req.Msg.Matchers,
+			Start:    req.Msg.Start,
+			End:      req.Msg.End,
 		}))
 		if err != nil {
 			return nil, err
@@ -159,8 +227,23 @@ func (q *Querier) LabelValues(ctx context.Context, req *connect.Request[querierv
 func (q *Querier) LabelNames(ctx context.Context, req *connect.Request[querierv1.LabelNamesRequest]) (*connect.Response[querierv1.LabelNamesResponse], error) {
 	sp, ctx := opentracing.StartSpanFromContext(ctx, "LabelNames")
 	defer sp.Finish()
+	tenantIDs, err := q.federatedTenants(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if tenantIDs != nil {
+		res, err := q.federatedLabelNames(ctx, tenantIDs, req.Msg)
+		if err != nil {
+			return nil, err
+		}
+		return connect.NewResponse(res), nil
+	}
 	responses, err := forAllIngesters(ctx, q.ingesterQuerier, func(childCtx context.Context, ic IngesterQueryClient) ([]string, error) {
-		res, err := ic.LabelNames(childCtx, connect.NewRequest(&ingestv1.LabelNamesRequest{}))
+		res, err := ic.LabelNames(childCtx, connect.NewRequest(&ingestv1.LabelNamesRequest{
+			Matchers: req.Msg.Matchers,
+			Start:    req.Msg.Start,
+			End:      req.Msg.End,
+		}))
 		if err != nil {
 			return nil, err
 		}
@@ -183,9 +266,22 @@ func (q *Querier) Series(ctx context.Context, req *connect.Request[querierv1.Ser
 		)
 		sp.Finish()
 	}()
+	tenantIDs, err := q.federatedTenants(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if tenantIDs != nil {
+		res, err := q.federatedSeries(ctx, tenantIDs, req.Msg)
+		if err != nil {
+			return nil, err
+		}
+		return connect.NewResponse(res), nil
+	}
 	responses, err := forAllIngesters(ctx, q.ingesterQuerier, func(childCtx context.Context, ic IngesterQueryClient) ([]*commonv1.Labels, error) {
 		res, err := ic.Series(childCtx, connect.NewRequest(&ingestv1.SeriesRequest{
 			Matchers: req.Msg.Matchers,
+			Start:    req.Msg.Start,
+			End:      req.Msg.End,
 		}))
 		if err != nil {
 			return nil, err
@@ -195,14 +291,18 @@ func (q *Querier) Series(ctx context.Context, req *connect.Request[querierv1.Ser
 	if err != nil {
 		return nil, err
 	}
+	labelsSet := lo.UniqBy(
+		lo.FlatMap(responses, func(r responseFromIngesters[[]*commonv1.Labels], _ int) []*commonv1.Labels {
+			return r.response
+		}),
+		func(t *commonv1.Labels) uint64 {
+			return phlaremodel.Labels(t.Labels).Hash()
+		})
+	sort.Slice(labelsSet, func(i, j int) bool {
+		return phlaremodel.CompareLabelPairs(labelsSet[i].Labels, labelsSet[j].Labels) < 0
+	})
 	return connect.NewResponse(&querierv1.SeriesResponse{
-		LabelsSet: lo.UniqBy(
-			lo.FlatMap(responses, func(r responseFromIngesters[[]*commonv1.Labels], _ int) []*commonv1.Labels {
-				return r.response
-			}),
-			func(t *commonv1.Labels) uint64 {
-				return phlaremodel.Labels(t.Labels).Hash()
-			}),
+		LabelsSet: labelsSet,
 	}), nil
 }
 
@@ -214,6 +314,8 @@ func (q *Querier) SelectMergeStacktraces(ctx context.Context, req *connect.Reque
 			otlog.String("end", model.Time(req.Msg.End).Time().String()),
 			otlog.String("selector", req.Msg.LabelSelector),
 			otlog.String("profile_id", req.Msg.ProfileTypeID),
+			otlog.String("group_by", strings.Join(req.Msg.GroupBy, ",")),
+			otlog.Int("shards", q.cfg.QueryShards),
 		)
 		sp.Finish()
 	}()
@@ -222,44 +324,122 @@ func (q *Querier) SelectMergeStacktraces(ctx context.Context, req *connect.Reque
 	if err != nil {
 		return nil, connect.NewError(connect.CodeInvalidArgument, err)
 	}
-	ctx, cancel := context.WithCancel(ctx)
-	defer cancel()
+	start := time.Now()
+	ctx, queryStats := q.withQueryStats(ctx)
+	var st []stacktraces
+	if len(req.Msg.GroupBy) == 0 {
+		st, err = q.selectCachedStacktraces(ctx, req.Msg, profileType)
+	} else {
+		// Grouped stacktraces are not cached, the groups are lost by the cache.
+		st, err = q.selectShardedStacktraces(ctx, profileType, req.Msg.LabelSelector, req.Msg.Start, req.Msg.End, req.Msg.GroupBy)
+	}
+	queryStats.ObserveStage("select", start)
+	if err != nil {
+		q.finishQuery(ctx, queryStats, start, nil, "SelectMergeStacktraces", "selector", req.Msg.LabelSelector, "profile_id", req.Msg.ProfileTypeID, "err", err)
+		return nil, err
+	}
+	mergeStart := time.Now()
+	res := connect.NewResponse(&querierv1.SelectMergeStacktracesResponse{})
+	if len(req.Msg.GroupBy) == 0 {
+		res.Msg.Flamegraph = NewFlameGraph(newTree(st))
+	} else {
+		for _, group := range groupStacktraces(st) {
+			res.Msg.Groups = append(res.Msg.Groups, &querierv1.FlameGraphGroup{
+				Labels:     group.labels,
+				Flamegraph: NewFlameGraph(newTree(group.stacktraces)),
+			})
+		}
+	}
+	queryStats.ObserveStage("merge", mergeStart)
+	q.finishQuery(ctx, queryStats, start, res.Header(), "SelectMergeStacktraces", "selector", req.Msg.LabelSelector, "profile_id", req.Msg.ProfileTypeID, "start", req.Msg.Start, "end", req.Msg.End)
+	return res, nil
+}
 
-	responses, err := forAllIngesters(ctx, q.ingesterQuerier, func(_ context.Context, ic IngesterQueryClient) (clientpool.BidiClientMergeProfilesStacktraces, error) {
-		// we plan to use those streams to merge profiles
-		// so we use the main context here otherwise will be canceled
-		return ic.MergeProfilesStacktraces(ctx), nil
-	})
+// selectShardedStacktraces selects the stacktraces of the profiles matching the selector,
+// splitting the query into the configured number of shards. The stacktraces are labeled
+// with the labels of their group, when grouped by labels.
+func (q *Querier) selectShardedStacktraces(ctx context.Context, profileType *commonv1.ProfileType, selector string, start, end int64, by []string) ([]stacktraces, error) {
+	tenantIDs, err := q.federatedTenants(ctx)
 	if err != nil {
-		return nil, connect.NewError(connect.CodeInternal, err)
+		return nil, err
+	}
+	if tenantIDs != nil {
+		return q.selectFederatedStacktraces(ctx, tenantIDs, profileType, selector, start, end, by)
 	}
-	// send the first initial request to all ingesters.
+	selectors, err := shardSelectors(selector, q.cfg.QueryShards)
+	if err != nil {
+		return nil, connect.NewError(connect.CodeInvalidArgument, err)
+	}
+
+	// Shards select distinct series, their stacktraces are merged into the same tree.
+	results := make([][]stacktraces, len(selectors))
 	g, gCtx := errgroup.WithContext(ctx)
-	for _, r := range responses {
-		r := r
+	for i, selector := range selectors {
+		i, selector := i, selector
 		g.Go(func() error {
-			return r.response.Send(&ingestv1.MergeProfilesStacktracesRequest{
-				Request: &ingestv1.SelectProfilesRequest{
-					LabelSelector: req.Msg.LabelSelector,
-					Start:         req.Msg.Start,
-					End:           req.Msg.End,
-					Type:          profileType,
-				},
-			})
+			st, err := q.selectMergeStacktraces(gCtx, &ingestv1.SelectProfilesRequest{
+				LabelSelector: selector,
+				Start:         start,
+				End:           end,
+				Type:          profileType,
+			}, by)
+			results[i] = st
+			return err
 		})
 	}
 	if err := g.Wait(); err != nil {
+		return nil, err
+	}
+	return lo.Flatten(results), nil
+}
+
+func (q *Querier) selectMergeStacktraces(ctx context.Context, req *ingestv1.SelectProfilesRequest, by []string) ([]stacktraces, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// The initial request is sent to the ingesters within the replication set
+	// quorum, so that failing ingesters, up to a whole zone, are tolerated.
+	responses, err := forAllIngesters(ctx, q.ingesterQuerier, func(_ context.Context, ic IngesterQueryClient) (clientpool.BidiClientMergeProfilesStacktraces, error) {
+		// we plan to use those streams to merge profiles
+		// so we use the main context here otherwise will be canceled
+		bidi := ic.MergeProfilesStacktraces(ctx)
+		if err := bidi.Send(&ingestv1.MergeProfilesStacktracesRequest{
+			Request: req,
+			By:      by,
+		}); err != nil {
+			return nil, err
+		}
+		return bidi, nil
+	})
+	if err != nil {
 		return nil, connect.NewError(connect.CodeInternal, err)
 	}
 
 	// merge all profiles
-	st, err := selectMergeStacktraces(gCtx, responses)
+	return selectMergeStacktraces(ctx, responses)
+}
+
+// shardSelectors splits the label selector into one selector per shard.
+// Each selector selects the series of its shard, using the shard label.
+func shardSelectors(selector string, shards int) ([]string, error) {
+	if shards <= 1 {
+		return []string{selector}, nil
+	}
+	matchers, err := parser.ParseMetricSelector(selector)
 	if err != nil {
 		return nil, err
 	}
-	return connect.NewResponse(&querierv1.SelectMergeStacktracesResponse{
-		Flamegraph: NewFlameGraph(newTree(st)),
-	}), nil
+	result := make([]string, shards)
+	for i := range result {
+		sharded := make([]string, 0, len(matchers)+1)
+		for _, m := range matchers {
+			sharded = append(sharded, m.String())
+		}
+		s := shard.Annotation{Shard: i, Of: shards}.Label()
+		sharded = append(sharded, labels.MustNewMatcher(labels.MatchEqual, s.Name, s.Value).String())
+		result[i] = "{" + strings.Join(sharded, ",") + "}"
+	}
+	return result, nil
 }
 
 func (q *Querier) SelectSeries(ctx context.Context, req *connect.Request[querierv1.SelectSeriesRequest]) (*connect.Response[querierv1.SelectSeriesResponse], error) {
@@ -272,6 +452,7 @@ func (q *Querier) SelectSeries(ctx context.Context, req *connect.Request[querier
 			otlog.String("profile_id", req.Msg.ProfileTypeID),
 			otlog.String("group_by", strings.Join(req.Msg.GroupBy, ",")),
 			otlog.Float64("step", req.Msg.Step),
+			otlog.String("aggregation", req.Msg.Aggregation.String()),
 		)
 		sp.Finish()
 	}()
@@ -289,106 +470,128 @@ func (q *Querier) SelectSeries(ctx context.Context, req *connect.Request[querier
 	}
 
 	stepMs := time.Duration(req.Msg.Step * float64(time.Second)).Milliseconds()
-	// we need to request profile from start - step to end since start is inclusive.
-	// The first step starts at start-step to start.
-	start := req.Msg.Start - stepMs
 	sort.Strings(req.Msg.GroupBy)
+	start := time.Now()
+	ctx, queryStats := q.withQueryStats(ctx)
+	result, err := q.selectCachedSeries(ctx, req.Msg, profileType, stepMs)
+	queryStats.ObserveStage("select", start)
+	if err == nil {
+		err = queryStats.AddSeries(len(result))
+	}
+	if err != nil {
+		q.finishQuery(ctx, queryStats, start, nil, "SelectSeries", "selector", req.Msg.LabelSelector, "profile_id", req.Msg.ProfileTypeID, "err", err)
+		return nil, err
+	}
+	unit, scale := seriesUnit(profileType.SampleUnit, req.Msg.Aggregation)
+	if scale != 1 {
+		for _, s := range result {
+			for _, p := range s.Points {
+				p.Value *= scale
+			}
+		}
+	}
+
+	res := connect.NewResponse(&querierv1.SelectSeriesResponse{
+		Series: result,
+		Unit:   unit,
+	})
+	q.finishQuery(ctx, queryStats, start, res.Header(), "SelectSeries", "selector", req.Msg.LabelSelector, "profile_id", req.Msg.ProfileTypeID, "start", req.Msg.Start, "end", req.Msg.End, "step", req.Msg.Step)
+	return res, nil
+}
+
+// selectRangeSeries selects the series of points spaced by step from start to end,
+// aggregating the profiles from fetchStart. Points before start are dropped.
+func (q *Querier) selectRangeSeries(ctx context.Context, req *querierv1.SelectSeriesRequest, profileType *commonv1.ProfileType, fetchStart, start, end, step int64) ([]*commonv1.Series, error) {
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
 
-	responses, err := forAllIngesters(ctx, q.ingesterQuerier, func(_ context.Context, ic IngesterQueryClient) (clientpool.BidiClientMergeProfilesLabels, error) {
-		return ic.MergeProfilesLabels(ctx), nil
-	})
-	if err != nil {
-		return nil, connect.NewError(connect.CodeInternal, err)
+	mergeReq := &ingestv1.MergeProfilesLabelsRequest{
+		Request: &ingestv1.SelectProfilesRequest{
+			LabelSelector: req.LabelSelector,
+			Start:         fetchStart,
+			End:           end,
+			Type:          profileType,
+		},
+		By:          req.GroupBy,
+		Aggregation: req.Aggregation,
+		Step:        req.Step,
 	}
-	// send the first initial request to all ingesters.
-	g, gCtx := errgroup.WithContext(ctx)
-	for _, r := range responses {
-		r := r
-		g.Go(func() error {
-			return r.response.Send(&ingestv1.MergeProfilesLabelsRequest{
-				Request: &ingestv1.SelectProfilesRequest{
-					LabelSelector: req.Msg.LabelSelector,
-					Start:         start,
-					End:           req.Msg.End,
-					Type:          profileType,
-				},
-				By: req.Msg.GroupBy,
-			})
-		})
+	var it iter.Iterator[ProfileValue]
+	tenantIDs, err := q.federatedTenants(ctx)
+	if err != nil {
+		return nil, err
 	}
-	if err := g.Wait(); err != nil {
-		return nil, connect.NewError(connect.CodeInternal, err)
+	if tenantIDs != nil {
+		it, err = q.selectFederatedProfileValues(ctx, tenantIDs, mergeReq)
+	} else {
+		it, err = q.selectProfileValues(ctx, mergeReq)
 	}
-	it, err := selectMergeSeries(gCtx, responses)
 	if err != nil {
-		return nil, connect.NewError(connect.CodeInternal, err)
+		return nil, err
 	}
-	result := rangeSeries(it, req.Msg.Start, req.Msg.End, stepMs)
+	result := rangeSeries(it, fetchStart+step, end, step, req.Aggregation)
 	if it.Err() != nil {
 		return nil, connect.NewError(connect.CodeInternal, it.Err())
 	}
+	if fetchStart+step < start {
+		for _, s := range result {
+			s.Points = lo.DropWhile(s.Points, func(p *commonv1.Point) bool { return p.Timestamp < start })
+		}
+		result = lo.Filter(result, func(s *commonv1.Series, _ int) bool { return len(s.Points) > 0 })
+	}
+	return result, nil
+}
 
-	return connect.NewResponse(&querierv1.SelectSeriesResponse{
-		Series: result,
-	}), nil
+// selectProfileValues selects the values of the profiles matching the request
+// from the ingesters, aggregated by the labels of the request.
+func (q *Querier) selectProfileValues(ctx context.Context, req *ingestv1.MergeProfilesLabelsRequest) (iter.Iterator[ProfileValue], error) {
+	// The initial request is sent to the ingesters within the replication set
+	// quorum, so that failing ingesters, up to a whole zone, are tolerated.
+	responses, err := forAllIngesters(ctx, q.ingesterQuerier, func(_ context.Context, ic IngesterQueryClient) (clientpool.BidiClientMergeProfilesLabels, error) {
+		bidi := ic.MergeProfilesLabels(ctx)
+		if err := bidi.Send(req); err != nil {
+			return nil, err
+		}
+		return bidi, nil
+	})
+	if err != nil {
+		return nil, connect.NewError(connect.CodeInternal, err)
+	}
+	it, err := selectMergeSeries(ctx, responses)
+	if err != nil {
+		return nil, connect.NewError(connect.CodeInternal, err)
+	}
+	return it, nil
+}
+
+// seriesUnit returns the unit of the points aggregated from profiles of the given sample unit,
+// and the factor to apply to the values to convert them to that unit.
+func seriesUnit(sampleUnit string, agg commonv1.SeriesAggregation) (string, float64) {
+	switch agg {
+	case commonv1.SeriesAggregation_SERIES_AGGREGATION_COUNT:
+		return "profiles", 1
+	case commonv1.SeriesAggregation_SERIES_AGGREGATION_RATE:
+		if sampleUnit == "nanoseconds" {
+			// nanoseconds spent per second are reported as cores.
+			return "cores", 1 / float64(time.Second)
+		}
+		return sampleUnit + "/s", 1
+	default:
+		return sampleUnit, 1
+	}
 }
 
 // rangeSeries aggregates profiles into series.
 // Series contains points spaced by step from start to end.
-// Profiles from the same step are aggregated into one point.
-func rangeSeries(it iter.Iterator[ProfileValue], start, end, step int64) []*commonv1.Series {
+// Profiles from the same step are aggregated into one point using agg.
+func rangeSeries(it iter.Iterator[ProfileValue], start, end, step int64, agg commonv1.SeriesAggregation) []*commonv1.Series {
 	defer it.Close()
-	seriesMap := make(map[uint64]*commonv1.Series)
-
-	if !it.Next() {
-		return nil
+	result := phlaremodel.NewSeriesAggregator(agg, start, end, step)
+	for it.Next() {
+		p := it.At()
+		result.Add(p.Lbs, p.LabelsHash, p.Ts, p.Value, p.Count)
 	}
-	// advance from the start to the end, adding each step results to the map.
-Outer:
-	for currentStep := start; currentStep <= end; currentStep += step {
-		for {
-			if it.At().Ts > currentStep {
-				break // no more profiles for the currentStep
-			}
-			// find or create series
-			series, ok := seriesMap[it.At().LabelsHash]
-			if !ok {
-				seriesMap[it.At().LabelsHash] = &commonv1.Series{
-					Labels: it.At().Lbs,
-					Points: []*commonv1.Point{
-						{Value: it.At().Value, Timestamp: currentStep},
-					},
-				}
-				if !it.Next() {
-					break Outer
-				}
-				continue
-			}
-			// Aggregate point if it is in the current step.
-			if series.Points[len(series.Points)-1].Timestamp == currentStep {
-				series.Points[len(series.Points)-1].Value += it.At().Value
-				if !it.Next() {
-					break Outer
-				}
-				continue
-			}
-			// Next step is missing
-			series.Points = append(series.Points, &commonv1.Point{
-				Value:     it.At().Value,
-				Timestamp: currentStep,
-			})
-			if !it.Next() {
-				break Outer
-			}
-		}
-	}
-	series := lo.Values(seriesMap)
-	sort.Slice(series, func(i, j int) bool {
-		return phlaremodel.CompareLabelPairs(series[i].Labels, series[j].Labels) < 0
-	})
-	return series
+	return result.Result()
 }
 
 func uniqueSortedStrings(responses []responseFromIngesters[[]string]) []string {
@@ -2,8 +2,10 @@ package querier
 
 import (
 	"context"
+	"errors"
 	"os"
 	"sort"
+	"sync"
 	"testing"
 	"time"
 
@@ -20,7 +22,9 @@ import (
 	"github.com/grafana/phlare/pkg/ingester/clientpool"
 	"github.com/grafana/phlare/pkg/iter"
 	phlaremodel "github.com/grafana/phlare/pkg/model"
+	"github.com/grafana/phlare/pkg/tenant"
 	"github.com/grafana/phlare/pkg/testhelper"
+	"github.com/grafana/phlare/pkg/validation"
 )
 
 func Test_QuerySampleType(t *testing.T) {
@@ -59,7 +63,7 @@ func Test_QuerySampleType(t *testing.T) {
 				}), nil)
 		}
 		return q, nil
-	}, log.NewLogfmtLogger(os.Stdout))
+	}, validation.MockDefaultOverrides(), nil, log.NewLogfmtLogger(os.Stdout))
 
 	require.NoError(t, err)
 	out, err := querier.ProfileTypes(context.Background(), connect.NewRequest(&querierv1.ProfileTypesRequest{}))
@@ -72,7 +76,11 @@ func Test_QuerySampleType(t *testing.T) {
 }
 
 func Test_QueryLabelValues(t *testing.T) {
-	req := connect.NewRequest(&querierv1.LabelValuesRequest{Name: "foo"})
+	req := connect.NewRequest(&querierv1.LabelValuesRequest{Name: "foo", Matchers: []string{`{job="a"}`}, Start: 1, End: 2})
+	// The selectors and the time range are forwarded to the ingesters.
+	forwarded := mock.MatchedBy(func(r *connect.Request[ingestv1.LabelValuesRequest]) bool {
+		return r.Msg.Name == "foo" && r.Msg.Start == 1 && r.Msg.End == 2 && len(r.Msg.Matchers) == 1 && r.Msg.Matchers[0] == `{job="a"}`
+	})
 	querier, err := New(Config{
 		PoolConfig: clientpool.PoolConfig{ClientCleanupPeriod: 1 * time.Millisecond},
 	}, testhelper.NewMockRing([]ring.InstanceDesc{
@@ -83,14 +91,14 @@ func Test_QueryLabelValues(t *testing.T) {
 		q := newFakeQuerier()
 		switch addr {
 		case "1":
-			q.On("LabelValues", mock.Anything, mock.Anything).Return(connect.NewResponse(&ingestv1.LabelValuesResponse{Names: []string{"foo", "bar"}}), nil)
+			q.On("LabelValues", mock.Anything, forwarded).Return(connect.NewResponse(&ingestv1.LabelValuesResponse{Names: []string{"foo", "bar"}}), nil)
 		case "2":
-			q.On("LabelValues", mock.Anything, mock.Anything).Return(connect.NewResponse(&ingestv1.LabelValuesResponse{Names: []string{"bar", "buzz"}}), nil)
+			q.On("LabelValues", mock.Anything, forwarded).Return(connect.NewResponse(&ingestv1.LabelValuesResponse{Names: []string{"bar", "buzz"}}), nil)
 		case "3":
-			q.On("LabelValues", mock.Anything, mock.Anything).Return(connect.NewResponse(&ingestv1.LabelValuesResponse{Names: []string{"buzz", "foo"}}), nil)
+			q.On("LabelValues", mock.Anything, forwarded).Return(connect.NewResponse(&ingestv1.LabelValuesResponse{Names: []string{"buzz", "foo"}}), nil)
 		}
 		return q, nil
-	}, log.NewLogfmtLogger(os.Stdout))
+	}, validation.MockDefaultOverrides(), nil, log.NewLogfmtLogger(os.Stdout))
 
 	require.NoError(t, err)
 	out, err := querier.LabelValues(context.Background(), req)
@@ -117,7 +125,7 @@ func Test_QueryLabelNames(t *testing.T) {
 			q.On("LabelNames", mock.Anything, mock.Anything).Return(connect.NewResponse(&ingestv1.LabelNamesResponse{Names: []string{"buzz", "foo"}}), nil)
 		}
 		return q, nil
-	}, log.NewLogfmtLogger(os.Stdout))
+	}, validation.MockDefaultOverrides(), nil, log.NewLogfmtLogger(os.Stdout))
 
 	require.NoError(t, err)
 	out, err := querier.LabelNames(context.Background(), req)
@@ -125,6 +133,38 @@ func Test_QueryLabelNames(t *testing.T) {
 	require.Equal(t, []string{"bar", "buzz", "foo"}, out.Msg.Names)
 }
 
+func Test_QueryShuffleShardedIngesters(t *testing.T) {
+	req := connect.NewRequest(&querierv1.LabelNamesRequest{})
+	querier, err := New(Config{
+		PoolConfig:                             clientpool.PoolConfig{ClientCleanupPeriod: 1 * time.Millisecond},
+		ShuffleShardingIngestersLookbackPeriod: time.Hour,
+	}, testhelper.NewMockRing([]ring.InstanceDesc{
+		{Addr: "1"},
+		{Addr: "2"},
+		{Addr: "3"},
+	}, 3), func(addr string) (client.PoolClient, error) {
+		q := newFakeQuerier()
+		switch addr {
+		case "1":
+			q.On("LabelNames", mock.Anything, mock.Anything).Return(connect.NewResponse(&ingestv1.LabelNamesResponse{Names: []string{"foo", "bar"}}), nil)
+		default:
+			q.On("LabelNames", mock.Anything, mock.Anything).Return(connect.NewResponse(&ingestv1.LabelNamesResponse{Names: []string{"buzz"}}), nil)
+		}
+		return q, nil
+	}, validation.MockOverrides(func(defaults *validation.Limits, tenantLimits map[string]*validation.Limits) {
+		defaults.IngestionTenantShardSize = 1
+	}), nil, log.NewLogfmtLogger(os.Stdout))
+	require.NoError(t, err)
+
+	// Only the ingester of the tenant's shard is queried.
+	out, err := querier.LabelNames(tenant.InjectTenantID(context.Background(), "foo"), req)
+	require.NoError(t, err)
+	require.Equal(t, []string{"bar", "foo"}, out.Msg.Names)
+
+	_, err = querier.LabelNames(context.Background(), req)
+	require.Equal(t, connect.CodeInvalidArgument, connect.CodeOf(err))
+}
+
 func Test_Series(t *testing.T) {
 	foobarlabels := phlaremodel.NewLabelsBuilder(nil).Set("foo", "bar")
 	foobuzzlabels := phlaremodel.NewLabelsBuilder(nil).Set("foo", "buzz")
@@ -150,7 +190,7 @@ func Test_Series(t *testing.T) {
 			q.On("Series", mock.Anything, mock.Anything).Return(ingesterReponse, nil)
 		}
 		return q, nil
-	}, log.NewLogfmtLogger(os.Stdout))
+	}, validation.MockDefaultOverrides(), nil, log.NewLogfmtLogger(os.Stdout))
 
 	require.NoError(t, err)
 	out, err := querier.Series(context.Background(), req)
@@ -236,7 +276,7 @@ func Test_SelectMergeStacktraces(t *testing.T) {
 			q.On("MergeProfilesStacktraces", mock.Anything).Once().Return(bidi3)
 		}
 		return q, nil
-	}, log.NewLogfmtLogger(os.Stdout))
+	}, validation.MockDefaultOverrides(), nil, log.NewLogfmtLogger(os.Stdout))
 	require.NoError(t, err)
 	flame, err := querier.SelectMergeStacktraces(context.Background(), req)
 	require.NoError(t, err)
@@ -342,7 +382,7 @@ func TestSelectSeries(t *testing.T) {
 			q.On("MergeProfilesLabels", mock.Anything).Once().Return(bidi3)
 		}
 		return q, nil
-	}, log.NewLogfmtLogger(os.Stdout))
+	}, validation.MockDefaultOverrides(), nil, log.NewLogfmtLogger(os.Stdout))
 	require.NoError(t, err)
 	res, err := querier.SelectSeries(context.Background(), req)
 	require.NoError(t, err)
@@ -350,6 +390,7 @@ func TestSelectSeries(t *testing.T) {
 	testhelper.EqualProto(t, []*commonv1.Series{
 		{Labels: foobarlabels, Points: []*commonv1.Point{{Value: 2, Timestamp: 1}, {Value: 4, Timestamp: 2}}},
 	}, res.Msg.Series)
+	require.Equal(t, "bytes", res.Msg.Unit)
 	var selected []testProfile
 	selected = append(selected, bidi1.kept...)
 	selected = append(selected, bidi2.kept...)
@@ -370,6 +411,200 @@ func TestSelectSeries(t *testing.T) {
 		}, selected)
 }
 
+// zoneAwareRing replicates to all its instances, tolerating one unavailable zone.
+type zoneAwareRing struct {
+	ring.ReadRing
+	instances []ring.InstanceDesc
+}
+
+func (r zoneAwareRing) GetReplicationSetForOperation(op ring.Operation) (ring.ReplicationSet, error) {
+	return ring.ReplicationSet{
+		Instances:           r.instances,
+		MaxUnavailableZones: 1,
+	}, nil
+}
+
+func Test_SelectMergeStacktracesGroupBy(t *testing.T) {
+	req := connect.NewRequest(&querierv1.SelectMergeStacktracesRequest{
+		LabelSelector: `{}`,
+		ProfileTypeID: "memory:inuse_space:bytes:space:byte",
+		Start:         0,
+		End:           2,
+		GroupBy:       []string{"app"},
+	})
+	newBidi := func() *fakeBidiClientStacktraces {
+		return newFakeBidiClientStacktraces([]*ingestv1.ProfileSets{
+			{
+				LabelsSets: []*commonv1.Labels{
+					{Labels: phlaremodel.LabelsFromStrings("app", "foo", "pod", "foo-1")},
+					{Labels: phlaremodel.LabelsFromStrings("app", "foo", "pod", "foo-2")},
+					{Labels: phlaremodel.LabelsFromStrings("pod", "other")},
+				},
+				Profiles: []*ingestv1.SeriesProfile{
+					{Timestamp: 1, LabelIndex: 0},
+					{Timestamp: 1, LabelIndex: 1},
+					{Timestamp: 1, LabelIndex: 2},
+					{Timestamp: 2, LabelIndex: 0},
+				},
+			},
+		})
+	}
+	var bidis []*fakeBidiClientStacktraces
+	querier, err := New(Config{
+		PoolConfig: clientpool.PoolConfig{ClientCleanupPeriod: 1 * time.Millisecond},
+	}, testhelper.NewMockRing([]ring.InstanceDesc{
+		{Addr: "1"},
+		{Addr: "2"},
+		{Addr: "3"},
+	}, 3), func(addr string) (client.PoolClient, error) {
+		q := newFakeQuerier()
+		bidi := newBidi()
+		bidis = append(bidis, bidi)
+		q.On("MergeProfilesStacktraces", mock.Anything).Once().Return(bidi)
+		return q, nil
+	}, validation.MockDefaultOverrides(), nil, log.NewLogfmtLogger(os.Stdout))
+	require.NoError(t, err)
+
+	res, err := querier.SelectMergeStacktraces(context.Background(), req)
+	require.NoError(t, err)
+	// The profiles are selected once and merged per group, across ingesters.
+	for _, b := range bidis {
+		b.mtx.Lock()
+		require.Equal(t, []string{"app"}, b.by)
+		b.mtx.Unlock()
+	}
+	require.Nil(t, res.Msg.Flamegraph)
+	require.Len(t, res.Msg.Groups, 2)
+	require.Empty(t, res.Msg.Groups[0].Labels)
+	require.Equal(t, int64(1), res.Msg.Groups[0].Flamegraph.Total)
+	require.Equal(t, phlaremodel.LabelsFromStrings("app", "foo"), phlaremodel.Labels(res.Msg.Groups[1].Labels))
+	require.Equal(t, int64(3), res.Msg.Groups[1].Flamegraph.Total)
+}
+
+func Test_SelectMergeStacktracesZoneOutage(t *testing.T) {
+	req := connect.NewRequest(&querierv1.SelectMergeStacktracesRequest{
+		LabelSelector: `{app="foo"}`,
+		ProfileTypeID: "memory:inuse_space:bytes:space:byte",
+		Start:         0,
+		End:           2,
+	})
+	newBidi := func() *fakeBidiClientStacktraces {
+		return newFakeBidiClientStacktraces([]*ingestv1.ProfileSets{
+			{
+				LabelsSets: []*commonv1.Labels{
+					{Labels: []*commonv1.LabelPair{{Name: "app", Value: "foo"}}},
+				},
+				Profiles: []*ingestv1.SeriesProfile{
+					{Timestamp: 1, LabelIndex: 0},
+					{Timestamp: 2, LabelIndex: 0},
+				},
+			},
+		})
+	}
+	bidis := map[string]*fakeBidiClientStacktraces{
+		"1": newBidi(),
+		"2": newBidi(),
+		"3": newBidi(),
+	}
+	// All ingesters of zone-c are unavailable.
+	bidis["3"].err = errors.New("ingester unavailable")
+
+	instances := []ring.InstanceDesc{
+		{Addr: "1", Zone: "zone-a"},
+		{Addr: "2", Zone: "zone-b"},
+		{Addr: "3", Zone: "zone-c"},
+	}
+	querier, err := New(Config{
+		PoolConfig: clientpool.PoolConfig{ClientCleanupPeriod: 1 * time.Millisecond},
+	}, zoneAwareRing{ReadRing: testhelper.NewMockRing(instances, 3), instances: instances}, func(addr string) (client.PoolClient, error) {
+		q := newFakeQuerier()
+		q.On("MergeProfilesStacktraces", mock.Anything).Once().Return(bidis[addr])
+		return q, nil
+	}, validation.MockDefaultOverrides(), nil, log.NewLogfmtLogger(os.Stdout))
+	require.NoError(t, err)
+
+	_, err = querier.SelectMergeStacktraces(context.Background(), req)
+	require.NoError(t, err)
+	// Each profile is kept once, from the ingesters of the available zones.
+	require.Len(t, append(bidis["1"].kept, bidis["2"].kept...), 2)
+	require.Empty(t, bidis["3"].kept)
+}
+
+func Test_SelectMergeStacktracesSharded(t *testing.T) {
+	req := connect.NewRequest(&querierv1.SelectMergeStacktracesRequest{
+		LabelSelector: `{app="foo"}`,
+		ProfileTypeID: "memory:inuse_space:bytes:space:byte",
+		Start:         0,
+		End:           2,
+	})
+	newBidi := func() *fakeBidiClientStacktraces {
+		return newFakeBidiClientStacktraces([]*ingestv1.ProfileSets{
+			{
+				LabelsSets: []*commonv1.Labels{
+					{Labels: []*commonv1.LabelPair{{Name: "app", Value: "foo"}}},
+				},
+				Profiles: []*ingestv1.SeriesProfile{
+					{Timestamp: 1, LabelIndex: 0},
+				},
+			},
+		})
+	}
+	var bidis []*fakeBidiClientStacktraces
+	querier, err := New(Config{
+		PoolConfig:  clientpool.PoolConfig{ClientCleanupPeriod: 1 * time.Millisecond},
+		QueryShards: 2,
+	}, testhelper.NewMockRing([]ring.InstanceDesc{
+		{Addr: "1"},
+		{Addr: "2"},
+		{Addr: "3"},
+	}, 3), func(addr string) (client.PoolClient, error) {
+		q := newFakeQuerier()
+		// One stream per shard.
+		for i := 0; i < 2; i++ {
+			bidi := newBidi()
+			bidis = append(bidis, bidi)
+			q.On("MergeProfilesStacktraces", mock.Anything).Once().Return(bidi)
+		}
+		return q, nil
+	}, validation.MockDefaultOverrides(), nil, log.NewLogfmtLogger(os.Stdout))
+	require.NoError(t, err)
+
+	flame, err := querier.SelectMergeStacktraces(context.Background(), req)
+	require.NoError(t, err)
+	// Both shards results are merged.
+	require.Equal(t, int64(4), flame.Msg.Flamegraph.Total)
+
+	selectors := map[string]struct{}{}
+	for _, b := range bidis {
+		b.mtx.Lock()
+		if b.req != nil {
+			selectors[b.req.LabelSelector] = struct{}{}
+		}
+		b.mtx.Unlock()
+	}
+	require.Equal(t, map[string]struct{}{
+		`{app="foo",__cortex_shard__="0_of_2"}`: {},
+		`{app="foo",__cortex_shard__="1_of_2"}`: {},
+	}, selectors)
+}
+
+func Test_ShardSelectors(t *testing.T) {
+	selectors, err := shardSelectors(`{app="foo"}`, 0)
+	require.NoError(t, err)
+	require.Equal(t, []string{`{app="foo"}`}, selectors)
+
+	selectors, err = shardSelectors(`{app=~"foo|bar", env!=""}`, 3)
+	require.NoError(t, err)
+	require.Equal(t, []string{
+		`{app=~"foo|bar",env!="",__cortex_shard__="0_of_3"}`,
+		`{app=~"foo|bar",env!="",__cortex_shard__="1_of_3"}`,
+		`{app=~"foo|bar",env!="",__cortex_shard__="2_of_3"}`,
+	}, selectors)
+
+	_, err = shardSelectors(`{app="foo"`, 2)
+	require.Error(t, err)
+}
+
 type fakeQuerierIngester struct {
 	mock.Mock
 	testhelper.FakePoolClient
@@ -447,6 +682,10 @@ type testProfile struct {
 }
 
 type fakeBidiClientStacktraces struct {
+	err      error
+	mtx      sync.Mutex
+	req      *ingestv1.SelectProfilesRequest
+	by       []string
 	profiles chan *ingestv1.ProfileSets
 	batches  []*ingestv1.ProfileSets
 	kept     []testProfile
@@ -465,7 +704,11 @@ func newFakeBidiClientStacktraces(batches []*ingestv1.ProfileSets) *fakeBidiClie
 
 func (f *fakeBidiClientStacktraces) Send(in *ingestv1.MergeProfilesStacktracesRequest) error {
 	if in.Request != nil {
-		return nil
+		f.mtx.Lock()
+		f.req = in.Request
+		f.by = in.By
+		f.mtx.Unlock()
+		return f.err
 	}
 	for i, b := range in.Profiles {
 		if b {
@@ -486,6 +729,26 @@ func (f *fakeBidiClientStacktraces) Send(in *ingestv1.MergeProfilesStacktracesRe
 
 func (f *fakeBidiClientStacktraces) Receive() (*ingestv1.MergeProfilesStacktracesResponse, error) {
 	profiles := <-f.profiles
+	if profiles == nil && len(f.by) > 0 {
+		// Each group has a single stacktrace, valued with its number of kept profiles.
+		res := &ingestv1.MergeProfilesStacktracesResponse{}
+		groups := map[uint64]*ingestv1.MergeProfilesStacktracesResult{}
+		for _, p := range f.kept {
+			lbs := phlaremodel.Labels(p.Labels.Labels).WithLabels(f.by...)
+			group, ok := groups[lbs.Hash()]
+			if !ok {
+				group = &ingestv1.MergeProfilesStacktracesResult{
+					Labels:        lbs,
+					Stacktraces:   []*ingestv1.StacktraceSample{{FunctionIds: []int32{0, 1, 2}}},
+					FunctionNames: []string{"foo", "bar", "buzz"},
+				}
+				groups[lbs.Hash()] = group
+				res.Groups = append(res.Groups, group)
+			}
+			group.Stacktraces[0].Value++
+		}
+		return res, nil
+	}
 	if profiles == nil {
 		return &ingestv1.MergeProfilesStacktracesResponse{
 			Result: &ingestv1.MergeProfilesStacktracesResult{
@@ -584,9 +847,29 @@ func (f *fakeQuerierIngester) MergeProfilesLabels(ctx context.Context) clientpoo
 	return res
 }
 
+func TestSeriesUnit(t *testing.T) {
+	for _, tc := range []struct {
+		sampleUnit string
+		agg        commonv1.SeriesAggregation
+		unit       string
+		scale      float64
+	}{
+		{"bytes", commonv1.SeriesAggregation_SERIES_AGGREGATION_UNSPECIFIED, "bytes", 1},
+		{"bytes", commonv1.SeriesAggregation_SERIES_AGGREGATION_MAX, "bytes", 1},
+		{"bytes", commonv1.SeriesAggregation_SERIES_AGGREGATION_COUNT, "profiles", 1},
+		{"count", commonv1.SeriesAggregation_SERIES_AGGREGATION_RATE, "count/s", 1},
+		{"nanoseconds", commonv1.SeriesAggregation_SERIES_AGGREGATION_RATE, "cores", 1e-9},
+	} {
+		unit, scale := seriesUnit(tc.sampleUnit, tc.agg)
+		require.Equal(t, tc.unit, unit)
+		require.Equal(t, tc.scale, scale)
+	}
+}
+
 func TestRangeSeries(t *testing.T) {
 	for _, tc := range []struct {
 		name string
+		agg  commonv1.SeriesAggregation
 		in   []ProfileValue
 		out  []*commonv1.Series
 	}{
@@ -645,10 +928,66 @@ func TestRangeSeries(t *testing.T) {
 				},
 			},
 		},
+		{
+			name: "avg",
+			agg:  commonv1.SeriesAggregation_SERIES_AGGREGATION_AVG,
+			in: []ProfileValue{
+				{Ts: 1, Value: 1, Count: 1},
+				{Ts: 1, Value: 3, Count: 1},
+				{Ts: 2, Value: 2, Count: 1},
+				{Ts: 2, Value: 10, Count: 2}, // already aggregated by an ingester
+				{Ts: 4, Value: 4, Count: 1},
+			},
+			out: []*commonv1.Series{
+				{
+					Points: []*commonv1.Point{
+						{Timestamp: 1, Value: 2},
+						{Timestamp: 2, Value: 4},
+						{Timestamp: 4, Value: 4},
+					},
+				},
+			},
+		},
+		{
+			name: "min",
+			agg:  commonv1.SeriesAggregation_SERIES_AGGREGATION_MIN,
+			in: []ProfileValue{
+				{Ts: 1, Value: 3},
+				{Ts: 1, Value: 1},
+				{Ts: 2, Value: 4},
+				{Ts: 2, Value: 2},
+			},
+			out: []*commonv1.Series{
+				{
+					Points: []*commonv1.Point{
+						{Timestamp: 1, Value: 1},
+						{Timestamp: 2, Value: 2},
+					},
+				},
+			},
+		},
+		{
+			name: "max",
+			agg:  commonv1.SeriesAggregation_SERIES_AGGREGATION_MAX,
+			in: []ProfileValue{
+				{Ts: 1, Value: 3},
+				{Ts: 1, Value: 1},
+				{Ts: 2, Value: 4},
+				{Ts: 2, Value: 2},
+			},
+			out: []*commonv1.Series{
+				{
+					Points: []*commonv1.Point{
+						{Timestamp: 1, Value: 3},
+						{Timestamp: 2, Value: 4},
+					},
+				},
+			},
+		},
 	} {
 		t.Run(tc.name, func(t *testing.T) {
 			in := iter.NewSliceIterator(tc.in)
-			out := rangeSeries(in, 1, 5, 1)
+			out := rangeSeries(in, 1, 5, 1, tc.agg)
 			testhelper.EqualProto(t, tc.out, out)
 		})
 	}
@@ -0,0 +1,509 @@
+package querier
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bufbuild/connect-go"
+	"github.com/opentracing/opentracing-go"
+	otlog "github.com/opentracing/opentracing-go/log"
+	"github.com/pkg/errors"
+	"github.com/prometheus/prometheus/model/labels"
+	ptree "github.com/pyroscope-io/pyroscope/pkg/storage/tree"
+	"github.com/samber/lo"
+	"golang.org/x/sync/errgroup"
+
+	commonv1 "github.com/grafana/phlare/pkg/gen/common/v1"
+	querierv1 "github.com/grafana/phlare/pkg/gen/querier/v1"
+	phlaremodel "github.com/grafana/phlare/pkg/model"
+	"github.com/grafana/phlare/pkg/phlareql"
+)
+
+// defaultMaxNodes is the default maximum number of nodes of diff flamegraphs.
+const defaultMaxNodes = 8192
+
+// queryable selects the profiles PhlareQL queries are evaluated on.
+type queryable interface {
+	profileTypes(ctx context.Context, start, end int64) ([]*commonv1.ProfileType, error)
+	selectSeries(ctx context.Context, req *querierv1.SelectSeriesRequest) ([]*commonv1.Series, error)
+	labelNames(ctx context.Context, selector string, start, end int64) ([]string, error)
+	selectStacktraces(ctx context.Context, profileType *commonv1.ProfileType, selector string, start, end int64) ([]stacktraces, error)
+}
+
+func (q *Querier) profileTypes(ctx context.Context, start, end int64) ([]*commonv1.ProfileType, error) {
+	res, err := q.ProfileTypes(ctx, connect.NewRequest(&querierv1.ProfileTypesRequest{Start: start, End: end}))
+	if err != nil {
+		return nil, err
+	}
+	return res.Msg.ProfileTypes, nil
+}
+
+func (q *Querier) selectSeries(ctx context.Context, req *querierv1.SelectSeriesRequest) ([]*commonv1.Series, error) {
+	res, err := q.SelectSeries(ctx, connect.NewRequest(req))
+	if err != nil {
+		return nil, err
+	}
+	return res.Msg.Series, nil
+}
+
+func (q *Querier) labelNames(ctx context.Context, selector string, start, end int64) ([]string, error) {
+	res, err := q.LabelNames(ctx, connect.NewRequest(&querierv1.LabelNamesRequest{Matchers: []string{selector}, Start: start, End: end}))
+	if err != nil {
+		return nil, err
+	}
+	return res.Msg.Names, nil
+}
+
+func (q *Querier) selectStacktraces(ctx context.Context, profileType *commonv1.ProfileType, selector string, start, end int64) ([]stacktraces, error) {
+	return q.selectShardedStacktraces(ctx, profileType, selector, start, end, nil)
+}
+
+func (q *Querier) QueryRange(ctx context.Context, req *connect.Request[querierv1.QueryRangeRequest]) (*connect.Response[querierv1.QueryRangeResponse], error) {
+	sp, ctx := opentracing.StartSpanFromContext(ctx, "QueryRange")
+	defer func() {
+		sp.LogFields(
+			otlog.String("query", req.Msg.Query),
+			otlog.Int64("start", req.Msg.Start),
+			otlog.Int64("end", req.Msg.End),
+			otlog.Float64("step", req.Msg.Step),
+		)
+		sp.Finish()
+	}()
+	expr, err := phlareql.ParseExpr(req.Msg.Query)
+	if err != nil {
+		return nil, connect.NewError(connect.CodeInvalidArgument, err)
+	}
+	if req.Msg.Step <= 0 {
+		return nil, connect.NewError(connect.CodeInvalidArgument, errors.New("step must be positive"))
+	}
+	e := newEvaluator(q, req.Msg.Start, req.Msg.End, req.Msg.Step)
+	series, err := e.series(ctx, expr, groupBy(nil))
+	if err != nil {
+		return nil, err
+	}
+	return connect.NewResponse(&querierv1.QueryRangeResponse{Series: series}), nil
+}
+
+func (q *Querier) QueryFlamegraph(ctx context.Context, req *connect.Request[querierv1.QueryFlamegraphRequest]) (*connect.Response[querierv1.QueryFlamegraphResponse], error) {
+	sp, ctx := opentracing.StartSpanFromContext(ctx, "QueryFlamegraph")
+	defer func() {
+		sp.LogFields(
+			otlog.String("query", req.Msg.Query),
+			otlog.Int64("start", req.Msg.Start),
+			otlog.Int64("end", req.Msg.End),
+		)
+		sp.Finish()
+	}()
+	expr, err := phlareql.ParseExpr(req.Msg.Query)
+	if err != nil {
+		return nil, connect.NewError(connect.CodeInvalidArgument, err)
+	}
+	maxNodes := int(req.Msg.MaxNodes)
+	if maxNodes <= 0 {
+		maxNodes = defaultMaxNodes
+	}
+	res, err := newEvaluator(q, req.Msg.Start, req.Msg.End, 0).flameGraph(ctx, expr, maxNodes)
+	if err != nil {
+		return nil, err
+	}
+	return connect.NewResponse(res), nil
+}
+
+// evaluator evaluates PhlareQL expressions over a time range.
+type evaluator struct {
+	q          queryable
+	start, end int64
+	// step is in seconds, as in SelectSeries requests.
+	step float64
+
+	// profile types of the time range, loaded by the first selector.
+	mtx   sync.Mutex
+	types []*commonv1.ProfileType
+}
+
+func newEvaluator(q queryable, start, end int64, step float64) *evaluator {
+	return &evaluator{q: q, start: start, end: end, step: step}
+}
+
+func invalidQuery(format string, args ...interface{}) error {
+	return connect.NewError(connect.CodeInvalidArgument, fmt.Errorf(format, args...))
+}
+
+// profileType resolves the profile type of a selector.
+// The name is either a profile type ID, a name and sample type like memory:alloc_space,
+// or a sample type like alloc_space when a single profile type has it.
+func (e *evaluator) profileType(ctx context.Context, name string) (*commonv1.ProfileType, error) {
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+	if e.types == nil {
+		types, err := e.q.profileTypes(ctx, e.start, e.end)
+		if err != nil {
+			return nil, err
+		}
+		e.types = types
+	}
+	var matches []*commonv1.ProfileType
+	for _, t := range e.types {
+		if t.ID == name {
+			return t, nil
+		}
+		if t.Name+":"+t.SampleType == name || t.SampleType == name {
+			matches = append(matches, t)
+		}
+	}
+	switch len(matches) {
+	case 0:
+		return nil, invalidQuery("unknown profile type %q", name)
+	case 1:
+		return matches[0], nil
+	}
+	ids := lo.Map(matches, func(t *commonv1.ProfileType, _ int) string { return t.ID })
+	return nil, invalidQuery("profile type %q is ambiguous, it matches %v", name, ids)
+}
+
+// grouping is how the series selected for an enclosing aggregation are
+// grouped: summed by the given labels, or all kept apart.
+type grouping struct {
+	by  []string
+	all bool
+}
+
+// groupBy sums the selected series by the labels.
+func groupBy(by []string) grouping { return grouping{by: by} }
+
+// allSeries keeps the selected series apart.
+var allSeries = grouping{all: true}
+
+// series evaluates the expression into series, the selected series are grouped as required by the
+// enclosing aggregation.
+func (e *evaluator) series(ctx context.Context, expr phlareql.Expr, g grouping) ([]*commonv1.Series, error) {
+	switch n := expr.(type) {
+	case *phlareql.Selector:
+		return e.selectSeries(ctx, n, g, commonv1.SeriesAggregation_SERIES_AGGREGATION_UNSPECIFIED)
+	case *phlareql.Call:
+		if n.Func == "rate" {
+			s, ok := n.Args[0].(*phlareql.Selector)
+			if !ok {
+				return nil, invalidQuery("rate expects a selector, got %s", n.Args[0])
+			}
+			return e.selectSeries(ctx, s, g, commonv1.SeriesAggregation_SERIES_AGGREGATION_RATE)
+		}
+		return nil, invalidQuery("%s can only be rendered as a flamegraph", n)
+	case *phlareql.AggregateExpr:
+		if n.Op == phlareql.TopK || n.Op == phlareql.BottomK {
+			if len(n.Grouping) > 0 {
+				return nil, invalidQuery("%s does not support grouping", n.Op)
+			}
+			series, err := e.series(ctx, n.Expr, allSeries)
+			if err != nil {
+				return nil, err
+			}
+			return topK(series, n.Param, n.Op == phlareql.BottomK), nil
+		}
+		agg := aggregations[n.Op]
+		// Aggregations of selectors are done by the ingesters.
+		if s, ok := n.Expr.(*phlareql.Selector); ok {
+			return e.selectSeries(ctx, s, groupBy(n.Grouping), agg)
+		}
+		// Summing the selected series by the grouping labels early doesn't change
+		// the sum, the other aggregations need the series apart.
+		inner := allSeries
+		if n.Op == phlareql.Sum {
+			inner = groupBy(n.Grouping)
+		}
+		series, err := e.series(ctx, n.Expr, inner)
+		if err != nil {
+			return nil, err
+		}
+		return e.aggregate(series, n.Grouping, agg), nil
+	case *phlareql.BinaryExpr:
+		return e.binarySeries(ctx, n, g)
+	}
+	return nil, invalidQuery("%s does not select profiles", expr)
+}
+
+var aggregations = map[phlareql.AggregateOp]commonv1.SeriesAggregation{
+	phlareql.Sum:   commonv1.SeriesAggregation_SERIES_AGGREGATION_SUM,
+	phlareql.Avg:   commonv1.SeriesAggregation_SERIES_AGGREGATION_AVG,
+	phlareql.Min:   commonv1.SeriesAggregation_SERIES_AGGREGATION_MIN,
+	phlareql.Max:   commonv1.SeriesAggregation_SERIES_AGGREGATION_MAX,
+	phlareql.Count: commonv1.SeriesAggregation_SERIES_AGGREGATION_COUNT,
+}
+
+func (e *evaluator) selectSeries(ctx context.Context, s *phlareql.Selector, g grouping, agg commonv1.SeriesAggregation) ([]*commonv1.Series, error) {
+	profileType, err := e.profileType(ctx, s.Name)
+	if err != nil {
+		return nil, err
+	}
+	// The request is sorted in place.
+	by := append([]string(nil), g.by...)
+	if g.all {
+		// The series are kept apart by grouping them by all their labels.
+		names, err := e.q.labelNames(ctx, convertMatchersToString(append(s.Matchers[:len(s.Matchers):len(s.Matchers)],
+			labels.MustNewMatcher(labels.MatchEqual, phlaremodel.LabelNameProfileType, profileType.ID))), e.start, e.end)
+		if err != nil {
+			return nil, err
+		}
+		by = lo.Filter(names, func(name string, _ int) bool { return !strings.HasPrefix(name, "__") })
+	}
+	return e.q.selectSeries(ctx, &querierv1.SelectSeriesRequest{
+		ProfileTypeID: profileType.ID,
+		LabelSelector: convertMatchersToString(s.Matchers),
+		Start:         e.start,
+		End:           e.end,
+		GroupBy:       by,
+		Step:          e.step,
+		Aggregation:   agg,
+	})
+}
+
+// aggregate aggregates the points of series with the same grouping labels.
+func (e *evaluator) aggregate(series []*commonv1.Series, by []string, agg commonv1.SeriesAggregation) []*commonv1.Series {
+	stepMs := time.Duration(e.step * float64(time.Second)).Milliseconds()
+	result := phlaremodel.NewSeriesAggregator(agg, e.start, e.end, stepMs)
+	for _, s := range series {
+		lbs := phlaremodel.Labels(s.Labels).WithLabels(by...)
+		hash := lbs.Hash()
+		for _, p := range s.Points {
+			value := p.Value
+			if agg == commonv1.SeriesAggregation_SERIES_AGGREGATION_COUNT {
+				value = 1
+			}
+			result.Add(lbs, hash, p.Timestamp, value, 1)
+		}
+	}
+	return result.Result()
+}
+
+// topK returns the k series with the highest sum of points, or the lowest for bottom.
+func topK(series []*commonv1.Series, k int, bottom bool) []*commonv1.Series {
+	sums := make(map[*commonv1.Series]float64, len(series))
+	for _, s := range series {
+		for _, p := range s.Points {
+			sums[s] += p.Value
+		}
+	}
+	sort.SliceStable(series, func(i, j int) bool {
+		if bottom {
+			return sums[series[i]] < sums[series[j]]
+		}
+		return sums[series[i]] > sums[series[j]]
+	})
+	if len(series) > k {
+		series = series[:k]
+	}
+	return series
+}
+
+func (e *evaluator) binarySeries(ctx context.Context, n *phlareql.BinaryExpr, g grouping) ([]*commonv1.Series, error) {
+	lhsScalar, lhsIsScalar := scalar(n.LHS)
+	rhsScalar, rhsIsScalar := scalar(n.RHS)
+	switch {
+	case lhsIsScalar && rhsIsScalar:
+		return nil, invalidQuery("%s does not select profiles", n)
+	case lhsIsScalar:
+		series, err := e.series(ctx, n.RHS, g)
+		if err != nil {
+			return nil, err
+		}
+		return mapPoints(series, func(v float64) (float64, bool) { return apply(n.Op, lhsScalar, v) }), nil
+	case rhsIsScalar:
+		series, err := e.series(ctx, n.LHS, g)
+		if err != nil {
+			return nil, err
+		}
+		return mapPoints(series, func(v float64) (float64, bool) { return apply(n.Op, v, rhsScalar) }), nil
+	}
+
+	var lhs, rhs []*commonv1.Series
+	eg, gCtx := errgroup.WithContext(ctx)
+	eg.Go(func() (err error) {
+		lhs, err = e.series(gCtx, n.LHS, g)
+		return err
+	})
+	eg.Go(func() (err error) {
+		rhs, err = e.series(gCtx, n.RHS, g)
+		return err
+	})
+	if err := eg.Wait(); err != nil {
+		return nil, err
+	}
+	return joinSeries(n.Op, lhs, rhs), nil
+}
+
+// scalar returns the value of expressions made of numbers only.
+func scalar(expr phlareql.Expr) (float64, bool) {
+	switch n := expr.(type) {
+	case *phlareql.NumberLiteral:
+		return n.Val, true
+	case *phlareql.BinaryExpr:
+		lhs, ok := scalar(n.LHS)
+		if !ok {
+			return 0, false
+		}
+		rhs, ok := scalar(n.RHS)
+		if !ok {
+			return 0, false
+		}
+		return apply(n.Op, lhs, rhs)
+	}
+	return 0, false
+}
+
+// apply applies the operator, divisions by zero have no result.
+func apply(op phlareql.BinaryOp, lhs, rhs float64) (float64, bool) {
+	switch op {
+	case phlareql.Add:
+		return lhs + rhs, true
+	case phlareql.Sub:
+		return lhs - rhs, true
+	case phlareql.Mul:
+		return lhs * rhs, true
+	case phlareql.Div:
+		if rhs == 0 {
+			return 0, false
+		}
+		return lhs / rhs, true
+	}
+	return 0, false
+}
+
+// mapPoints applies f to the value of each point, points without result are dropped.
+func mapPoints(series []*commonv1.Series, f func(float64) (float64, bool)) []*commonv1.Series {
+	for _, s := range series {
+		points := s.Points[:0]
+		for _, p := range s.Points {
+			v, ok := f(p.Value)
+			if !ok {
+				continue
+			}
+			p.Value = v
+			points = append(points, p)
+		}
+		s.Points = points
+	}
+	return series
+}
+
+// joinSeries applies the operator to the points with the same timestamp of the series with the same labels.
+// Series and points missing on either side have no result.
+func joinSeries(op phlareql.BinaryOp, lhs, rhs []*commonv1.Series) []*commonv1.Series {
+	rhsByLabels := make(map[uint64]*commonv1.Series, len(rhs))
+	for _, s := range rhs {
+		rhsByLabels[phlaremodel.Labels(s.Labels).Hash()] = s
+	}
+	result := make([]*commonv1.Series, 0, len(lhs))
+	for _, l := range lhs {
+		r, ok := rhsByLabels[phlaremodel.Labels(l.Labels).Hash()]
+		if !ok {
+			continue
+		}
+		s := &commonv1.Series{Labels: l.Labels}
+		// Points are sorted by timestamp.
+		for i, j := 0, 0; i < len(l.Points) && j < len(r.Points); {
+			switch lp, rp := l.Points[i], r.Points[j]; {
+			case lp.Timestamp < rp.Timestamp:
+				i++
+			case lp.Timestamp > rp.Timestamp:
+				j++
+			default:
+				if v, ok := apply(op, lp.Value, rp.Value); ok {
+					s.Points = append(s.Points, &commonv1.Point{Timestamp: lp.Timestamp, Value: v})
+				}
+				i++
+				j++
+			}
+		}
+		result = append(result, s)
+	}
+	return result
+}
+
+// flameGraph evaluates the expression into a flamegraph, or into a diff flamegraph for diff calls.
+func (e *evaluator) flameGraph(ctx context.Context, expr phlareql.Expr, maxNodes int) (*querierv1.QueryFlamegraphResponse, error) {
+	if call, ok := expr.(*phlareql.Call); ok && call.Func == "diff" {
+		diff, err := e.flameGraphDiff(ctx, call.Args[0], call.Args[1], maxNodes)
+		if err != nil {
+			return nil, err
+		}
+		return &querierv1.QueryFlamegraphResponse{FlamegraphDiff: diff}, nil
+	}
+	st, err := e.stacktraces(ctx, expr)
+	if err != nil {
+		return nil, err
+	}
+	return &querierv1.QueryFlamegraphResponse{Flamegraph: NewFlameGraph(newTree(st))}, nil
+}
+
+// stacktraces evaluates the expression into the stacktraces of a flamegraph.
+// Only selectors, and sums of selectors without grouping, can be rendered as flamegraphs.
+func (e *evaluator) stacktraces(ctx context.Context, expr phlareql.Expr) ([]stacktraces, error) {
+	switch n := expr.(type) {
+	case *phlareql.Selector:
+		profileType, err := e.profileType(ctx, n.Name)
+		if err != nil {
+			return nil, err
+		}
+		return e.q.selectStacktraces(ctx, profileType, convertMatchersToString(n.Matchers), e.start, e.end)
+	case *phlareql.AggregateExpr:
+		if n.Op == phlareql.Sum && len(n.Grouping) == 0 {
+			return e.stacktraces(ctx, n.Expr)
+		}
+	case *phlareql.Call:
+		if n.Func == "diff" {
+			return nil, invalidQuery("%s must be the root of the query", n)
+		}
+	}
+	return nil, invalidQuery("%s can't be rendered as a flamegraph", expr)
+}
+
+// flameGraphDiff compares the flamegraphs of two expressions.
+func (e *evaluator) flameGraphDiff(ctx context.Context, left, right phlareql.Expr, maxNodes int) (*querierv1.FlameGraphDiff, error) {
+	var leftStacks, rightStacks []stacktraces
+	g, gCtx := errgroup.WithContext(ctx)
+	g.Go(func() (err error) {
+		leftStacks, err = e.stacktraces(gCtx, left)
+		return err
+	})
+	g.Go(func() (err error) {
+		rightStacks, err = e.stacktraces(gCtx, right)
+		return err
+	})
+	if err := g.Wait(); err != nil {
+		return nil, err
+	}
+	leftTree, rightTree := ptree.CombineTree(pyroscopeTree(leftStacks), pyroscopeTree(rightStacks))
+	fb := ptree.CombineToFlamebearerStruct(leftTree, rightTree, maxNodes)
+	levels := make([]*querierv1.Level, len(fb.Levels))
+	for i, l := range fb.Levels {
+		levels[i] = &querierv1.Level{Values: lo.Map(l, func(v int, _ int) int64 { return int64(v) })}
+	}
+	return &querierv1.FlameGraphDiff{
+		Names:      fb.Names,
+		Levels:     levels,
+		Total:      int64(fb.NumTicks),
+		MaxSelf:    int64(fb.MaxSelf),
+		LeftTicks:  int64(leftTree.Samples()),
+		RightTicks: int64(rightTree.Samples()),
+	}, nil
+}
+
+func pyroscopeTree(stacks []stacktraces) *ptree.Tree {
+	t := ptree.New()
+	for _, s := range stacks {
+		if s.value <= 0 {
+			continue
+		}
+		// Pyroscope stacks start from the root, locations start from the leaf.
+		stack := make([]string, len(s.locations))
+		for i, l := range s.locations {
+			stack[len(stack)-1-i] = l
+		}
+		t.InsertStackString(stack, uint64(s.value))
+	}
+	return t
+}
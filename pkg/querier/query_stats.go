@@ -0,0 +1,62 @@
+package querier
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/go-kit/log/level"
+
+	"github.com/grafana/phlare/pkg/tenant"
+	"github.com/grafana/phlare/pkg/util/querystats"
+)
+
+// queryLimits returns the limits of the query. A query across several tenants
+// is limited by the smallest limits of its tenants.
+func (q *Querier) queryLimits(ctx context.Context) querystats.Limits {
+	var limits querystats.Limits
+	if q.limits == nil {
+		return limits
+	}
+	tenantIDs, err := tenant.ExtractTenantIDsFromContext(ctx)
+	if err != nil {
+		return limits
+	}
+	for _, tenantID := range tenantIDs {
+		limits.MaxStacktraces = smallestLimit(limits.MaxStacktraces, q.limits.MaxQueryStacktraces(tenantID))
+		limits.MaxSeries = smallestLimit(limits.MaxSeries, q.limits.MaxQuerySeries(tenantID))
+		limits.MaxBytesRead = smallestLimit(limits.MaxBytesRead, q.limits.MaxQueryBytesRead(tenantID))
+	}
+	return limits
+}
+
+// smallestLimit returns the smallest of both limits, 0 being no limit.
+func smallestLimit(a, b int) int {
+	if a <= 0 || (b > 0 && b < a) {
+		return b
+	}
+	return a
+}
+
+// withQueryStats returns a context collecting the statistics of the query and
+// enforcing its limits.
+func (q *Querier) withQueryStats(ctx context.Context) (context.Context, *querystats.Stats) {
+	st := querystats.New(q.queryLimits(ctx))
+	return querystats.NewContext(ctx, st), st
+}
+
+// finishQuery records the total wall time of the query, sets its statistics in
+// the response headers and logs the query when it was slow.
+func (q *Querier) finishQuery(ctx context.Context, st *querystats.Stats, start time.Time, h http.Header, method string, params ...interface{}) {
+	st.ObserveStage("total", start)
+	if h != nil {
+		st.SetHeaders(h)
+	}
+	duration := time.Since(start)
+	if q.cfg.LogQueriesLongerThan <= 0 || duration < q.cfg.LogQueriesLongerThan {
+		return
+	}
+	tenantID, _ := tenant.ExtractTenantIDFromContext(ctx)
+	kv := append([]interface{}{"msg", "slow query", "method", method, "tenant", tenantID, "duration", duration}, params...)
+	level.Info(q.logger).Log(append(kv, st.KeyValues()...)...)
+}
@@ -0,0 +1,95 @@
+package querier
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/bufbuild/connect-go"
+	"github.com/go-kit/log"
+	"github.com/grafana/dskit/ring"
+	"github.com/grafana/dskit/ring/client"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+
+	commonv1 "github.com/grafana/phlare/pkg/gen/common/v1"
+	ingestv1 "github.com/grafana/phlare/pkg/gen/ingester/v1"
+	querierv1 "github.com/grafana/phlare/pkg/gen/querier/v1"
+	"github.com/grafana/phlare/pkg/ingester/clientpool"
+	"github.com/grafana/phlare/pkg/tenant"
+	"github.com/grafana/phlare/pkg/testhelper"
+	"github.com/grafana/phlare/pkg/util/querystats"
+	"github.com/grafana/phlare/pkg/validation"
+)
+
+func Test_QueryStats(t *testing.T) {
+	newQuerier := func(t *testing.T, limits *validation.Overrides) *Querier {
+		t.Helper()
+		q, err := New(Config{
+			PoolConfig:           clientpool.PoolConfig{ClientCleanupPeriod: 1 * time.Millisecond},
+			LogQueriesLongerThan: time.Nanosecond,
+		}, testhelper.NewMockRing([]ring.InstanceDesc{
+			{Addr: "1"},
+			{Addr: "2"},
+			{Addr: "3"},
+		}, 3), func(addr string) (client.PoolClient, error) {
+			q := newFakeQuerier()
+			q.On("MergeProfilesStacktraces", mock.Anything).Once().Return(newFakeBidiClientStacktraces([]*ingestv1.ProfileSets{
+				{
+					LabelsSets: []*commonv1.Labels{{Labels: []*commonv1.LabelPair{{Name: "app", Value: "foo"}}}},
+					Profiles:   []*ingestv1.SeriesProfile{{Timestamp: 1, LabelIndex: 0}},
+				},
+			}))
+			return q, nil
+		}, limits, nil, log.NewLogfmtLogger(os.Stdout))
+		require.NoError(t, err)
+		return q
+	}
+	req := connect.NewRequest(&querierv1.SelectMergeStacktracesRequest{
+		LabelSelector: `{app="foo"}`,
+		ProfileTypeID: "memory:inuse_space:bytes:space:byte",
+		Start:         0,
+		End:           2,
+	})
+	ctx := tenant.InjectTenantID(context.Background(), "foo")
+
+	t.Run("headers", func(t *testing.T) {
+		res, err := newQuerier(t, validation.MockDefaultOverrides()).SelectMergeStacktraces(ctx, req)
+		require.NoError(t, err)
+		// The stacktraces of the ingesters within the quorum are merged.
+		require.Regexp(t, `stacktraces=[23] `, res.Header().Get(querystats.StatsHeader))
+		require.NotContains(t, res.Header().Get(querystats.StatsHeader), "bytes_streamed=0")
+		require.Regexp(t, `^select;dur=[0-9.]+, merge;dur=[0-9.]+, total;dur=[0-9.]+$`, res.Header().Get(querystats.ServerTimingHeader))
+	})
+
+	t.Run("max stacktraces", func(t *testing.T) {
+		limits := validation.MockOverrides(func(defaults *validation.Limits, tenantLimits map[string]*validation.Limits) {
+			l := *defaults
+			l.MaxQueryStacktraces = 1
+			tenantLimits["foo"] = &l
+		})
+		_, err := newQuerier(t, limits).SelectMergeStacktraces(ctx, req)
+		require.Error(t, err)
+		require.Equal(t, connect.CodeResourceExhausted, connect.CodeOf(err))
+		require.Contains(t, err.Error(), "maximum number of stacktraces (limit: 1)")
+	})
+}
+
+func Test_QueryLimits(t *testing.T) {
+	limits := validation.MockOverrides(func(defaults *validation.Limits, tenantLimits map[string]*validation.Limits) {
+		defaults.MaxQuerySeries = 100
+		a, b := *defaults, *defaults
+		a.MaxQueryStacktraces = 10
+		a.MaxQueryBytesRead = 1000
+		b.MaxQueryStacktraces = 20
+		b.MaxQuerySeries = 50
+		tenantLimits["a"] = &a
+		tenantLimits["b"] = &b
+	})
+	q := &Querier{limits: limits}
+
+	require.Equal(t, querystats.Limits{MaxStacktraces: 10, MaxSeries: 100, MaxBytesRead: 1000}, q.queryLimits(tenant.InjectTenantID(context.Background(), "a")))
+	require.Equal(t, querystats.Limits{MaxStacktraces: 10, MaxSeries: 50, MaxBytesRead: 1000}, q.queryLimits(tenant.InjectTenantID(context.Background(), "a|b")))
+	require.Equal(t, querystats.Limits{}, q.queryLimits(context.Background()))
+}
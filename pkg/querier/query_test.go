@@ -0,0 +1,278 @@
+package querier
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	commonv1 "github.com/grafana/phlare/pkg/gen/common/v1"
+	querierv1 "github.com/grafana/phlare/pkg/gen/querier/v1"
+	phlaremodel "github.com/grafana/phlare/pkg/model"
+	"github.com/grafana/phlare/pkg/phlareql"
+	"github.com/grafana/phlare/pkg/testhelper"
+)
+
+// fakeQueryable returns the points of each series by profile type ID, and the stacktraces by selector.
+// The series are keyed by service, or by service and instance as in "service/instance".
+type fakeQueryable struct {
+	types  []*commonv1.ProfileType
+	points map[string]map[string][]*commonv1.Point
+	stacks map[string][]stacktraces
+
+	mtx      sync.Mutex
+	requests []*querierv1.SelectSeriesRequest
+}
+
+func (f *fakeQueryable) profileTypes(context.Context, int64, int64) ([]*commonv1.ProfileType, error) {
+	return f.types, nil
+}
+
+func (f *fakeQueryable) selectSeries(_ context.Context, req *querierv1.SelectSeriesRequest) ([]*commonv1.Series, error) {
+	f.mtx.Lock()
+	f.requests = append(f.requests, req)
+	f.mtx.Unlock()
+
+	a := phlaremodel.NewSeriesAggregator(commonv1.SeriesAggregation_SERIES_AGGREGATION_SUM, req.Start, req.End, 10)
+	for key, points := range f.points[req.ProfileTypeID] {
+		lbs := phlaremodel.LabelsFromStrings("service", key)
+		if service, instance, ok := strings.Cut(key, "/"); ok {
+			lbs = phlaremodel.LabelsFromStrings("service", service, "instance", instance)
+		}
+		lbs = lbs.WithLabels(req.GroupBy...)
+		for _, p := range points {
+			a.Add(lbs, lbs.Hash(), p.Timestamp, p.Value, 1)
+		}
+	}
+	return a.Result(), nil
+}
+
+func (f *fakeQueryable) labelNames(context.Context, string, int64, int64) ([]string, error) {
+	return []string{"__name__", "instance", "service"}, nil
+}
+
+func (f *fakeQueryable) selectStacktraces(_ context.Context, _ *commonv1.ProfileType, selector string, _, _ int64) ([]stacktraces, error) {
+	return f.stacks[selector], nil
+}
+
+func newFakeQueryable() *fakeQueryable {
+	return &fakeQueryable{
+		types: []*commonv1.ProfileType{
+			{ID: "process_cpu:cpu:nanoseconds:cpu:nanoseconds", Name: "process_cpu", SampleType: "cpu"},
+			{ID: "memory:alloc_space:bytes:space:bytes", Name: "memory", SampleType: "alloc_space"},
+			{ID: "memory:alloc_objects:count:space:bytes", Name: "memory", SampleType: "alloc_objects"},
+			{ID: "memory:inuse_space:bytes:space:bytes", Name: "memory", SampleType: "inuse_space"},
+			{ID: "jvm:inuse_space:bytes:space:bytes", Name: "jvm", SampleType: "inuse_space"},
+			{ID: "goroutines:goroutine:count:goroutine:count", Name: "goroutines", SampleType: "goroutine"},
+		},
+		points: map[string]map[string][]*commonv1.Point{
+			"process_cpu:cpu:nanoseconds:cpu:nanoseconds": {
+				"a": {{Timestamp: 10, Value: 1}, {Timestamp: 20, Value: 2}},
+				"b": {{Timestamp: 10, Value: 3}, {Timestamp: 20, Value: 4}},
+			},
+			"memory:alloc_space:bytes:space:bytes": {
+				"a": {{Timestamp: 10, Value: 10}, {Timestamp: 20, Value: 20}},
+				"b": {{Timestamp: 10, Value: 5}, {Timestamp: 20, Value: 30}},
+			},
+			"memory:alloc_objects:count:space:bytes": {
+				"a": {{Timestamp: 10, Value: 2}, {Timestamp: 20, Value: 0}},
+				"b": {{Timestamp: 20, Value: 3}},
+			},
+			"goroutines:goroutine:count:goroutine:count": {
+				"a/1": {{Timestamp: 10, Value: 1}, {Timestamp: 20, Value: 1}},
+				"a/2": {{Timestamp: 10, Value: 3}, {Timestamp: 20, Value: 5}},
+				"b/1": {{Timestamp: 10, Value: 2}, {Timestamp: 20, Value: 2}},
+			},
+		},
+		stacks: map[string][]stacktraces{
+			`{version="1"}`: {{locations: []string{"foo", "main"}, value: 1}},
+			`{version="2"}`: {
+				{locations: []string{"foo", "main"}, value: 2},
+				{locations: []string{"bar", "main"}, value: 3},
+			},
+		},
+	}
+}
+
+func TestEvaluateSeries(t *testing.T) {
+	a := phlaremodel.LabelsFromStrings("service", "a")
+	b := phlaremodel.LabelsFromStrings("service", "b")
+	for _, tc := range []struct {
+		query    string
+		expected []*commonv1.Series
+	}{
+		{
+			query: "cpu",
+			expected: []*commonv1.Series{
+				{Labels: phlaremodel.Labels{}, Points: []*commonv1.Point{{Timestamp: 10, Value: 4}, {Timestamp: 20, Value: 6}}},
+			},
+		},
+		{
+			query: "sum by (service) (process_cpu:cpu)",
+			expected: []*commonv1.Series{
+				{Labels: a, Points: []*commonv1.Point{{Timestamp: 10, Value: 1}, {Timestamp: 20, Value: 2}}},
+				{Labels: b, Points: []*commonv1.Point{{Timestamp: 10, Value: 3}, {Timestamp: 20, Value: 4}}},
+			},
+		},
+		{
+			query: "topk(1, sum by (service) (cpu))",
+			expected: []*commonv1.Series{
+				{Labels: b, Points: []*commonv1.Point{{Timestamp: 10, Value: 3}, {Timestamp: 20, Value: 4}}},
+			},
+		},
+		{
+			query: "bottomk(1, sum by (service) (cpu))",
+			expected: []*commonv1.Series{
+				{Labels: a, Points: []*commonv1.Point{{Timestamp: 10, Value: 1}, {Timestamp: 20, Value: 2}}},
+			},
+		},
+		{
+			query: "max(sum by (service) (cpu) * 10)",
+			expected: []*commonv1.Series{
+				{Labels: phlaremodel.Labels{}, Points: []*commonv1.Point{{Timestamp: 10, Value: 30}, {Timestamp: 20, Value: 40}}},
+			},
+		},
+		{
+			// The series of each service are aggregated apart, not summed first.
+			query: "max by (service) (rate(goroutine))",
+			expected: []*commonv1.Series{
+				{Labels: a, Points: []*commonv1.Point{{Timestamp: 10, Value: 3}, {Timestamp: 20, Value: 5}}},
+				{Labels: b, Points: []*commonv1.Point{{Timestamp: 10, Value: 2}, {Timestamp: 20, Value: 2}}},
+			},
+		},
+		{
+			query: "avg by (service) (goroutine * 2)",
+			expected: []*commonv1.Series{
+				{Labels: a, Points: []*commonv1.Point{{Timestamp: 10, Value: 4}, {Timestamp: 20, Value: 6}}},
+				{Labels: b, Points: []*commonv1.Point{{Timestamp: 10, Value: 4}, {Timestamp: 20, Value: 4}}},
+			},
+		},
+		{
+			query: "count by (service) (rate(goroutine))",
+			expected: []*commonv1.Series{
+				{Labels: a, Points: []*commonv1.Point{{Timestamp: 10, Value: 2}, {Timestamp: 20, Value: 2}}},
+				{Labels: b, Points: []*commonv1.Point{{Timestamp: 10, Value: 1}, {Timestamp: 20, Value: 1}}},
+			},
+		},
+		{
+			query: "topk(2, goroutine)",
+			expected: []*commonv1.Series{
+				{Labels: phlaremodel.LabelsFromStrings("service", "a", "instance", "2"), Points: []*commonv1.Point{{Timestamp: 10, Value: 3}, {Timestamp: 20, Value: 5}}},
+				{Labels: phlaremodel.LabelsFromStrings("service", "b", "instance", "1"), Points: []*commonv1.Point{{Timestamp: 10, Value: 2}, {Timestamp: 20, Value: 2}}},
+			},
+		},
+		{
+			query: "1 - 2 * cpu",
+			expected: []*commonv1.Series{
+				{Labels: phlaremodel.Labels{}, Points: []*commonv1.Point{{Timestamp: 10, Value: -7}, {Timestamp: 20, Value: -11}}},
+			},
+		},
+		{
+			// Divisions by zero and points missing on one side have no result.
+			query: "sum by (service) (alloc_space / alloc_objects)",
+			expected: []*commonv1.Series{
+				{Labels: a, Points: []*commonv1.Point{{Timestamp: 10, Value: 5}}},
+				{Labels: b, Points: []*commonv1.Point{{Timestamp: 20, Value: 10}}},
+			},
+		},
+	} {
+		tc := tc
+		t.Run(tc.query, func(t *testing.T) {
+			expr, err := phlareql.ParseExpr(tc.query)
+			require.NoError(t, err)
+			series, err := newEvaluator(newFakeQueryable(), 10, 20, 0.01).series(context.Background(), expr, groupBy(nil))
+			require.NoError(t, err)
+			testhelper.EqualProto(t, tc.expected, series)
+		})
+	}
+}
+
+func TestEvaluateSeriesRequests(t *testing.T) {
+	q := newFakeQueryable()
+	expr, err := phlareql.ParseExpr(`sum by (service) (rate(memory:alloc_space{env="prod"}) / alloc_objects)`)
+	require.NoError(t, err)
+	_, err = newEvaluator(q, 10, 20, 0.01).series(context.Background(), expr, groupBy(nil))
+	require.NoError(t, err)
+
+	sort.Slice(q.requests, func(i, j int) bool { return q.requests[i].ProfileTypeID < q.requests[j].ProfileTypeID })
+	require.Equal(t, []*querierv1.SelectSeriesRequest{
+		{
+			ProfileTypeID: "memory:alloc_objects:count:space:bytes",
+			LabelSelector: "{}",
+			Start:         10,
+			End:           20,
+			GroupBy:       []string{"service"},
+			Step:          0.01,
+		},
+		{
+			ProfileTypeID: "memory:alloc_space:bytes:space:bytes",
+			LabelSelector: `{env="prod"}`,
+			Start:         10,
+			End:           20,
+			GroupBy:       []string{"service"},
+			Step:          0.01,
+			Aggregation:   commonv1.SeriesAggregation_SERIES_AGGREGATION_RATE,
+		},
+	}, q.requests)
+}
+
+func TestEvaluateErrors(t *testing.T) {
+	for _, tc := range []struct {
+		query string
+		err   string
+	}{
+		{`inuse_space`, `invalid_argument: profile type "inuse_space" is ambiguous, it matches [memory:inuse_space:bytes:space:bytes jvm:inuse_space:bytes:space:bytes]`},
+		{`wall`, `invalid_argument: unknown profile type "wall"`},
+		{`1 + 2`, `invalid_argument: 1 + 2 does not select profiles`},
+		{`rate(sum(cpu))`, `invalid_argument: rate expects a selector, got sum(cpu)`},
+		{`topk by (service) (1, cpu)`, `invalid_argument: topk does not support grouping`},
+		{`diff(cpu, cpu)`, `invalid_argument: diff(cpu, cpu) can only be rendered as a flamegraph`},
+	} {
+		tc := tc
+		t.Run(tc.query, func(t *testing.T) {
+			expr, err := phlareql.ParseExpr(tc.query)
+			require.NoError(t, err)
+			_, err = newEvaluator(newFakeQueryable(), 10, 20, 0.01).series(context.Background(), expr, groupBy(nil))
+			require.EqualError(t, err, tc.err)
+		})
+	}
+}
+
+func TestEvaluateFlameGraph(t *testing.T) {
+	evaluate := func(query string) (*querierv1.QueryFlamegraphResponse, error) {
+		expr, err := phlareql.ParseExpr(query)
+		require.NoError(t, err)
+		return newEvaluator(newFakeQueryable(), 10, 20, 0).flameGraph(context.Background(), expr, defaultMaxNodes)
+	}
+
+	res, err := evaluate(`sum(cpu{version="2"})`)
+	require.NoError(t, err)
+	require.Nil(t, res.FlamegraphDiff)
+	require.Equal(t, []string{"total", "main", "bar", "foo"}, res.Flamegraph.Names)
+	require.Equal(t, int64(5), res.Flamegraph.Total)
+
+	res, err = evaluate(`diff(cpu{version="1"}, cpu{version="2"})`)
+	require.NoError(t, err)
+	require.Nil(t, res.Flamegraph)
+	testhelper.EqualProto(t, &querierv1.FlameGraphDiff{
+		Names: []string{"total", "main", "foo", "bar"},
+		Levels: []*querierv1.Level{
+			{Values: []int64{0, 1, 0, 0, 5, 0, 0}},
+			{Values: []int64{0, 1, 0, 0, 5, 0, 1}},
+			// bar is only in the right flamegraph, the x offsets are delta encoded.
+			{Values: []int64{0, 0, 0, 0, 3, 3, 3, 0, 1, 1, 0, 2, 2, 2}},
+		},
+		Total:      6,
+		MaxSelf:    3,
+		LeftTicks:  1,
+		RightTicks: 5,
+	}, res.FlamegraphDiff)
+
+	for _, query := range []string{`cpu / 2`, `sum by (service) (cpu)`, `sum(diff(cpu, cpu))`} {
+		_, err := evaluate(query)
+		require.Error(t, err, query)
+	}
+}
@@ -0,0 +1,561 @@
+package querier
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/grafana/dskit/flagext"
+	"github.com/hashicorp/golang-lru/simplelru"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/samber/lo"
+	"github.com/thanos-io/thanos/pkg/cacheutil"
+	"github.com/thanos-io/thanos/pkg/model"
+	"golang.org/x/sync/errgroup"
+
+	commonv1 "github.com/grafana/phlare/pkg/gen/common/v1"
+	ingestv1 "github.com/grafana/phlare/pkg/gen/ingester/v1"
+	querierv1 "github.com/grafana/phlare/pkg/gen/querier/v1"
+	phlaremodel "github.com/grafana/phlare/pkg/model"
+	"github.com/grafana/phlare/pkg/tenant"
+)
+
+const (
+	resultsCacheBackendInMemory  = "inmemory"
+	resultsCacheBackendMemcached = "memcached"
+
+	// maxConcurrentExtents is the maximum number of extents of a query selected concurrently.
+	maxConcurrentExtents = 8
+)
+
+// ResultsCacheConfig configures the cache of the results of SelectMergeStacktraces and SelectSeries.
+type ResultsCacheConfig struct {
+	Backend       string        `yaml:"backend"`
+	SplitInterval time.Duration `yaml:"split_interval"`
+	MaxFreshness  time.Duration `yaml:"max_freshness"`
+	// IngestionWindow is the window of the ingesters heads out of which profiles are rejected,
+	// the block alignment plus the out-of-order window. It is 0 when profiles of any age are accepted.
+	IngestionWindow time.Duration `yaml:"-"`
+
+	InMemory  InMemoryResultsCacheConfig  `yaml:"inmemory"`
+	Memcached MemcachedResultsCacheConfig `yaml:"memcached"`
+}
+
+type InMemoryResultsCacheConfig struct {
+	MaxSizeBytes int `yaml:"max_size_bytes"`
+}
+
+type MemcachedResultsCacheConfig struct {
+	Addresses          flagext.StringSliceCSV `yaml:"addresses"`
+	Timeout            time.Duration          `yaml:"timeout"`
+	MaxIdleConnections int                    `yaml:"max_idle_connections"`
+	MaxItemSize        int                    `yaml:"max_item_size"`
+	Expiration         time.Duration          `yaml:"expiration"`
+}
+
+func (cfg *ResultsCacheConfig) RegisterFlagsWithPrefix(prefix string, f *flag.FlagSet) {
+	f.StringVar(&cfg.Backend, prefix+".backend", "", fmt.Sprintf("Backend of the cache of the results of flamegraph and series queries. Supported values: %s, %s. The results are not cached when empty.", resultsCacheBackendInMemory, resultsCacheBackendMemcached))
+	f.DurationVar(&cfg.SplitInterval, prefix+".split-interval", 15*time.Minute, "Queries are split into extents aligned to this interval, the results of each extent are cached separately.")
+	f.DurationVar(&cfg.MaxFreshness, prefix+".max-freshness", 0, "Extents ending within this duration from now may still receive profiles, their results are not cached. It is raised to the window profiles are accepted in: the reject_older_than limit of the tenant, or the block alignment plus the out-of-order window of the ingesters when shorter. When 0 and profiles of any age are accepted, the results are not cached.")
+	f.IntVar(&cfg.InMemory.MaxSizeBytes, prefix+".inmemory.max-size-bytes", 100*1024*1024, "Maximum size in bytes of the results kept in memory.")
+	f.Var(&cfg.Memcached.Addresses, prefix+".memcached.addresses", "Comma separated list of memcached addresses. Addresses may use DNS service discovery, e.g. dnssrv+_memcached._tcp.memcached.svc.")
+	f.DurationVar(&cfg.Memcached.Timeout, prefix+".memcached.timeout", 500*time.Millisecond, "Timeout of memcached requests.")
+	f.IntVar(&cfg.Memcached.MaxIdleConnections, prefix+".memcached.max-idle-connections", 100, "Maximum number of idle connections kept open per memcached server.")
+	f.IntVar(&cfg.Memcached.MaxItemSize, prefix+".memcached.max-item-size", 1024*1024, "Maximum size in bytes of a result stored in memcached, larger results are not cached. It should not exceed the item size limit of memcached.")
+	f.DurationVar(&cfg.Memcached.Expiration, prefix+".memcached.expiration", 24*time.Hour, "How long the results are kept in memcached.")
+}
+
+func (cfg *ResultsCacheConfig) Validate() error {
+	switch cfg.Backend {
+	case "":
+		return nil
+	case resultsCacheBackendInMemory:
+		if cfg.InMemory.MaxSizeBytes <= 0 {
+			return errors.New("the results cache in-memory size must be greater than 0")
+		}
+	case resultsCacheBackendMemcached:
+		if len(cfg.Memcached.Addresses) == 0 {
+			return errors.New("the results cache memcached addresses are required")
+		}
+	default:
+		return fmt.Errorf("unsupported results cache backend: %s", cfg.Backend)
+	}
+	if cfg.SplitInterval <= 0 {
+		return errors.New("the results cache split interval must be greater than 0")
+	}
+	return nil
+}
+
+// cacheBackend stores results by key.
+type cacheBackend interface {
+	// Fetch returns the results found for the keys.
+	Fetch(ctx context.Context, keys []string) map[string][]byte
+	Store(ctx context.Context, data map[string][]byte)
+	Stop()
+}
+
+// inMemoryCache keeps the results in memory, the least recently used results
+// are evicted once the maximum size is reached.
+type inMemoryCache struct {
+	mtx     sync.Mutex
+	lru     *simplelru.LRU
+	size    int
+	maxSize int
+}
+
+func newInMemoryCache(maxSize int) (*inMemoryCache, error) {
+	c := &inMemoryCache{maxSize: maxSize}
+	// The number of results is only bounded by their size.
+	lru, err := simplelru.NewLRU(maxSize, func(key, value interface{}) {
+		c.size -= len(key.(string)) + len(value.([]byte))
+	})
+	if err != nil {
+		return nil, err
+	}
+	c.lru = lru
+	return c, nil
+}
+
+func (c *inMemoryCache) Fetch(_ context.Context, keys []string) map[string][]byte {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	found := make(map[string][]byte, len(keys))
+	for _, k := range keys {
+		if v, ok := c.lru.Get(k); ok {
+			found[k] = v.([]byte)
+		}
+	}
+	return found
+}
+
+func (c *inMemoryCache) Store(_ context.Context, data map[string][]byte) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	for k, v := range data {
+		size := len(k) + len(v)
+		if size > c.maxSize {
+			continue
+		}
+		// The previous value is evicted first so that the size accounts for the new one only.
+		c.lru.Remove(k)
+		for c.size+size > c.maxSize {
+			c.lru.RemoveOldest()
+		}
+		c.lru.Add(k, v)
+		c.size += size
+	}
+}
+
+func (c *inMemoryCache) Stop() {}
+
+// memcachedCache stores the results in memcached.
+type memcachedCache struct {
+	client     cacheutil.RemoteCacheClient
+	expiration time.Duration
+	logger     log.Logger
+}
+
+func newMemcachedCache(cfg MemcachedResultsCacheConfig, reg prometheus.Registerer, logger log.Logger) (*memcachedCache, error) {
+	client, err := cacheutil.NewMemcachedClientWithConfig(logger, "querier-results-cache", cacheutil.MemcachedClientConfig{
+		Addresses:                 cfg.Addresses,
+		Timeout:                   cfg.Timeout,
+		MaxIdleConnections:        cfg.MaxIdleConnections,
+		MaxAsyncConcurrency:       20,
+		MaxAsyncBufferSize:        10000,
+		MaxGetMultiConcurrency:    100,
+		MaxItemSize:               model.Bytes(cfg.MaxItemSize),
+		DNSProviderUpdateInterval: 10 * time.Second,
+	}, reg)
+	if err != nil {
+		return nil, errors.Wrap(err, "memcached client")
+	}
+	return &memcachedCache{client: client, expiration: cfg.Expiration, logger: logger}, nil
+}
+
+func (c *memcachedCache) Fetch(ctx context.Context, keys []string) map[string][]byte {
+	return c.client.GetMulti(ctx, keys)
+}
+
+func (c *memcachedCache) Store(ctx context.Context, data map[string][]byte) {
+	for k, v := range data {
+		if err := c.client.SetAsync(ctx, k, v, c.expiration); err != nil {
+			level.Warn(c.logger).Log("msg", "failed to store query results in memcached", "err", err)
+		}
+	}
+}
+
+func (c *memcachedCache) Stop() {
+	c.client.Stop()
+}
+
+type resultsCacheMetrics struct {
+	hits   *prometheus.CounterVec
+	misses *prometheus.CounterVec
+}
+
+func newResultsCacheMetrics(reg prometheus.Registerer) *resultsCacheMetrics {
+	m := &resultsCacheMetrics{
+		hits: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "phlare",
+			Name:      "querier_results_cache_hits_total",
+			Help:      "The total number of query extents whose results were found in the results cache.",
+		}, []string{"method"}),
+		misses: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "phlare",
+			Name:      "querier_results_cache_misses_total",
+			Help:      "The total number of cacheable query extents whose results were not found in the results cache.",
+		}, []string{"method"}),
+	}
+	if reg != nil {
+		reg.MustRegister(m.hits, m.misses)
+	}
+	return m
+}
+
+// resultsCache caches the results of the extents of queries old enough to be immutable.
+type resultsCache struct {
+	backend         cacheBackend
+	metrics         *resultsCacheMetrics
+	splitInterval   time.Duration
+	maxFreshness    time.Duration
+	ingestionWindow time.Duration
+	logger          log.Logger
+}
+
+// newResultsCache returns the results cache of the config, or nil when results are not cached.
+func newResultsCache(cfg ResultsCacheConfig, reg prometheus.Registerer, logger log.Logger) (*resultsCache, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	var (
+		backend cacheBackend
+		err     error
+	)
+	switch cfg.Backend {
+	case "":
+		return nil, nil
+	case resultsCacheBackendInMemory:
+		backend, err = newInMemoryCache(cfg.InMemory.MaxSizeBytes)
+	case resultsCacheBackendMemcached:
+		backend, err = newMemcachedCache(cfg.Memcached, reg, logger)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &resultsCache{
+		backend:         backend,
+		metrics:         newResultsCacheMetrics(reg),
+		splitInterval:   cfg.SplitInterval,
+		maxFreshness:    cfg.MaxFreshness,
+		ingestionWindow: cfg.IngestionWindow,
+		logger:          logger,
+	}, nil
+}
+
+// extent is a range of points of a query, from start to end included.
+type extent struct {
+	start, end int64
+	// cached is true when the results of the extent are cached.
+	cached bool
+}
+
+// splitExtents splits the points spaced by step from start to end into extents
+// of the points between consecutive multiples of the split interval, rounded up
+// to a multiple of step so that the extents of queries of the same step align.
+// Only the extents with all their points within the range and before maxEnd
+// are cached, consecutive extents not cached are merged.
+func splitExtents(start, end, step, splitInterval, maxEnd int64) []extent {
+	interval := (splitInterval + step - 1) / step * step
+	var result []extent
+	for first := start; first <= end; {
+		boundary := first - first%interval
+		// The last point before the next boundary.
+		last := first + (boundary+interval-1-first)/step*step
+		e := extent{
+			start: first,
+			end:   last,
+			// All the points between the boundaries are within the range.
+			cached: first-step < boundary && last <= end && last <= maxEnd,
+		}
+		if last > end {
+			e.end = first + (end-first)/step*step
+		}
+		if n := len(result); n > 0 && !result[n-1].cached && !e.cached {
+			result[n-1].end = e.end
+		} else {
+			result = append(result, e)
+		}
+		first = last + step
+	}
+	return result
+}
+
+// resultsCacheKey returns the key of the results of the extent of a query of the tenant.
+// Query parameters are hashed, as keys of memcached have a limited length.
+func resultsCacheKey(tenantID, method string, e extent, params ...string) string {
+	h := sha256.New()
+	for _, p := range append([]string{tenantID}, params...) {
+		_, _ = h.Write([]byte(p))
+		_, _ = h.Write([]byte{0})
+	}
+	return fmt.Sprintf("%s:%s:%d:%d", method, hex.EncodeToString(h.Sum(nil)), e.start, e.end)
+}
+
+// selectExtents returns the results of each extent of a query. Cached extents are
+// fetched from the cache, the others are selected and stored in the cache when
+// they are cacheable.
+func selectExtents[T any](
+	ctx context.Context,
+	c *resultsCache,
+	method string,
+	extents []extent,
+	params []string,
+	selectExtent func(ctx context.Context, e extent) (T, error),
+	marshal func(T) ([]byte, error),
+	unmarshal func([]byte) (T, error),
+) ([]T, error) {
+	tenantID, err := tenant.ExtractTenantIDFromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]string, len(extents))
+	cachedKeys := make([]string, 0, len(extents))
+	for i, e := range extents {
+		if e.cached {
+			keys[i] = resultsCacheKey(tenantID, method, e, params...)
+			cachedKeys = append(cachedKeys, keys[i])
+		}
+	}
+	var found map[string][]byte
+	if len(cachedKeys) > 0 {
+		found = c.backend.Fetch(ctx, cachedKeys)
+	}
+
+	var (
+		results = make([]T, len(extents))
+		mtx     sync.Mutex
+		store   = make(map[string][]byte)
+		hits    int
+	)
+	g, gCtx := errgroup.WithContext(ctx)
+	g.SetLimit(maxConcurrentExtents)
+	for i, e := range extents {
+		if data, ok := found[keys[i]]; ok {
+			res, err := unmarshal(data)
+			if err == nil {
+				results[i] = res
+				hits++
+				continue
+			}
+			level.Warn(c.logger).Log("msg", "failed to decode cached query results", "key", keys[i], "err", err)
+		}
+		i, e := i, e
+		g.Go(func() error {
+			res, err := selectExtent(gCtx, e)
+			if err != nil {
+				return err
+			}
+			results[i] = res
+			if !e.cached {
+				return nil
+			}
+			data, err := marshal(res)
+			if err != nil {
+				return err
+			}
+			mtx.Lock()
+			store[keys[i]] = data
+			mtx.Unlock()
+			return nil
+		})
+	}
+	c.metrics.hits.WithLabelValues(method).Add(float64(hits))
+	c.metrics.misses.WithLabelValues(method).Add(float64(len(cachedKeys) - hits))
+	if err := g.Wait(); err != nil {
+		return nil, err
+	}
+	if len(store) > 0 {
+		c.backend.Store(ctx, store)
+	}
+	return results, nil
+}
+
+// maxCachedTime returns the time, in milliseconds, of the most recent point that can be cached.
+// Profiles may still be ingested within the window they are accepted in, which is bounded by
+// the reject_older_than limit of the tenants and the ingestion window of the ingesters. Nothing
+// is cached when profiles of any age are accepted, unless a max freshness is set.
+func (q *Querier) maxCachedTime(ctx context.Context) (int64, bool) {
+	if q.resultsCache == nil {
+		return 0, false
+	}
+	tenantIDs, err := tenant.ExtractTenantIDsFromContext(ctx)
+	if err != nil {
+		return 0, false
+	}
+	var freshness time.Duration
+	for _, tenantID := range tenantIDs {
+		window := q.resultsCache.ingestionWindow
+		if q.limits != nil {
+			if maxAge := q.limits.RejectOlderThan(tenantID); maxAge > 0 && (window == 0 || maxAge < window) {
+				window = maxAge
+			}
+		}
+		if window < q.resultsCache.maxFreshness {
+			window = q.resultsCache.maxFreshness
+		}
+		if window <= 0 {
+			return 0, false
+		}
+		if window > freshness {
+			freshness = window
+		}
+	}
+	return time.Now().Add(-freshness).UnixMilli(), true
+}
+
+// selectCachedStacktraces selects the stacktraces of the profiles from start to
+// end, the stacktraces of the extents of the range found in the results cache
+// are not selected again.
+func (q *Querier) selectCachedStacktraces(ctx context.Context, req *querierv1.SelectMergeStacktracesRequest, profileType *commonv1.ProfileType) ([]stacktraces, error) {
+	maxCachedTime, ok := q.maxCachedTime(ctx)
+	if !ok {
+		return q.selectShardedStacktraces(ctx, profileType, req.LabelSelector, req.Start, req.End, nil)
+	}
+	extents := splitExtents(req.Start, req.End, 1, q.resultsCache.splitInterval.Milliseconds(), maxCachedTime)
+	results, err := selectExtents(ctx, q.resultsCache, "SelectMergeStacktraces", extents,
+		[]string{req.ProfileTypeID, req.LabelSelector},
+		func(ctx context.Context, e extent) ([]stacktraces, error) {
+			return q.selectShardedStacktraces(ctx, profileType, req.LabelSelector, e.start, e.end, nil)
+		},
+		marshalStacktraces,
+		unmarshalStacktraces,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return lo.Flatten(results), nil
+}
+
+func marshalStacktraces(st []stacktraces) ([]byte, error) {
+	var (
+		result = &ingestv1.MergeProfilesStacktracesResult{
+			Stacktraces: make([]*ingestv1.StacktraceSample, len(st)),
+		}
+		ids = make(map[string]int32)
+	)
+	for i, s := range st {
+		sample := &ingestv1.StacktraceSample{
+			FunctionIds: make([]int32, len(s.locations)),
+			Value:       s.value,
+		}
+		for j, name := range s.locations {
+			id, ok := ids[name]
+			if !ok {
+				id = int32(len(result.FunctionNames))
+				ids[name] = id
+				result.FunctionNames = append(result.FunctionNames, name)
+			}
+			sample.FunctionIds[j] = id
+		}
+		result.Stacktraces[i] = sample
+	}
+	return result.MarshalVT()
+}
+
+func unmarshalStacktraces(data []byte) ([]stacktraces, error) {
+	var result ingestv1.MergeProfilesStacktracesResult
+	if err := result.UnmarshalVT(data); err != nil {
+		return nil, err
+	}
+	st := make([]stacktraces, len(result.Stacktraces))
+	for i, s := range result.Stacktraces {
+		st[i] = stacktraces{
+			locations: make([]string, len(s.FunctionIds)),
+			value:     s.Value,
+		}
+		for j, id := range s.FunctionIds {
+			if id < 0 || int(id) >= len(result.FunctionNames) {
+				return nil, fmt.Errorf("invalid function id %d", id)
+			}
+			st[i].locations[j] = result.FunctionNames[id]
+		}
+	}
+	return st, nil
+}
+
+// selectCachedSeries selects the series of points spaced by step from start to
+// end, the points of the extents of the range found in the results cache are
+// not selected again.
+func (q *Querier) selectCachedSeries(ctx context.Context, req *querierv1.SelectSeriesRequest, profileType *commonv1.ProfileType, step int64) ([]*commonv1.Series, error) {
+	// The first point aggregates the profiles from start-step, others only
+	// aggregate the profiles after the previous point.
+	maxCachedTime, ok := q.maxCachedTime(ctx)
+	if !ok {
+		return q.selectRangeSeries(ctx, req, profileType, req.Start-step, req.Start, req.End, step)
+	}
+	extents := splitExtents(req.Start, req.End, step, q.resultsCache.splitInterval.Milliseconds(), maxCachedTime)
+	// Unlike the first point of other extents, the first point of the range
+	// includes the profiles at start-step, it is not cached.
+	extents[0].cached = false
+	results, err := selectExtents(ctx, q.resultsCache, "SelectSeries", extents,
+		[]string{req.ProfileTypeID, req.LabelSelector, strings.Join(req.GroupBy, ","), req.Aggregation.String(), strconv.FormatInt(step, 10)},
+		func(ctx context.Context, e extent) ([]*commonv1.Series, error) {
+			if e.start == req.Start {
+				return q.selectRangeSeries(ctx, req, profileType, req.Start-step, e.start, e.end, step)
+			}
+			// Ingesters aggregate the profiles at the start of the request with the
+			// first point, which is dropped so that they aren't counted twice.
+			return q.selectRangeSeries(ctx, req, profileType, e.start-2*step, e.start, e.end, step)
+		},
+		func(series []*commonv1.Series) ([]byte, error) {
+			return (&querierv1.SelectSeriesResponse{Series: series}).MarshalVT()
+		},
+		func(data []byte) ([]*commonv1.Series, error) {
+			var res querierv1.SelectSeriesResponse
+			if err := res.UnmarshalVT(data); err != nil {
+				return nil, err
+			}
+			return res.Series, nil
+		},
+	)
+	if err != nil {
+		return nil, err
+	}
+	return concatSeries(results), nil
+}
+
+// concatSeries concatenates the points of the series of consecutive extents with the same labels.
+func concatSeries(extents [][]*commonv1.Series) []*commonv1.Series {
+	if len(extents) == 1 {
+		return extents[0]
+	}
+	var (
+		series = make(map[uint64]*commonv1.Series)
+		result []*commonv1.Series
+	)
+	for _, extent := range extents {
+		for _, s := range extent {
+			h := phlaremodel.Labels(s.Labels).Hash()
+			if prev, ok := series[h]; ok {
+				prev.Points = append(prev.Points, s.Points...)
+				continue
+			}
+			series[h] = s
+			result = append(result, s)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return phlaremodel.CompareLabelPairs(result[i].Labels, result[j].Labels) < 0
+	})
+	return result
+}
@@ -0,0 +1,305 @@
+package querier
+
+import (
+	"context"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bufbuild/connect-go"
+	"github.com/go-kit/log"
+	"github.com/grafana/dskit/ring"
+	"github.com/grafana/dskit/ring/client"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/common/model"
+	"github.com/samber/lo"
+	"github.com/stretchr/testify/require"
+
+	commonv1 "github.com/grafana/phlare/pkg/gen/common/v1"
+	ingestv1 "github.com/grafana/phlare/pkg/gen/ingester/v1"
+	querierv1 "github.com/grafana/phlare/pkg/gen/querier/v1"
+	"github.com/grafana/phlare/pkg/ingester/clientpool"
+	phlaremodel "github.com/grafana/phlare/pkg/model"
+	"github.com/grafana/phlare/pkg/tenant"
+	"github.com/grafana/phlare/pkg/testhelper"
+	"github.com/grafana/phlare/pkg/validation"
+)
+
+func Test_splitExtents(t *testing.T) {
+	for _, tc := range []struct {
+		name                               string
+		start, end, step, interval, maxEnd int64
+		expected                           []extent
+	}{
+		{
+			name: "stacktraces", start: 5, end: 35, step: 1, interval: 10, maxEnd: 100,
+			expected: []extent{{5, 9, false}, {10, 19, true}, {20, 29, true}, {30, 35, false}},
+		},
+		{
+			name: "fresh extents are merged", start: 5, end: 35, step: 1, interval: 10, maxEnd: 25,
+			expected: []extent{{5, 9, false}, {10, 19, true}, {20, 35, false}},
+		},
+		{
+			name: "aligned range", start: 10, end: 29, step: 1, interval: 10, maxEnd: 100,
+			expected: []extent{{10, 19, true}, {20, 29, true}},
+		},
+		{
+			name: "interval rounded up to a multiple of step", start: 4, end: 40, step: 3, interval: 10, maxEnd: 100,
+			expected: []extent{{4, 10, false}, {13, 22, true}, {25, 34, true}, {37, 40, false}},
+		},
+		{
+			name: "not cached", start: 4, end: 40, step: 3, interval: 10, maxEnd: 0,
+			expected: []extent{{4, 40, false}},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			require.Equal(t, tc.expected, splitExtents(tc.start, tc.end, tc.step, tc.interval, tc.maxEnd))
+		})
+	}
+}
+
+// rangeIngester answers with a profile every interval, each with the value of its timestamp.
+type rangeIngester struct {
+	testhelper.FakePoolClient
+	// Only merge queries are implemented.
+	IngesterQueryClient
+
+	interval int64
+	mtx      sync.Mutex
+	requests [][2]int64
+}
+
+func (f *rangeIngester) profiles(req *ingestv1.SelectProfilesRequest) *ingestv1.ProfileSets {
+	f.mtx.Lock()
+	f.requests = append(f.requests, [2]int64{req.Start, req.End})
+	f.mtx.Unlock()
+	profiles := &ingestv1.ProfileSets{
+		LabelsSets: []*commonv1.Labels{{Labels: phlaremodel.LabelsFromStrings("service", "api")}},
+	}
+	for ts := req.Start + (f.interval-req.Start%f.interval)%f.interval; ts <= req.End; ts += f.interval {
+		profiles.Profiles = append(profiles.Profiles, &ingestv1.SeriesProfile{Timestamp: ts})
+	}
+	return profiles
+}
+
+func (f *rangeIngester) MergeProfilesStacktraces(context.Context) clientpool.BidiClientMergeProfilesStacktraces {
+	return &rangeBidiClient[*ingestv1.MergeProfilesStacktracesRequest, *ingestv1.MergeProfilesStacktracesResponse]{
+		result: func(req *ingestv1.MergeProfilesStacktracesRequest) (*ingestv1.ProfileSets, *ingestv1.MergeProfilesStacktracesResponse) {
+			profiles := f.profiles(req.Request)
+			result := &ingestv1.MergeProfilesStacktracesResult{FunctionNames: []string{"main", "even", "odd"}}
+			for _, p := range profiles.Profiles {
+				result.Stacktraces = append(result.Stacktraces, &ingestv1.StacktraceSample{
+					FunctionIds: []int32{int32(1 + p.Timestamp/f.interval%2), 0},
+					Value:       p.Timestamp,
+				})
+			}
+			return profiles, &ingestv1.MergeProfilesStacktracesResponse{Result: result}
+		},
+		selected: func(p *ingestv1.ProfileSets) *ingestv1.MergeProfilesStacktracesResponse {
+			return &ingestv1.MergeProfilesStacktracesResponse{SelectedProfiles: p}
+		},
+	}
+}
+
+func (f *rangeIngester) MergeProfilesLabels(context.Context) clientpool.BidiClientMergeProfilesLabels {
+	return &rangeBidiClient[*ingestv1.MergeProfilesLabelsRequest, *ingestv1.MergeProfilesLabelsResponse]{
+		result: func(req *ingestv1.MergeProfilesLabelsRequest) (*ingestv1.ProfileSets, *ingestv1.MergeProfilesLabelsResponse) {
+			profiles := f.profiles(req.Request)
+			// Ingesters aggregate the profiles at the start of the request with the first point.
+			step := time.Duration(req.Step * float64(time.Second)).Milliseconds()
+			agg := phlaremodel.NewSeriesAggregator(req.Aggregation, req.Request.Start+step, req.Request.End, step)
+			lbs := profiles.LabelsSets[0].Labels
+			for _, p := range profiles.Profiles {
+				agg.Add(lbs, phlaremodel.Labels(lbs).Hash(), p.Timestamp, float64(p.Timestamp), 1)
+			}
+			series, counts := agg.Series()
+			return profiles, &ingestv1.MergeProfilesLabelsResponse{Series: series, Counts: counts}
+		},
+		selected: func(p *ingestv1.ProfileSets) *ingestv1.MergeProfilesLabelsResponse {
+			return &ingestv1.MergeProfilesLabelsResponse{SelectedProfiles: p}
+		},
+	}
+}
+
+// rangeBidiClient sends the selected profiles once, then the result.
+type rangeBidiClient[Req any, Res any] struct {
+	result   func(Req) (*ingestv1.ProfileSets, Res)
+	selected func(*ingestv1.ProfileSets) Res
+
+	profiles *ingestv1.ProfileSets
+	res      Res
+}
+
+func (c *rangeBidiClient[Req, Res]) Send(req Req) error {
+	if c.selected != nil && c.profiles == nil {
+		c.profiles, c.res = c.result(req)
+	}
+	return nil
+}
+
+func (c *rangeBidiClient[Req, Res]) Receive() (Res, error) {
+	if c.profiles != nil && len(c.profiles.Profiles) > 0 && c.selected != nil {
+		selected := c.selected(c.profiles)
+		c.selected = nil
+		return selected, nil
+	}
+	c.selected = nil
+	return c.res, nil
+}
+
+func (c *rangeBidiClient[Req, Res]) CloseRequest() error  { return nil }
+func (c *rangeBidiClient[Req, Res]) CloseResponse() error { return nil }
+
+func newRangeTestQuerier(t *testing.T, interval int64, cacheCfg ResultsCacheConfig, reg prometheus.Registerer) (*Querier, *rangeIngester) {
+	ingester := &rangeIngester{interval: interval}
+	querier, err := New(Config{
+		PoolConfig:   clientpool.PoolConfig{ClientCleanupPeriod: 1 * time.Millisecond},
+		ResultsCache: cacheCfg,
+	}, testhelper.NewMockRing([]ring.InstanceDesc{{Addr: "1"}}, 1), func(addr string) (client.PoolClient, error) {
+		return ingester, nil
+	}, validation.MockDefaultOverrides(), reg, log.NewLogfmtLogger(os.Stdout))
+	require.NoError(t, err)
+	return querier, ingester
+}
+
+func Test_ResultsCache(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	cached, ingester := newRangeTestQuerier(t, 5, ResultsCacheConfig{
+		Backend:       resultsCacheBackendInMemory,
+		SplitInterval: 100 * time.Millisecond,
+		// Profiles older than an hour are rejected.
+		IngestionWindow: time.Hour,
+		InMemory:        InMemoryResultsCacheConfig{MaxSizeBytes: 1024 * 1024},
+	}, reg)
+	uncached, _ := newRangeTestQuerier(t, 5, ResultsCacheConfig{}, nil)
+	ctx := tenant.InjectTenantID(context.Background(), "tenant")
+
+	for _, tc := range []struct {
+		start, end int64
+		step       float64
+		agg        commonv1.SeriesAggregation
+	}{
+		{start: 30, end: 470, step: 0.01},
+		{start: 30, end: 470, step: 0.01, agg: commonv1.SeriesAggregation_SERIES_AGGREGATION_AVG},
+		{start: 100, end: 500, step: 0.01},
+		{start: 7, end: 493, step: 0.015, agg: commonv1.SeriesAggregation_SERIES_AGGREGATION_MAX},
+		{start: 7, end: 493, step: 0.015, agg: commonv1.SeriesAggregation_SERIES_AGGREGATION_COUNT},
+	} {
+		req := &querierv1.SelectSeriesRequest{
+			ProfileTypeID: "memory:inuse_space:bytes:space:bytes",
+			LabelSelector: "{}",
+			Start:         tc.start,
+			End:           tc.end,
+			Step:          tc.step,
+			Aggregation:   tc.agg,
+		}
+		expected, err := uncached.SelectSeries(ctx, connect.NewRequest(req))
+		require.NoError(t, err)
+		// The second query uses the cached extents.
+		for i := 0; i < 2; i++ {
+			actual, err := cached.SelectSeries(ctx, connect.NewRequest(req))
+			require.NoError(t, err)
+			testhelper.EqualProto(t, expected.Msg, actual.Msg)
+		}
+
+		stReq := &querierv1.SelectMergeStacktracesRequest{
+			ProfileTypeID: "memory:inuse_space:bytes:space:bytes",
+			LabelSelector: "{}",
+			Start:         tc.start,
+			End:           tc.end,
+		}
+		expectedSt, err := uncached.SelectMergeStacktraces(ctx, connect.NewRequest(stReq))
+		require.NoError(t, err)
+		for i := 0; i < 2; i++ {
+			actual, err := cached.SelectMergeStacktraces(ctx, connect.NewRequest(stReq))
+			require.NoError(t, err)
+			testhelper.EqualProto(t, expectedSt.Msg, actual.Msg)
+		}
+	}
+
+	// Only the extents not cached are selected from ingesters.
+	ingester.requests = nil
+	_, err := cached.SelectMergeStacktraces(ctx, connect.NewRequest(&querierv1.SelectMergeStacktracesRequest{
+		ProfileTypeID: "memory:inuse_space:bytes:space:bytes",
+		LabelSelector: "{}",
+		Start:         30,
+		End:           470,
+	}))
+	require.NoError(t, err)
+	require.ElementsMatch(t, [][2]int64{{30, 99}, {400, 470}}, ingester.requests)
+
+	require.Equal(t, float64(4), testutil.ToFloat64(cached.resultsCache.metrics.misses.WithLabelValues("SelectMergeStacktraces")))
+	require.Equal(t, float64(31), testutil.ToFloat64(cached.resultsCache.metrics.hits.WithLabelValues("SelectMergeStacktraces")))
+}
+
+func Test_ResultsCache_Fresh(t *testing.T) {
+	for _, tc := range []struct {
+		name            string
+		maxFreshness    time.Duration
+		ingestionWindow time.Duration
+		rejectOlderThan time.Duration
+		// fresh is the duration selected again, the whole range when 0.
+		fresh time.Duration
+	}{
+		{name: "max freshness", maxFreshness: 10 * time.Minute, fresh: 10 * time.Minute},
+		{name: "profiles of any age accepted"},
+		{name: "tenant ingestion window", rejectOlderThan: 30 * time.Minute, fresh: 30 * time.Minute},
+		{name: "ingesters ingestion window", ingestionWindow: 20 * time.Minute, rejectOlderThan: 30 * time.Minute, fresh: 20 * time.Minute},
+		{name: "max freshness raised to the ingestion window", maxFreshness: 10 * time.Minute, ingestionWindow: 20 * time.Minute, fresh: 20 * time.Minute},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			querier, ingester := newRangeTestQuerier(t, time.Second.Milliseconds(), ResultsCacheConfig{
+				Backend:         resultsCacheBackendInMemory,
+				SplitInterval:   time.Minute,
+				MaxFreshness:    tc.maxFreshness,
+				IngestionWindow: tc.ingestionWindow,
+				InMemory:        InMemoryResultsCacheConfig{MaxSizeBytes: 1024 * 1024},
+			}, nil)
+			querier.limits = validation.MockOverrides(func(defaults *validation.Limits, tenantLimits map[string]*validation.Limits) {
+				defaults.RejectOlderThan = model.Duration(tc.rejectOlderThan)
+			})
+			ctx := tenant.InjectTenantID(context.Background(), "tenant")
+			now := time.Now().UnixMilli()
+			req := &querierv1.SelectMergeStacktracesRequest{
+				ProfileTypeID: "memory:inuse_space:bytes:space:bytes",
+				LabelSelector: "{}",
+				Start:         now - time.Hour.Milliseconds(),
+				End:           now,
+			}
+			_, err := querier.SelectMergeStacktraces(ctx, connect.NewRequest(req))
+			require.NoError(t, err)
+			ingester.requests = nil
+			_, err = querier.SelectMergeStacktraces(ctx, connect.NewRequest(req))
+			require.NoError(t, err)
+
+			if tc.fresh == 0 {
+				// Nothing is cached.
+				require.Equal(t, [][2]int64{{req.Start, req.End}}, ingester.requests)
+				return
+			}
+			// The first minute, not fully within the range, and the fresh extents are selected again.
+			require.Len(t, ingester.requests, 2)
+			tail := lo.MaxBy(ingester.requests, func(a, b [2]int64) bool { return a[0] > b[0] })
+			require.Equal(t, now, tail[1])
+			require.Greater(t, tail[0], now-(tc.fresh+time.Minute).Milliseconds())
+			require.Less(t, tail[0], now-(tc.fresh-time.Minute).Milliseconds())
+		})
+	}
+}
+
+func Test_inMemoryCache(t *testing.T) {
+	c, err := newInMemoryCache(10)
+	require.NoError(t, err)
+	c.Store(context.Background(), map[string][]byte{"a": []byte("1234"), "b": []byte("1234")})
+	require.Equal(t, map[string][]byte{"a": []byte("1234")}, c.Fetch(context.Background(), []string{"a", "c"}))
+
+	// b is evicted as the least recently used result.
+	c.Store(context.Background(), map[string][]byte{"c": []byte("12")})
+	require.Equal(t, map[string][]byte{"a": []byte("1234"), "c": []byte("12")}, c.Fetch(context.Background(), []string{"a", "b", "c"}))
+
+	// Results larger than the cache are not stored.
+	c.Store(context.Background(), map[string][]byte{"d": []byte("12345678910")})
+	require.Empty(t, c.Fetch(context.Background(), []string{"d"}))
+}
@@ -3,6 +3,7 @@ package querier
 import (
 	"container/heap"
 	"context"
+	"sort"
 
 	"github.com/grafana/dskit/multierror"
 	"github.com/prometheus/common/model"
@@ -14,6 +15,7 @@ import (
 	"github.com/grafana/phlare/pkg/ingester/clientpool"
 	"github.com/grafana/phlare/pkg/iter"
 	phlaremodel "github.com/grafana/phlare/pkg/model"
+	"github.com/grafana/phlare/pkg/util/querystats"
 )
 
 type ProfileWithLabels struct {
@@ -49,6 +51,7 @@ type mergeIterator[R any, Req Request, Res Response] struct {
 	ctx          context.Context
 	bidi         BidiClientMerge[Req, Res]
 	ingesterAddr string
+	stats        *querystats.Stats
 
 	err      error
 	curr     *ingestv1.ProfileSets
@@ -71,6 +74,7 @@ func NewMergeIterator[
 		ingesterAddr: r.addr,
 		keepSent:     true, // at the start we don't send a keep request.
 		ctx:          ctx,
+		stats:        querystats.FromContext(ctx),
 	}
 }
 
@@ -103,6 +107,7 @@ func (s *mergeIterator[R, Req, Res]) Next() bool {
 				s.err = err
 				return false
 			}
+			s.stats.AddBytesStreamed(res.SizeVT())
 			selectedProfiles = res.SelectedProfiles
 		case BidiClientMerge[*ingestv1.MergeProfilesLabelsRequest, *ingestv1.MergeProfilesLabelsResponse]:
 			res, err := bidi.Receive()
@@ -110,6 +115,7 @@ func (s *mergeIterator[R, Req, Res]) Next() bool {
 				s.err = err
 				return false
 			}
+			s.stats.AddBytesStreamed(res.SizeVT())
 			selectedProfiles = res.SelectedProfiles
 		}
 
@@ -154,14 +160,32 @@ func (s *mergeIterator[R, Req, Res]) Result() (R, error) {
 			s.err = err
 			return result, err
 		}
-		result = any(res.Result).(R)
+		s.stats.AddBytesStreamed(res.SizeVT())
+		if err := s.stats.Merge(res.Stats); err != nil {
+			s.err = err
+			return result, err
+		}
+		n := len(res.Result.GetStacktraces())
+		for _, group := range res.Groups {
+			n += len(group.Stacktraces)
+		}
+		if err := s.stats.AddStacktraces(n); err != nil {
+			s.err = err
+			return result, err
+		}
+		result = any(res).(R)
 	case BidiClientMerge[*ingestv1.MergeProfilesLabelsRequest, *ingestv1.MergeProfilesLabelsResponse]:
 		res, err := bidi.Receive()
 		if err != nil {
 			s.err = err
 			return result, err
 		}
-		result = any(res.Series).(R)
+		s.stats.AddBytesStreamed(res.SizeVT())
+		if err := s.stats.Merge(res.Stats); err != nil {
+			s.err = err
+			return result, err
+		}
+		result = any(res).(R)
 	}
 	if err := s.bidi.CloseResponse(); err != nil {
 		s.err = err
@@ -281,16 +305,19 @@ func requeueAsync(h heap.Interface, eis ...MergeIterator) error {
 }
 
 type stacktraces struct {
+	// labels are the labels of the group of the stacktrace, when grouped.
+	labels    phlaremodel.Labels
 	locations []string
 	value     int64
 }
 
 // selectMergeStacktraces selects the  profile from each ingester by deduping them and request merges of stacktraces of them.
+// The stacktraces of each group are merged together, when the ingesters group them.
 func selectMergeStacktraces(ctx context.Context, responses []responseFromIngesters[clientpool.BidiClientMergeProfilesStacktraces]) ([]stacktraces, error) {
-	mergeResults := make([]MergeResult[*ingestv1.MergeProfilesStacktracesResult], len(responses))
+	mergeResults := make([]MergeResult[*ingestv1.MergeProfilesStacktracesResponse], len(responses))
 	iters := make([]MergeIterator, len(responses))
 	for i, resp := range responses {
-		it := NewMergeIterator[*ingestv1.MergeProfilesStacktracesResult](
+		it := NewMergeIterator[*ingestv1.MergeProfilesStacktracesResponse](
 			ctx, responseFromIngesters[BidiClientMerge[*ingestv1.MergeProfilesStacktracesRequest, *ingestv1.MergeProfilesStacktracesResponse]]{
 				addr:     resp.addr,
 				response: resp.response,
@@ -304,18 +331,27 @@ func selectMergeStacktraces(ctx context.Context, responses []responseFromIngeste
 	}
 
 	// Collects the results in parallel.
-	results := make([]*ingestv1.MergeProfilesStacktracesResult, 0, len(iters))
+	var (
+		results []*ingestv1.MergeProfilesStacktracesResult
+		groups  = make(map[uint64][]*ingestv1.MergeProfilesStacktracesResult)
+	)
 	s := lo.Synchronize()
 	g, _ := errgroup.WithContext(ctx)
 	for _, iter := range mergeResults {
 		iter := iter
 		g.Go(func() error {
-			result, err := iter.Result()
+			res, err := iter.Result()
 			if err != nil {
 				return err
 			}
 			s.Do(func() {
-				results = append(results, result)
+				if res.Result != nil {
+					results = append(results, res.Result)
+				}
+				for _, group := range res.Groups {
+					hash := phlaremodel.Labels(group.Labels).Hash()
+					groups[hash] = append(groups[hash], group)
+				}
 			})
 			return nil
 		})
@@ -323,7 +359,15 @@ func selectMergeStacktraces(ctx context.Context, responses []responseFromIngeste
 	if err := g.Wait(); err != nil {
 		return nil, err
 	}
-	return mergeProfilesStacktracesResult(results), nil
+	result := mergeProfilesStacktracesResult(results)
+	for _, group := range groups {
+		st := mergeProfilesStacktracesResult(group)
+		for i := range st {
+			st[i].labels = group[0].Labels
+		}
+		result = append(result, st...)
+	}
+	return result, nil
 }
 
 // mergeProfilesStacktracesResult merges the results of multiple MergeProfilesStacktraces into a single result.
@@ -343,11 +387,41 @@ func mergeProfilesStacktracesResult(results []*ingestv1.MergeProfilesStacktraces
 	return result
 }
 
+// stacktracesGroup is the stacktraces of a group of series.
+type stacktracesGroup struct {
+	labels      phlaremodel.Labels
+	stacktraces []stacktraces
+}
+
+// groupStacktraces splits the stacktraces by the labels of their group, sorted by labels.
+func groupStacktraces(st []stacktraces) []stacktracesGroup {
+	var (
+		result []stacktracesGroup
+		groups = make(map[uint64]int)
+	)
+	for _, s := range st {
+		hash := s.labels.Hash()
+		i, ok := groups[hash]
+		if !ok {
+			i = len(result)
+			groups[hash] = i
+			result = append(result, stacktracesGroup{labels: s.labels})
+		}
+		result[i].stacktraces = append(result[i].stacktraces, s)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return phlaremodel.CompareLabelPairs(result[i].labels, result[j].labels) < 0
+	})
+	return result
+}
+
 type ProfileValue struct {
 	Ts         int64
 	Lbs        []*commonv1.LabelPair
 	LabelsHash uint64
 	Value      float64
+	// Count is the number of profiles aggregated into the value.
+	Count int64
 }
 
 func (p ProfileValue) Labels() phlaremodel.Labels {
@@ -359,11 +433,12 @@ func (p ProfileValue) Timestamp() model.Time {
 }
 
 // selectMergeSeries selects the  profile from each ingester by deduping them and request merges of total values.
+// Ingesters may aggregate the profiles by step, the values returned must still be aggregated across ingesters.
 func selectMergeSeries(ctx context.Context, responses []responseFromIngesters[clientpool.BidiClientMergeProfilesLabels]) (iter.Iterator[ProfileValue], error) {
-	mergeResults := make([]MergeResult[[]*commonv1.Series], len(responses))
+	mergeResults := make([]MergeResult[*ingestv1.MergeProfilesLabelsResponse], len(responses))
 	iters := make([]MergeIterator, len(responses))
 	for i, resp := range responses {
-		it := NewMergeIterator[[]*commonv1.Series](
+		it := NewMergeIterator[*ingestv1.MergeProfilesLabelsResponse](
 			ctx, responseFromIngesters[BidiClientMerge[*ingestv1.MergeProfilesLabelsRequest, *ingestv1.MergeProfilesLabelsResponse]]{
 				addr:     resp.addr,
 				response: resp.response,
@@ -377,7 +452,7 @@ func selectMergeSeries(ctx context.Context, responses []responseFromIngesters[cl
 	}
 
 	// Collects the results in parallel.
-	results := make([][]*commonv1.Series, 0, len(iters))
+	results := make([]*ingestv1.MergeProfilesLabelsResponse, 0, len(iters))
 	s := lo.Synchronize()
 	g, _ := errgroup.WithContext(ctx)
 	for _, iter := range mergeResults {
@@ -396,24 +471,30 @@ func selectMergeSeries(ctx context.Context, responses []responseFromIngesters[cl
 	if err := g.Wait(); err != nil {
 		return nil, err
 	}
-	series := phlaremodel.MergeSeries(results...)
-	seriesIters := make([]iter.Iterator[ProfileValue], 0, len(series))
-	for _, s := range series {
-		s := s
-		seriesIters = append(seriesIters, newSeriesIterator(s.Labels, s.Points))
+	var seriesIters []iter.Iterator[ProfileValue]
+	for _, r := range results {
+		for i, s := range r.Series {
+			var counts []int64
+			if i < len(r.Counts) {
+				counts = r.Counts[i].Counts
+			}
+			seriesIters = append(seriesIters, newSeriesIterator(s.Labels, s.Points, counts))
+		}
 	}
 	return iter.NewSortProfileIterator(seriesIters), nil
 }
 
 type seriesIterator struct {
-	point []*commonv1.Point
+	point  []*commonv1.Point
+	counts []int64
 
 	curr ProfileValue
 }
 
-func newSeriesIterator(lbs []*commonv1.LabelPair, points []*commonv1.Point) *seriesIterator {
+func newSeriesIterator(lbs []*commonv1.LabelPair, points []*commonv1.Point, counts []int64) *seriesIterator {
 	return &seriesIterator{
-		point: points,
+		point:  points,
+		counts: counts,
 
 		curr: ProfileValue{
 			Lbs:        lbs,
@@ -430,6 +511,12 @@ func (s *seriesIterator) Next() bool {
 	s.point = s.point[1:]
 	s.curr.Ts = p.Timestamp
 	s.curr.Value = p.Value
+	// Without counts, each point is a single profile.
+	s.curr.Count = 1
+	if len(s.counts) > 0 {
+		s.curr.Count = s.counts[0]
+		s.counts = s.counts[1:]
+	}
 	return true
 }
 
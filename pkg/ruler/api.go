@@ -0,0 +1,96 @@
+package ruler
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/grafana/phlare/pkg/tenant"
+)
+
+type rulesResponse struct {
+	Status string    `json:"status"`
+	Data   rulesData `json:"data"`
+}
+
+type rulesData struct {
+	Groups []ruleGroupState `json:"groups"`
+}
+
+type ruleGroupState struct {
+	Name           string      `json:"name"`
+	File           string      `json:"file"`
+	Interval       float64     `json:"interval"`
+	LastEvaluation time.Time   `json:"lastEvaluation"`
+	EvaluationTime float64     `json:"evaluationTime"`
+	LastError      string      `json:"lastError,omitempty"`
+	Rules          []ruleEntry `json:"rules"`
+}
+
+type ruleEntry struct {
+	Rule
+	// Health is unknown until the rule is evaluated, then either ok or err.
+	Health         string    `json:"health"`
+	LastError      string    `json:"lastError,omitempty"`
+	LastEvaluation time.Time `json:"lastEvaluation"`
+	Samples        int       `json:"samples"`
+}
+
+// RulesHandler returns the rule groups of the tenant, with the result of their last evaluation.
+func (r *Ruler) RulesHandler(w http.ResponseWriter, req *http.Request) {
+	tenantID, _, err := tenant.ExtractTenantIDFromHeaders(req.Context(), req.Header)
+	if err != nil {
+		if r.multitenancy {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		tenantID = tenant.DefaultTenantID
+	}
+
+	r.mtx.Lock()
+	groups := make([]*group, 0, len(r.groups[tenantID]))
+	for _, g := range r.groups[tenantID] {
+		groups = append(groups, g)
+	}
+	r.mtx.Unlock()
+	sort.Slice(groups, func(i, j int) bool { return groups[i].Name < groups[j].Name })
+
+	res := rulesResponse{Status: "success", Data: rulesData{Groups: make([]ruleGroupState, 0, len(groups))}}
+	for _, g := range groups {
+		res.Data.Groups = append(res.Data.Groups, g.state())
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(res); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func (g *group) state() ruleGroupState {
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+	s := ruleGroupState{
+		Name:           g.Name,
+		File:           g.File,
+		Interval:       g.interval.Seconds(),
+		LastEvaluation: g.lastEvaluation,
+		EvaluationTime: g.evaluationTime.Seconds(),
+		Rules:          make([]ruleEntry, len(g.Rules)),
+	}
+	if g.lastError != nil {
+		s.LastError = g.lastError.Error()
+	}
+	for i, rule := range g.Rules {
+		state := g.rules[i]
+		e := ruleEntry{Rule: rule, Health: "unknown", LastEvaluation: state.lastEvaluation, Samples: state.samples}
+		switch {
+		case state.lastError != nil:
+			e.Health = "err"
+			e.LastError = state.lastError.Error()
+		case !state.lastEvaluation.IsZero():
+			e.Health = "ok"
+		}
+		s.Rules[i] = e
+	}
+	return s
+}
@@ -0,0 +1,46 @@
+package ruler
+
+import (
+	"errors"
+	"flag"
+	"time"
+
+	"github.com/grafana/dskit/flagext"
+)
+
+type Config struct {
+	RulePath           string        `yaml:"rule_path"`
+	PollInterval       time.Duration `yaml:"poll_interval"`
+	EvaluationInterval time.Duration `yaml:"evaluation_interval"`
+	EvaluationDelay    time.Duration `yaml:"evaluation_delay"`
+
+	QuerierURL  flagext.URLValue  `yaml:"querier_url"`
+	RemoteWrite RemoteWriteConfig `yaml:"remote_write"`
+}
+
+// RemoteWriteConfig configures the Prometheus remote write endpoint the results of rules are written to.
+type RemoteWriteConfig struct {
+	URL     flagext.URLValue `yaml:"url"`
+	Timeout time.Duration    `yaml:"timeout"`
+}
+
+// RegisterFlags registers ruler-related flags.
+func (cfg *Config) RegisterFlags(f *flag.FlagSet) {
+	f.StringVar(&cfg.RulePath, "ruler.rule-path", "./data/rules", "Directory of the rule group files. Each tenant has a sub-directory named after its ID holding its YAML rule group files, the tenant is anonymous when multi-tenancy is disabled.")
+	f.DurationVar(&cfg.PollInterval, "ruler.poll-interval", time.Minute, "How frequently the rule group files are reloaded.")
+	f.DurationVar(&cfg.EvaluationInterval, "ruler.evaluation-interval", time.Minute, "Default interval of the rule groups, rules aggregate the profiles of each interval.")
+	f.DurationVar(&cfg.EvaluationDelay, "ruler.evaluation-delay", 0, "Duration by which to delay the evaluation of rules, to ensure the profiles of an interval have been ingested.")
+	f.Var(&cfg.QuerierURL, "ruler.querier-url", "URL of the querier, rules are evaluated by the querier of the same process when empty.")
+	f.Var(&cfg.RemoteWrite.URL, "ruler.remote-write.url", "URL of the Prometheus remote write endpoint the results of rules are written to.")
+	f.DurationVar(&cfg.RemoteWrite.Timeout, "ruler.remote-write.timeout", 30*time.Second, "Timeout of remote write requests.")
+}
+
+func (cfg *Config) Validate() error {
+	if cfg.RemoteWrite.URL.String() == "" {
+		return errors.New("the ruler remote write URL is required")
+	}
+	if cfg.PollInterval <= 0 || cfg.EvaluationInterval <= 0 {
+		return errors.New("the ruler poll and evaluation intervals must be greater than 0")
+	}
+	return nil
+}
@@ -0,0 +1,150 @@
+package ruler
+
+import (
+	"context"
+	"time"
+
+	"github.com/bufbuild/connect-go"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/prompb"
+
+	commonv1 "github.com/grafana/phlare/pkg/gen/common/v1"
+	querierv1 "github.com/grafana/phlare/pkg/gen/querier/v1"
+)
+
+// QuerierClient is the part of the querier API rules are evaluated with.
+// It is implemented by both the querier and its clients.
+type QuerierClient interface {
+	SelectMergeStacktraces(context.Context, *connect.Request[querierv1.SelectMergeStacktracesRequest]) (*connect.Response[querierv1.SelectMergeStacktracesResponse], error)
+	SelectSeries(context.Context, *connect.Request[querierv1.SelectSeriesRequest]) (*connect.Response[querierv1.SelectSeriesResponse], error)
+}
+
+// evalRule aggregates the profiles of the interval ending at ts into samples at ts.
+func evalRule(ctx context.Context, q QuerierClient, rule *Rule, interval time.Duration, ts time.Time) ([]prompb.TimeSeries, error) {
+	if rule.Function != "" {
+		return evalFunctionRule(ctx, q, rule, interval, ts)
+	}
+	agg, err := rule.aggregation()
+	if err != nil {
+		return nil, err
+	}
+	selector := rule.Selector
+	if selector == "" {
+		selector = "{}"
+	}
+	end := ts.UnixMilli()
+	// A single point at end aggregates the profiles of the interval.
+	res, err := q.SelectSeries(ctx, connect.NewRequest(&querierv1.SelectSeriesRequest{
+		ProfileTypeID: rule.ProfileType,
+		LabelSelector: selector,
+		Start:         end,
+		End:           end,
+		GroupBy:       append([]string(nil), rule.GroupBy...),
+		Step:          interval.Seconds(),
+		Aggregation:   agg,
+	}))
+	if err != nil {
+		return nil, err
+	}
+	result := make([]prompb.TimeSeries, 0, len(res.Msg.Series))
+	for _, s := range res.Msg.Series {
+		for _, p := range s.Points {
+			if p.Timestamp == end {
+				result = append(result, timeSeries(rule, s.Labels, p.Value, end))
+			}
+		}
+	}
+	return result, nil
+}
+
+// evalFunctionRule sums the samples with the function in their stacktrace, for each group of series.
+// The stacktraces of all groups are selected at once.
+func evalFunctionRule(ctx context.Context, q QuerierClient, rule *Rule, interval time.Duration, ts time.Time) ([]prompb.TimeSeries, error) {
+	selector := rule.Selector
+	if selector == "" {
+		selector = "{}"
+	}
+	end := ts.UnixMilli()
+	res, err := q.SelectMergeStacktraces(ctx, connect.NewRequest(&querierv1.SelectMergeStacktracesRequest{
+		ProfileTypeID: rule.ProfileType,
+		LabelSelector: selector,
+		// The interval excludes its start, as for SelectSeries points.
+		Start:   ts.Add(-interval).UnixMilli() + 1,
+		End:     end,
+		GroupBy: append([]string(nil), rule.GroupBy...),
+	}))
+	if err != nil {
+		return nil, err
+	}
+	if len(rule.GroupBy) == 0 {
+		// No sample is recorded without profiles, as for grouped rules.
+		if res.Msg.Flamegraph.GetTotal() == 0 {
+			return nil, nil
+		}
+		return []prompb.TimeSeries{timeSeries(rule, nil, float64(functionTotal(res.Msg.Flamegraph, rule.Function)), end)}, nil
+	}
+	result := make([]prompb.TimeSeries, 0, len(res.Msg.Groups))
+	for _, group := range res.Msg.Groups {
+		result = append(result, timeSeries(rule, group.Labels, float64(functionTotal(group.Flamegraph, rule.Function)), end))
+	}
+	return result, nil
+}
+
+// functionTotal returns the total of the samples with the function in their stacktrace.
+// Nodes of the function called by the function itself are not counted twice.
+func functionTotal(fg *querierv1.FlameGraph, function string) int64 {
+	if fg == nil {
+		return 0
+	}
+	type span struct{ start, end int64 }
+	var (
+		total   int64
+		counted []span
+	)
+	for _, level := range fg.Levels {
+		// Each node is made of 4 values: the delta encoded x offset, total, self and the index of its name.
+		var prev int64
+		for i := 0; i+3 < len(level.Values); i += 4 {
+			x := prev + level.Values[i]
+			nodeTotal := level.Values[i+1]
+			prev = x + nodeTotal
+			if fg.Names[level.Values[i+3]] != function {
+				continue
+			}
+			nested := false
+			for _, s := range counted {
+				if x >= s.start && x < s.end {
+					nested = true
+					break
+				}
+			}
+			if !nested {
+				total += nodeTotal
+				counted = append(counted, span{start: x, end: x + nodeTotal})
+			}
+		}
+	}
+	return total
+}
+
+// timeSeries returns the sample of the rule for the series with the given labels.
+// The labels of the rule override the labels of the series.
+func timeSeries(rule *Rule, lbs []*commonv1.LabelPair, value float64, ts int64) prompb.TimeSeries {
+	b := labels.NewBuilder(nil)
+	for _, l := range lbs {
+		b.Set(l.Name, l.Value)
+	}
+	for name, value := range rule.Labels {
+		b.Set(name, value)
+	}
+	b.Set(labels.MetricName, rule.Record)
+	result := b.Labels()
+	s := prompb.TimeSeries{
+		Labels:  make([]prompb.Label, len(result)),
+		Samples: []prompb.Sample{{Value: value, Timestamp: ts}},
+	}
+	for i, l := range result {
+		s.Labels[i] = prompb.Label{Name: l.Name, Value: l.Value}
+	}
+	return s
+}
@@ -0,0 +1,97 @@
+package ruler
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+type metrics struct {
+	groupEvaluations           *prometheus.CounterVec
+	groupEvaluationFailures    *prometheus.CounterVec
+	groupEvaluationDuration    prometheus.Histogram
+	groupLastEvaluationTime    *prometheus.GaugeVec
+	ruleGroups                 *prometheus.GaugeVec
+	samplesWritten             *prometheus.CounterVec
+	remoteWriteFailures        *prometheus.CounterVec
+	configLastReloadSuccessful prometheus.Gauge
+}
+
+func newMetrics(reg prometheus.Registerer) *metrics {
+	m := &metrics{
+		groupEvaluations: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: "phlare",
+				Name:      "ruler_group_evaluations_total",
+				Help:      "The total number of evaluations of rule groups.",
+			},
+			[]string{"tenant", "rule_group"},
+		),
+		groupEvaluationFailures: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: "phlare",
+				Name:      "ruler_group_evaluation_failures_total",
+				Help:      "The total number of evaluations of rule groups where a rule failed or the results could not be written.",
+			},
+			[]string{"tenant", "rule_group"},
+		),
+		groupEvaluationDuration: prometheus.NewHistogram(
+			prometheus.HistogramOpts{
+				Namespace: "phlare",
+				Name:      "ruler_group_evaluation_duration_seconds",
+				Help:      "The duration of evaluations of rule groups, including the remote write of their results.",
+				Buckets:   prometheus.DefBuckets,
+			},
+		),
+		groupLastEvaluationTime: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: "phlare",
+				Name:      "ruler_group_last_evaluation_timestamp_seconds",
+				Help:      "The timestamp of the last evaluation of rule groups.",
+			},
+			[]string{"tenant", "rule_group"},
+		),
+		ruleGroups: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: "phlare",
+				Name:      "ruler_rule_groups",
+				Help:      "The number of rule groups loaded.",
+			},
+			[]string{"tenant"},
+		),
+		samplesWritten: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: "phlare",
+				Name:      "ruler_samples_written_total",
+				Help:      "The total number of samples resulting from rules written to the remote write endpoint.",
+			},
+			[]string{"tenant"},
+		),
+		remoteWriteFailures: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: "phlare",
+				Name:      "ruler_remote_write_failures_total",
+				Help:      "The total number of failed remote write requests.",
+			},
+			[]string{"tenant"},
+		),
+		configLastReloadSuccessful: prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Namespace: "phlare",
+				Name:      "ruler_config_last_reload_successful",
+				Help:      "Whether the last reload of the rule group files was successful (1) or not (0).",
+			},
+		),
+	}
+	if reg != nil {
+		reg.MustRegister(
+			m.groupEvaluations,
+			m.groupEvaluationFailures,
+			m.groupEvaluationDuration,
+			m.groupLastEvaluationTime,
+			m.ruleGroups,
+			m.samplesWritten,
+			m.remoteWriteFailures,
+			m.configLastReloadSuccessful,
+		)
+	}
+	return m
+}
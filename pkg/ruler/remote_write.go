@@ -0,0 +1,56 @@
+package ruler
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/golang/snappy"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/weaveworks/common/user"
+
+	"github.com/grafana/phlare/pkg/util"
+)
+
+// remoteWriter writes series to a Prometheus remote write endpoint.
+type remoteWriter struct {
+	cfg    RemoteWriteConfig
+	client *http.Client
+}
+
+func newRemoteWriter(cfg RemoteWriteConfig) *remoteWriter {
+	return &remoteWriter{
+		cfg: cfg,
+		client: &http.Client{
+			Transport: util.WrapWithInstrumentedHTTPTransport(http.DefaultTransport),
+			Timeout:   cfg.Timeout,
+		},
+	}
+}
+
+func (w *remoteWriter) write(ctx context.Context, tenantID string, series []prompb.TimeSeries) error {
+	data, err := (&prompb.WriteRequest{Timeseries: series}).Marshal()
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.cfg.URL.String(), bytes.NewReader(snappy.Encode(nil, data)))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	req.Header.Set(user.OrgIDHeaderName, tenantID)
+	res, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode/100 != 2 {
+		body, _ := io.ReadAll(io.LimitReader(res.Body, 512))
+		return fmt.Errorf("remote write returned HTTP status %s: %s", res.Status, bytes.TrimSpace(body))
+	}
+	return nil
+}
@@ -0,0 +1,261 @@
+package ruler
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/grafana/dskit/multierror"
+	"github.com/grafana/dskit/services"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/samber/lo"
+
+	"github.com/grafana/phlare/pkg/tenant"
+)
+
+// Ruler periodically evaluates the rule groups of each tenant and writes
+// the resulting series to a Prometheus remote write endpoint.
+type Ruler struct {
+	services.Service
+
+	cfg     Config
+	querier QuerierClient
+	writer  *remoteWriter
+	// multitenancy requires the tenant of API requests, it is anonymous otherwise.
+	multitenancy bool
+	metrics      *metrics
+	logger       log.Logger
+
+	mtx sync.Mutex
+	// groups by tenant and name.
+	groups map[string]map[string]*group
+}
+
+func New(cfg Config, querier QuerierClient, multitenancy bool, reg prometheus.Registerer, logger log.Logger) *Ruler {
+	r := &Ruler{
+		cfg:          cfg,
+		querier:      querier,
+		writer:       newRemoteWriter(cfg.RemoteWrite),
+		multitenancy: multitenancy,
+		metrics:      newMetrics(reg),
+		logger:       log.With(logger, "component", "ruler"),
+		groups:       make(map[string]map[string]*group),
+	}
+	r.Service = services.NewBasicService(nil, r.running, r.stopping)
+	return r
+}
+
+func (r *Ruler) running(ctx context.Context) error {
+	ticker := time.NewTicker(r.cfg.PollInterval)
+	defer ticker.Stop()
+	for {
+		if err := r.reload(ctx); err != nil {
+			level.Error(r.logger).Log("msg", "failed to load rule groups", "err", err)
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+func (r *Ruler) stopping(_ error) error {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	for _, groups := range r.groups {
+		for _, g := range groups {
+			g.stop()
+		}
+	}
+	return nil
+}
+
+// reload loads the rule group files and applies them: removed groups are stopped,
+// modified groups are restarted and new groups are started. The groups of tenants
+// with invalid rule files are kept as they are and the errors of their files returned.
+func (r *Ruler) reload(ctx context.Context) error {
+	loaded, invalid, err := LoadRuleGroups(r.cfg.RulePath)
+	if err != nil {
+		r.metrics.configLastReloadSuccessful.Set(0)
+		return err
+	}
+	var errs multierror.MultiError
+	tenantIDs := lo.Keys(invalid)
+	sort.Strings(tenantIDs)
+	for _, tenantID := range tenantIDs {
+		errs.Add(invalid[tenantID])
+	}
+	if len(errs) > 0 {
+		r.metrics.configLastReloadSuccessful.Set(0)
+	} else {
+		r.metrics.configLastReloadSuccessful.Set(1)
+	}
+
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	for tenantID, groups := range r.groups {
+		if _, ok := invalid[tenantID]; ok {
+			// Tenants with invalid rule files keep their current groups.
+			continue
+		}
+		next := make(map[string]RuleGroup, len(loaded[tenantID]))
+		for _, g := range loaded[tenantID] {
+			next[g.Name] = g
+		}
+		for name, g := range groups {
+			if def, ok := next[name]; ok && reflect.DeepEqual(def, g.RuleGroup) {
+				continue
+			}
+			g.stop()
+			delete(groups, name)
+			r.metrics.groupEvaluations.DeleteLabelValues(tenantID, name)
+			r.metrics.groupEvaluationFailures.DeleteLabelValues(tenantID, name)
+			r.metrics.groupLastEvaluationTime.DeleteLabelValues(tenantID, name)
+		}
+		if len(groups) == 0 {
+			delete(r.groups, tenantID)
+			r.metrics.ruleGroups.DeleteLabelValues(tenantID)
+		}
+	}
+	for tenantID, defs := range loaded {
+		groups, ok := r.groups[tenantID]
+		if !ok {
+			groups = make(map[string]*group, len(defs))
+			r.groups[tenantID] = groups
+		}
+		for _, def := range defs {
+			if _, ok := groups[def.Name]; ok {
+				continue
+			}
+			level.Info(r.logger).Log("msg", "starting rule group", "tenant", tenantID, "rule_group", def.Name, "file", def.File)
+			g := r.newGroup(tenantID, def)
+			groups[def.Name] = g
+			g.start(ctx)
+		}
+		r.metrics.ruleGroups.WithLabelValues(tenantID).Set(float64(len(groups)))
+	}
+	return errs.Err()
+}
+
+// group evaluates the rules of a rule group at its interval.
+type group struct {
+	RuleGroup
+	tenantID string
+	interval time.Duration
+	r        *Ruler
+
+	cancel context.CancelFunc
+	done   chan struct{}
+
+	mtx            sync.Mutex
+	lastEvaluation time.Time
+	evaluationTime time.Duration
+	lastError      error
+	rules          []ruleState
+}
+
+// ruleState is the result of the last evaluation of a rule.
+type ruleState struct {
+	lastEvaluation time.Time
+	lastError      error
+	samples        int
+}
+
+func (r *Ruler) newGroup(tenantID string, def RuleGroup) *group {
+	interval := time.Duration(def.Interval)
+	if interval == 0 {
+		interval = r.cfg.EvaluationInterval
+	}
+	return &group{
+		RuleGroup: def,
+		tenantID:  tenantID,
+		interval:  interval,
+		r:         r,
+		rules:     make([]ruleState, len(def.Rules)),
+	}
+}
+
+func (g *group) start(ctx context.Context) {
+	ctx, g.cancel = context.WithCancel(tenant.InjectTenantID(ctx, g.tenantID))
+	g.done = make(chan struct{})
+	go func() {
+		defer close(g.done)
+		g.run(ctx)
+	}()
+}
+
+func (g *group) stop() {
+	g.cancel()
+	<-g.done
+}
+
+func (g *group) run(ctx context.Context) {
+	// Evaluations are aligned on the interval, so that each one aggregates the profiles of a full interval.
+	next := time.Now().Truncate(g.interval).Add(g.interval)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Until(next.Add(g.r.cfg.EvaluationDelay))):
+		}
+		g.evaluate(ctx, next)
+		next = next.Add(g.interval)
+		// Evaluations missed while evaluating are skipped.
+		if now := time.Now().Add(-g.r.cfg.EvaluationDelay); next.Before(now) {
+			next = now.Truncate(g.interval).Add(g.interval)
+		}
+	}
+}
+
+// evaluate evaluates the rules of the interval ending at ts and writes their results.
+func (g *group) evaluate(ctx context.Context, ts time.Time) {
+	start := time.Now()
+	m := g.r.metrics
+	m.groupEvaluations.WithLabelValues(g.tenantID, g.Name).Inc()
+
+	var (
+		series []prompb.TimeSeries
+		failed bool
+		states = make([]ruleState, len(g.Rules))
+	)
+	for i := range g.Rules {
+		result, err := evalRule(ctx, g.r.querier, &g.Rules[i], g.interval, ts)
+		states[i] = ruleState{lastEvaluation: ts, lastError: err, samples: len(result)}
+		if err != nil {
+			failed = true
+			level.Warn(g.r.logger).Log("msg", "failed to evaluate rule", "tenant", g.tenantID, "rule_group", g.Name, "record", g.Rules[i].Record, "err", err)
+			continue
+		}
+		series = append(series, result...)
+	}
+
+	var writeErr error
+	if len(series) > 0 {
+		if writeErr = g.r.writer.write(ctx, g.tenantID, series); writeErr != nil {
+			failed = true
+			m.remoteWriteFailures.WithLabelValues(g.tenantID).Inc()
+			level.Warn(g.r.logger).Log("msg", "failed to write rule results", "tenant", g.tenantID, "rule_group", g.Name, "err", writeErr)
+		} else {
+			m.samplesWritten.WithLabelValues(g.tenantID).Add(float64(len(series)))
+		}
+	}
+	if failed {
+		m.groupEvaluationFailures.WithLabelValues(g.tenantID, g.Name).Inc()
+	}
+	duration := time.Since(start)
+	m.groupEvaluationDuration.Observe(duration.Seconds())
+	m.groupLastEvaluationTime.WithLabelValues(g.tenantID, g.Name).Set(float64(ts.Unix()))
+
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+	g.lastEvaluation = ts
+	g.evaluationTime = duration
+	g.lastError = writeErr
+	g.rules = states
+}
@@ -0,0 +1,344 @@
+package ruler
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bufbuild/connect-go"
+	"github.com/go-kit/log"
+	"github.com/golang/snappy"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/samber/lo"
+	"github.com/stretchr/testify/require"
+
+	commonv1 "github.com/grafana/phlare/pkg/gen/common/v1"
+	querierv1 "github.com/grafana/phlare/pkg/gen/querier/v1"
+	phlaremodel "github.com/grafana/phlare/pkg/model"
+)
+
+const cpu = "process_cpu:cpu:nanoseconds:cpu:nanoseconds"
+
+// remoteWriteReceiver stands in for a Prometheus remote write endpoint.
+type remoteWriteReceiver struct {
+	*httptest.Server
+
+	mtx      sync.Mutex
+	tenants  []string
+	requests []*prompb.WriteRequest
+}
+
+func newRemoteWriteReceiver(t *testing.T) *remoteWriteReceiver {
+	r := &remoteWriteReceiver{}
+	r.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		compressed, err := io.ReadAll(req.Body)
+		require.NoError(t, err)
+		data, err := snappy.Decode(nil, compressed)
+		require.NoError(t, err)
+		var wr prompb.WriteRequest
+		require.NoError(t, wr.Unmarshal(data))
+		r.mtx.Lock()
+		defer r.mtx.Unlock()
+		r.tenants = append(r.tenants, req.Header.Get("X-Scope-OrgID"))
+		r.requests = append(r.requests, &wr)
+	}))
+	t.Cleanup(r.Close)
+	return r
+}
+
+type fakeQuerier struct {
+	mtx                 sync.Mutex
+	seriesRequests      []*querierv1.SelectSeriesRequest
+	stacktracesRequests []*querierv1.SelectMergeStacktracesRequest
+}
+
+func (f *fakeQuerier) SelectMergeStacktraces(_ context.Context, req *connect.Request[querierv1.SelectMergeStacktracesRequest]) (*connect.Response[querierv1.SelectMergeStacktracesResponse], error) {
+	f.mtx.Lock()
+	f.stacktracesRequests = append(f.stacktracesRequests, req.Msg)
+	f.mtx.Unlock()
+	if len(req.Msg.GroupBy) == 0 {
+		return connect.NewResponse(&querierv1.SelectMergeStacktracesResponse{Flamegraph: testFlameGraph()}), nil
+	}
+	// Series without the labels are grouped together.
+	return connect.NewResponse(&querierv1.SelectMergeStacktracesResponse{
+		Groups: []*querierv1.FlameGraphGroup{
+			{Flamegraph: testFlameGraph()},
+			{Labels: phlaremodel.LabelsFromStrings("service", "a"), Flamegraph: testFlameGraph()},
+		},
+	}), nil
+}
+
+func (f *fakeQuerier) SelectSeries(_ context.Context, req *connect.Request[querierv1.SelectSeriesRequest]) (*connect.Response[querierv1.SelectSeriesResponse], error) {
+	f.mtx.Lock()
+	f.seriesRequests = append(f.seriesRequests, req.Msg)
+	f.mtx.Unlock()
+	return connect.NewResponse(&querierv1.SelectSeriesResponse{
+		Series: []*commonv1.Series{
+			{Labels: phlaremodel.LabelsFromStrings("service", "a"), Points: []*commonv1.Point{{Timestamp: req.Msg.End, Value: 10}}},
+			{Labels: phlaremodel.LabelsFromStrings("service", "b"), Points: []*commonv1.Point{{Timestamp: req.Msg.End, Value: 20}}},
+		},
+	}), nil
+}
+
+// testFlameGraph has the stacktraces main;gc with a value of 2, main;gc;gc with 3 and main;foo with 5.
+func testFlameGraph() *querierv1.FlameGraph {
+	return &querierv1.FlameGraph{
+		Names: []string{"total", "main", "gc", "foo"},
+		Levels: []*querierv1.Level{
+			{Values: []int64{0, 10, 0, 0}},
+			{Values: []int64{0, 10, 0, 1}},
+			{Values: []int64{0, 5, 2, 2, 0, 5, 5, 3}},
+			{Values: []int64{0, 3, 3, 2}},
+		},
+		Total:   10,
+		MaxSelf: 5,
+	}
+}
+
+func TestFunctionTotal(t *testing.T) {
+	fg := testFlameGraph()
+	require.Equal(t, int64(10), functionTotal(fg, "main"))
+	// The recursive call is not counted twice.
+	require.Equal(t, int64(5), functionTotal(fg, "gc"))
+	require.Equal(t, int64(5), functionTotal(fg, "foo"))
+	require.Equal(t, int64(0), functionTotal(fg, "bar"))
+	require.Equal(t, int64(0), functionTotal(nil, "bar"))
+}
+
+func writeRuleGroups(t *testing.T, dir, tenantID, file, content string) {
+	t.Helper()
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, tenantID), 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, tenantID, file), []byte(content), 0o644))
+}
+
+func TestLoadRuleGroups(t *testing.T) {
+	dir := t.TempDir()
+	writeRuleGroups(t, dir, "tenant-a", "gc.yaml", `
+groups:
+  - name: gc
+    interval: 30s
+    rules:
+      - record: service:cpu_nanoseconds:sum
+        profile_type: `+cpu+`
+        group_by: [service]
+      - record: service:gc_cpu_nanoseconds:sum
+        profile_type: `+cpu+`
+        selector: '{namespace="prod"}'
+        group_by: [service]
+        function: runtime.gcBgMarkWorker
+        labels:
+          team: runtime
+`)
+	writeRuleGroups(t, dir, "tenant-b", "memory.yml", `
+groups:
+  - name: memory
+    rules:
+      - record: memory:alloc_space:rate
+        profile_type: memory:alloc_space:bytes:space:bytes
+        aggregation: rate
+`)
+	writeRuleGroups(t, dir, "tenant-b", "README.md", `not a rule group file`)
+
+	groups, invalid, err := LoadRuleGroups(dir)
+	require.NoError(t, err)
+	require.Empty(t, invalid)
+	require.Len(t, groups, 2)
+	require.Len(t, groups["tenant-a"], 1)
+	require.Equal(t, "gc", groups["tenant-a"][0].Name)
+	require.Equal(t, filepath.Join(dir, "tenant-a", "gc.yaml"), groups["tenant-a"][0].File)
+	require.Len(t, groups["tenant-a"][0].Rules, 2)
+	require.Equal(t, "runtime.gcBgMarkWorker", groups["tenant-a"][0].Rules[1].Function)
+	require.Equal(t, "memory", groups["tenant-b"][0].Name)
+
+	for _, tc := range []struct {
+		name    string
+		content string
+		err     string
+	}{
+		{
+			name:    "unknown aggregation",
+			content: "groups: [{name: a, rules: [{record: a, profile_type: " + cpu + ", aggregation: median}]}]",
+			err:     `unknown aggregation "median"`,
+		},
+		{
+			name:    "function without sum",
+			content: "groups: [{name: a, rules: [{record: a, profile_type: " + cpu + ", aggregation: max, function: gc}]}]",
+			err:     "rules with a function only support the sum aggregation",
+		},
+		{
+			name:    "invalid record",
+			content: "groups: [{name: a, rules: [{record: 'a-b', profile_type: " + cpu + "}]}]",
+			err:     `invalid record name "a-b"`,
+		},
+		{
+			name:    "unknown field",
+			content: "groups: [{name: a, rules: [{record: a, profile_type: " + cpu + ", expr: a}]}]",
+			err:     "field expr not found",
+		},
+		{
+			name:    "duplicate group",
+			content: "groups: [{name: a, rules: []}, {name: a, rules: []}]",
+			err:     `rule group "a"`,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			writeRuleGroups(t, dir, "tenant", "rules.yaml", tc.content)
+			writeRuleGroups(t, dir, "other", "rules.yaml", "groups: [{name: a, rules: []}]")
+			groups, invalid, err := LoadRuleGroups(dir)
+			require.NoError(t, err)
+			require.Len(t, invalid, 1)
+			require.Contains(t, invalid["tenant"].Error(), tc.err)
+			// The other tenants are still loaded.
+			require.Equal(t, []string{"other"}, lo.Keys(groups))
+		})
+	}
+}
+
+func TestRulerEvaluate(t *testing.T) {
+	receiver := newRemoteWriteReceiver(t)
+	q := &fakeQuerier{}
+	cfg := Config{PollInterval: time.Minute, EvaluationInterval: time.Minute}
+	require.NoError(t, cfg.RemoteWrite.URL.Set(receiver.URL))
+	r := New(cfg, q, false, nil, log.NewNopLogger())
+
+	g := r.newGroup("anonymous", RuleGroup{
+		Name: "gc",
+		Rules: []Rule{
+			{Record: "service:cpu_nanoseconds:sum", ProfileType: cpu, GroupBy: []string{"service"}, Labels: map[string]string{"team": "runtime"}},
+			{Record: "service:gc_cpu_nanoseconds:sum", ProfileType: cpu, Selector: `{namespace="prod"}`, GroupBy: []string{"service"}, Function: "gc"},
+			{Record: "gc_cpu_nanoseconds:sum", ProfileType: cpu, Function: "gc"},
+		},
+	})
+	ts := time.UnixMilli(120000)
+	g.evaluate(context.Background(), ts)
+
+	require.Equal(t, []*querierv1.SelectSeriesRequest{{
+		ProfileTypeID: cpu,
+		LabelSelector: "{}",
+		Start:         120000,
+		End:           120000,
+		GroupBy:       []string{"service"},
+		Step:          60,
+		Aggregation:   commonv1.SeriesAggregation_SERIES_AGGREGATION_SUM,
+	}}, q.seriesRequests)
+	// The stacktraces of all groups are selected at once.
+	require.Equal(t, []*querierv1.SelectMergeStacktracesRequest{
+		{ProfileTypeID: cpu, LabelSelector: `{namespace="prod"}`, Start: 60001, End: 120000, GroupBy: []string{"service"}},
+		{ProfileTypeID: cpu, LabelSelector: `{}`, Start: 60001, End: 120000},
+	}, q.stacktracesRequests)
+
+	require.Equal(t, []string{"anonymous"}, receiver.tenants)
+	require.Equal(t, []prompb.TimeSeries{
+		{
+			Labels:  []prompb.Label{{Name: "__name__", Value: "service:cpu_nanoseconds:sum"}, {Name: "service", Value: "a"}, {Name: "team", Value: "runtime"}},
+			Samples: []prompb.Sample{{Value: 10, Timestamp: 120000}},
+		},
+		{
+			Labels:  []prompb.Label{{Name: "__name__", Value: "service:cpu_nanoseconds:sum"}, {Name: "service", Value: "b"}, {Name: "team", Value: "runtime"}},
+			Samples: []prompb.Sample{{Value: 20, Timestamp: 120000}},
+		},
+		{
+			Labels:  []prompb.Label{{Name: "__name__", Value: "service:gc_cpu_nanoseconds:sum"}},
+			Samples: []prompb.Sample{{Value: 5, Timestamp: 120000}},
+		},
+		{
+			Labels:  []prompb.Label{{Name: "__name__", Value: "service:gc_cpu_nanoseconds:sum"}, {Name: "service", Value: "a"}},
+			Samples: []prompb.Sample{{Value: 5, Timestamp: 120000}},
+		},
+		{
+			Labels:  []prompb.Label{{Name: "__name__", Value: "gc_cpu_nanoseconds:sum"}},
+			Samples: []prompb.Sample{{Value: 5, Timestamp: 120000}},
+		},
+	}, receiver.requests[0].Timeseries)
+
+	require.Equal(t, float64(1), testutil.ToFloat64(r.metrics.groupEvaluations.WithLabelValues("anonymous", "gc")))
+	require.Equal(t, float64(0), testutil.ToFloat64(r.metrics.groupEvaluationFailures.WithLabelValues("anonymous", "gc")))
+	require.Equal(t, float64(5), testutil.ToFloat64(r.metrics.samplesWritten.WithLabelValues("anonymous")))
+
+	// Failed remote writes are reported by the group.
+	receiver.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		http.Error(w, "out of order sample", http.StatusBadRequest)
+	})
+	g.evaluate(context.Background(), ts.Add(time.Minute))
+	require.Equal(t, float64(1), testutil.ToFloat64(r.metrics.groupEvaluationFailures.WithLabelValues("anonymous", "gc")))
+	require.Equal(t, float64(1), testutil.ToFloat64(r.metrics.remoteWriteFailures.WithLabelValues("anonymous")))
+	state := g.state()
+	require.Equal(t, "remote write returned HTTP status 400 Bad Request: out of order sample", state.LastError)
+	require.Equal(t, "ok", state.Rules[0].Health)
+	require.Equal(t, 2, state.Rules[0].Samples)
+}
+
+func TestRulerReload(t *testing.T) {
+	dir := t.TempDir()
+	receiver := newRemoteWriteReceiver(t)
+	cfg := Config{RulePath: dir, PollInterval: time.Minute, EvaluationInterval: time.Minute}
+	require.NoError(t, cfg.RemoteWrite.URL.Set(receiver.URL))
+	r := New(cfg, &fakeQuerier{}, true, nil, log.NewNopLogger())
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	rules := func(groups ...string) string {
+		content := "groups:\n"
+		for _, g := range groups {
+			content += "  - {name: " + g + ", rules: [{record: cpu, profile_type: " + cpu + "}]}\n"
+		}
+		return content
+	}
+	groupNames := func(tenantID string) []string {
+		req := httptest.NewRequest("GET", "/rules", nil)
+		req.Header.Set("X-Scope-OrgID", tenantID)
+		w := httptest.NewRecorder()
+		r.RulesHandler(w, req)
+		require.Equal(t, http.StatusOK, w.Code)
+		var res rulesResponse
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&res))
+		var names []string
+		for _, g := range res.Data.Groups {
+			names = append(names, g.Name)
+			require.Equal(t, "unknown", g.Rules[0].Health)
+		}
+		return names
+	}
+
+	writeRuleGroups(t, dir, "tenant-a", "rules.yaml", rules("a", "b"))
+	writeRuleGroups(t, dir, "tenant-b", "rules.yaml", rules("c"))
+	require.NoError(t, r.reload(ctx))
+	require.Equal(t, []string{"a", "b"}, groupNames("tenant-a"))
+	require.Equal(t, []string{"c"}, groupNames("tenant-b"))
+	previous := r.groups["tenant-a"]["a"]
+
+	// Unchanged groups keep running, modified groups are restarted.
+	writeRuleGroups(t, dir, "tenant-a", "rules.yaml", rules("a", "d"))
+	require.NoError(t, os.RemoveAll(filepath.Join(dir, "tenant-b")))
+	require.NoError(t, r.reload(ctx))
+	require.Equal(t, []string{"a", "d"}, groupNames("tenant-a"))
+	require.Empty(t, groupNames("tenant-b"))
+	require.Same(t, previous, r.groups["tenant-a"]["a"])
+	require.NotContains(t, r.groups, "tenant-b")
+
+	// Invalid files keep the current groups of their tenant, the other tenants are still reloaded.
+	writeRuleGroups(t, dir, "tenant-a", "rules.yaml", "groups: [")
+	writeRuleGroups(t, dir, "tenant-b", "rules.yaml", rules("e"))
+	err := r.reload(ctx)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "tenant tenant-a")
+	require.Equal(t, []string{"a", "d"}, groupNames("tenant-a"))
+	require.Equal(t, []string{"e"}, groupNames("tenant-b"))
+	require.Equal(t, float64(0), testutil.ToFloat64(r.metrics.configLastReloadSuccessful))
+
+	// The tenant is required when multi-tenancy is enabled.
+	w := httptest.NewRecorder()
+	r.RulesHandler(w, httptest.NewRequest("GET", "/rules", nil))
+	require.Equal(t, http.StatusUnauthorized, w.Code)
+
+	require.NoError(t, r.stopping(nil))
+}
@@ -0,0 +1,170 @@
+package ruler
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql/parser"
+	"gopkg.in/yaml.v2"
+
+	commonv1 "github.com/grafana/phlare/pkg/gen/common/v1"
+	phlaremodel "github.com/grafana/phlare/pkg/model"
+)
+
+// RuleGroups is the content of a rule group file.
+type RuleGroups struct {
+	Groups []RuleGroup `yaml:"groups"`
+}
+
+// RuleGroup is a group of rules evaluated at the same interval.
+type RuleGroup struct {
+	Name string `yaml:"name"`
+	// Interval defaults to the evaluation interval of the ruler.
+	Interval model.Duration `yaml:"interval,omitempty"`
+	Rules    []Rule         `yaml:"rules"`
+
+	// File the group is loaded from.
+	File string `yaml:"-"`
+}
+
+// Rule aggregates the profiles of each interval into series, written as the Record metric.
+type Rule struct {
+	Record      string            `yaml:"record" json:"record"`
+	ProfileType string            `yaml:"profile_type" json:"profileType"`
+	Selector    string            `yaml:"selector,omitempty" json:"selector,omitempty"`
+	GroupBy     []string          `yaml:"group_by,omitempty" json:"groupBy,omitempty"`
+	Aggregation string            `yaml:"aggregation,omitempty" json:"aggregation,omitempty"`
+	Labels      map[string]string `yaml:"labels,omitempty" json:"labels,omitempty"`
+	// Function restricts the values to the samples with the function in their stacktrace.
+	Function string `yaml:"function,omitempty" json:"function,omitempty"`
+}
+
+// aggregation returns the aggregation of the rule, sum when empty.
+func (r *Rule) aggregation() (commonv1.SeriesAggregation, error) {
+	if r.Aggregation == "" {
+		return commonv1.SeriesAggregation_SERIES_AGGREGATION_SUM, nil
+	}
+	agg, ok := commonv1.SeriesAggregation_value["SERIES_AGGREGATION_"+strings.ToUpper(r.Aggregation)]
+	if !ok || agg == int32(commonv1.SeriesAggregation_SERIES_AGGREGATION_UNSPECIFIED) {
+		return 0, fmt.Errorf("unknown aggregation %q", r.Aggregation)
+	}
+	return commonv1.SeriesAggregation(agg), nil
+}
+
+// matchers returns the matchers of the selector of the rule.
+func (r *Rule) matchers() ([]*labels.Matcher, error) {
+	if r.Selector == "" {
+		return nil, nil
+	}
+	return parser.ParseMetricSelector(r.Selector)
+}
+
+func (r *Rule) Validate() error {
+	if !model.IsValidMetricName(model.LabelValue(r.Record)) {
+		return fmt.Errorf("invalid record name %q", r.Record)
+	}
+	if _, err := phlaremodel.ParseProfileTypeSelector(r.ProfileType); err != nil {
+		return err
+	}
+	if _, err := r.matchers(); err != nil {
+		return errors.Wrapf(err, "invalid selector %q", r.Selector)
+	}
+	agg, err := r.aggregation()
+	if err != nil {
+		return err
+	}
+	if r.Function != "" && agg != commonv1.SeriesAggregation_SERIES_AGGREGATION_SUM {
+		return errors.New("rules with a function only support the sum aggregation")
+	}
+	for name := range r.Labels {
+		if !model.LabelName(name).IsValid() || name == model.MetricNameLabel {
+			return fmt.Errorf("invalid label name %q", name)
+		}
+	}
+	return nil
+}
+
+func (g *RuleGroup) Validate() error {
+	if g.Name == "" {
+		return errors.New("rule group name is required")
+	}
+	if g.Interval < 0 {
+		return fmt.Errorf("rule group %q interval must be positive", g.Name)
+	}
+	for i := range g.Rules {
+		if err := g.Rules[i].Validate(); err != nil {
+			return errors.Wrapf(err, "rule group %q, rule %d", g.Name, i)
+		}
+	}
+	return nil
+}
+
+// LoadRuleGroups loads the rule groups of each tenant, from the files of the tenants sub-directories.
+// The errors of tenants with invalid rule files are returned by tenant, without failing the other tenants.
+func LoadRuleGroups(dir string) (map[string][]RuleGroup, map[string]error, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return map[string][]RuleGroup{}, nil, nil
+		}
+		return nil, nil, err
+	}
+	result := make(map[string][]RuleGroup)
+	invalid := make(map[string]error)
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		groups, err := loadTenantRuleGroups(filepath.Join(dir, e.Name()))
+		if err != nil {
+			invalid[e.Name()] = errors.Wrapf(err, "tenant %s", e.Name())
+			continue
+		}
+		if len(groups) > 0 {
+			result[e.Name()] = groups
+		}
+	}
+	return result, invalid, nil
+}
+
+func loadTenantRuleGroups(dir string) ([]RuleGroup, error) {
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var result []RuleGroup
+	names := make(map[string]string)
+	for _, f := range files {
+		if f.IsDir() || (filepath.Ext(f.Name()) != ".yaml" && filepath.Ext(f.Name()) != ".yml") {
+			continue
+		}
+		path := filepath.Join(dir, f.Name())
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		var groups RuleGroups
+		if err := yaml.UnmarshalStrict(data, &groups); err != nil {
+			return nil, errors.Wrapf(err, "parse %s", path)
+		}
+		for _, g := range groups.Groups {
+			if err := g.Validate(); err != nil {
+				return nil, errors.Wrap(err, path)
+			}
+			if other, ok := names[g.Name]; ok {
+				return nil, fmt.Errorf("rule group %q of %s is already defined in %s", g.Name, path, other)
+			}
+			names[g.Name] = path
+			g.File = path
+			result = append(result, g)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Name < result[j].Name })
+	return result, nil
+}
@@ -89,6 +89,14 @@ func ExtractTenantIDFromHeaders(ctx context.Context, headers http.Header) (strin
 	return tenantID, ctx, nil
 }
 
+var multiResolver tenant.Resolver = tenant.NewMultiResolver()
+
+// ExtractTenantIDsFromContext extracts the TenantIDs of the context, several
+// tenants are separated by a | in the org ID.
+func ExtractTenantIDsFromContext(ctx context.Context) ([]string, error) {
+	return multiResolver.TenantIDs(ctx)
+}
+
 // ExtractTenantIDFromContext extracts a single TenantID from the context.
 func ExtractTenantIDFromContext(ctx context.Context) (string, error) {
 	tenantID, err := defaultResolver.TenantID(ctx)
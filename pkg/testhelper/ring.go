@@ -36,9 +36,14 @@ func (r MockRing) GetAllHealthy(op ring.Operation) (ring.ReplicationSet, error)
 }
 
 func (r MockRing) GetReplicationSetForOperation(op ring.Operation) (ring.ReplicationSet, error) {
+	maxErrors := 1
+	// A single instance (e.g. a shuffle shard of size 1) can't tolerate any error.
+	if len(r.ingesters) <= 1 {
+		maxErrors = 0
+	}
 	return ring.ReplicationSet{
 		Instances: r.ingesters,
-		MaxErrors: 1,
+		MaxErrors: maxErrors,
 	}, nil
 }
 
@@ -64,13 +69,17 @@ func (r MockRing) HasInstance(instanceID string) bool {
 }
 
 func (r MockRing) ShuffleShard(identifier string, size int) ring.ReadRing {
+	// Nothing to do if the shard size is not smaller then the actual ring.
+	if size <= 0 || len(r.ingesters) <= size {
+		return r
+	}
 	// take advantage of pass by value to bound to size:
 	r.ingesters = r.ingesters[:size]
 	return r
 }
 
 func (r MockRing) ShuffleShardWithLookback(identifier string, size int, lookbackPeriod time.Duration, now time.Time) ring.ReadRing {
-	return r
+	return r.ShuffleShard(identifier, size)
 }
 
 func (r MockRing) CleanupShuffleShardCache(identifier string) {}
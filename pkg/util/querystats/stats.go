@@ -0,0 +1,182 @@
+// Package querystats collects the statistics of queries and enforces their limits.
+package querystats
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bufbuild/connect-go"
+	"go.uber.org/atomic"
+
+	ingestv1 "github.com/grafana/phlare/pkg/gen/ingester/v1"
+)
+
+const (
+	// StatsHeader is the response header of the statistics of a query, in logfmt.
+	StatsHeader = "X-Phlare-Query-Stats"
+	// ServerTimingHeader is the response header of the wall time of the stages of a query.
+	ServerTimingHeader = "Server-Timing"
+)
+
+type contextKey uint8
+
+const statsContextKey contextKey = iota
+
+// Limits are the limits of a query, 0 disables a limit.
+type Limits struct {
+	MaxStacktraces int
+	MaxSeries      int
+	MaxBytesRead   int
+}
+
+// Stats are the statistics of a query, collected along the query and safe for
+// concurrent use. Adding to a statistic returns an error when the query
+// exceeds its limit.
+type Stats struct {
+	limits Limits
+
+	blocksQueried atomic.Int64
+	pagesRead     atomic.Int64
+	valuesRead    atomic.Int64
+	bytesRead     atomic.Int64
+	stacktraces   atomic.Int64
+	series        atomic.Int64
+	bytesStreamed atomic.Int64
+
+	mtx    sync.Mutex
+	stages []stage
+}
+
+type stage struct {
+	name     string
+	duration time.Duration
+}
+
+func New(limits Limits) *Stats {
+	return &Stats{limits: limits}
+}
+
+// NewContext returns a context collecting the statistics of the query into s.
+func NewContext(ctx context.Context, s *Stats) context.Context {
+	return context.WithValue(ctx, statsContextKey, s)
+}
+
+// FromContext returns the statistics of the query of the context, statistics
+// are discarded when the context doesn't collect them.
+func FromContext(ctx context.Context) *Stats {
+	s, ok := ctx.Value(statsContextKey).(*Stats)
+	if !ok {
+		return New(Limits{})
+	}
+	return s
+}
+
+func (s *Stats) AddBlocksQueried(n int) {
+	s.blocksQueried.Add(int64(n))
+}
+
+func (s *Stats) AddPagesRead(n int64) {
+	s.pagesRead.Add(n)
+}
+
+func (s *Stats) AddValuesRead(n int64) {
+	s.valuesRead.Add(n)
+}
+
+func (s *Stats) AddBytesRead(n int64) error {
+	return exceeded(s.bytesRead.Add(n), s.limits.MaxBytesRead, "bytes read")
+}
+
+func (s *Stats) AddStacktraces(n int) error {
+	return exceeded(s.stacktraces.Add(int64(n)), s.limits.MaxStacktraces, "stacktraces")
+}
+
+func (s *Stats) AddSeries(n int) error {
+	return exceeded(s.series.Add(int64(n)), s.limits.MaxSeries, "series")
+}
+
+func (s *Stats) AddBytesStreamed(n int) {
+	s.bytesStreamed.Add(int64(n))
+}
+
+func exceeded(value int64, limit int, what string) error {
+	if limit > 0 && value > int64(limit) {
+		return connect.NewError(connect.CodeResourceExhausted, fmt.Errorf("the query exceeded the maximum number of %s (limit: %d), reduce the time range of the query or use a more selective label selector", what, limit))
+	}
+	return nil
+}
+
+// Merge adds the statistics of the query in an ingester.
+func (s *Stats) Merge(in *ingestv1.QueryStats) error {
+	if in == nil {
+		return nil
+	}
+	s.blocksQueried.Add(in.BlocksQueried)
+	s.pagesRead.Add(in.PagesRead)
+	s.valuesRead.Add(in.ValuesRead)
+	return s.AddBytesRead(in.BytesRead)
+}
+
+// Proto returns the statistics of the blocks read by the query.
+func (s *Stats) Proto() *ingestv1.QueryStats {
+	return &ingestv1.QueryStats{
+		BlocksQueried: s.blocksQueried.Load(),
+		PagesRead:     s.pagesRead.Load(),
+		ValuesRead:    s.valuesRead.Load(),
+		BytesRead:     s.bytesRead.Load(),
+	}
+}
+
+// ObserveStage records the wall time of a stage of the query started at start.
+func (s *Stats) ObserveStage(name string, start time.Time) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.stages = append(s.stages, stage{name: name, duration: time.Since(start)})
+}
+
+// KeyValues returns the statistics as key value pairs, for logging.
+func (s *Stats) KeyValues() []interface{} {
+	kv := []interface{}{
+		"blocks_queried", s.blocksQueried.Load(),
+		"pages_read", s.pagesRead.Load(),
+		"values_read", s.valuesRead.Load(),
+		"bytes_read", s.bytesRead.Load(),
+		"stacktraces", s.stacktraces.Load(),
+		"series", s.series.Load(),
+		"bytes_streamed", s.bytesStreamed.Load(),
+	}
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	for _, st := range s.stages {
+		kv = append(kv, st.name+"_duration", st.duration)
+	}
+	return kv
+}
+
+// SetHeaders sets the statistics and the wall time of the stages of the query in the headers.
+func (s *Stats) SetHeaders(h http.Header) {
+	kv := s.KeyValues()
+	var stats []string
+	for i := 0; i < len(kv); i += 2 {
+		if v, ok := kv[i+1].(int64); ok {
+			stats = append(stats, kv[i].(string)+"="+strconv.FormatInt(v, 10))
+		}
+	}
+	h.Set(StatsHeader, strings.Join(stats, " "))
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if len(s.stages) == 0 {
+		return
+	}
+	timings := make([]string, len(s.stages))
+	for i, st := range s.stages {
+		timings[i] = fmt.Sprintf("%s;dur=%.3f", st.name, float64(st.duration)/float64(time.Millisecond))
+	}
+	h.Set(ServerTimingHeader, strings.Join(timings, ", "))
+}
@@ -0,0 +1,63 @@
+package querystats
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/bufbuild/connect-go"
+	"github.com/stretchr/testify/require"
+
+	ingestv1 "github.com/grafana/phlare/pkg/gen/ingester/v1"
+)
+
+func Test_Limits(t *testing.T) {
+	s := New(Limits{MaxStacktraces: 10, MaxSeries: 2, MaxBytesRead: 100})
+	require.NoError(t, s.AddStacktraces(10))
+	err := s.AddStacktraces(1)
+	require.Equal(t, connect.CodeResourceExhausted, connect.CodeOf(err))
+	require.Contains(t, err.Error(), "maximum number of stacktraces (limit: 10)")
+
+	require.NoError(t, s.AddSeries(2))
+	require.Error(t, s.AddSeries(1))
+
+	require.NoError(t, s.Merge(&ingestv1.QueryStats{BytesRead: 60}))
+	require.Error(t, s.Merge(&ingestv1.QueryStats{BytesRead: 60}))
+
+	// Statistics without limits never fail.
+	s = New(Limits{})
+	require.NoError(t, s.AddStacktraces(1<<30))
+	require.NoError(t, s.AddBytesRead(1<<40))
+}
+
+func Test_Context(t *testing.T) {
+	s := New(Limits{})
+	ctx := NewContext(context.Background(), s)
+	FromContext(ctx).AddBlocksQueried(2)
+	FromContext(ctx).AddPagesRead(3)
+	FromContext(ctx).AddValuesRead(4)
+	require.NoError(t, FromContext(ctx).AddBytesRead(5))
+	require.Equal(t, &ingestv1.QueryStats{BlocksQueried: 2, PagesRead: 3, ValuesRead: 4, BytesRead: 5}, s.Proto())
+
+	// A context without statistics discards them.
+	require.NotSame(t, FromContext(context.Background()), FromContext(context.Background()))
+}
+
+func Test_SetHeaders(t *testing.T) {
+	s := New(Limits{})
+	require.NoError(t, s.Merge(&ingestv1.QueryStats{BlocksQueried: 1, PagesRead: 2, ValuesRead: 3, BytesRead: 4}))
+	require.NoError(t, s.AddStacktraces(5))
+	require.NoError(t, s.AddSeries(6))
+	s.AddBytesStreamed(7)
+
+	h := http.Header{}
+	s.SetHeaders(h)
+	require.Equal(t, "blocks_queried=1 pages_read=2 values_read=3 bytes_read=4 stacktraces=5 series=6 bytes_streamed=7", h.Get(StatsHeader))
+	require.Empty(t, h.Get(ServerTimingHeader))
+
+	s.ObserveStage("select", time.Now().Add(-1500*time.Microsecond))
+	s.ObserveStage("total", time.Now().Add(-2*time.Millisecond))
+	s.SetHeaders(h)
+	require.Regexp(t, `^select;dur=[0-9]+\.[0-9]{3}, total;dur=[0-9]+\.[0-9]{3}$`, h.Get(ServerTimingHeader))
+}
@@ -0,0 +1,287 @@
+package validation
+
+import (
+	"flag"
+	"fmt"
+	"regexp"
+	"time"
+
+	"github.com/grafana/dskit/flagext"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/relabel"
+)
+
+const bytesInMB = 1048576
+
+// Limits describe all the limits for tenants; can be used to describe global default
+// limits via flags, or per-tenant limits via yaml config.
+// NOTE: we use custom `model.Duration` instead of standard `time.Duration`
+// to support tenant-friendly duration format (e.g: "1h30m45s") in JSON value.
+type Limits struct {
+	// Distributor enforced limits.
+	IngestionRateMB            float64           `yaml:"ingestion_rate_mb" json:"ingestion_rate_mb"`
+	IngestionBurstSizeMB       float64           `yaml:"ingestion_burst_size_mb" json:"ingestion_burst_size_mb"`
+	IngestionRateProfiles      float64           `yaml:"ingestion_rate_profiles" json:"ingestion_rate_profiles"`
+	IngestionBurstSizeProfiles int               `yaml:"ingestion_burst_size_profiles" json:"ingestion_burst_size_profiles"`
+	IngestionTenantShardSize   int               `yaml:"ingestion_tenant_shard_size" json:"ingestion_tenant_shard_size"`
+	IngestionRelabelConfigs    []*relabel.Config `yaml:"ingestion_relabel_configs,omitempty" json:"ingestion_relabel_configs,omitempty" doc:"nocli|description=List of relabel configurations applied to the labels of the series pushed by the tenant, before they are validated and distributed to ingesters. Series dropped by the relabeling are discarded."`
+	MaxLabelNameLength         int               `yaml:"max_label_name_length" json:"max_label_name_length"`
+	MaxLabelValueLength        int               `yaml:"max_label_value_length" json:"max_label_value_length"`
+	MaxLabelNamesPerSeries     int               `yaml:"max_label_names_per_series" json:"max_label_names_per_series"`
+	MaxProfileSizeBytes        int               `yaml:"max_profile_size_bytes" json:"max_profile_size_bytes"`
+	MaxProfileLocations        int               `yaml:"max_profile_locations" json:"max_profile_locations"`
+	MaxProfileStacktraceDepth  int               `yaml:"max_profile_stacktrace_depth" json:"max_profile_stacktrace_depth"`
+	RejectOlderThan            model.Duration    `yaml:"reject_older_than" json:"reject_older_than"`
+	CreationGracePeriod        model.Duration    `yaml:"creation_grace_period" json:"creation_grace_period"`
+	AllowNegativeSampleValues  bool              `yaml:"allow_negative_sample_values" json:"allow_negative_sample_values"`
+
+	// Ingester enforced limits.
+	MaxLocalSeriesPerTenant       int `yaml:"max_local_series_per_tenant" json:"max_local_series_per_tenant"`
+	MaxProfilesPerSeriesPerMinute int `yaml:"max_profiles_per_series_per_minute" json:"max_profiles_per_series_per_minute"`
+
+	// Querier enforced limits.
+	TenantFederationEnabled bool `yaml:"tenant_federation_enabled" json:"tenant_federation_enabled"`
+	MaxQueryStacktraces     int  `yaml:"max_query_stacktraces" json:"max_query_stacktraces"`
+	MaxQuerySeries          int  `yaml:"max_query_series" json:"max_query_series"`
+	MaxQueryBytesRead       int  `yaml:"max_query_bytes_read" json:"max_query_bytes_read"`
+
+	// Function metrics exported by the ingesters.
+	TrackedFunctions         []string `yaml:"tracked_functions,omitempty" json:"tracked_functions,omitempty" doc:"nocli|description=List of regular expressions of the function names tracked in the profiles of the tenant. The sample values of the profiles with a matching function in their stacktrace are exported by the ingesters as the phlare_function_value_total metric on the /metrics/profiles endpoint, except for gauge sample types such as inuse_space. Each ingester counts the profiles replicated to it, divide the sum across ingesters by the replication factor. The regular expressions are fully anchored."`
+	MaxTrackedFunctionSeries int      `yaml:"max_tracked_function_series" json:"max_tracked_function_series"`
+}
+
+// RegisterFlags adds the flags required to config this to the given FlagSet
+func (l *Limits) RegisterFlags(f *flag.FlagSet) {
+	f.Float64Var(&l.IngestionRateMB, "distributor.ingestion-rate-limit-mb", 0, "Per-tenant ingestion rate limit in compressed megabytes per second, shared across all healthy distributors. 0 to disable.")
+	f.Float64Var(&l.IngestionBurstSizeMB, "distributor.ingestion-burst-size-mb", 2, "Per-tenant allowed ingestion burst size in compressed megabytes, enforced by each distributor. Pushes larger than the burst size are rejected when the ingestion rate is limited.")
+	f.Float64Var(&l.IngestionRateProfiles, "distributor.ingestion-rate-limit-profiles", 0, "Per-tenant ingestion rate limit in profiles per second, shared across all healthy distributors. 0 to disable.")
+	f.IntVar(&l.IngestionBurstSizeProfiles, "distributor.ingestion-burst-size-profiles", 100, "Per-tenant allowed ingestion burst size in profiles, enforced by each distributor. Pushes with more profiles are rejected when the ingestion rate is limited.")
+	f.IntVar(&l.IngestionTenantShardSize, "distributor.ingestion-tenant-shard-size", 0, "The tenant's shard size used by shuffle-sharding. Profiles of the tenant are only written to this number of ingesters. 0 to disable shuffle-sharding and use all ingesters.")
+	f.IntVar(&l.MaxLabelNameLength, "validation.max-length-label-name", 1024, "Maximum length accepted for label names.")
+	f.IntVar(&l.MaxLabelValueLength, "validation.max-length-label-value", 2048, "Maximum length accepted for label value. This setting also applies to the profile name.")
+	f.IntVar(&l.MaxLabelNamesPerSeries, "validation.max-label-names-per-series", 0, "Maximum number of label names per series. 0 to disable.")
+	f.IntVar(&l.MaxProfileSizeBytes, "validation.max-profile-size-bytes", 4*1024*1024, "Maximum size of a profile in bytes, once decompressed. 0 to disable.")
+	f.IntVar(&l.MaxProfileLocations, "validation.max-profile-locations", 100000, "Maximum number of locations in a profile. 0 to disable.")
+	f.IntVar(&l.MaxProfileStacktraceDepth, "validation.max-profile-stacktrace-depth", 1000, "Maximum number of locations of a single stacktrace in a profile. 0 to disable.")
+
+	f.Var(&l.RejectOlderThan, "validation.reject-older-than", "Reject profiles older than this duration. 0 to disable, which allows to backfill older profiles.")
+	_ = l.CreationGracePeriod.Set("10m")
+	f.Var(&l.CreationGracePeriod, "validation.create-grace-period", "Reject profiles with a timestamp in the future beyond this duration. 0 to disable.")
+	f.BoolVar(&l.AllowNegativeSampleValues, "validation.allow-negative-sample-values", false, "Accept profiles with negative sample values.")
+
+	f.IntVar(&l.MaxLocalSeriesPerTenant, "ingester.max-local-series-per-tenant", 0, "Maximum number of active series of a tenant in the heads of each ingester, including the heads waiting to be flushed. Profiles creating new series are rejected once reached. 0 to disable.")
+	f.IntVar(&l.MaxProfilesPerSeriesPerMinute, "ingester.max-profiles-per-series-per-minute", 0, "Maximum number of profiles per series per minute, using the profile timestamps, enforced by each ingester. 0 to disable.")
+	f.BoolVar(&l.TenantFederationEnabled, "querier.tenant-federation-enabled", false, "Allow the profiles of the tenant to be queried together with other tenants, using the tenant IDs separated by | in the X-Scope-OrgID header. A query across tenants is only allowed when it is enabled for all of them.")
+	f.IntVar(&l.MaxQueryStacktraces, "querier.max-query-stacktraces", 0, "Maximum number of stacktraces merged by a flamegraph query, received from all ingesters. 0 to disable.")
+	f.IntVar(&l.MaxQuerySeries, "querier.max-query-series", 0, "Maximum number of series returned by a series query. 0 to disable.")
+	f.IntVar(&l.MaxQueryBytesRead, "querier.max-query-bytes-read", 0, "Maximum number of bytes of blocks read by a query, enforced by each ingester while reading and by the querier for all ingesters. 0 to disable.")
+	f.IntVar(&l.MaxTrackedFunctionSeries, "ingester.max-tracked-function-series", 1000, "Maximum number of series of the tracked functions metric of a tenant exported by each ingester. The values of new series are discarded once reached, series without values for an hour are removed. 0 to disable.")
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface.
+func (l *Limits) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	// We want to set l to the defaults and then overwrite it with the input.
+	// To make unmarshal fill the plain data struct rather than calling UnmarshalYAML
+	// again, we have to hide it using a type indirection.
+	// See github.com/prometheus/config/config.go.
+	if defaultLimits != nil {
+		*l = *defaultLimits
+	}
+	type plain Limits
+	if err := unmarshal((*plain)(l)); err != nil {
+		return err
+	}
+	for _, f := range l.TrackedFunctions {
+		if _, err := CompileTrackedFunction(f); err != nil {
+			return fmt.Errorf("invalid tracked function %q: %w", f, err)
+		}
+	}
+	return nil
+}
+
+// CompileTrackedFunction compiles the fully anchored regular expression of a tracked function.
+func CompileTrackedFunction(expr string) (*regexp.Regexp, error) {
+	return regexp.Compile("^(?:" + expr + ")$")
+}
+
+// When we load YAML from disk, we want the various per-tenant limits
+// to default to any values specified on the command line, not default
+// command line values. This global contains those values.
+var defaultLimits *Limits
+
+// SetDefaultLimitsForYAMLUnmarshalling sets global default limits, used when loading
+// Limits from YAML files. This is used to ensure per-tenant limits are defaulted to
+// those values.
+func SetDefaultLimitsForYAMLUnmarshalling(defaults Limits) {
+	defaultLimits = &defaults
+}
+
+// TenantLimits exposes per-tenant limit overrides to various resource usage limits.
+type TenantLimits interface {
+	// TenantLimits is a function that returns limits for given tenant, or
+	// nil, if there are no tenant-specific limits.
+	TenantLimits(tenantID string) *Limits
+}
+
+// Overrides provides the limits of a tenant, falling back to the default limits
+// when the tenant has no overrides.
+type Overrides struct {
+	defaultLimits *Limits
+	tenantLimits  TenantLimits
+}
+
+// NewOverrides makes a new Overrides.
+func NewOverrides(defaults Limits, tenantLimits TenantLimits) (*Overrides, error) {
+	return &Overrides{
+		tenantLimits:  tenantLimits,
+		defaultLimits: &defaults,
+	}, nil
+}
+
+// IngestionRateBytes returns the limit on ingester rate in bytes per second, 0 means unlimited.
+func (o *Overrides) IngestionRateBytes(tenantID string) float64 {
+	return o.getOverridesForTenant(tenantID).IngestionRateMB * bytesInMB
+}
+
+// IngestionBurstSizeBytes returns the burst size for ingestion rate in bytes.
+func (o *Overrides) IngestionBurstSizeBytes(tenantID string) int {
+	return int(o.getOverridesForTenant(tenantID).IngestionBurstSizeMB * bytesInMB)
+}
+
+// IngestionRateProfiles returns the limit on ingester rate in profiles per second, 0 means unlimited.
+func (o *Overrides) IngestionRateProfiles(tenantID string) float64 {
+	return o.getOverridesForTenant(tenantID).IngestionRateProfiles
+}
+
+// IngestionBurstSizeProfiles returns the burst size for ingestion rate in profiles.
+func (o *Overrides) IngestionBurstSizeProfiles(tenantID string) int {
+	return o.getOverridesForTenant(tenantID).IngestionBurstSizeProfiles
+}
+
+// IngestionTenantShardSize returns the number of ingesters the tenant's profiles are written to.
+func (o *Overrides) IngestionTenantShardSize(tenantID string) int {
+	return o.getOverridesForTenant(tenantID).IngestionTenantShardSize
+}
+
+// IngestionRelabelConfigs returns the relabel configurations applied to the series pushed by the tenant.
+func (o *Overrides) IngestionRelabelConfigs(tenantID string) []*relabel.Config {
+	return o.getOverridesForTenant(tenantID).IngestionRelabelConfigs
+}
+
+// MaxLocalSeriesPerTenant returns the maximum number of series of the tenant in the heads of an ingester, 0 means unlimited.
+func (o *Overrides) MaxLocalSeriesPerTenant(tenantID string) int {
+	return o.getOverridesForTenant(tenantID).MaxLocalSeriesPerTenant
+}
+
+// MaxProfilesPerSeriesPerMinute returns the maximum number of profiles per series per minute, 0 means unlimited.
+func (o *Overrides) MaxProfilesPerSeriesPerMinute(tenantID string) int {
+	return o.getOverridesForTenant(tenantID).MaxProfilesPerSeriesPerMinute
+}
+
+// TrackedFunctions returns the regular expressions of the functions tracked in the profiles of the tenant.
+func (o *Overrides) TrackedFunctions(tenantID string) []string {
+	return o.getOverridesForTenant(tenantID).TrackedFunctions
+}
+
+// MaxTrackedFunctionSeries returns the maximum number of series of the tracked functions of the tenant, 0 means unlimited.
+func (o *Overrides) MaxTrackedFunctionSeries(tenantID string) int {
+	return o.getOverridesForTenant(tenantID).MaxTrackedFunctionSeries
+}
+
+// TenantFederationEnabled returns whether the tenant can be queried together with other tenants.
+func (o *Overrides) TenantFederationEnabled(tenantID string) bool {
+	return o.getOverridesForTenant(tenantID).TenantFederationEnabled
+}
+
+// MaxQueryStacktraces returns the maximum number of stacktraces merged by a query of the tenant.
+func (o *Overrides) MaxQueryStacktraces(tenantID string) int {
+	return o.getOverridesForTenant(tenantID).MaxQueryStacktraces
+}
+
+// MaxQuerySeries returns the maximum number of series returned by a query of the tenant.
+func (o *Overrides) MaxQuerySeries(tenantID string) int {
+	return o.getOverridesForTenant(tenantID).MaxQuerySeries
+}
+
+// MaxQueryBytesRead returns the maximum number of bytes of blocks read by a query of the tenant.
+func (o *Overrides) MaxQueryBytesRead(tenantID string) int {
+	return o.getOverridesForTenant(tenantID).MaxQueryBytesRead
+}
+
+// MaxLabelNameLength returns maximum length a label name can be.
+func (o *Overrides) MaxLabelNameLength(tenantID string) int {
+	return o.getOverridesForTenant(tenantID).MaxLabelNameLength
+}
+
+// MaxLabelValueLength returns maximum length a label value can be.
+func (o *Overrides) MaxLabelValueLength(tenantID string) int {
+	return o.getOverridesForTenant(tenantID).MaxLabelValueLength
+}
+
+// MaxLabelNamesPerSeries returns maximum number of label/value pairs of a series.
+func (o *Overrides) MaxLabelNamesPerSeries(tenantID string) int {
+	return o.getOverridesForTenant(tenantID).MaxLabelNamesPerSeries
+}
+
+// MaxProfileSizeBytes returns the maximum size of a decompressed profile.
+func (o *Overrides) MaxProfileSizeBytes(tenantID string) int {
+	return o.getOverridesForTenant(tenantID).MaxProfileSizeBytes
+}
+
+// MaxProfileLocations returns the maximum number of locations in a profile.
+func (o *Overrides) MaxProfileLocations(tenantID string) int {
+	return o.getOverridesForTenant(tenantID).MaxProfileLocations
+}
+
+// MaxProfileStacktraceDepth returns the maximum number of locations of a single stacktrace.
+func (o *Overrides) MaxProfileStacktraceDepth(tenantID string) int {
+	return o.getOverridesForTenant(tenantID).MaxProfileStacktraceDepth
+}
+
+// RejectOlderThan returns the age after which profiles are rejected.
+func (o *Overrides) RejectOlderThan(tenantID string) time.Duration {
+	return time.Duration(o.getOverridesForTenant(tenantID).RejectOlderThan)
+}
+
+// CreationGracePeriod returns how far into the future profiles are accepted.
+func (o *Overrides) CreationGracePeriod(tenantID string) time.Duration {
+	return time.Duration(o.getOverridesForTenant(tenantID).CreationGracePeriod)
+}
+
+// AllowNegativeSampleValues returns whether negative sample values are accepted.
+func (o *Overrides) AllowNegativeSampleValues(tenantID string) bool {
+	return o.getOverridesForTenant(tenantID).AllowNegativeSampleValues
+}
+
+// MockDefaultOverrides returns overrides using the default limits of the flags,
+// without any tenant overrides.
+func MockDefaultOverrides() *Overrides {
+	return MockOverrides(func(defaults *Limits, tenantLimits map[string]*Limits) {})
+}
+
+// MockOverrides returns overrides using the default limits of the flags, and
+// the defaults and tenant limits set by customize.
+func MockOverrides(customize func(defaults *Limits, tenantLimits map[string]*Limits)) *Overrides {
+	var defaults Limits
+	flagext.DefaultValues(&defaults)
+	tenantLimits := mockTenantLimits{}
+	customize(&defaults, tenantLimits)
+	o, _ := NewOverrides(defaults, tenantLimits)
+	return o
+}
+
+type mockTenantLimits map[string]*Limits
+
+func (l mockTenantLimits) TenantLimits(tenantID string) *Limits {
+	return l[tenantID]
+}
+
+func (o *Overrides) getOverridesForTenant(tenantID string) *Limits {
+	if o.tenantLimits != nil {
+		l := o.tenantLimits.TenantLimits(tenantID)
+		if l != nil {
+			return l
+		}
+	}
+	return o.defaultLimits
+}
@@ -0,0 +1,178 @@
+package validation
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/common/model"
+
+	commonv1 "github.com/grafana/phlare/pkg/gen/common/v1"
+	profilev1 "github.com/grafana/phlare/pkg/gen/google/v1"
+	phlaremodel "github.com/grafana/phlare/pkg/model"
+)
+
+// Reason is the reason why profiles are discarded, used as label of the
+// discarded profiles metric.
+type Reason string
+
+const (
+	Unknown Reason = "unknown"
+	// InvalidProfile is a reason for discarding profiles which can't be decoded.
+	InvalidProfile Reason = "invalid_profile"
+	// MaxLabelNamesPerSeries is a reason for discarding a request which has too many label names.
+	MaxLabelNamesPerSeries Reason = "max_label_names_per_series"
+	// InvalidLabels is a reason for discarding a request which has an invalid label name.
+	InvalidLabels Reason = "invalid_labels"
+	// LabelNameTooLong is a reason for discarding a request which has a label name too long.
+	LabelNameTooLong Reason = "label_name_too_long"
+	// LabelValueTooLong is a reason for discarding a request which has a label value too long.
+	LabelValueTooLong Reason = "label_value_too_long"
+	// DuplicateLabelNames is a reason for discarding a request which has duplicate label names.
+	DuplicateLabelNames Reason = "duplicate_label_names"
+	// ProfileSizeLimit is a reason for discarding a profile which is too big once decompressed.
+	ProfileSizeLimit Reason = "profile_size_limit"
+	// TooOld is a reason for discarding a profile older than the reject_older_than limit.
+	TooOld Reason = "too_old"
+	// TooFarInFuture is a reason for discarding a profile beyond the creation grace period.
+	TooFarInFuture Reason = "too_far_in_future"
+	// SampleValueTypeMismatch is a reason for discarding a profile which has samples
+	// with a number of values different from the number of sample types.
+	SampleValueTypeMismatch Reason = "sample_value_type_mismatch"
+	// NegativeSampleValue is a reason for discarding a profile which has negative sample values.
+	NegativeSampleValue Reason = "negative_sample_value"
+	// MaxLocations is a reason for discarding a profile which has too many locations.
+	MaxLocations Reason = "max_profile_locations"
+	// StacktraceTooDeep is a reason for discarding a profile which has a stacktrace with too many locations.
+	StacktraceTooDeep Reason = "stacktrace_too_deep"
+	// RateLimited is a reason for discarding profiles when the tenant exceeds its ingestion rate limit.
+	RateLimited Reason = "rate_limited"
+	// BurstSizeExceeded is a reason for discarding a push larger than the ingestion burst size of the tenant,
+	// which can never be accepted.
+	BurstSizeExceeded Reason = "burst_size_exceeded"
+	// DroppedByRelabelRules is a reason for discarding profiles of series dropped by the ingestion relabeling rules.
+	DroppedByRelabelRules Reason = "dropped_by_relabel_rules"
+	// SeriesLimit is a reason for discarding profiles creating new series when the tenant has too many series in an ingester.
+	SeriesLimit Reason = "series_limit"
+	// ProfilesPerSeriesLimit is a reason for discarding profiles when a series has too many profiles per minute.
+	ProfilesPerSeriesLimit Reason = "profiles_per_series_limit"
+	// OutOfOrder is a reason for discarding profiles older than the heads still open in the ingester.
+	OutOfOrder Reason = "out_of_order"
+	// HeadSizeLimit is a reason for discarding profiles when the heads of the ingester use too much memory.
+	HeadSizeLimit Reason = "head_size_limit"
+)
+
+// Error is a validation error, carrying the reason profiles are discarded.
+type Error struct {
+	Reason Reason
+	msg    string
+}
+
+// NewErrorf returns a new validation error with the given reason.
+func NewErrorf(reason Reason, msg string, args ...interface{}) *Error {
+	return &Error{
+		Reason: reason,
+		msg:    fmt.Sprintf(msg, args...),
+	}
+}
+
+func (e *Error) Error() string {
+	return e.msg
+}
+
+// ReasonOf returns the reason of a validation error, or Unknown if the error
+// isn't a validation error.
+func ReasonOf(err error) Reason {
+	var validationErr *Error
+	if errors.As(err, &validationErr) {
+		return validationErr.Reason
+	}
+	return Unknown
+}
+
+// LabelValidationLimits are the limits used to validate the labels of a series.
+type LabelValidationLimits interface {
+	MaxLabelNameLength(tenantID string) int
+	MaxLabelValueLength(tenantID string) int
+	MaxLabelNamesPerSeries(tenantID string) int
+}
+
+// ValidateLabels validates the labels of a series.
+func ValidateLabels(limits LabelValidationLimits, tenantID string, ls []*commonv1.LabelPair) error {
+	if max := limits.MaxLabelNamesPerSeries(tenantID); max > 0 && len(ls) > max {
+		return NewErrorf(MaxLabelNamesPerSeries, "profile series %s has %d label names; limit %d", phlaremodel.LabelPairsString(ls), len(ls), max)
+	}
+	for i, l := range ls {
+		if !model.LabelName(l.Name).IsValid() {
+			return NewErrorf(InvalidLabels, "invalid label name '%s' in profile series %s", l.Name, phlaremodel.LabelPairsString(ls))
+		}
+		if len(l.Name) > limits.MaxLabelNameLength(tenantID) {
+			return NewErrorf(LabelNameTooLong, "label name too long: '%s' in profile series %s", l.Name, phlaremodel.LabelPairsString(ls))
+		}
+		if len(l.Value) > limits.MaxLabelValueLength(tenantID) {
+			return NewErrorf(LabelValueTooLong, "label value too long: '%s' for label '%s' in profile series %s", l.Value, l.Name, phlaremodel.LabelPairsString(ls))
+		}
+		if !model.LabelValue(l.Value).IsValid() {
+			return NewErrorf(InvalidLabels, "invalid label value '%s' for label '%s' in profile series %s", l.Value, l.Name, phlaremodel.LabelPairsString(ls))
+		}
+		// The number of labels is bounded, comparing each pair is cheaper than sorting a copy.
+		for _, other := range ls[:i] {
+			if other.Name == l.Name {
+				return NewErrorf(DuplicateLabelNames, "duplicate label name '%s' in profile series %s", l.Name, phlaremodel.LabelPairsString(ls))
+			}
+		}
+	}
+	return nil
+}
+
+// ProfileValidationLimits are the limits used to validate a profile.
+type ProfileValidationLimits interface {
+	MaxProfileSizeBytes(tenantID string) int
+	MaxProfileLocations(tenantID string) int
+	MaxProfileStacktraceDepth(tenantID string) int
+	RejectOlderThan(tenantID string) time.Duration
+	CreationGracePeriod(tenantID string) time.Duration
+	AllowNegativeSampleValues(tenantID string) bool
+}
+
+// ValidateProfile validates a decoded profile of the given series, size is the
+// size of the decompressed profile.
+func ValidateProfile(limits ProfileValidationLimits, tenantID string, p *profilev1.Profile, size int, ls []*commonv1.LabelPair, now time.Time) error {
+	if maxSize := limits.MaxProfileSizeBytes(tenantID); maxSize > 0 && size > maxSize {
+		return NewErrorf(ProfileSizeLimit, "profile of series %s is too big: %d bytes; limit %d bytes", phlaremodel.LabelPairsString(ls), size, maxSize)
+	}
+	// Profiles without a timestamp are assigned the current time.
+	if p.TimeNanos > 0 {
+		ts := time.Unix(0, p.TimeNanos)
+		if maxAge := limits.RejectOlderThan(tenantID); maxAge > 0 && ts.Before(now.Add(-maxAge)) {
+			return NewErrorf(TooOld, "profile of series %s is too old: timestamp %s is older than %s", phlaremodel.LabelPairsString(ls), ts.UTC().Format(time.RFC3339), maxAge)
+		}
+		if gracePeriod := limits.CreationGracePeriod(tenantID); gracePeriod > 0 && ts.After(now.Add(gracePeriod)) {
+			return NewErrorf(TooFarInFuture, "profile of series %s is too far in the future: timestamp %s is more than %s ahead", phlaremodel.LabelPairsString(ls), ts.UTC().Format(time.RFC3339), gracePeriod)
+		}
+	}
+	if maxLocations := limits.MaxProfileLocations(tenantID); maxLocations > 0 && len(p.Location) > maxLocations {
+		return NewErrorf(MaxLocations, "profile of series %s has %d locations; limit %d", phlaremodel.LabelPairsString(ls), len(p.Location), maxLocations)
+	}
+	var (
+		maxDepth      = limits.MaxProfileStacktraceDepth(tenantID)
+		allowNegative = limits.AllowNegativeSampleValues(tenantID)
+	)
+	for _, s := range p.Sample {
+		if len(s.Value) != len(p.SampleType) {
+			return NewErrorf(SampleValueTypeMismatch, "profile of series %s has a sample with %d values, expected %d values for sample types", phlaremodel.LabelPairsString(ls), len(s.Value), len(p.SampleType))
+		}
+		if maxDepth > 0 && len(s.LocationId) > maxDepth {
+			return NewErrorf(StacktraceTooDeep, "profile of series %s has a stacktrace of %d locations; limit %d", phlaremodel.LabelPairsString(ls), len(s.LocationId), maxDepth)
+		}
+		if allowNegative {
+			continue
+		}
+		for _, v := range s.Value {
+			if v < 0 {
+				return NewErrorf(NegativeSampleValue, "profile of series %s has a negative sample value: %d", phlaremodel.LabelPairsString(ls), v)
+			}
+		}
+	}
+	return nil
+}
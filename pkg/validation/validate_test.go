@@ -0,0 +1,196 @@
+package validation
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/stretchr/testify/require"
+
+	commonv1 "github.com/grafana/phlare/pkg/gen/common/v1"
+	profilev1 "github.com/grafana/phlare/pkg/gen/google/v1"
+)
+
+func TestValidateLabels(t *testing.T) {
+	for _, tt := range []struct {
+		name           string
+		lbs            []*commonv1.LabelPair
+		expectedErr    string
+		expectedReason Reason
+	}{
+		{
+			name: "valid labels",
+			lbs: []*commonv1.LabelPair{
+				{Name: "__name__", Value: "memory"},
+				{Name: "service_name", Value: "svc"},
+			},
+		},
+		{
+			name: "too many labels",
+			lbs: func() []*commonv1.LabelPair {
+				lbs := make([]*commonv1.LabelPair, 31)
+				for i := range lbs {
+					lbs[i] = &commonv1.LabelPair{Name: "foo", Value: "bar"}
+				}
+				return lbs
+			}(),
+			expectedErr:    "has 31 label names; limit 30",
+			expectedReason: MaxLabelNamesPerSeries,
+		},
+		{
+			name: "invalid label name",
+			lbs: []*commonv1.LabelPair{
+				{Name: "__name__", Value: "memory"},
+				{Name: "service.name", Value: "svc"},
+			},
+			expectedErr:    `invalid label name 'service.name' in profile series {__name__="memory", service.name="svc"}`,
+			expectedReason: InvalidLabels,
+		},
+		{
+			name: "label name too long",
+			lbs: []*commonv1.LabelPair{
+				{Name: strings.Repeat("a", 1025), Value: "svc"},
+			},
+			expectedErr:    "label name too long",
+			expectedReason: LabelNameTooLong,
+		},
+		{
+			name: "label value too long",
+			lbs: []*commonv1.LabelPair{
+				{Name: "service_name", Value: strings.Repeat("a", 2049)},
+			},
+			expectedErr:    "label value too long",
+			expectedReason: LabelValueTooLong,
+		},
+		{
+			name: "duplicate label names",
+			lbs: []*commonv1.LabelPair{
+				{Name: "__name__", Value: "memory"},
+				{Name: "service_name", Value: "svc"},
+				{Name: "service_name", Value: "svc2"},
+			},
+			expectedErr:    "duplicate label name 'service_name'",
+			expectedReason: DuplicateLabelNames,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			limits := MockOverrides(func(defaults *Limits, tenantLimits map[string]*Limits) {
+				defaults.MaxLabelNamesPerSeries = 30
+			})
+			err := ValidateLabels(limits, "foo", tt.lbs)
+			if tt.expectedErr == "" {
+				require.NoError(t, err)
+				return
+			}
+			require.ErrorContains(t, err, tt.expectedErr)
+			require.Equal(t, tt.expectedReason, ReasonOf(err))
+		})
+	}
+}
+
+func TestValidateDefaults(t *testing.T) {
+	// Series with many labels and old profiles are accepted by default.
+	lbs := make([]*commonv1.LabelPair, 50)
+	for i := range lbs {
+		lbs[i] = &commonv1.LabelPair{Name: fmt.Sprintf("label_%d", i), Value: "bar"}
+	}
+	require.NoError(t, ValidateLabels(MockDefaultOverrides(), "foo", lbs))
+
+	now := time.Now()
+	profile := &profilev1.Profile{TimeNanos: now.Add(-30 * 24 * time.Hour).UnixNano()}
+	require.NoError(t, ValidateProfile(MockDefaultOverrides(), "foo", profile, 0, lbs[:1], now))
+}
+
+func TestValidateProfile(t *testing.T) {
+	now := time.Date(2022, 10, 1, 12, 0, 0, 0, time.UTC)
+	lbs := []*commonv1.LabelPair{{Name: "__name__", Value: "memory"}}
+	newProfile := func(fn func(p *profilev1.Profile)) *profilev1.Profile {
+		p := &profilev1.Profile{
+			TimeNanos:  now.UnixNano(),
+			SampleType: []*profilev1.ValueType{{Type: 1, Unit: 2}, {Type: 3, Unit: 4}},
+			Location:   []*profilev1.Location{{Id: 1}, {Id: 2}},
+			Sample: []*profilev1.Sample{
+				{LocationId: []uint64{1, 2}, Value: []int64{1, 2}},
+			},
+		}
+		if fn != nil {
+			fn(p)
+		}
+		return p
+	}
+	for _, tt := range []struct {
+		name           string
+		profile        *profilev1.Profile
+		size           int
+		expectedReason Reason
+	}{
+		{
+			name:    "valid profile",
+			profile: newProfile(nil),
+		},
+		{
+			name:    "missing timestamp",
+			profile: newProfile(func(p *profilev1.Profile) { p.TimeNanos = 0 }),
+		},
+		{
+			name:           "too big",
+			profile:        newProfile(nil),
+			size:           5 * 1024 * 1024,
+			expectedReason: ProfileSizeLimit,
+		},
+		{
+			name:           "too old",
+			profile:        newProfile(func(p *profilev1.Profile) { p.TimeNanos = now.Add(-2 * time.Hour).UnixNano() }),
+			expectedReason: TooOld,
+		},
+		{
+			name:           "too far in the future",
+			profile:        newProfile(func(p *profilev1.Profile) { p.TimeNanos = now.Add(time.Hour).UnixNano() }),
+			expectedReason: TooFarInFuture,
+		},
+		{
+			name: "too many locations",
+			profile: newProfile(func(p *profilev1.Profile) {
+				p.Location = make([]*profilev1.Location, 100001)
+			}),
+			expectedReason: MaxLocations,
+		},
+		{
+			name: "sample values mismatch",
+			profile: newProfile(func(p *profilev1.Profile) {
+				p.Sample[0].Value = []int64{1}
+			}),
+			expectedReason: SampleValueTypeMismatch,
+		},
+		{
+			name: "negative sample value",
+			profile: newProfile(func(p *profilev1.Profile) {
+				p.Sample[0].Value = []int64{1, -2}
+			}),
+			expectedReason: NegativeSampleValue,
+		},
+		{
+			name: "stacktrace too deep",
+			profile: newProfile(func(p *profilev1.Profile) {
+				p.Sample[0].LocationId = make([]uint64, 1001)
+			}),
+			expectedReason: StacktraceTooDeep,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			limits := MockOverrides(func(defaults *Limits, tenantLimits map[string]*Limits) {
+				defaults.RejectOlderThan = model.Duration(time.Hour)
+			})
+			err := ValidateProfile(limits, "foo", tt.profile, tt.size, lbs, now)
+			if tt.expectedReason == "" {
+				require.NoError(t, err)
+				return
+			}
+			require.Error(t, err)
+			require.Contains(t, err.Error(), `{__name__="memory"}`)
+			require.Equal(t, tt.expectedReason, ReasonOf(err))
+		})
+	}
+}
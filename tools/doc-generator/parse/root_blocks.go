@@ -18,6 +18,7 @@ import (
 	"github.com/grafana/phlare/pkg/objstore/providers/s3"
 	"github.com/grafana/phlare/pkg/objstore/providers/swift"
 	"github.com/grafana/phlare/pkg/querier"
+	"github.com/grafana/phlare/pkg/validation"
 )
 
 var (
@@ -49,6 +50,11 @@ var (
 			StructType: reflect.TypeOf(querier.Config{}),
 			Desc:       "The querier block configures the querier.",
 		},
+		{
+			Name:       "limits",
+			StructType: reflect.TypeOf(validation.Limits{}),
+			Desc:       "The limits block configures default and per-tenant limits imposed by components.",
+		},
 		{
 			Name:       "grpc_client",
 			StructType: reflect.TypeOf(grpcclient.Config{}),